@@ -1,6 +1,7 @@
 // This program performs administrative tasks for the garage sale service.
 //
-// Run it with --cmd keygen or --cmd useradd
+// Run it with --cmd keygen, --cmd useradd, --cmd import-adverts,
+// --cmd export-adverts, --cmd migrate-advertisers or --cmd migrate-tenants
 
 package main
 
@@ -9,6 +10,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log"
@@ -16,9 +18,13 @@ import (
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
 	"github.com/mattlaver/peeps/internal/platform/auth"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/export"
 	"github.com/mattlaver/peeps/internal/platform/flag"
+	"github.com/mattlaver/peeps/internal/tenant"
 	"github.com/mattlaver/peeps/internal/user"
 	"github.com/pkg/errors"
 )
@@ -42,9 +48,31 @@ func main() {
 		Auth struct {
 			PrivateKeyFile string `default:"private.pem" envconfig:"PRIVATE_KEY_FILE"`
 		}
+		Tenant struct {
+			Slug string
+			Name string
+		}
 		User struct {
 			Email    string
 			Password string
+			Super    bool
+		}
+		Import struct {
+			File           string
+			Format         string `default:"csv"`
+			Mapping        string
+			DryRun         bool
+			AllowDuplicate bool
+		}
+		Export struct {
+			File       string
+			Format     string `default:"csv"`
+			Columns    string
+			Advertiser string
+			Size       string
+			Edition    string
+			Year       string
+			State      string
 		}
 	}
 
@@ -64,9 +92,24 @@ func main() {
 	case "keygen":
 		err = keygen(cfg.Auth.PrivateKeyFile)
 	case "useradd":
-		err = useradd(cfg.DB.Host, cfg.DB.DialTimeout, cfg.User.Email, cfg.User.Password)
+		err = useradd(cfg.DB.Host, cfg.DB.DialTimeout, cfg.Tenant.Slug, cfg.User.Email, cfg.User.Password, cfg.User.Super)
+	case "import-adverts":
+		err = importAdverts(cfg.DB.Host, cfg.DB.DialTimeout, cfg.Tenant.Slug, cfg.Import.File, cfg.Import.Format, cfg.Import.Mapping, cfg.Import.DryRun, cfg.Import.AllowDuplicate)
+	case "export-adverts":
+		flt := advert.Filter{
+			Advertiser: cfg.Export.Advertiser,
+			Size:       cfg.Export.Size,
+			Edition:    cfg.Export.Edition,
+			Year:       cfg.Export.Year,
+			State:      cfg.Export.State,
+		}
+		err = exportAdverts(cfg.DB.Host, cfg.DB.DialTimeout, cfg.Tenant.Slug, cfg.Export.File, cfg.Export.Format, cfg.Export.Columns, flt)
+	case "migrate-advertisers":
+		err = migrateAdvertisers(cfg.DB.Host, cfg.DB.DialTimeout, cfg.Tenant.Slug)
+	case "migrate-tenants":
+		err = migrateTenants(cfg.DB.Host, cfg.DB.DialTimeout, cfg.Tenant.Slug, cfg.Tenant.Name)
 	default:
-		err = errors.New("Must provide --cmd keygen or --cmd useradd")
+		err = errors.New("Must provide --cmd keygen, --cmd useradd, --cmd import-adverts, --cmd export-adverts, --cmd migrate-advertisers or --cmd migrate-tenants")
 	}
 
 	if err != nil {
@@ -103,7 +146,9 @@ func keygen(path string) error {
 	return nil
 }
 
-func useradd(dbHost string, dbTimeout time.Duration, email, pass string) error {
+// useradd creates an admin of the named tenant. A super-admin also works
+// across every tenant.
+func useradd(dbHost string, dbTimeout time.Duration, slug, email, pass string, super bool) error {
 
 	dbConn, err := db.New(dbHost, dbTimeout)
 	if err != nil {
@@ -111,6 +156,9 @@ func useradd(dbHost string, dbTimeout time.Duration, email, pass string) error {
 	}
 	defer dbConn.Close()
 
+	if slug == "" {
+		return errors.New("Must provide --tenant_slug")
+	}
 	if email == "" {
 		return errors.New("Must provide --user_email")
 	}
@@ -118,7 +166,10 @@ func useradd(dbHost string, dbTimeout time.Duration, email, pass string) error {
 		return errors.New("Must provide --user_password or set the env var SALES_USER_PASSWORD")
 	}
 
-	ctx := context.Background()
+	ctx, err := scope(context.Background(), dbConn, slug)
+	if err != nil {
+		return err
+	}
 
 	newU := user.NewUser{
 		Email:           email,
@@ -126,8 +177,12 @@ func useradd(dbHost string, dbTimeout time.Duration, email, pass string) error {
 		PasswordConfirm: pass,
 		Roles:           []string{auth.RoleAdmin, auth.RoleUser},
 	}
+	if super {
+		newU.Roles = append(newU.Roles, auth.RoleSuperAdmin)
+	}
 
-	usr, err := user.Create(ctx, dbConn, &newU, time.Now())
+	now := time.Now()
+	usr, err := user.Create(ctx, adminClaims(now), dbConn, &newU, now)
 	if err != nil {
 		return err
 	}
@@ -135,3 +190,275 @@ func useradd(dbHost string, dbTimeout time.Duration, email, pass string) error {
 	fmt.Printf("User created with id: %v\n", usr.ID.Hex())
 	return nil
 }
+
+// scope returns ctx scoped to the tenant with the given slug, or to every
+// tenant when the slug is empty.
+func scope(ctx context.Context, dbConn *db.DB, slug string) (context.Context, error) {
+	if slug == "" {
+		return tenant.WithAll(ctx), nil
+	}
+
+	t, err := tenant.BySlug(tenant.WithAll(ctx), dbConn, slug)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding tenant %q", slug)
+	}
+
+	return tenant.With(ctx, t.ID), nil
+}
+
+// adminClaims identifies changes made by this program in histories and events.
+func adminClaims(now time.Time) auth.Claims {
+	return auth.NewClaims("peeps-admin", []string{auth.RoleAdmin}, now, time.Hour)
+}
+
+// importAdverts loads adverts from a CSV or NDJSON file and prints the
+// validation report. The adverts are booked for the named tenant.
+func importAdverts(dbHost string, dbTimeout time.Duration, slug, path, format, mapping string, dryRun, allowDuplicate bool) error {
+	if slug == "" {
+		return errors.New("Must provide --tenant_slug")
+	}
+	if path == "" {
+		return errors.New("Must provide --import_file")
+	}
+
+	m, err := advert.ParseMapping(mapping)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening import file")
+	}
+	defer file.Close()
+
+	dbConn, err := db.New(dbHost, dbTimeout)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	ctx, err := scope(context.Background(), dbConn, slug)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	opts := advert.ImportOptions{
+		Format:          format,
+		Mapping:         m,
+		DryRun:          dryRun,
+		AllowDuplicates: allowDuplicate,
+	}
+
+	rep, err := advert.Import(ctx, adminClaims(now), dbConn, file, opts, now)
+	if rep != nil {
+		out, jerr := json.MarshalIndent(rep, "", "  ")
+		if jerr != nil {
+			return jerr
+		}
+		fmt.Println(string(out))
+	}
+
+	return err
+}
+
+// exportAdverts writes the adverts of the named tenant, or of every tenant,
+// matching the filter to a file. It is intended for scheduled dumps.
+func exportAdverts(dbHost string, dbTimeout time.Duration, slug, path, format, columns string, flt advert.Filter) error {
+	if path == "" {
+		return errors.New("Must provide --export_file")
+	}
+
+	cols, err := advert.ParseColumns(columns)
+	if err != nil {
+		return err
+	}
+
+	dbConn, err := db.New(dbHost, dbTimeout)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	ctx, err := scope(context.Background(), dbConn, slug)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed export never replaces the
+	// previous dump.
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "creating export file")
+	}
+	defer os.Remove(tmp)
+
+	ew, err := export.NewWriter(format, file, cols)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	var n int
+	fn := func(a *advert.Advert) error {
+		n++
+		return ew.Write(advert.Row(a, cols))
+	}
+	if err := advert.Export(ctx, dbConn, flt, fn); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := ew.Close(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "finishing export")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "closing export file")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "replacing export file")
+	}
+
+	fmt.Printf("Exported %d adverts to %s\n", n, path)
+	return nil
+}
+
+// migrateAdvertisers turns the free text advertiser names on adverts into
+// advertisers. Similar spellings are clustered into one advertiser, with the
+// most used spelling as its name and the rest as aliases, and every advert is
+// linked to its advertiser. Every tenant has its own advertisers, so the
+// adverts of the named tenant are migrated. It is safe to run more than once.
+func migrateAdvertisers(dbHost string, dbTimeout time.Duration, slug string) error {
+	if slug == "" {
+		return errors.New("Must provide --tenant_slug")
+	}
+
+	dbConn, err := db.New(dbHost, dbTimeout)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	ctx, err := scope(context.Background(), dbConn, slug)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	claims := adminClaims(now)
+
+	spellings, err := advert.Spellings(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	var created, linked int
+	for _, c := range advertiser.ClusterSpellings(spellings) {
+		names := append([]string{c.Name}, c.Aliases...)
+
+		// Reuse an advertiser that already answers to any of the spellings.
+		var adv *advertiser.Advertiser
+		for _, name := range names {
+			adv, err = advertiser.FindByName(ctx, dbConn, name)
+			if err == nil {
+				break
+			}
+			if err != advertiser.ErrNotFound {
+				return err
+			}
+		}
+
+		if adv == nil {
+			na := advertiser.NewAdvertiser{Name: c.Name, Aliases: c.Aliases}
+			if adv, err = advertiser.Create(ctx, dbConn, &na, now); err != nil {
+				return errors.Wrapf(err, "creating advertiser %q", c.Name)
+			}
+			created++
+		} else if err := advertiser.AddAliases(ctx, dbConn, adv.ID, names, now); err != nil {
+			return errors.Wrapf(err, "adding aliases to advertiser %q", adv.Name)
+		}
+
+		n, err := advert.LinkAdvertiser(ctx, claims, dbConn, names, adv, now)
+		if err != nil {
+			return errors.Wrapf(err, "linking adverts to advertiser %q", adv.Name)
+		}
+		linked += n
+	}
+
+	fmt.Printf("Found %d spellings, created %d advertisers and linked %d adverts\n", len(spellings), created, linked)
+	return nil
+}
+
+// migrateTenants moves the data of a deployment from before tenants into its
+// first tenant, creating the tenant if need be. The unique indexes that would
+// stop another tenant reusing edition names, rate card years, advertiser
+// names, invoice numbers or audit log sequence numbers are dropped; the new
+// ones are built as editions, rate cards, advertisers, invoices and audit
+// entries are next added. It is safe to run more than once.
+func migrateTenants(dbHost string, dbTimeout time.Duration, slug, name string) error {
+	if slug == "" {
+		return errors.New("Must provide --tenant_slug")
+	}
+
+	dbConn, err := db.New(dbHost, dbTimeout)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	ctx := context.Background()
+
+	t, err := tenant.BySlug(ctx, dbConn, slug)
+	if err == tenant.ErrNotFound {
+		if name == "" {
+			return errors.New("Must provide --tenant_name to create the tenant")
+		}
+		t, err = tenant.Create(ctx, dbConn, &tenant.NewTenant{Slug: slug, Name: name}, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+
+	// The outbox is adopted so events still waiting for delivery are handled
+	// in the tenant's scope. Some collections are left alone:
+	//
+	//   audit_log                 the tenant is part of each entry's hash, so
+	//                             adopting entries would break the chain; they
+	//                             stay readable in the scope of every tenant.
+	//   webhook_deliveries        deliveries belong to their endpoint, which
+	//                             is adopted with the webhooks.
+	//   notifications             the send queue is shared by every tenant and
+	//                             each notification is addressed already.
+	//   notification_preferences  preferences are keyed by user ID, and users
+	//                             are adopted.
+	for _, coll := range []string{"users", "adverts", "advert_revisions", "advert_comments", "editions", "rate_cards", "webhooks", "invoices", "advertisers", "outbox"} {
+		n, err := tenant.Adopt(ctx, dbConn, t.ID, coll)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d documents of %s to tenant %s\n", n, coll, t.Slug)
+	}
+
+	if err := tenant.DropIndex(ctx, dbConn, "editions", "year", "name"); err != nil {
+		return err
+	}
+	if err := tenant.DropIndex(ctx, dbConn, "rate_cards", "year"); err != nil {
+		return err
+	}
+	if err := tenant.DropIndex(ctx, dbConn, "webhooks", "events", "active"); err != nil {
+		return err
+	}
+	if err := tenant.DropIndex(ctx, dbConn, "advertisers", "keys"); err != nil {
+		return err
+	}
+	if err := tenant.DropIndex(ctx, dbConn, "invoices", "number"); err != nil {
+		return err
+	}
+	if err := tenant.DropIndex(ctx, dbConn, "audit_log", "seq"); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -2,24 +2,45 @@ package handlers
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/blob"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/export"
 	"github.com/mattlaver/peeps/internal/platform/web"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 )
 
+// maxImportBytes bounds the size of an advert import upload.
+const maxImportBytes = 32 << 20
+
+// maxAttachmentBytes bounds the size of a file attached to an advert.
+const maxAttachmentBytes = 100 << 20
+
 // Advert represents the Advert API method handler set.
 type Advert struct {
-	MasterDB *db.DB
-
-	// ADD OTHER STATE LIKE THE LOGGER IF NEEDED.
+	MasterDB        *db.DB
+	Blobs           blob.Store
+	Log             *log.Logger
+	TransferTimeout time.Duration // How long each read or write of an attachment may take.
 }
 
-
-// List returns all the existing Adverts in the system.
+// List returns all the existing Adverts in the system that match the filter
+// query parameters.
 func (p *Advert) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Advert.List")
 	defer span.End()
@@ -27,7 +48,7 @@ func (p *Advert) List(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	dbConn := p.MasterDB.Copy()
 	defer dbConn.Close()
 
-	Adverts, err := advert.List(ctx, dbConn)
+	Adverts, err := advert.List(ctx, dbConn, advertFilter(r))
 	if err != nil {
 		return err
 	}
@@ -35,6 +56,105 @@ func (p *Advert) List(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	return web.Respond(ctx, w, Adverts, http.StatusOK)
 }
 
+// advertFilter reads the filter query parameters shared by List and Export.
+func advertFilter(r *http.Request) advert.Filter {
+	q := r.URL.Query()
+	return advert.Filter{
+		Status:       q.Get("status"),
+		AdvertiserID: q.Get("advertiser_id"),
+		Advertiser:   q.Get("advertiser"),
+		Size:         q.Get("size"),
+		Edition:      q.Get("edition"),
+		Year:         q.Get("year"),
+		State:        q.Get("state"),
+	}
+}
+
+// Export streams the Adverts that match the List filters as CSV, NDJSON or
+// XLSX. The format comes from the format query parameter or the Accept header
+// and the columns query parameter selects which columns are written.
+func (p *Advert) Export(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Export")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.Negotiate(r.Header.Get("Accept"))
+	}
+	if format == "" {
+		format = export.CSV
+	}
+	if export.ContentType(format) == "" {
+		return web.NewRequestError(export.ErrUnknownFormat, http.StatusNotAcceptable)
+	}
+
+	cols, err := advert.ParseColumns(r.URL.Query().Get("columns"))
+	if err != nil {
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	// The response is written as rows arrive rather than through web.Respond.
+	// Nothing is sent until the first row is ready so an error from the query
+	// can still be reported with an error status.
+	var ew export.Writer
+	start := func() error {
+		v.StatusCode = http.StatusOK
+		w.Header().Set("Content-Type", export.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"adverts.%s\"", format))
+
+		var err error
+		ew, err = export.NewWriter(format, w, cols)
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	var n int
+	fn := func(a *advert.Advert) error {
+		if ew == nil {
+			if err := start(); err != nil {
+				return errors.Wrap(err, "starting export")
+			}
+		}
+		if err := ew.Write(advert.Row(a, cols)); err != nil {
+			return err
+		}
+
+		// Push rows to the client regularly rather than buffering the export.
+		n++
+		if flusher != nil && n%500 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if err := advert.Export(ctx, dbConn, advertFilter(r), fn); err != nil {
+		err = errors.Wrapf(err, "Export: %s rows: %d", format, n)
+		if ew == nil {
+			return err
+		}
+
+		// The client has been sent a 200 and some rows, so the failure can
+		// only be reported at the end of the export itself.
+		p.Log.Printf("%s : ERROR : %+v", v.TraceID, err)
+		return ew.Abort(fmt.Sprintf("export stopped after %d rows", n))
+	}
+
+	if ew == nil {
+		if err := start(); err != nil {
+			return errors.Wrap(err, "starting export")
+		}
+	}
+	return ew.Close()
+}
+
 // Retrieve returns the specified Advert from the system.
 func (p *Advert) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Retrieve")
@@ -55,6 +175,11 @@ func (p *Advert) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Re
 		}
 	}
 
+	w.Header().Set("ETag", web.ETag(prod.Version))
+	if web.NotModified(r, prod.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
 	return web.Respond(ctx, w, prod, http.StatusOK)
 }
 
@@ -71,19 +196,55 @@ func (p *Advert) Create(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
 	var np advert.NewAdvert
 	if err := web.Decode(r, &np); err != nil {
 		return errors.Wrap(err, "")
 	}
 
-	nUsr, err := advert.Create(ctx, dbConn, &np, v.Now)
+	if done, err := checkDuplicates(ctx, w, r, dbConn, &np, ""); done || err != nil {
+		return err
+	}
+
+	nUsr, err := advert.Create(ctx, claims, dbConn, &np, v.Now)
 	if err != nil {
-		return errors.Wrapf(err, "Advert: %+v", &np)
+		switch err {
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Advert: %+v", &np)
+		}
 	}
+	audit.Changed(ctx, nUsr.ID.Hex(), nil, nUsr)
 
 	return web.Respond(ctx, w, nUsr, http.StatusCreated)
 }
 
+// Quote prices an advert on the rate card without saving it.
+func (p *Advert) Quote(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Quote")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	var na advert.NewAdvert
+	if err := web.Decode(r, &na); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	price, err := advert.Quote(ctx, dbConn, &na)
+	if err != nil {
+		return errors.Wrapf(err, "Quote: %+v", &na)
+	}
+
+	return web.Respond(ctx, w, price, http.StatusOK)
+}
+
 // Update updates the specified Advert in the system.
 func (p *Advert) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Update")
@@ -97,26 +258,138 @@ func (p *Advert) Update(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
 	var up advert.UpdateAdvert
 	if err := web.Decode(r, &up); err != nil {
 		return errors.Wrap(err, "")
 	}
 
-	err := advert.Update(ctx, dbConn, params["id"], up, v.Now)
+	cur, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	na := advert.Updated(cur, up)
+	if bookingChanged(advert.Editable(cur), na) {
+		if done, err := checkDuplicates(ctx, w, r, dbConn, &na, params["id"]); done || err != nil {
+			return err
+		}
+	}
+
+	err = advert.Update(ctx, claims, dbConn, params["id"], version, up, v.Now)
 	if err != nil {
 		switch err {
 		case advert.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case advert.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
 		default:
 			return errors.Wrapf(err, "ID: %s Update: %+v", params["id"], up)
 		}
 	}
 
+	a, err := retrieveAdvert(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
+// Patch applies a JSON Merge Patch or JSON Patch to the specified Advert.
+func (p *Advert) Patch(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Patch")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	a, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	// If-Match is optional for a patch. The write is always conditional on the
+	// version that was patched so a concurrent change is still detected.
+	if r.Header.Get("If-Match") != "" {
+		version, err := web.IfMatch(r)
+		if err != nil {
+			return err
+		}
+		if !web.VersionMatches(version, a.Version) {
+			return web.NewRequestError(advert.ErrVersionConflict, http.StatusPreconditionFailed)
+		}
+	}
+
+	var na advert.NewAdvert
+	if err := applyPatch(w, r, advert.Editable(a), &na); err != nil {
+		return err
+	}
+
+	if bookingChanged(advert.Editable(a), na) {
+		if done, err := checkDuplicates(ctx, w, r, dbConn, &na, params["id"]); done || err != nil {
+			return err
+		}
+	}
+
+	cur := a
+	a, err = advert.Replace(ctx, claims, dbConn, params["id"], a.Version, &na, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Patch: %+v", params["id"], na)
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
+	w.Header().Set("ETag", web.ETag(a.Version))
+	return web.Respond(ctx, w, a, http.StatusOK)
+}
+
 // Delete removes the specified Advert from the system.
 func (p *Advert) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Delete")
@@ -125,17 +398,1108 @@ func (p *Advert) Delete(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	dbConn := p.MasterDB.Copy()
 	defer dbConn.Close()
 
-	err := advert.Delete(ctx, dbConn, params["id"])
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := retrieveAdvert(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	err = advert.Delete(ctx, claims, dbConn, params["id"], version, v.Now)
 	if err != nil {
 		switch err {
 		case advert.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case advert.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
 		default:
 			return errors.Wrapf(err, "Id: %s", params["id"])
 		}
 	}
+	audit.Changed(ctx, cur.ID.Hex(), cur, nil)
 
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
+
+// History returns every revision of the specified Advert, oldest first.
+func (p *Advert) History(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.History")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	revs, err := advert.History(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, revs, http.StatusOK)
+}
+
+// Diff returns the field level changes between the two revisions named by the
+// from and to query parameters.
+func (p *Advert) Diff(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Diff")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	var revs [2]*advert.Revision
+	for i, name := range []string{"from", "to"} {
+		n, err := strconv.Atoi(r.URL.Query().Get(name))
+		if err != nil {
+			err = errors.Errorf("query parameter %q must be a revision number", name)
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+
+		rev, err := advert.RetrieveRevision(ctx, dbConn, params["id"], n)
+		if err != nil {
+			switch err {
+			case advert.ErrInvalidID:
+				return web.NewRequestError(err, http.StatusBadRequest)
+			case advert.ErrRevisionNotFound:
+				return web.NewRequestError(err, http.StatusNotFound)
+			default:
+				return errors.Wrapf(err, "ID: %s Revision: %d", params["id"], n)
+			}
+		}
+		revs[i] = rev
+	}
+
+	changes, err := advert.Diff(revs[0], revs[1])
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+
+	return web.Respond(ctx, w, changes, http.StatusOK)
+}
+
+// Revert restores the specified Advert to an earlier revision. The If-Match
+// header names the current version of the advert, or the version it had when
+// it was deleted.
+func (p *Advert) Revert(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Revert")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	n, err := strconv.Atoi(params["rev"])
+	if err != nil {
+		err = errors.New("revision must be a number")
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	// A deleted advert can be restored, so there may be nothing before.
+	cur, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil && err != advert.ErrNotFound && err != advert.ErrInvalidID {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+
+	a, err := advert.Revert(ctx, claims, dbConn, params["id"], n, version, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrRevisionNotFound, advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case advert.ErrAlreadyRenewed:
+			return web.NewRequestError(err, http.StatusConflict)
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Revision: %d", params["id"], n)
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
+	return web.Respond(ctx, w, a, http.StatusOK)
+}
+
+// Import creates Adverts in bulk from a CSV or NDJSON upload. The format is
+// taken from the format query parameter or the Content-Type. Columns are
+// mapped to advert fields with the mapping query parameter and dry_run=true
+// validates the upload without saving anything. Rows that look like existing
+// bookings are rejected unless allow_duplicate=true.
+func (p *Advert) Import(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Import")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	q := r.URL.Query()
+
+	format := q.Get("format")
+	if format == "" {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mt {
+		case "text/csv":
+			format = advert.FormatCSV
+		case "application/x-ndjson", "application/ndjson":
+			format = advert.FormatNDJSON
+		}
+	}
+
+	mapping, err := advert.ParseMapping(q.Get("mapping"))
+	if err != nil {
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	var dryRun bool
+	if s := q.Get("dry_run"); s != "" {
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			err = errors.New("dry_run must be true or false")
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+	}
+
+	var allow bool
+	if s := q.Get("allow_duplicate"); s != "" {
+		if allow, err = strconv.ParseBool(s); err != nil {
+			err = errors.New("allow_duplicate must be true or false")
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+	}
+
+	opts := advert.ImportOptions{
+		Format:          format,
+		Mapping:         mapping,
+		DryRun:          dryRun,
+		AllowDuplicates: allow,
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	rep, err := advert.Import(ctx, claims, dbConn, body, opts, v.Now)
+
+	// Adverts inserted before an import fails are recorded too.
+	if rep != nil && len(rep.Created) > 0 {
+		created := struct {
+			Adverts []string `json:"adverts"`
+		}{rep.Created}
+		audit.Changed(ctx, "", nil, created)
+	}
+	if err != nil {
+		switch err {
+		case advert.ErrUnknownFormat:
+			return web.NewRequestError(err, http.StatusUnsupportedMediaType)
+		default:
+			return errors.Wrapf(err, "Import: %+v Report: %+v", opts, rep)
+		}
+	}
+	return web.Respond(ctx, w, rep, http.StatusOK)
+}
+
+// Contacts returns the contacts of the specified Advert.
+func (p *Advert) Contacts(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Contacts")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	a, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	contacts := a.Contacts
+	if contacts == nil {
+		contacts = []advert.Contact{}
+	}
+
+	return web.Respond(ctx, w, contacts, http.StatusOK)
+}
+
+// SetContact adds or replaces the contact for a role on the specified Advert.
+func (p *Advert) SetContact(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.SetContact")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var nc advert.NewContact
+	if err := web.Decode(r, &nc); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveAdvert(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	a, err := advert.SetContact(ctx, claims, dbConn, params["id"], params["role"], version, &nc, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID, advert.ErrInvalidRole:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s Role: %s Contact: %+v", params["id"], params["role"], &nc)
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
+	c, _ := advert.ContactFor(a, params["role"])
+
+	w.Header().Set("ETag", web.ETag(a.Version))
+	return web.Respond(ctx, w, c, http.StatusOK)
+}
+
+// RemoveContact removes the contact for a role from the specified Advert.
+func (p *Advert) RemoveContact(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.RemoveContact")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := retrieveAdvert(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	a, err := advert.RemoveContact(ctx, claims, dbConn, params["id"], params["role"], version, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID, advert.ErrInvalidRole:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound, advert.ErrContactNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s Role: %s", params["id"], params["role"])
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Transitions returns the status history of the specified Advert and the
+// statuses the caller may move it to.
+func (p *Advert) Transitions(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Transitions")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	a, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	history := a.StatusHistory
+	if history == nil {
+		history = []advert.StatusChange{}
+	}
+
+	resp := struct {
+		Status  string                `json:"status"`
+		Allowed []string              `json:"allowed"`
+		History []advert.StatusChange `json:"history"`
+	}{
+		Status:  a.CurrentStatus(),
+		Allowed: advert.Allowed(claims, a),
+		History: history,
+	}
+
+	w.Header().Set("ETag", web.ETag(a.Version))
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// Transition moves the specified Advert to another status. Moves the state
+// machine does not allow are rejected with 409.
+func (p *Advert) Transition(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Transition")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var tr advert.NewTransition
+	if err := web.Decode(r, &tr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveAdvert(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	a, err := advert.Transition(ctx, claims, dbConn, params["id"], version, &tr, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case advert.ErrIllegalTransition:
+			return web.NewRequestError(err, http.StatusConflict)
+		case advert.ErrTransitionForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Transition: %+v", params["id"], tr)
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), cur, a)
+
+	w.Header().Set("ETag", web.ETag(a.Version))
+	return web.Respond(ctx, w, a, http.StatusOK)
+}
+
+// Attachments returns the files attached to the specified Advert.
+func (p *Advert) Attachments(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Attachments")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	a, err := advert.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	atts := a.Attachments
+	if atts == nil {
+		atts = []advert.Attachment{}
+	}
+
+	return web.Respond(ctx, w, atts, http.StatusOK)
+}
+
+// Attach uploads a file to the specified Advert. The request is
+// multipart/form-data with the file in a part named file. The kind of file,
+// artwork or proof, comes from the kind query parameter or a kind field sent
+// before the file, and defaults to artwork.
+//
+// An upload outlives the ReadTimeout of the server, so each read of the body
+// is given its own deadline instead.
+func (p *Advert) Attach(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Attach")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	r.Body = &deadlineReader{r: r.Body, rc: rc, timeout: p.TransferTimeout}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	kind := r.URL.Query().Get("kind")
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return web.NewRequestError(errors.New("multipart body has no file part"), http.StatusBadRequest)
+		}
+		if err != nil {
+			return web.NewRequestError(err, http.StatusBadRequest)
+		}
+
+		switch part.FormName() {
+		case "kind":
+			b, err := ioutil.ReadAll(io.LimitReader(part, 64))
+			if err != nil {
+				return web.NewRequestError(err, http.StatusBadRequest)
+			}
+			kind = string(b)
+			continue
+		case "file":
+		default:
+			continue
+		}
+
+		if kind == "" {
+			kind = advert.AttachmentArtwork
+		}
+		na := advert.NewAttachment{
+			Kind:     kind,
+			Filename: part.FileName(),
+		}
+		if err := web.Validate(na); err != nil {
+			return err
+		}
+
+		att, err := advert.Attach(ctx, claims, dbConn, p.Blobs, params["id"], version, &na, part, maxAttachmentBytes, v.Now)
+		if err != nil {
+			switch err {
+			case advert.ErrInvalidID:
+				return web.NewRequestError(err, http.StatusBadRequest)
+			case advert.ErrNotFound:
+				return web.NewRequestError(err, http.StatusNotFound)
+			case advert.ErrVersionConflict:
+				return web.NewRequestError(err, http.StatusPreconditionFailed)
+			case advert.ErrContentType:
+				return web.NewRequestError(err, http.StatusUnsupportedMediaType)
+			case advert.ErrTooLarge:
+				return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+			default:
+				return errors.Wrapf(err, "ID: %s Attach: %+v", params["id"], na)
+			}
+		}
+		audit.Changed(ctx, params["id"], nil, att)
+
+		// The server's write deadline ran from the start of the upload.
+		if err := rc.SetWriteDeadline(time.Now().Add(p.TransferTimeout)); err != nil {
+			return errors.Wrap(err, "extending write deadline")
+		}
+		return web.Respond(ctx, w, att, http.StatusCreated)
+	}
+}
+
+// Attachment downloads a file attached to the specified Advert. Range and
+// conditional requests are supported. As with an upload, each write of the
+// file is given its own deadline rather than the server's WriteTimeout.
+func (p *Advert) Attachment(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Attachment")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	att, err := advert.RetrieveAttachment(ctx, dbConn, params["id"], params["attachment"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound, advert.ErrAttachmentNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s Attachment: %s", params["id"], params["attachment"])
+		}
+	}
+
+	obj, err := p.Blobs.Open(ctx, att.Key, att.Size)
+	if err != nil {
+		return errors.Wrapf(err, "opening attachment %s", att.Key)
+	}
+	defer obj.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", att.ContentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+	h.Set("ETag", `"`+att.SHA256+`"`)
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent writes the response itself, including partial content and
+	// not modified responses, so note the status it chooses for the logger.
+	dw := deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: p.TransferTimeout}
+	sw := statusWriter{ResponseWriter: &dw, status: &v.StatusCode}
+	http.ServeContent(&sw, r, att.Filename, att.DateUploaded, obj)
+	return nil
+}
+
+// RemoveAttachment deletes a file attached to the specified Advert.
+func (p *Advert) RemoveAttachment(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.RemoveAttachment")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	attachmentError := func(err error) error {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound, advert.ErrAttachmentNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s Attachment: %s", params["id"], params["attachment"])
+		}
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := advert.RetrieveAttachment(ctx, dbConn, params["id"], params["attachment"])
+	if err != nil {
+		return attachmentError(err)
+	}
+
+	if err := advert.RemoveAttachment(ctx, claims, dbConn, p.Blobs, params["id"], params["attachment"], version, v.Now); err != nil {
+		return attachmentError(err)
+	}
+	audit.Changed(ctx, params["id"], cur, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Comments returns the comments on the specified Advert, oldest first.
+func (p *Advert) Comments(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Comments")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	cs, err := advert.Comments(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, cs, http.StatusOK)
+}
+
+// AddComment adds a comment, or a reply to a comment, to the specified Advert.
+// Comments are kept apart from the advert and leave its version alone, so
+// no If-Match is needed. Edits to a comment match on the comment's version.
+func (p *Advert) AddComment(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.AddComment")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var nc advert.NewComment
+	if err := web.Decode(r, &nc); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	c, err := advert.AddComment(ctx, claims, dbConn, params["id"], &nc, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s Comment: %+v", params["id"], nc)
+		}
+	}
+	audit.Changed(ctx, params["id"], nil, c)
+
+	w.Header().Set("ETag", web.ETag(c.Version))
+	return web.Respond(ctx, w, c, http.StatusCreated)
+}
+
+// UpdateComment edits a comment on the specified Advert. Only the author of
+// the comment may edit it.
+func (p *Advert) UpdateComment(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.UpdateComment")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var uc advert.UpdateComment
+	if err := web.Decode(r, &uc); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := advert.RetrieveComment(ctx, dbConn, params["id"], params["comment"])
+	if err != nil {
+		return commentError(err, params)
+	}
+
+	c, err := advert.EditComment(ctx, claims, dbConn, params["id"], params["comment"], version, &uc, v.Now)
+	if err != nil {
+		return commentError(err, params)
+	}
+	audit.Changed(ctx, params["id"], cur, c)
+
+	w.Header().Set("ETag", web.ETag(c.Version))
+	return web.Respond(ctx, w, c, http.StatusOK)
+}
+
+// DeleteComment deletes a comment on the specified Advert. Only the author of
+// the comment may delete it.
+func (p *Advert) DeleteComment(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.DeleteComment")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := advert.RetrieveComment(ctx, dbConn, params["id"], params["comment"])
+	if err != nil {
+		return commentError(err, params)
+	}
+
+	if err := advert.DeleteComment(ctx, claims, dbConn, params["id"], params["comment"], version, v.Now); err != nil {
+		return commentError(err, params)
+	}
+	audit.Changed(ctx, params["id"], cur, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// commentError maps the errors from changing a comment to responses.
+func commentError(err error, params map[string]string) error {
+	switch err {
+	case advert.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case advert.ErrCommentNotFound:
+		return web.NewRequestError(err, http.StatusNotFound)
+	case advert.ErrNotAuthor:
+		return web.NewRequestError(err, http.StatusForbidden)
+	case advert.ErrCommentVersionConflict:
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	default:
+		return errors.Wrapf(err, "ID: %s Comment: %s", params["id"], params["comment"])
+	}
+}
+
+// Activity returns the comments on the specified Advert merged with its
+// recorded changes, oldest first.
+func (p *Advert) Activity(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Activity")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	feed, err := advert.ActivityFeed(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, feed, http.StatusOK)
+}
+
+// Renew books a copy of the specified Advert for another year, linked back
+// to it. The body may name the year and editions and may be an empty object
+// to renew into the next year's editions of the same names. The advert
+// renewed from is not changed, so no If-Match is needed.
+func (p *Advert) Renew(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Renew")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var nr advert.NewRenewal
+	if err := web.Decode(r, &nr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	a, err := advert.Renew(ctx, claims, dbConn, params["id"], &nr, v.Now)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advert.ErrAlreadyRenewed:
+			return web.NewRequestError(err, http.StatusConflict)
+		case edition.ErrFull:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Renewal: %+v", params["id"], nr)
+		}
+	}
+	audit.Changed(ctx, a.ID.Hex(), nil, a)
+
+	w.Header().Set("ETag", web.ETag(a.Version))
+	return web.Respond(ctx, w, a, http.StatusCreated)
+}
+
+// Renewals returns the adverts of the year named by the year query parameter
+// that have not been renewed, so they can be chased. The year defaults to
+// last year.
+func (p *Advert) Renewals(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Renewals")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	year := r.URL.Query().Get("year")
+	if year == "" {
+		year = strconv.Itoa(v.Now.Year() - 1)
+	}
+
+	adverts, err := advert.Unrenewed(ctx, dbConn, year)
+	if err != nil {
+		return errors.Wrapf(err, "Year: %s", year)
+	}
+
+	return web.Respond(ctx, w, adverts, http.StatusOK)
+}
+
+// duplicatesResponse is the body of the response refusing a booking that
+// looks like one already made.
+type duplicatesResponse struct {
+	Error      string           `json:"error"`
+	Duplicates []advert.Suspect `json:"duplicates"`
+}
+
+// checkDuplicates looks for adverts that na may duplicate. A booking with
+// suspects is refused with a 409 listing them, and done reports that the
+// response has been written. Clients that know better send
+// allow_duplicate=true and the suspects are named in a Warning header instead.
+func checkDuplicates(ctx context.Context, w http.ResponseWriter, r *http.Request, dbConn *db.DB, na *advert.NewAdvert, self string) (done bool, err error) {
+	allow := false
+	if s := r.URL.Query().Get("allow_duplicate"); s != "" {
+		if allow, err = strconv.ParseBool(s); err != nil {
+			err = errors.New("query parameter allow_duplicate must be true or false")
+			return false, web.NewRequestError(err, http.StatusBadRequest)
+		}
+	}
+
+	suspects, err := advert.Duplicates(ctx, dbConn, na, self)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking duplicates of %+v", na)
+	}
+	if len(suspects) == 0 {
+		return false, nil
+	}
+
+	if allow {
+		ids := make([]string, len(suspects))
+		for i, s := range suspects {
+			ids[i] = s.ID.Hex()
+		}
+		w.Header().Set("Warning", fmt.Sprintf(`299 - "Possible duplicate of adverts %s"`, strings.Join(ids, ", ")))
+		return false, nil
+	}
+
+	resp := duplicatesResponse{
+		Error:      "Advert looks like a duplicate of an existing booking",
+		Duplicates: suspects,
+	}
+	return true, web.Respond(ctx, w, resp, http.StatusConflict)
+}
+
+// bookingChanged reports whether an edit changes who an advert is booked for
+// or where it runs, which are the fields duplicates are detected on.
+func bookingChanged(before, after advert.NewAdvert) bool {
+	return before.AdvertiserID != after.AdvertiserID ||
+		before.Advertiser != after.Advertiser ||
+		before.Year != after.Year ||
+		!reflect.DeepEqual(before.Editions, after.Editions) ||
+		!reflect.DeepEqual(before.Contacts, after.Contacts)
+}
+
+// Duplicates returns groups of adverts that look like the same booking made
+// more than once, for the year named by the year query parameter or for
+// every year.
+func (p *Advert) Duplicates(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advert.Duplicates")
+	defer span.End()
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	year := r.URL.Query().Get("year")
+
+	clusters, err := advert.DuplicateClusters(ctx, dbConn, year)
+	if err != nil {
+		return errors.Wrapf(err, "Year: %s", year)
+	}
+
+	return web.Respond(ctx, w, clusters, http.StatusOK)
+}
+
+// retrieveAdvert gets the specified Advert, mapping failures to responses.
+func retrieveAdvert(ctx context.Context, dbConn *db.DB, id string) (*advert.Advert, error) {
+	a, err := advert.Retrieve(ctx, dbConn, id)
+	if err != nil {
+		switch err {
+		case advert.ErrInvalidID:
+			return nil, web.NewRequestError(err, http.StatusBadRequest)
+		case advert.ErrNotFound:
+			return nil, web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return nil, errors.Wrapf(err, "ID: %s", id)
+		}
+	}
+	return a, nil
+}
+
+// statusWriter records the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status *int
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (sw *statusWriter) WriteHeader(code int) {
+	*sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if *sw.status == 0 {
+		*sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// deadlineReader gives each read of a request body its own deadline so a
+// large upload is limited by how long the client stalls rather than how long
+// the whole body takes.
+type deadlineReader struct {
+	r       io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// Read implements the io.Reader interface.
+func (dr *deadlineReader) Read(b []byte) (int, error) {
+	if err := dr.rc.SetReadDeadline(time.Now().Add(dr.timeout)); err != nil {
+		return 0, err
+	}
+	return dr.r.Read(b)
+}
+
+// Close implements the io.Closer interface.
+func (dr *deadlineReader) Close() error {
+	return dr.r.Close()
+}
+
+// deadlineWriter gives each write of a response its own deadline, the
+// counterpart of deadlineReader for large downloads.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// Write implements the http.ResponseWriter interface.
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	if err := dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout)); err != nil {
+		return 0, err
+	}
+	return dw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// errAdvertiserInUse occurs when deleting an advertiser that adverts still
+// reference.
+var errAdvertiserInUse = errors.New("Advertiser still has adverts booked")
+
+// Advertiser represents the Advertiser API method handler set.
+type Advertiser struct {
+	MasterDB *db.DB
+}
+
+// List returns all the existing Advertisers in the system.
+func (a *Advertiser) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.List")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	advertisers, err := advertiser.List(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, advertisers, http.StatusOK)
+}
+
+// Retrieve returns the specified Advertiser from the system.
+func (a *Advertiser) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Retrieve")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	adv, err := advertiser.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advertiser.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	w.Header().Set("ETag", web.ETag(adv.Version))
+	if web.NotModified(r, adv.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
+	return web.Respond(ctx, w, adv, http.StatusOK)
+}
+
+// Create inserts a new Advertiser into the system.
+func (a *Advertiser) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Create")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var na advertiser.NewAdvertiser
+	if err := web.Decode(r, &na); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	adv, err := advertiser.Create(ctx, dbConn, &na, v.Now)
+	if err != nil {
+		switch err {
+		case advertiser.ErrNameTaken:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Advertiser: %+v", &na)
+		}
+	}
+
+	audit.Changed(ctx, adv.ID.Hex(), nil, adv)
+
+	w.Header().Set("ETag", web.ETag(adv.Version))
+	return web.Respond(ctx, w, adv, http.StatusCreated)
+}
+
+// Update updates the specified Advertiser in the system. Adverts booked for
+// the advertiser pick up a change to its name.
+func (a *Advertiser) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Update")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var upd advertiser.UpdateAdvertiser
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	old, err := advertiser.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advertiser.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	adv, err := advertiser.Update(ctx, dbConn, params["id"], version, &upd, v.Now)
+	if err != nil {
+		switch err {
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advertiser.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case advertiser.ErrNameTaken:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Update: %+v", params["id"], upd)
+		}
+	}
+
+	if adv.Name != old.Name {
+		if _, err := advert.LinkAdvertiser(ctx, claims, dbConn, []string{old.Name}, adv, v.Now); err != nil {
+			return errors.Wrapf(err, "ID: %s renaming adverts", params["id"])
+		}
+	}
+
+	audit.Changed(ctx, adv.ID.Hex(), old, adv)
+
+	w.Header().Set("ETag", web.ETag(adv.Version))
+	return web.Respond(ctx, w, adv, http.StatusOK)
+}
+
+// Delete removes the specified Advertiser from the system. An advertiser with
+// adverts booked cannot be deleted.
+func (a *Advertiser) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Delete")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	adv, err := advertiser.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advertiser.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	booked, err := advert.List(ctx, dbConn, advert.Filter{AdvertiserID: adv.ID.Hex()})
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+	if len(booked) > 0 {
+		return web.NewRequestError(errAdvertiserInUse, http.StatusConflict)
+	}
+
+	// An advert booked after the check above still refers to the advertiser,
+	// which is only marked deleted.
+	err = advertiser.Delete(ctx, dbConn, params["id"], version, v.Now)
+	if err != nil {
+		switch err {
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case advertiser.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	audit.Changed(ctx, adv.ID.Hex(), adv, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Adverts returns the booking history of the specified Advertiser.
+func (a *Advertiser) Adverts(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Adverts")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	adv, err := advertiser.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case advertiser.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case advertiser.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	adverts, err := advert.List(ctx, dbConn, advert.Filter{AdvertiserID: adv.ID.Hex()})
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+
+	return web.Respond(ctx, w, adverts, http.StatusOK)
+}
+
+// Duplicates returns groups of Advertisers that look like the same company,
+// so they can be merged.
+func (a *Advertiser) Duplicates(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Advertiser.Duplicates")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	advertisers, err := advertiser.List(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	dups := advertiser.Duplicates(advertisers)
+	if dups == nil {
+		dups = [][]advertiser.Advertiser{}
+	}
+
+	return web.Respond(ctx, w, dups, http.StatusOK)
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Audit represents the Audit API method handler set.
+type Audit struct {
+	MasterDB *db.DB
+}
+
+// List returns entries from the audit log of the caller's tenant, newest
+// first. The actor, action, resource, resource_id, outcome, from and to query
+// parameters filter the entries, and before pages back through the log.
+func (a *Audit) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Audit.List")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	flt, err := audit.ParseFilter(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	entries, err := audit.List(ctx, dbConn, flt)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, entries, http.StatusOK)
+}
+
+// Verify checks the hash chain of the audit log and reports the first entry
+// found to have been tampered with.
+func (a *Audit) Verify(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Audit.Verify")
+	defer span.End()
+
+	dbConn := a.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ver, err := audit.Verify(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, ver, http.StatusOK)
+}
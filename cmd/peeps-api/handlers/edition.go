@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// errEditionInUse occurs when deleting an edition that adverts are still
+// booked into.
+var errEditionInUse = errors.New("Edition still has adverts booked")
+
+// Edition represents the Edition API method handler set.
+type Edition struct {
+	MasterDB *db.DB
+}
+
+// List returns the editions in the catalogue. The year query parameter limits
+// the list to a single year.
+func (e *Edition) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.List")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	editions, err := edition.List(ctx, dbConn, r.URL.Query().Get("year"))
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, editions, http.StatusOK)
+}
+
+// Retrieve returns the specified Edition from the system.
+func (e *Edition) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Retrieve")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ed, err := retrieveEdition(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", web.ETag(ed.Version))
+	if web.NotModified(r, ed.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
+	return web.Respond(ctx, w, ed, http.StatusOK)
+}
+
+// Create adds a new Edition to the catalogue.
+func (e *Edition) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Create")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var ne edition.NewEdition
+	if err := web.Decode(r, &ne); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	ed, err := edition.Create(ctx, dbConn, &ne, v.Now)
+	if err != nil {
+		switch err {
+		case edition.ErrDuplicate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Edition: %+v", &ne)
+		}
+	}
+
+	audit.Changed(ctx, ed.ID.Hex(), nil, ed)
+
+	w.Header().Set("ETag", web.ETag(ed.Version))
+	return web.Respond(ctx, w, ed, http.StatusCreated)
+}
+
+// Update changes the dates or status of the specified Edition. Closing an
+// edition stops further bookings into it.
+func (e *Edition) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Update")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var upd edition.UpdateEdition
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveEdition(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	ed, err := edition.Update(ctx, dbConn, params["id"], version, &upd, v.Now)
+	if err != nil {
+		switch err {
+		case edition.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case edition.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case edition.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s Update: %+v", params["id"], upd)
+		}
+	}
+
+	audit.Changed(ctx, ed.ID.Hex(), cur, ed)
+
+	w.Header().Set("ETag", web.ETag(ed.Version))
+	return web.Respond(ctx, w, ed, http.StatusOK)
+}
+
+// Delete removes the specified Edition from the catalogue. An edition with
+// adverts booked into it cannot be deleted.
+func (e *Edition) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Delete")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	ed, err := retrieveEdition(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	booked, err := advert.List(ctx, dbConn, advert.Filter{Edition: ed.Name, Year: ed.Year})
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+	if len(booked) > 0 {
+		return web.NewRequestError(errEditionInUse, http.StatusConflict)
+	}
+
+	err = edition.Delete(ctx, dbConn, params["id"], version)
+	if err != nil {
+		switch err {
+		case edition.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case edition.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	audit.Changed(ctx, ed.ID.Hex(), ed, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Adverts returns the adverts booked into the specified Edition.
+func (e *Edition) Adverts(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Adverts")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ed, err := retrieveEdition(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	adverts, err := advert.List(ctx, dbConn, advert.Filter{Edition: ed.Name, Year: ed.Year})
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+
+	return web.Respond(ctx, w, adverts, http.StatusOK)
+}
+
+// retrieveEdition gets an edition and maps lookup failures to responses.
+func retrieveEdition(ctx context.Context, dbConn *db.DB, id string) (*edition.Edition, error) {
+	ed, err := edition.Retrieve(ctx, dbConn, id)
+	if err != nil {
+		switch err {
+		case edition.ErrInvalidID:
+			return nil, web.NewRequestError(err, http.StatusBadRequest)
+		case edition.ErrNotFound:
+			return nil, web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return nil, errors.Wrapf(err, "ID: %s", id)
+		}
+	}
+	return ed, nil
+}
+
+// Layout plans the pages and ad slots of the specified Edition. Adverts
+// already booked into the edition are given slots where they fit, and the
+// resulting flat plan is returned.
+func (e *Edition) Layout(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.Layout")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var nl edition.NewLayout
+	if err := web.Decode(r, &nl); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveEdition(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	ed, err := edition.SetLayout(ctx, dbConn, params["id"], version, &nl, v.Now)
+	if err != nil {
+		switch err {
+		case edition.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case edition.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case edition.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		case edition.ErrLayoutInUse:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s Layout: %+v", params["id"], nl)
+		}
+	}
+
+	audit.Changed(ctx, ed.ID.Hex(), cur, ed)
+
+	if err := advert.Place(ctx, dbConn, ed); err != nil {
+		return errors.Wrapf(err, "ID: %s placing adverts", params["id"])
+	}
+
+	fp, err := advert.Plan(ctx, dbConn, params["id"])
+	if err != nil {
+		return errors.Wrapf(err, "ID: %s", params["id"])
+	}
+
+	w.Header().Set("ETag", web.ETag(fp.Edition.Version))
+	return web.Respond(ctx, w, fp, http.StatusOK)
+}
+
+// FlatPlan shows which advert occupies each position of the specified
+// Edition, page by page.
+func (e *Edition) FlatPlan(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Edition.FlatPlan")
+	defer span.End()
+
+	dbConn := e.MasterDB.Copy()
+	defer dbConn.Close()
+
+	fp, err := advert.Plan(ctx, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case edition.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case edition.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, fp, http.StatusOK)
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/invoice"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Invoice represents the Invoice API method handler set.
+type Invoice struct {
+	MasterDB *db.DB
+	Seller   invoice.Party
+}
+
+// List returns the invoices that match the advertiser_id and status query
+// parameters.
+func (i *Invoice) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.List")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	flt := invoice.Filter{
+		AdvertiserID: r.URL.Query().Get("advertiser_id"),
+		Status:       r.URL.Query().Get("status"),
+	}
+
+	invoices, err := invoice.List(ctx, dbConn, flt)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, invoices, http.StatusOK)
+}
+
+// Retrieve returns the specified Invoice from the system.
+func (i *Invoice) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Retrieve")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	inv, err := retrieveInvoice(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", web.ETag(inv.Version))
+	if web.NotModified(r, inv.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
+	return web.Respond(ctx, w, inv, http.StatusOK)
+}
+
+// PDF renders the specified Invoice as a PDF document.
+func (i *Invoice) PDF(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.PDF")
+	defer span.End()
+
+	return i.render(ctx, w, params["id"], "application/pdf", "pdf", invoice.WritePDF)
+}
+
+// UBL renders the specified Invoice as an OASIS UBL 2.1 XML document.
+func (i *Invoice) UBL(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.UBL")
+	defer span.End()
+
+	return i.render(ctx, w, params["id"], "application/xml", "xml", invoice.WriteUBL)
+}
+
+// render writes an invoice document with the given renderer.
+func (i *Invoice) render(ctx context.Context, w http.ResponseWriter, id, contentType, ext string, fn func(w io.Writer, inv *invoice.Invoice, seller invoice.Party) error) error {
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	inv, err := retrieveInvoice(ctx, dbConn, id)
+	if err != nil {
+		return err
+	}
+
+	name := inv.Reference()
+	if name == "" {
+		name = "draft-" + inv.ID.Hex()
+	}
+
+	// Render into memory first so a failure can still be reported as an
+	// error response.
+	var buf bytes.Buffer
+	if err := fn(&buf, inv, i.Seller); err != nil {
+		return errors.Wrapf(err, "rendering invoice %s", id)
+	}
+
+	v.StatusCode = http.StatusOK
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.%s\"", name, ext))
+	w.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// Create drafts a new Invoice for adverts booked by an advertiser.
+func (i *Invoice) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Create")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	var ni invoice.NewInvoice
+	if err := web.Decode(r, &ni); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	inv, err := invoice.Create(ctx, claims, dbConn, &ni, v.Now)
+	if err != nil {
+		return errors.Wrapf(err, "Invoice: %+v", &ni)
+	}
+
+	audit.Changed(ctx, inv.ID.Hex(), nil, inv)
+
+	w.Header().Set("ETag", web.ETag(inv.Version))
+	return web.Respond(ctx, w, inv, http.StatusCreated)
+}
+
+// Issue numbers the specified draft Invoice and fixes its contents.
+func (i *Invoice) Issue(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Issue")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := retrieveInvoice(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	inv, err := invoice.Issue(ctx, dbConn, params["id"], version, v.Now)
+	if err != nil {
+		return invoiceError(err, params["id"])
+	}
+
+	audit.Changed(ctx, inv.ID.Hex(), cur, inv)
+
+	w.Header().Set("ETag", web.ETag(inv.Version))
+	return web.Respond(ctx, w, inv, http.StatusOK)
+}
+
+// Pay records payment of the specified issued Invoice.
+func (i *Invoice) Pay(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Pay")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var p invoice.Payment
+	if err := web.Decode(r, &p); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveInvoice(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	inv, err := invoice.MarkPaid(ctx, dbConn, params["id"], version, &p, v.Now)
+	if err != nil {
+		return invoiceError(err, params["id"])
+	}
+
+	audit.Changed(ctx, inv.ID.Hex(), cur, inv)
+
+	w.Header().Set("ETag", web.ETag(inv.Version))
+	return web.Respond(ctx, w, inv, http.StatusOK)
+}
+
+// Void cancels the specified issued Invoice.
+func (i *Invoice) Void(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Void")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var c invoice.Cancellation
+	if err := web.Decode(r, &c); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveInvoice(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	inv, err := invoice.Void(ctx, dbConn, params["id"], version, &c, v.Now)
+	if err != nil {
+		return invoiceError(err, params["id"])
+	}
+
+	audit.Changed(ctx, inv.ID.Hex(), cur, inv)
+
+	w.Header().Set("ETag", web.ETag(inv.Version))
+	return web.Respond(ctx, w, inv, http.StatusOK)
+}
+
+// Delete removes the specified draft Invoice from the system.
+func (i *Invoice) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Invoice.Delete")
+	defer span.End()
+
+	dbConn := i.MasterDB.Copy()
+	defer dbConn.Close()
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := retrieveInvoice(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	if err := invoice.Delete(ctx, dbConn, params["id"], version); err != nil {
+		return invoiceError(err, params["id"])
+	}
+
+	audit.Changed(ctx, cur.ID.Hex(), cur, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// retrieveInvoice gets an invoice and maps lookup failures to responses.
+func retrieveInvoice(ctx context.Context, dbConn *db.DB, id string) (*invoice.Invoice, error) {
+	inv, err := invoice.Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, invoiceError(err, id)
+	}
+	return inv, nil
+}
+
+// invoiceError maps the errors of the invoice package to responses.
+func invoiceError(err error, id string) error {
+	switch err {
+	case invoice.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case invoice.ErrNotFound:
+		return web.NewRequestError(err, http.StatusNotFound)
+	case invoice.ErrVersionConflict:
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	case invoice.ErrStatus:
+		return web.NewRequestError(err, http.StatusConflict)
+	default:
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+}
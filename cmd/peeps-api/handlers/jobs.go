@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/platform/jobs"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Jobs represents the Jobs API method handler set.
+type Jobs struct {
+	Scheduler *jobs.Scheduler
+}
+
+// List returns the registered jobs with their next and last runs.
+func (j *Jobs) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Jobs.List")
+	defer span.End()
+
+	infos, err := j.Scheduler.Jobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	return web.Respond(ctx, w, infos, http.StatusOK)
+}
+
+// Runs returns the most recent runs of the specified job.
+func (j *Jobs) Runs(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Jobs.Runs")
+	defer span.End()
+
+	runs, err := j.Scheduler.Runs(ctx, params["name"])
+	if err != nil {
+		return jobsError(err, params["name"])
+	}
+
+	return web.Respond(ctx, w, runs, http.StatusOK)
+}
+
+// Trigger starts the specified job straight away and returns its run without
+// waiting for it to finish.
+func (j *Jobs) Trigger(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Jobs.Trigger")
+	defer span.End()
+
+	run, err := j.Scheduler.Trigger(ctx, params["name"])
+	if err != nil {
+		return jobsError(err, params["name"])
+	}
+
+	return web.Respond(ctx, w, run, http.StatusAccepted)
+}
+
+// jobsError maps the errors of the jobs package to responses.
+func jobsError(err error, name string) error {
+	switch err {
+	case jobs.ErrUnknownJob:
+		return web.NewRequestError(err, http.StatusNotFound)
+	case jobs.ErrLocked:
+		return web.NewRequestError(err, http.StatusConflict)
+	case jobs.ErrStopping:
+		return web.NewRequestError(err, http.StatusServiceUnavailable)
+	default:
+		return errors.Wrapf(err, "Job: %s", name)
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/notify"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Notification represents the notification preferences API method handler
+// set.
+type Notification struct {
+	MasterDB *db.DB
+	Locale   string // Locale of users who have not chosen one.
+}
+
+// Preferences returns how the specified user wants to be notified. Users may
+// see their own preferences and admins anyone's.
+func (n *Notification) Preferences(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Notification.Preferences")
+	defer span.End()
+
+	dbConn := n.MasterDB.Copy()
+	defer dbConn.Close()
+
+	if err := n.checkUser(ctx, dbConn, params["id"]); err != nil {
+		return err
+	}
+
+	p, err := notify.RetrievePreferences(ctx, dbConn, params["id"], n.Locale)
+	if err != nil {
+		return notificationError(err, params["id"])
+	}
+
+	w.Header().Set("ETag", web.ETag(p.Version))
+	return web.Respond(ctx, w, p, http.StatusOK)
+}
+
+// SetPreferences replaces how the specified user wants to be notified. Users
+// may change their own preferences and admins anyone's. The If-Match header
+// of the first change names version 0.
+func (n *Notification) SetPreferences(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Notification.SetPreferences")
+	defer span.End()
+
+	dbConn := n.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	if err := n.checkUser(ctx, dbConn, params["id"]); err != nil {
+		return err
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var np notify.NewPreferences
+	if err := web.Decode(r, &np); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	p, err := notify.SetPreferences(ctx, dbConn, params["id"], version, &np, v.Now)
+	if err != nil {
+		return notificationError(err, params["id"])
+	}
+
+	w.Header().Set("ETag", web.ETag(p.Version))
+	return web.Respond(ctx, w, p, http.StatusOK)
+}
+
+// checkUser makes sure the user exists and the caller may act for them.
+func (n *Notification) checkUser(ctx context.Context, dbConn *db.DB, id string) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	if _, err := user.Retrieve(ctx, claims, dbConn, id); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s", id)
+		}
+	}
+
+	return nil
+}
+
+// notificationError translates the errors of the notify package into
+// request errors.
+func notificationError(err error, id string) error {
+	switch err {
+	case notify.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case notify.ErrVersionConflict:
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	default:
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+}
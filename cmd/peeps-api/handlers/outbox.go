@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Outbox represents the Outbox API method handler set.
+type Outbox struct {
+	MasterDB *db.DB
+}
+
+// outboxStatuses are the statuses the outbox can be listed by.
+var outboxStatuses = map[string]bool{
+	event.StatusStaged:     true,
+	event.StatusPending:    true,
+	event.StatusDelivering: true,
+	event.StatusDelivered:  true,
+	event.StatusDead:       true,
+}
+
+// List returns the most recent events in the outbox, optionally only those
+// with the status given in the status query parameter.
+func (o *Outbox) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Outbox.List")
+	defer span.End()
+
+	dbConn := o.MasterDB.Copy()
+	defer dbConn.Close()
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !outboxStatuses[status] {
+		return web.NewFieldErrors(web.FieldError{
+			Field: "status",
+			Error: "status must be one of staged, pending, delivering, delivered or dead",
+		})
+	}
+
+	es, err := event.List(ctx, dbConn, status)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	return web.Respond(ctx, w, es, http.StatusOK)
+}
+
+// Retry queues an event that was given up on to be delivered again.
+func (o *Outbox) Retry(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Outbox.Retry")
+	defer span.End()
+
+	dbConn := o.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	e, err := event.Retry(ctx, dbConn, params["id"], v.Now)
+	if err != nil {
+		switch err {
+		case event.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case event.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case event.ErrNotDead:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "ID: %s", params["id"])
+		}
+	}
+
+	return web.Respond(ctx, w, e, http.StatusAccepted)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/platform/patch"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+)
+
+// maxPatchBytes bounds the size of a PATCH request body.
+const maxPatchBytes = 1 << 20
+
+// applyPatch applies the body of a PATCH request to the JSON encoding of doc.
+// The patch format is chosen by the request Content-Type. The patched document
+// is decoded into out and checked against its validation tags.
+func applyPatch(w http.ResponseWriter, r *http.Request, doc interface{}, out interface{}) error {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mt = ""
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchBytes))
+	if err != nil {
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	orig, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "encoding document")
+	}
+
+	var patched []byte
+	switch mt {
+	case patch.MergePatchType:
+		patched, err = patch.Merge(orig, body)
+	case patch.JSONPatchType:
+		patched, err = patch.Apply(orig, body)
+	default:
+		err := errors.Errorf("Content-Type must be %s or %s", patch.MergePatchType, patch.JSONPatchType)
+		return web.NewRequestError(err, http.StatusUnsupportedMediaType)
+	}
+	if err != nil {
+		switch e := errors.Cause(err); e {
+		case patch.ErrMalformed:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case patch.ErrTestFailed:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			if _, ok := e.(*patch.Error); ok {
+				return web.NewRequestError(err, http.StatusUnprocessableEntity)
+			}
+			return errors.Wrap(err, "applying patch")
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return web.NewRequestError(err, http.StatusUnprocessableEntity)
+	}
+
+	return web.Validate(out)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/ratecard"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// RateCard represents the RateCard API method handler set.
+type RateCard struct {
+	MasterDB *db.DB
+}
+
+// List returns every rate card in the system.
+func (rc *RateCard) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.RateCard.List")
+	defer span.End()
+
+	dbConn := rc.MasterDB.Copy()
+	defer dbConn.Close()
+
+	cards, err := ratecard.List(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, cards, http.StatusOK)
+}
+
+// Retrieve returns the specified RateCard from the system.
+func (rc *RateCard) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.RateCard.Retrieve")
+	defer span.End()
+
+	dbConn := rc.MasterDB.Copy()
+	defer dbConn.Close()
+
+	card, err := retrieveRateCard(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", web.ETag(card.Version))
+	if web.NotModified(r, card.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
+	return web.Respond(ctx, w, card, http.StatusOK)
+}
+
+// Create inserts a new RateCard into the system.
+func (rc *RateCard) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.RateCard.Create")
+	defer span.End()
+
+	dbConn := rc.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nr ratecard.NewRateCard
+	if err := web.Decode(r, &nr); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	card, err := ratecard.Create(ctx, dbConn, &nr, v.Now)
+	if err != nil {
+		switch err {
+		case ratecard.ErrDuplicate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "RateCard: %+v", &nr)
+		}
+	}
+
+	audit.Changed(ctx, card.ID.Hex(), nil, card)
+
+	w.Header().Set("ETag", web.ETag(card.Version))
+	return web.Respond(ctx, w, card, http.StatusCreated)
+}
+
+// Update updates the specified RateCard in the system. Adverts that are
+// already booked keep their price.
+func (rc *RateCard) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.RateCard.Update")
+	defer span.End()
+
+	dbConn := rc.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var upd ratecard.UpdateRateCard
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := retrieveRateCard(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	card, err := ratecard.Update(ctx, dbConn, params["id"], version, &upd, v.Now)
+	if err != nil {
+		switch err {
+		case ratecard.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case ratecard.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case ratecard.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "ID: %s Update: %+v", params["id"], upd)
+		}
+	}
+
+	audit.Changed(ctx, card.ID.Hex(), cur, card)
+
+	w.Header().Set("ETag", web.ETag(card.Version))
+	return web.Respond(ctx, w, card, http.StatusOK)
+}
+
+// Delete removes the specified RateCard from the system.
+func (rc *RateCard) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.RateCard.Delete")
+	defer span.End()
+
+	dbConn := rc.MasterDB.Copy()
+	defer dbConn.Close()
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := retrieveRateCard(ctx, dbConn, params["id"])
+	if err != nil {
+		return err
+	}
+
+	err = ratecard.Delete(ctx, dbConn, params["id"], version)
+	if err != nil {
+		switch err {
+		case ratecard.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case ratecard.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case ratecard.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	audit.Changed(ctx, cur.ID.Hex(), cur, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// retrieveRateCard gets a rate card and maps lookup failures to responses.
+func retrieveRateCard(ctx context.Context, dbConn *db.DB, id string) (*ratecard.RateCard, error) {
+	card, err := ratecard.Retrieve(ctx, dbConn, id)
+	if err != nil {
+		switch err {
+		case ratecard.ErrInvalidID:
+			return nil, web.NewRequestError(err, http.StatusBadRequest)
+		case ratecard.ErrNotFound:
+			return nil, web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return nil, errors.Wrapf(err, "ID: %s", id)
+		}
+	}
+	return card, nil
+}
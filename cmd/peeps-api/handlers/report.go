@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/platform/cache"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/export"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Report represents the Report API method handler set.
+type Report struct {
+	MasterDB *db.DB
+	Cache    *cache.Cache
+}
+
+// Adverts groups adverts by the dimensions in group_by and returns the
+// requested metrics for each group. The table is returned as JSON unless the
+// format query parameter or Accept header asks for csv, ndjson or xlsx.
+// Results are cached for a short time; a request sent with
+// Cache-Control: no-cache always runs the report. Only admins and editors may
+// see reports as they show revenue.
+func (rp *Report) Adverts(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.Adverts")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.Negotiate(r.Header.Get("Accept"))
+	}
+	if format != "" && format != "json" && export.ContentType(format) == "" {
+		return web.NewRequestError(export.ErrUnknownFormat, http.StatusNotAcceptable)
+	}
+
+	rq, err := advert.ParseReportQuery(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	key := rq.Key(ctx)
+	t, hit := (*advert.Table)(nil), false
+	if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		if cached, ok := rp.Cache.Get(key, v.Now); ok {
+			t, hit = cached.(*advert.Table), true
+		}
+	}
+	if !hit {
+		dbConn := rp.MasterDB.Copy()
+		defer dbConn.Close()
+
+		if t, err = advert.Report(ctx, dbConn, rq); err != nil {
+			return err
+		}
+		rp.Cache.Set(key, t, v.Now)
+	}
+
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	if format == "" || format == "json" {
+		return web.Respond(ctx, w, t, http.StatusOK)
+	}
+
+	v.StatusCode = http.StatusOK
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"adverts-report.%s\"", format))
+
+	tw, err := export.NewWriter(format, w, t.Columns)
+	if err != nil {
+		return errors.Wrap(err, "starting report")
+	}
+	for _, row := range t.Rows {
+		cells := make([]string, len(row))
+		for i, c := range row {
+			if c != nil {
+				cells[i] = fmt.Sprint(c)
+			}
+		}
+		if err := tw.Write(cells); err != nil {
+			return errors.Wrapf(err, "Report: %s", format)
+		}
+	}
+
+	return tw.Close()
+}
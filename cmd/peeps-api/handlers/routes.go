@@ -1,29 +1,35 @@
 package handlers
 
 import (
+	"github.com/mattlaver/peeps/internal/invoice"
 	"github.com/mattlaver/peeps/internal/mid"
+	"github.com/mattlaver/peeps/internal/notify"
 	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/blob"
+	"github.com/mattlaver/peeps/internal/platform/cache"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/jobs"
+	"github.com/mattlaver/peeps/internal/platform/stream"
 	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/search"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
-func API(shutdown chan os.Signal, log *log.Logger, masterDB *db.DB, authenticator *auth.Authenticator) http.Handler {
+func API(shutdown chan os.Signal, log *log.Logger, masterDB *db.DB, authenticator *auth.Authenticator, seller invoice.Party, blobs blob.Store, reports *cache.Cache, events *stream.Broker, heartbeat, streamWriteTimeout, transferTimeout time.Duration, scheduler *jobs.Scheduler, notifier *notify.Notifier) http.Handler {
 
 	// Construct the web.App which holds all routes as well as common Middleware.
-	app := web.NewApp(shutdown, log, mid.Logger(log), mid.Errors(log), mid.Metrics(), mid.Panics())
-
+	app := web.NewApp(shutdown, log, mid.Logger(log), mid.Audit(log, masterDB), mid.Errors(log), mid.Metrics(), mid.Panics())
 
 	// Register health check endpoint. This route is not authenticated.
-	 check := Check{
+	check := Check{
 		MasterDB: masterDB,
 	}
 	//app.han
 	app.Handle("GET", "/v1/health", check.Health)
 
-
 	// Register user management and authentication endpoints.
 	u := User{
 		MasterDB:       masterDB,
@@ -33,20 +39,156 @@ func API(shutdown chan os.Signal, log *log.Logger, masterDB *db.DB, authenticato
 	app.Handle("POST", "/v1/users", u.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
 	app.Handle("GET", "/v1/users/:id", u.Retrieve, mid.Authenticate(authenticator))
 	app.Handle("PUT", "/v1/users/:id", u.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("PATCH", "/v1/users/:id", u.Patch, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
 	app.Handle("DELETE", "/v1/users/:id", u.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
 
+	nt := Notification{
+		MasterDB: masterDB,
+		Locale:   notifier.Locale,
+	}
+	app.Handle("GET", "/v1/users/:id/notifications", nt.Preferences, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/users/:id/notifications", nt.SetPreferences, mid.Authenticate(authenticator))
+
+	tn := Tenant{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/tenants", tn.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("POST", "/v1/tenants", tn.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("GET", "/v1/tenants/:id", tn.Retrieve, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("PUT", "/v1/tenants/:id", tn.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("GET", "/v1/tenants/:id/users", tn.Users, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("POST", "/v1/tenants/:id/users", tn.AddUser, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+
+	ad := Advertiser{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/advertisers", ad.List, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/advertisers", ad.Create, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/advertisers/duplicates", ad.Duplicates, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/advertisers/:id", ad.Retrieve, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/advertisers/:id", ad.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/advertisers/:id", ad.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/advertisers/:id/adverts", ad.Adverts, mid.Authenticate(authenticator))
+
+	ed := Edition{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/editions", ed.List, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/editions", ed.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/editions/:id", ed.Retrieve, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/editions/:id", ed.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/editions/:id", ed.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/editions/:id/adverts", ed.Adverts, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/editions/:id/layout", ed.Layout, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/editions/:id/flatplan", ed.FlatPlan, mid.Authenticate(authenticator))
 
+	rc := RateCard{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/ratecards", rc.List, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/ratecards", rc.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/ratecards/:id", rc.Retrieve, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/ratecards/:id", rc.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/ratecards/:id", rc.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+
+	inv := Invoice{
+		MasterDB: masterDB,
+		Seller:   seller,
+	}
+	app.Handle("GET", "/v1/invoices", inv.List, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/invoices", inv.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/invoices/:id", inv.Retrieve, mid.Authenticate(authenticator))
+	app.Handle("DELETE", "/v1/invoices/:id", inv.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/invoices/:id/pdf", inv.PDF, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/invoices/:id/ubl", inv.UBL, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/invoices/:id/issue", inv.Issue, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/invoices/:id/pay", inv.Pay, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/invoices/:id/void", inv.Void, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
 
 	// advertisers
 	p := Advert{
-		MasterDB: masterDB,
+		MasterDB:        masterDB,
+		Blobs:           blobs,
+		Log:             log,
+		TransferTimeout: transferTimeout,
 	}
 	app.Handle("GET", "/v1/adverts", p.List, mid.Authenticate(authenticator))
 	app.Handle("POST", "/v1/adverts", p.Create, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/import", p.Import, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/quote", p.Quote, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/export", p.Export, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/duplicates", p.Duplicates, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/renewals", p.Renewals, mid.Authenticate(authenticator))
 	app.Handle("GET", "/v1/adverts/:id", p.Retrieve, mid.Authenticate(authenticator))
 	app.Handle("PUT", "/v1/adverts/:id", p.Update, mid.Authenticate(authenticator))
+	app.Handle("PATCH", "/v1/adverts/:id", p.Patch, mid.Authenticate(authenticator))
 	app.Handle("DELETE", "/v1/adverts/:id", p.Delete, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/history", p.History, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/history/diff", p.Diff, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/:id/revert/:rev", p.Revert, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/:id/renew", p.Renew, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/transitions", p.Transitions, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/:id/transitions", p.Transition, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/attachments", p.Attachments, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/:id/attachments", p.Attach, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/attachments/:attachment", p.Attachment, mid.Authenticate(authenticator))
+	app.Handle("DELETE", "/v1/adverts/:id/attachments/:attachment", p.RemoveAttachment, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/comments", p.Comments, mid.Authenticate(authenticator))
+	app.Handle("POST", "/v1/adverts/:id/comments", p.AddComment, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/adverts/:id/comments/:comment", p.UpdateComment, mid.Authenticate(authenticator))
+	app.Handle("DELETE", "/v1/adverts/:id/comments/:comment", p.DeleteComment, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/activity", p.Activity, mid.Authenticate(authenticator))
+	app.Handle("GET", "/v1/adverts/:id/contacts", p.Contacts, mid.Authenticate(authenticator))
+	app.Handle("PUT", "/v1/adverts/:id/contacts/:role", p.SetContact, mid.Authenticate(authenticator))
+	app.Handle("DELETE", "/v1/adverts/:id/contacts/:role", p.RemoveContact, mid.Authenticate(authenticator))
+
+	rp := Report{
+		MasterDB: masterDB,
+		Cache:    reports,
+	}
+	app.Handle("GET", "/v1/reports/adverts", rp.Adverts, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin, auth.RoleEditor))
+
+	sr := Search{
+		Index: search.NewMongo(masterDB),
+	}
+	app.Handle("GET", "/v1/search", sr.Find, mid.Authenticate(authenticator))
+
+	au := Audit{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/audit", au.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/audit/verify", au.Verify, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
 
+	wh := Webhook{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/webhooks", wh.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/webhooks", wh.Create, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/webhooks/:id", wh.Retrieve, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("PUT", "/v1/webhooks/:id", wh.Update, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("DELETE", "/v1/webhooks/:id", wh.Delete, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("GET", "/v1/webhooks/:id/deliveries", wh.Deliveries, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+	app.Handle("POST", "/v1/webhooks/:id/deliveries/:delivery/redeliver", wh.Redeliver, mid.Authenticate(authenticator), mid.HasRole(auth.RoleAdmin))
+
+	ob := Outbox{
+		MasterDB: masterDB,
+	}
+	app.Handle("GET", "/v1/outbox", ob.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("POST", "/v1/outbox/:id/retry", ob.Retry, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+
+	jb := Jobs{
+		Scheduler: scheduler,
+	}
+	app.Handle("GET", "/v1/jobs", jb.List, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("GET", "/v1/jobs/:name/runs", jb.Runs, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+	app.Handle("POST", "/v1/jobs/:name/runs", jb.Trigger, mid.Authenticate(authenticator), mid.HasRole(auth.RoleSuperAdmin))
+
+	st := Stream{
+		Broker:       events,
+		Heartbeat:    heartbeat,
+		WriteTimeout: streamWriteTimeout,
+	}
+	app.Handle("GET", "/v1/events", st.Events, mid.Authenticate(authenticator))
 
 	// This route is not authenticated
 	app.Handle("GET", "/v1/users/token", u.Token)
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/search"
+	"go.opencensus.io/trace"
+)
+
+// Search represents the Search API method handler set.
+type Search struct {
+	Index search.Index
+}
+
+// Find returns what matches the q query parameter, best match first. The
+// kinds parameter is a comma separated list of advert, advertiser and
+// comment that limits what is searched, and limit caps the number of hits.
+func (s *Search) Find(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Search.Find")
+	defer span.End()
+
+	v := r.URL.Query()
+	q := search.Query{
+		Text: v.Get("q"),
+	}
+	for _, k := range strings.Split(v.Get("kinds"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			q.Kinds = append(q.Kinds, k)
+		}
+	}
+	if l := v.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return web.NewFieldErrors(web.FieldError{Field: "limit", Error: "limit must be a number"})
+		}
+		q.Limit = n
+	}
+
+	hits, err := search.Search(ctx, s.Index, q)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, hits, http.StatusOK)
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/stream"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stream represents the live event stream handler set.
+type Stream struct {
+	Broker       *stream.Broker
+	Heartbeat    time.Duration // How often to write to an idle stream.
+	WriteTimeout time.Duration // How long a single write may take.
+}
+
+// Events streams the changes to adverts and users the caller can see as
+// Server-Sent Events. A client that reconnects with the Last-Event-ID header
+// is sent what it missed; when that is no longer held it is sent a reset
+// event and should reload what it shows.
+//
+// A stream outlives the ReadTimeout and WriteTimeout of the server, so the
+// read deadline is lifted and each write is given its own deadline.
+func (st *Stream) Events(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Stream.Events")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	// Some EventSource polyfills cannot set headers and send the ID in the
+	// query instead.
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	sub, replay, resumed := st.Broker.Subscribe(lastID)
+	defer sub.Close()
+
+	// Nothing more is expected from the client. Without a read deadline the
+	// request context is only cancelled once the client has gone.
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		return errors.Wrap(err, "lifting read deadline")
+	}
+
+	write := func(s string) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(st.WriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+
+	// The response is written as it goes rather than through web.Respond,
+	// so record the status for the logger here.
+	v.StatusCode = http.StatusOK
+
+	head := "retry: 3000\n\n"
+	if !resumed {
+		head += "event: reset\ndata: {}\n\n"
+	}
+	if err := write(head); err != nil {
+		return nil
+	}
+
+	// A failed write means the client has gone, which ends the stream
+	// without anything to report.
+	for _, ev := range replay {
+		if canSee(ctx, claims, ev) {
+			if err := write(sseEvent(ev)); err != nil {
+				return nil
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(st.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+
+			// The subscription ends when the client falls too far behind or
+			// the service is stopping. The client reconnects and resumes.
+			if !ok {
+				return nil
+			}
+			if !canSee(ctx, claims, ev) {
+				continue
+			}
+			if err := write(sseEvent(ev)); err != nil {
+				return nil
+			}
+
+		case <-heartbeat.C:
+			if err := write(": heartbeat\n\n"); err != nil {
+				return nil
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// canSee reports whether the user in claims may see an event. Only events
+// about the tenants ctx is scoped to are seen. Everyone sees adverts; users
+// are seen by admins and by themselves.
+func canSee(ctx context.Context, claims auth.Claims, ev stream.Event) bool {
+	switch v := ev.Value.(type) {
+	case *advert.Advert:
+		return tenant.Owns(ctx, v.TenantID)
+	case *user.User:
+		if !tenant.Owns(ctx, v.TenantID) {
+			return false
+		}
+		return claims.HasRole(auth.RoleAdmin) || v.ID.Hex() == claims.Subject
+	case *removed:
+		if !tenant.Owns(ctx, v.TenantID) {
+			return false
+		}
+		if v.aggregate == event.AggregateUser {
+			return claims.HasRole(auth.RoleAdmin) || v.ID.Hex() == claims.Subject
+		}
+		return true
+	}
+	return false
+}
+
+// streamed maps the events raised by writes to the names they are sent to
+// live streams as.
+var streamed = map[string]string{
+	event.AdvertCreated:      event.AdvertCreated,
+	event.AdvertUpdated:      event.AdvertUpdated,
+	event.AdvertTransitioned: event.AdvertUpdated,
+	event.AdvertDeleted:      event.AdvertDeleted,
+	event.UserCreated:        event.UserCreated,
+	event.UserUpdated:        event.UserUpdated,
+	event.UserDeleted:        event.UserDeleted,
+}
+
+// StreamedEvents lists the events raised by writes that are sent to live
+// streams, for subscribing a Publisher to the bus.
+func StreamedEvents() []string {
+	names := make([]string, 0, len(streamed))
+	for name := range streamed {
+		names = append(names, name)
+	}
+	return names
+}
+
+// removed is what streams are sent about an advert or user that is gone.
+type removed struct {
+	ID        bson.ObjectId `json:"id"`
+	TenantID  bson.ObjectId `json:"-"`
+	aggregate string
+}
+
+// Publisher publishes the events delivered to it from the outbox to live
+// streams, so streams only see changes that were written.
+type Publisher struct {
+	MasterDB *db.DB
+	Broker   *stream.Broker
+}
+
+// Handle publishes the current state of the advert or user an event is
+// about. Once that is gone, as for a delete, only its ID is published.
+func (p *Publisher) Handle(ctx context.Context, ev event.Event) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Publisher.Handle")
+	defer span.End()
+
+	name, ok := streamed[ev.Name]
+	if !ok || !ev.TenantID.Valid() {
+		return nil
+	}
+	ctx = tenant.With(ctx, ev.TenantID)
+
+	dbConn := p.MasterDB.Copy()
+	defer dbConn.Close()
+
+	var value interface{} = &removed{ID: ev.AggregateID, TenantID: ev.TenantID, aggregate: ev.Aggregate}
+
+	switch ev.Aggregate {
+	case event.AggregateAdvert:
+		a, err := advert.Retrieve(ctx, dbConn, ev.AggregateID.Hex())
+		switch {
+		case err == nil:
+			value = a
+		case err != advert.ErrNotFound:
+			return err
+		}
+
+	case event.AggregateUser:
+		us, err := user.ByID(ctx, dbConn, []string{ev.AggregateID.Hex()})
+		if err != nil {
+			return err
+		}
+		if len(us) > 0 {
+			value = &us[0]
+		}
+	}
+
+	_, err := p.Broker.Publish(name, value)
+	return err
+}
+
+// sseEvent formats an event for an event stream. The data is JSON, which
+// holds no newlines.
+func sseEvent(ev stream.Event) string {
+	return "id: " + ev.ID + "\nevent: " + ev.Name + "\ndata: " + string(ev.Data) + "\n\n"
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/stream"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestCanSee checks a live stream only carries the events of its own tenant,
+// and only carries other users to admins.
+func TestCanSee(t *testing.T) {
+	now := time.Now()
+	own, other := bson.NewObjectId(), bson.NewObjectId()
+	self := bson.NewObjectId()
+
+	admin := auth.NewClaims(bson.NewObjectId().Hex(), []string{auth.RoleAdmin}, now, time.Hour)
+	rep := auth.NewClaims(self.Hex(), []string{auth.RoleUser}, now, time.Hour)
+
+	ctx := tenant.With(context.Background(), own)
+	all := tenant.WithAll(context.Background())
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		claims auth.Claims
+		value  interface{}
+		want   bool
+	}{
+		{"own advert", ctx, rep, &advert.Advert{TenantID: own}, true},
+		{"other advert", ctx, admin, &advert.Advert{TenantID: other}, false},
+		{"other advert to all tenants", all, admin, &advert.Advert{TenantID: other}, true},
+		{"own user to admin", ctx, admin, &user.User{ID: bson.NewObjectId(), TenantID: own}, true},
+		{"own user to self", ctx, rep, &user.User{ID: self, TenantID: own}, true},
+		{"own user to another user", ctx, rep, &user.User{ID: bson.NewObjectId(), TenantID: own}, false},
+		{"other user to admin", ctx, admin, &user.User{ID: bson.NewObjectId(), TenantID: other}, false},
+		{"own removed advert", ctx, rep, &removed{ID: bson.NewObjectId(), TenantID: own, aggregate: event.AggregateAdvert}, true},
+		{"other removed advert", ctx, admin, &removed{ID: bson.NewObjectId(), TenantID: other, aggregate: event.AggregateAdvert}, false},
+		{"own removed user to another user", ctx, rep, &removed{ID: bson.NewObjectId(), TenantID: own, aggregate: event.AggregateUser}, false},
+		{"own removed user to admin", ctx, admin, &removed{ID: bson.NewObjectId(), TenantID: own, aggregate: event.AggregateUser}, true},
+		{"other removed user to admin", ctx, admin, &removed{ID: bson.NewObjectId(), TenantID: other, aggregate: event.AggregateUser}, false},
+		{"unknown value", ctx, admin, "something else", false},
+	}
+
+	for _, tt := range tests {
+		ev := stream.Event{Name: "test", Value: tt.value}
+		if got := canSee(tt.ctx, tt.claims, ev); got != tt.want {
+			t.Errorf("%s: canSee = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Tenant represents the Tenant API method handler set. It is for
+// super-admins, who work across every tenant.
+type Tenant struct {
+	MasterDB *db.DB
+}
+
+// List returns every tenant in the deployment.
+func (tn *Tenant) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.List")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ts, err := tenant.List(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, ts, http.StatusOK)
+}
+
+// Retrieve returns the specified tenant.
+func (tn *Tenant) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.Retrieve")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	t, err := tenant.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return tenantError(err, params["id"])
+	}
+
+	w.Header().Set("ETag", web.ETag(t.Version))
+	if web.NotModified(r, t.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
+	return web.Respond(ctx, w, t, http.StatusOK)
+}
+
+// Create adds a tenant. It starts with no users, editions or rate cards.
+func (tn *Tenant) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.Create")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var nt tenant.NewTenant
+	if err := web.Decode(r, &nt); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	t, err := tenant.Create(ctx, dbConn, &nt, v.Now)
+	if err != nil {
+		switch err {
+		case tenant.ErrDuplicate:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "Tenant: %+v", &nt)
+		}
+	}
+	audit.Changed(ctx, t.ID.Hex(), nil, t)
+
+	w.Header().Set("ETag", web.ETag(t.Version))
+	return web.Respond(ctx, w, t, http.StatusCreated)
+}
+
+// Update modifies the specified tenant. The slug cannot be changed as users
+// sign in with it.
+func (tn *Tenant) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.Update")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var upd tenant.UpdateTenant
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := tenant.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return tenantError(err, params["id"])
+	}
+
+	t, err := tenant.Update(ctx, dbConn, params["id"], version, &upd, v.Now)
+	if err != nil {
+		return tenantError(err, params["id"])
+	}
+	audit.Changed(ctx, t.ID.Hex(), cur, t)
+
+	w.Header().Set("ETag", web.ETag(t.Version))
+	return web.Respond(ctx, w, t, http.StatusOK)
+}
+
+// Users returns the users of the specified tenant.
+func (tn *Tenant) Users(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.Users")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	t, err := tenant.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return tenantError(err, params["id"])
+	}
+
+	usrs, err := user.List(tenant.With(ctx, t.ID), dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, usrs, http.StatusOK)
+}
+
+// AddUser adds a user to the specified tenant, such as the first admin of a
+// new tenant.
+func (tn *Tenant) AddUser(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Tenant.AddUser")
+	defer span.End()
+
+	dbConn := tn.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	t, err := tenant.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return tenantError(err, params["id"])
+	}
+
+	var newU user.NewUser
+	if err := web.Decode(r, &newU); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	usr, err := user.Create(tenant.With(ctx, t.ID), claims, dbConn, &newU, v.Now)
+	if err != nil {
+		return errors.Wrapf(err, "Tenant: %s User: %+v", params["id"], &usr)
+	}
+	audit.Changed(ctx, usr.ID.Hex(), nil, usr)
+
+	return web.Respond(ctx, w, usr, http.StatusCreated)
+}
+
+// tenantError translates the errors of the tenant package into request
+// errors.
+func tenantError(err error, id string) error {
+	switch err {
+	case tenant.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case tenant.ErrNotFound:
+		return web.NewRequestError(err, http.StatusNotFound)
+	case tenant.ErrVersionConflict:
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	default:
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/mattlaver/peeps/internal/audit"
 	"github.com/mattlaver/peeps/internal/platform/auth"
 	"github.com/mattlaver/peeps/internal/platform/db"
 	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
 	"github.com/mattlaver/peeps/internal/user"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
@@ -63,6 +65,11 @@ func (u *User) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	w.Header().Set("ETag", web.ETag(usr.Version))
+	if web.NotModified(r, usr.Version) {
+		return web.Respond(ctx, w, nil, http.StatusNotModified)
+	}
+
 	return web.Respond(ctx, w, usr, http.StatusOK)
 }
 
@@ -83,11 +90,20 @@ func (u *User) Create(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	if err := web.Decode(r, &newU); err != nil {
 		return errors.Wrap(err, "")
 	}
+	if err := checkGrant(ctx, nil, newU.Roles); err != nil {
+		return err
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
 
-	usr, err := user.Create(ctx, dbConn, &newU, v.Now)
+	usr, err := user.Create(ctx, claims, dbConn, &newU, v.Now)
 	if err != nil {
 		return errors.Wrapf(err, "User: %+v", &usr)
 	}
+	audit.Changed(ctx, usr.ID.Hex(), nil, usr)
 
 	return web.Respond(ctx, w, usr, http.StatusCreated)
 }
@@ -105,18 +121,35 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		return web.NewShutdownError("web value missing from context")
 	}
 
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
 	var upd user.UpdateUser
 	if err := web.Decode(r, &upd); err != nil {
 		return errors.Wrap(err, "")
 	}
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
 
-	err := user.Update(ctx, dbConn, params["id"], &upd, v.Now)
+	cur, err := user.Retrieve(ctx, claims, dbConn, params["id"])
+	if err == nil {
+		if err := checkGrant(ctx, cur.Roles, upd.Roles); err != nil {
+			return err
+		}
+		err = user.Update(ctx, claims, dbConn, params["id"], version, &upd, v.Now)
+	}
 	if err != nil {
 		switch err {
 		case user.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case user.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
 		case user.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
 		default:
@@ -124,9 +157,91 @@ func (u *User) Update(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	usr, err := user.Retrieve(ctx, claims, dbConn, params["id"])
+	if err != nil {
+		return errors.Wrapf(err, "Id: %s", params["id"])
+	}
+	audit.Changed(ctx, usr.ID.Hex(), cur, usr)
+
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
+// Patch applies a JSON Merge Patch or JSON Patch to the specified user.
+func (u *User) Patch(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.User.Patch")
+	defer span.End()
+
+	dbConn := u.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	usr, err := user.Retrieve(ctx, claims, dbConn, params["id"])
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "Id: %s", params["id"])
+		}
+	}
+
+	// If-Match is optional for a patch. The write is always conditional on the
+	// version that was patched so a concurrent change is still detected.
+	if r.Header.Get("If-Match") != "" {
+		version, err := web.IfMatch(r)
+		if err != nil {
+			return err
+		}
+		if !web.VersionMatches(version, usr.Version) {
+			return web.NewRequestError(user.ErrVersionConflict, http.StatusPreconditionFailed)
+		}
+	}
+
+	doc := user.PatchUser{
+		Name:  usr.Name,
+		Email: usr.Email,
+		Roles: usr.Roles,
+	}
+
+	var pu user.PatchUser
+	if err := applyPatch(w, r, doc, &pu); err != nil {
+		return err
+	}
+	if err := checkGrant(ctx, usr.Roles, pu.Roles); err != nil {
+		return err
+	}
+
+	cur := usr
+	usr, err = user.Replace(ctx, claims, dbConn, params["id"], usr.Version, &pu, v.Now)
+	if err != nil {
+		switch err {
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
+		default:
+			return errors.Wrapf(err, "Id: %s  Patch: %+v", params["id"], &pu)
+		}
+	}
+	audit.Changed(ctx, usr.ID.Hex(), cur, usr)
+
+	w.Header().Set("ETag", web.ETag(usr.Version))
+	return web.Respond(ctx, w, usr, http.StatusOK)
+}
+
 // Delete removes the specified user from the system.
 func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Delete")
@@ -135,25 +250,51 @@ func (u *User) Delete(ctx context.Context, w http.ResponseWriter, r *http.Reques
 	dbConn := u.MasterDB.Copy()
 	defer dbConn.Close()
 
-	err := user.Delete(ctx, dbConn, params["id"])
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+
+	cur, err := user.Retrieve(ctx, claims, dbConn, params["id"])
+	if err == nil {
+		if err := checkGrant(ctx, cur.Roles, nil); err != nil {
+			return err
+		}
+		err = user.Delete(ctx, claims, dbConn, params["id"], version, v.Now)
+	}
 	if err != nil {
 		switch err {
 		case user.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case user.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrVersionConflict:
+			return web.NewRequestError(err, http.StatusPreconditionFailed)
 		case user.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
 		default:
 			return errors.Wrapf(err, "Id: %s", params["id"])
 		}
 	}
+	audit.Changed(ctx, cur.ID.Hex(), cur, nil)
 
 	return web.Respond(ctx, w, nil, http.StatusNoContent)
 }
 
 // Token handles a request to authenticate a user. It expects a request using
-// Basic Auth with a user's email and password. It responds with a JWT.
+// Basic Auth with a user's email and password. It responds with a JWT. The
+// tenant query parameter names the slug of the tenant to sign in to, which
+// is needed when the email is used in more than one.
 func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.User.Token")
 	defer span.End()
@@ -167,16 +308,32 @@ func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request
 	}
 
 	email, pass, ok := r.BasicAuth()
+	audit.Login(ctx, email)
 	if !ok {
 		err := errors.New("must provide email and password in Basic auth")
 		return web.NewRequestError(err, http.StatusUnauthorized)
 	}
 
+	ctx = tenant.WithAll(ctx)
+	if slug := r.URL.Query().Get("tenant"); slug != "" {
+		t, err := tenant.BySlug(ctx, dbConn, slug)
+		if err != nil {
+			if err == tenant.ErrNotFound {
+				return web.NewRequestError(user.ErrAuthenticationFailure, http.StatusUnauthorized)
+			}
+			return errors.Wrap(err, "finding tenant")
+		}
+		ctx = tenant.With(ctx, t.ID)
+		audit.Tenant(ctx, t.ID)
+	}
+
 	tkn, err := user.Authenticate(ctx, dbConn, u.TokenGenerator, v.Now, email, pass)
 	if err != nil {
 		switch err {
 		case user.ErrAuthenticationFailure:
 			return web.NewRequestError(err, http.StatusUnauthorized)
+		case user.ErrTenantRequired:
+			return web.NewRequestError(err, http.StatusBadRequest)
 		default:
 			return errors.Wrap(err, "authenticating")
 		}
@@ -184,3 +341,25 @@ func (u *User) Token(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	return web.Respond(ctx, w, tkn, http.StatusOK)
 }
+
+// checkGrant makes sure only super-admins change a user who had the roles in
+// had to have the roles in roles when either includes the super-admin role.
+// Anyone else could otherwise grant the role, or take over a super-admin.
+func checkGrant(ctx context.Context, had, roles []string) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return errors.New("claims missing from context")
+	}
+	if claims.HasRole(auth.RoleSuperAdmin) {
+		return nil
+	}
+
+	for _, r := range append(append([]string(nil), had...), roles...) {
+		if r == auth.RoleSuperAdmin {
+			err := errors.New("only super-admins may change super-admins or grant the super-admin role")
+			return web.NewRequestError(err, http.StatusForbidden)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/webhook"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Webhook represents the Webhook API method handler set.
+type Webhook struct {
+	MasterDB *db.DB
+}
+
+// List returns the registered endpoints.
+func (wh *Webhook) List(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.List")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	endpoints, err := webhook.List(ctx, dbConn)
+	if err != nil {
+		return err
+	}
+
+	return web.Respond(ctx, w, endpoints, http.StatusOK)
+}
+
+// Retrieve returns the specified endpoint.
+func (wh *Webhook) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Retrieve")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	e, err := webhook.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	w.Header().Set("ETag", web.ETag(e.Version))
+	return web.Respond(ctx, w, e, http.StatusOK)
+}
+
+// Create registers an endpoint. The response holds the endpoint's secret,
+// which is not shown again.
+func (wh *Webhook) Create(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Create")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	var ne webhook.NewEndpoint
+	if err := web.Decode(r, &ne); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	e, err := webhook.Create(ctx, dbConn, &ne, v.Now)
+	if err != nil {
+		return errors.Wrapf(err, "Endpoint: %s", ne.URL)
+	}
+
+	audit.Changed(ctx, e.ID.Hex(), nil, e)
+
+	resp := struct {
+		*webhook.Endpoint
+		Secret string `json:"secret"`
+	}{e, e.Secret}
+
+	w.Header().Set("ETag", web.ETag(e.Version))
+	return web.Respond(ctx, w, resp, http.StatusCreated)
+}
+
+// Update modifies the specified endpoint.
+func (wh *Webhook) Update(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Update")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	var upd webhook.UpdateEndpoint
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	cur, err := webhook.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	e, err := webhook.Update(ctx, dbConn, params["id"], version, &upd, v.Now)
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	audit.Changed(ctx, e.ID.Hex(), cur, e)
+
+	w.Header().Set("ETag", web.ETag(e.Version))
+	return web.Respond(ctx, w, e, http.StatusOK)
+}
+
+// Delete removes the specified endpoint.
+func (wh *Webhook) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Delete")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	version, err := web.IfMatch(r)
+	if err != nil {
+		return err
+	}
+
+	cur, err := webhook.Retrieve(ctx, dbConn, params["id"])
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	if err := webhook.Delete(ctx, dbConn, params["id"], version); err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	audit.Changed(ctx, cur.ID.Hex(), cur, nil)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Deliveries returns the most recent deliveries to the specified endpoint
+// with every attempt made to send them.
+func (wh *Webhook) Deliveries(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Deliveries")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ds, err := webhook.Deliveries(ctx, dbConn, params["id"])
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	return web.Respond(ctx, w, ds, http.StatusOK)
+}
+
+// Redeliver queues a delivery to be sent again straight away.
+func (wh *Webhook) Redeliver(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Webhook.Redeliver")
+	defer span.End()
+
+	dbConn := wh.MasterDB.Copy()
+	defer dbConn.Close()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return web.NewShutdownError("web value missing from context")
+	}
+
+	d, err := webhook.Redeliver(ctx, dbConn, params["id"], params["delivery"], v.Now)
+	if err != nil {
+		return webhookError(err, params["id"])
+	}
+
+	return web.Respond(ctx, w, d, http.StatusAccepted)
+}
+
+// webhookError maps the errors of the webhook package to responses.
+func webhookError(err error, id string) error {
+	switch err {
+	case webhook.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	case webhook.ErrNotFound, webhook.ErrDeliveryNotFound:
+		return web.NewRequestError(err, http.StatusNotFound)
+	case webhook.ErrVersionConflict:
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	case webhook.ErrDeliveryInProgress:
+		return web.NewRequestError(err, http.StatusConflict)
+	default:
+		return errors.Wrapf(err, "ID: %s", id)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/notify"
+	"github.com/mattlaver/peeps/internal/platform/cache"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/jobs"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/webhook"
+	"github.com/pkg/errors"
+)
+
+// jobsConfig holds the schedules and settings of the recurring jobs.
+type jobsConfig struct {
+	Timezone       string        `default:"UTC" envconfig:"TIMEZONE"`
+	Purge          string        `default:"30 3 * * *" envconfig:"PURGE"`
+	Retention      time.Duration `default:"720h" envconfig:"RETENTION"`
+	Reminders      string        `default:"0 8 * * *" envconfig:"REMINDERS"`
+	ReminderWindow time.Duration `default:"72h" envconfig:"REMINDER_WINDOW"`
+	Notifications  string        `default:"* * * * *" envconfig:"NOTIFICATIONS"`
+	Digest         string        `default:"0 7 * * *" envconfig:"DIGEST"`
+	WarmReports    string        `default:"*/5 * * * *" envconfig:"WARM_REPORTS"`
+	Reports        string        `default:"group_by=edition;group_by=status;group_by=year&metrics=count,revenue,yoy" envconfig:"REPORTS"` // Report queries to warm, separated by semicolons.
+}
+
+// purgeProgress is the checkpoint of the purge job: the cut off it is working
+// to and the collections it has finished with.
+type purgeProgress struct {
+	Before time.Time `bson:"before"`
+	Done   []string  `bson:"done"`
+}
+
+// scheduleJobs registers the recurring jobs with s.
+func scheduleJobs(s *jobs.Scheduler, log *log.Logger, masterDB *db.DB, reports *cache.Cache, notifier *notify.Notifier, cfg jobsConfig) error {
+
+	// Remove the delivered events, finished webhook deliveries, job runs and
+	// sent notifications that are older than the retention period.
+	purge := func(ctx context.Context, run *jobs.Run) error {
+		dbConn := masterDB.Copy()
+		defer dbConn.Close()
+
+		p := purgeProgress{Before: time.Now().Add(-cfg.Retention)}
+		if _, err := run.Resume(&p); err != nil {
+			return err
+		}
+		done := make(map[string]bool)
+		for _, d := range p.Done {
+			done[d] = true
+		}
+
+		for _, step := range []struct {
+			name  string
+			purge func(context.Context, *db.DB, time.Time) (int, error)
+		}{
+			{"outbox", event.Purge},
+			{"webhook_deliveries", webhook.Purge},
+			{"job_runs", jobs.Purge},
+			{"notifications", notify.Purge},
+		} {
+			if done[step.name] {
+				continue
+			}
+			n, err := step.purge(ctx, dbConn, p.Before)
+			if err != nil {
+				return errors.Wrapf(err, "purging %s", step.name)
+			}
+			log.Printf("jobs : purge : removed %d from %s", n, step.name)
+
+			p.Done = append(p.Done, step.name)
+			if err := run.Save(ctx, p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+	if err := s.Register("purge", cfg.Purge, purge); err != nil {
+		return err
+	}
+
+	// Announce the copy deadlines coming up so contacts can be reminded.
+	reminders := func(ctx context.Context, run *jobs.Run) error {
+		dbConn := masterDB.Copy()
+		defer dbConn.Close()
+
+		es, err := edition.RemindDeadlines(tenant.WithAll(ctx), dbConn, cfg.ReminderWindow, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			log.Printf("jobs : reminders : %s %s copy deadline %s", e.Year, e.Name, e.CopyDeadline.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+	if err := s.Register("reminders", cfg.Reminders, reminders); err != nil {
+		return err
+	}
+
+	// Email the notifications queued for people who want them straight
+	// away, and once a day the digests of everyone else's.
+	send := func(ctx context.Context, run *jobs.Run) error {
+		n, err := notifier.Send(ctx, time.Now())
+		if n > 0 {
+			log.Printf("jobs : notifications : sent %d", n)
+		}
+		return err
+	}
+	if err := s.Register("notifications", cfg.Notifications, send); err != nil {
+		return err
+	}
+	digest := func(ctx context.Context, run *jobs.Run) error {
+		n, err := notifier.SendDigests(ctx, time.Now())
+		log.Printf("jobs : digest : sent %d", n)
+		return err
+	}
+	if err := s.Register("digest", cfg.Digest, digest); err != nil {
+		return err
+	}
+
+	// Run the common reports of every tenant ahead of time so they are
+	// answered from the cache. The cache belongs to the process, so this runs
+	// on every replica.
+	var queries []advert.ReportQuery
+	for _, raw := range strings.Split(cfg.Reports, ";") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		v, err := url.ParseQuery(raw)
+		if err != nil {
+			return errors.Wrapf(err, "report %q", raw)
+		}
+		rq, err := advert.ParseReportQuery(v)
+		if err != nil {
+			return errors.Wrapf(err, "report %q", raw)
+		}
+		queries = append(queries, rq)
+	}
+	warm := func(ctx context.Context, run *jobs.Run) error {
+		dbConn := masterDB.Copy()
+		defer dbConn.Close()
+
+		ts, err := tenant.List(ctx, dbConn)
+		if err != nil {
+			return err
+		}
+
+		for _, tn := range ts {
+			tctx := tenant.With(ctx, tn.ID)
+			for _, rq := range queries {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				t, err := advert.Report(tctx, dbConn, rq)
+				if err != nil {
+					return errors.Wrapf(err, "report %s", rq.Key(tctx))
+				}
+				reports.Set(rq.Key(tctx), t, time.Now())
+			}
+		}
+
+		return nil
+	}
+	return s.RegisterLocal("warm-reports", cfg.WarmReports, warm)
+}
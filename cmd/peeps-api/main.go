@@ -8,8 +8,22 @@ import (
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/invoice"
+	"github.com/mattlaver/peeps/internal/notify"
 	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/blob"
+	"github.com/mattlaver/peeps/internal/platform/cache"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/email"
+	"github.com/mattlaver/peeps/internal/platform/jobs"
+	"github.com/mattlaver/peeps/internal/platform/stream"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/mattlaver/peeps/internal/webhook"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -36,6 +50,7 @@ func main() {
 			ReadTimeout     time.Duration `default:"5s" envconfig:"READ_TIMEOUT"`
 			WriteTimeout    time.Duration `default:"5s" envconfig:"WRITE_TIMEOUT"`
 			ShutdownTimeout time.Duration `default:"5s" envconfig:"SHUTDOWN_TIMEOUT"`
+			TransferTimeout time.Duration `default:"10s" envconfig:"TRANSFER_TIMEOUT"`
 		}
 		DB struct {
 			DialTimeout time.Duration `default:"5s" envconfig:"DIAL_TIMEOUT"`
@@ -47,6 +62,55 @@ func main() {
 			SendInterval time.Duration `default:"15s" envconfig:"SEND_INTERVAL"`
 			SendTimeout  time.Duration `default:"500ms" envconfig:"SEND_TIMEOUT"`
 		}
+		Seller struct {
+			Name     string `default:"Peeps" envconfig:"NAME"`
+			TaxID    string `envconfig:"TAX_ID"`
+			Line1    string `envconfig:"LINE1"`
+			Line2    string `envconfig:"LINE2"`
+			City     string `envconfig:"CITY"`
+			State    string `envconfig:"STATE"`
+			Postcode string `envconfig:"POSTCODE"`
+			Country  string `envconfig:"COUNTRY"`
+		}
+		Blob struct {
+			Driver    string `default:"fs" envconfig:"DRIVER"`
+			Dir       string `default:"attachments" envconfig:"DIR"`
+			Endpoint  string `envconfig:"ENDPOINT"`
+			Region    string `default:"us-east-1" envconfig:"REGION"`
+			Bucket    string `envconfig:"BUCKET"`
+			AccessKey string `envconfig:"ACCESS_KEY"`
+			SecretKey string `envconfig:"SECRET_KEY" json:"-"`
+			PathStyle bool   `envconfig:"PATH_STYLE"`
+		}
+		Report struct {
+			CacheTTL time.Duration `default:"5m" envconfig:"CACHE_TTL"`
+		}
+		Webhook struct {
+			Timeout     time.Duration `default:"10s" envconfig:"TIMEOUT"`
+			Interval    time.Duration `default:"5s" envconfig:"INTERVAL"`
+			MaxAttempts int           `default:"10" envconfig:"MAX_ATTEMPTS"`
+		}
+		Jobs   jobsConfig
+		Outbox struct {
+			Interval    time.Duration `default:"1s" envconfig:"INTERVAL"`
+			MaxAttempts int           `default:"10" envconfig:"MAX_ATTEMPTS"`
+		}
+		Mail struct {
+			Addr     string        `envconfig:"ADDR"` // SMTP server as host:port. Mail is only logged when empty.
+			Username string        `envconfig:"USERNAME"`
+			Password string        `envconfig:"PASSWORD" json:"-"`
+			From     string        `default:"Peeps <no-reply@peeps.local>" envconfig:"FROM"`
+			Timeout  time.Duration `default:"30s" envconfig:"TIMEOUT"`
+		}
+		Notify struct {
+			Locale      string `default:"en" envconfig:"LOCALE"`
+			MaxAttempts int    `default:"5" envconfig:"MAX_ATTEMPTS"`
+		}
+		Stream struct {
+			Replay       int           `default:"1000" envconfig:"REPLAY"`
+			Heartbeat    time.Duration `default:"15s" envconfig:"HEARTBEAT"`
+			WriteTimeout time.Duration `default:"10s" envconfig:"WRITE_TIMEOUT"`
+		}
 		Auth struct {
 			KeyID          string `default:"1" envconfig:"KEY_ID"`
 			PrivateKeyFile string `default:"private.pem" envconfig:"PRIVATE_KEY_FILE"`
@@ -109,9 +173,77 @@ func main() {
 	defer masterDB.Close()
 
 
+	// =========================================================================
+	// Open blob storage
+
+	var blobs blob.Store
+	switch cfg.Blob.Driver {
+	case "fs":
+		blobs, err = blob.NewFS(cfg.Blob.Dir)
+	case "s3":
+		blobs, err = blob.NewS3(cfg.Blob.Endpoint, cfg.Blob.Region, cfg.Blob.Bucket, cfg.Blob.AccessKey, cfg.Blob.SecretKey, cfg.Blob.PathStyle)
+	default:
+		err = fmt.Errorf("unknown driver %q", cfg.Blob.Driver)
+	}
+	if err != nil {
+		log.Fatalf("main : Opening blob storage : %v", err)
+	}
+
 	// =========================================================================
 	// Start API Service
 
+	// Invoices name us as the seller.
+	seller := invoice.Party{
+		Name:  cfg.Seller.Name,
+		TaxID: cfg.Seller.TaxID,
+		Address: advertiser.Address{
+			Line1:    cfg.Seller.Line1,
+			Line2:    cfg.Seller.Line2,
+			City:     cfg.Seller.City,
+			State:    cfg.Seller.State,
+			Postcode: cfg.Seller.Postcode,
+			Country:  cfg.Seller.Country,
+		},
+	}
+
+	// Live streams are sent the events delivered from the outbox.
+	events := stream.NewBroker(cfg.Stream.Replay)
+
+	// Reports are cached for a short time and warmed by a job.
+	reports := cache.New(cfg.Report.CacheTTL, 256)
+
+	// =========================================================================
+	// Set up email notifications
+
+	var mailer email.Mailer = email.NewLog(log, cfg.Mail.From)
+	if cfg.Mail.Addr != "" {
+		mailer = email.NewSMTP(cfg.Mail.Addr, cfg.Mail.Username, cfg.Mail.Password, cfg.Mail.From, cfg.Mail.Timeout)
+	}
+	if !notify.Supported(cfg.Notify.Locale) {
+		log.Fatalf("main : Notification locale %q is not supported", cfg.Notify.Locale)
+	}
+
+	notifier := notify.New(masterDB, mailer)
+	notifier.Locale = cfg.Notify.Locale
+	notifier.MaxAttempts = cfg.Notify.MaxAttempts
+
+	// =========================================================================
+	// Schedule recurring jobs
+
+	loc, err := time.LoadLocation(cfg.Jobs.Timezone)
+	if err != nil {
+		log.Fatalf("main : Loading job timezone : %v", err)
+	}
+
+	scheduler := jobs.New(masterDB, log)
+	scheduler.Location = loc
+	if err := scheduleJobs(scheduler, log, masterDB, reports, notifier, cfg.Jobs); err != nil {
+		log.Fatalf("main : Scheduling jobs : %v", err)
+	}
+
+	scheduleCtx, stopSchedule := context.WithCancel(context.Background())
+	go scheduler.Run(scheduleCtx)
+
 	// Make a channel to listen for an interrupt or terminate signal from the OS.
 	// Use a buffered channel because the signal package requires it.
 	shutdown := make(chan os.Signal, 1)
@@ -119,12 +251,47 @@ func main() {
 
 	api := http.Server{
 		Addr:           cfg.Web.APIHost,
-		Handler:        handlers.API(shutdown, log, masterDB, authenticator),
+		Handler:        handlers.API(shutdown, log, masterDB, authenticator, seller, blobs, reports, events, cfg.Stream.Heartbeat, cfg.Stream.WriteTimeout, cfg.Web.TransferTimeout, scheduler, notifier),
 		ReadTimeout:    cfg.Web.ReadTimeout,
 		WriteTimeout:   cfg.Web.WriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// =========================================================================
+	// Start webhook deliveries
+
+	dispatcher := webhook.NewDispatcher(masterDB, webhook.NewClient(cfg.Webhook.Timeout), log)
+	dispatcher.Interval = cfg.Webhook.Interval
+	dispatcher.MaxAttempts = cfg.Webhook.MaxAttempts
+
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	dispatchDone := make(chan struct{})
+	go func() {
+		dispatcher.Run(dispatchCtx)
+		close(dispatchDone)
+	}()
+
+	// =========================================================================
+	// Start domain event delivery
+
+	bus := event.NewBus()
+	bus.Subscribe("notify", notifier.Handle, event.AdvertTransitioned, event.EditionDeadline)
+	bus.Subscribe("webhook", webhook.NewSubscriber(masterDB).Handle, webhook.DomainEvents()...)
+	bus.Subscribe("stream", (&handlers.Publisher{MasterDB: masterDB, Broker: events}).Handle, handlers.StreamedEvents()...)
+	bus.Subscribe("audit", (&audit.Recorder{MasterDB: masterDB}).Handle, event.AuditQueued)
+	bus.Subscribe("history", (&advert.HistoryRecorder{MasterDB: masterDB}).Handle, event.RevisionQueued)
+
+	outbox := event.NewDispatcher(masterDB, bus, log, advert.EventSource, advert.CommentEventSource, edition.EventSource, user.EventSource)
+	outbox.Interval = cfg.Outbox.Interval
+	outbox.MaxAttempts = cfg.Outbox.MaxAttempts
+
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	outboxDone := make(chan struct{})
+	go func() {
+		outbox.Run(outboxCtx)
+		close(outboxDone)
+	}()
+
 	// Make a channel to listen for errors coming from the listener. Use a
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
@@ -149,6 +316,9 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
 		defer cancel()
 
+		// Streams never go idle, so end them before waiting for requests.
+		events.Close()
+
 		// Asking listener to shutdown and load shed.
 		err := api.Shutdown(ctx)
 		if err != nil {
@@ -156,6 +326,21 @@ func main() {
 			err = api.Close()
 		}
 
+		// Stop sending deliveries. One cut short is sent again later.
+		stopDispatch()
+		<-dispatchDone
+
+		// Stop starting jobs and let running ones finish, or checkpoint
+		// if they take too long.
+		stopSchedule()
+		if jerr := scheduler.Shutdown(ctx); jerr != nil {
+			log.Printf("main : Jobs did not stop : %v", jerr)
+		}
+
+		// Stop delivering events. One cut short is delivered again later.
+		stopOutbox()
+		<-outboxDone
+
 		// Log the status of this shutdown.
 		switch {
 		case sig == syscall.SIGSTOP:
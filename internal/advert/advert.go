@@ -5,7 +5,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"gopkg.in/mgo.v2"
@@ -14,32 +19,75 @@ import (
 
 const advertsCollection = "adverts"
 
+// EventSource names the collection whose adverts carry the events raised by
+// writes to them until they are moved to the outbox.
+const EventSource = advertsCollection
+
 var (
 	// ErrNotFound abstracts the mgo not found error.
 	ErrNotFound = errors.New("Entity not found")
 
 	// ErrInvalidID occurs when an ID is not in a valid form.
 	ErrInvalidID = errors.New("ID is not in its proper form")
-)
 
+	// ErrVersionConflict occurs when a write names a version of the advert
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current advert")
+)
 
 // List retrieves a list of existing products from the database.
-func List(ctx context.Context, dbConn *db.DB) ([]Advert, error) {
+func List(ctx context.Context, dbConn *db.DB, flt Filter) ([]Advert, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.List")
 	defer span.End()
 
 	p := []Advert{}
+	q := flt.query()
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
 
 	f := func(collection *mgo.Collection) error {
-		return collection.Find(nil).All(&p)
+		return collection.Find(q).All(&p)
 	}
 	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
-		return nil, errors.Wrap(err, "db.adverts.find()")
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
 	}
 
 	return p, nil
 }
 
+// query builds the Mongo query for a filter. Editions and states match when
+// the advert includes the requested value.
+func (flt Filter) query() bson.M {
+	q := bson.M{}
+	switch flt.Status {
+	case "":
+	case StatusProspect:
+		q["status"] = bson.M{"$in": []interface{}{StatusProspect, nil}}
+	default:
+		q["status"] = flt.Status
+	}
+	if bson.IsObjectIdHex(flt.AdvertiserID) {
+		q["advertiser_id"] = bson.ObjectIdHex(flt.AdvertiserID)
+	}
+	if flt.Advertiser != "" {
+		q["advertiser"] = flt.Advertiser
+	}
+	if flt.Size != "" {
+		q["size"] = flt.Size
+	}
+	if flt.Edition != "" {
+		q["editions"] = flt.Edition
+	}
+	if flt.Year != "" {
+		q["year"] = flt.Year
+	}
+	if flt.State != "" {
+		q["state"] = flt.State
+	}
+	return q
+}
+
 // Retrieve gets the specified product from the database.
 func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Advert, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.product.Retrieve")
@@ -50,6 +98,9 @@ func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Advert, error) {
 	}
 
 	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
 
 	var p *Advert
 	f := func(collection *mgo.Collection) error {
@@ -66,36 +117,93 @@ func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Advert, error) {
 }
 
 // Create inserts a new product into the database.
-func Create(ctx context.Context, dbConn *db.DB, cp *NewAdvert, now time.Time) (*Advert, error) {
+func Create(ctx context.Context, claims auth.Claims, dbConn *db.DB, cp *NewAdvert, now time.Time) (*Advert, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.adverts.Create")
 	defer span.End()
 
+	return create(ctx, claims, dbConn, cp, nil, now)
+}
+
+// create books a new advert, renewing the advert renewedFrom when it is set.
+func create(ctx context.Context, claims auth.Claims, dbConn *db.DB, cp *NewAdvert, renewedFrom *bson.ObjectId, now time.Time) (*Advert, error) {
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkContacts(cp.Contacts); err != nil {
+		return nil, err
+	}
+	price, err := checkBooking(ctx, dbConn, cp.Size, cp.Year, cp.Editions, cp.State)
+	if err != nil {
+		return nil, err
+	}
+
+	adv, err := resolveAdvertiser(ctx, dbConn, cp.AdvertiserID, cp.Advertiser, now)
+	if err != nil {
+		return nil, err
+	}
+
 	// Mongo truncates times to milliseconds when storing. We and do the same
 	// here so the value we return is consistent with what we store.
 	now = now.Truncate(time.Millisecond)
 
 	p := Advert{
-		ID:           	bson.NewObjectId(),
-		Advertiser:     cp.Advertiser,
-		Editions:       cp.Editions,
-		Year:     		cp.Year,
-		State:    		cp.State,
-		DateCreated:  	now,
-		DateModified: 	now,
+		ID:           bson.NewObjectId(),
+		TenantID:     tid,
+		AdvertiserID: adv.ID,
+		Advertiser:   adv.Name,
+		Size:         cp.Size,
+		Contacts:     cp.Contacts,
+		Editions:     cp.Editions,
+		Year:         cp.Year,
+		State:        cp.State,
+		Price:        price,
+		Status:       StatusProspect,
+		RenewedFrom:  renewedFrom,
+		SalesRep:     claims.Subject,
+		Version:      1,
+		DateCreated:  now,
+		DateModified: now,
+	}
+
+	doc, err := event.Attach(&p, event.New(event.AdvertCreated, event.AggregateAdvert, p.ID, claims.Subject, now))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := reserve(ctx, dbConn, p.ID, p.Size, p.Year, p.Editions, nil); err != nil {
+		return nil, err
 	}
 
 	f := func(collection *mgo.Collection) error {
-		return collection.Insert(&p)
+		if renewedFrom != nil {
+			if err := collection.EnsureIndex(renewalIndex); err != nil {
+				return err
+			}
+		}
+		return collection.Insert(doc)
 	}
 	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if rerr := settle(ctx, dbConn, p.ID, nil); rerr != nil {
+			return nil, rerr
+		}
+		if renewedFrom != nil && mgo.IsDup(err) {
+			return nil, ErrAlreadyRenewed
+		}
 		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.insert(%s)", db.Query(&p)))
 	}
 
+	if err := recordRevision(ctx, dbConn, ActionCreate, claims.Subject, &p, now); err != nil {
+		return nil, err
+	}
+
 	return &p, nil
 }
 
-// Update replaces a product document in the database.
-func Update(ctx context.Context, dbConn *db.DB, id string, upd UpdateAdvert, now time.Time) error {
+// Update replaces a product document in the database. The write only succeeds
+// if version is still the current version of the advert.
+func Update(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, upd UpdateAdvert, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.advert.Update")
 	defer span.End()
 
@@ -105,17 +213,70 @@ func Update(ctx context.Context, dbConn *db.DB, id string, upd UpdateAdvert, now
 
 	fields := make(bson.M)
 
-	if upd.Advertiser != nil {
-		fields["advertiser"] = *upd.Advertiser
-	}
-	if upd.Editions != nil {
-		fields["editions"] = *upd.Editions
+	// prev is the booking before the update when the update takes new slots
+	// in the editions, so they can be given back if the write fails.
+	var prev *Advert
+
+	if upd.AdvertiserID != nil || upd.Advertiser != nil {
+		var id, name string
+		if upd.AdvertiserID != nil {
+			id = *upd.AdvertiserID
+		}
+		if upd.Advertiser != nil {
+			name = *upd.Advertiser
+		}
+
+		adv, err := resolveAdvertiser(ctx, dbConn, id, name, now)
+		if err != nil {
+			return err
+		}
+		fields["advertiser_id"] = adv.ID
+		fields["advertiser"] = adv.Name
 	}
-	if upd.Year != nil {
-		fields["year"] = *upd.Year
+	if upd.Contacts != nil {
+		if err := checkContacts(*upd.Contacts); err != nil {
+			return err
+		}
+		fields["contacts"] = *upd.Contacts
 	}
-	if upd.State != nil {
-		fields["state"] = *upd.State
+	if upd.Size != nil || upd.Editions != nil || upd.Year != nil || upd.State != nil {
+
+		// The booking is checked and priced as it will be after the update,
+		// taking anything that is not changing from the stored advert.
+		cur, err := Retrieve(ctx, dbConn, id)
+		if err != nil {
+			return err
+		}
+		old := *cur
+		if upd.Size != nil {
+			cur.Size = *upd.Size
+			fields["size"] = cur.Size
+		}
+		if upd.Editions != nil {
+			cur.Editions = *upd.Editions
+			fields["editions"] = cur.Editions
+		}
+		if upd.Year != nil {
+			cur.Year = *upd.Year
+			fields["year"] = cur.Year
+		}
+		if upd.State != nil {
+			cur.State = *upd.State
+			fields["state"] = cur.State
+		}
+
+		price, err := checkBooking(ctx, dbConn, cur.Size, cur.Year, cur.Editions, cur.State)
+		if err != nil {
+			return err
+		}
+		fields["price"] = price
+
+		if cur.CurrentStatus() != StatusCancelled {
+			if err := reserve(ctx, dbConn, cur.ID, cur.Size, cur.Year, cur.Editions, &old); err != nil {
+				return err
+			}
+			prev = &old
+		}
 	}
 
 	// If there's nothing to update we can quit early.
@@ -123,26 +284,216 @@ func Update(ctx context.Context, dbConn *db.DB, id string, upd UpdateAdvert, now
 		return nil
 	}
 
+	now = now.Truncate(time.Millisecond)
 	fields["date_modified"] = now
 
-	m := bson.M{"$set": fields}
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
 
+	// Ask for the document as it is after the update so the revision holds
+	// exactly what was stored.
+	var a Advert
 	f := func(collection *mgo.Collection) error {
-		return collection.Update(q, m)
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
 	}
 	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if prev != nil {
+			if rerr := settle(ctx, dbConn, prev.ID, prev); rerr != nil {
+				return rerr
+			}
+		}
 		if err == mgo.ErrNotFound {
-			return ErrNotFound
+			return versionError(ctx, dbConn, bson.ObjectIdHex(id))
 		}
 		return errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
 	}
 
+	if prev != nil {
+		if err := settle(ctx, dbConn, a.ID, &a); err != nil {
+			return err
+		}
+	}
+
+	return recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now)
+}
+
+// Editable returns the fields of an advert that clients may change, in the
+// same shape used to create one.
+func Editable(a *Advert) NewAdvert {
+	na := NewAdvert{
+		Advertiser: a.Advertiser,
+		Size:       a.Size,
+		Contacts:   a.Contacts,
+		Editions:   a.Editions,
+		Year:       a.Year,
+		State:      a.State,
+	}
+	if a.AdvertiserID.Valid() {
+		na.AdvertiserID = a.AdvertiserID.Hex()
+	}
+	return na
+}
+
+// Updated returns the editable fields of a as they will be once upd is
+// applied.
+func Updated(a *Advert, upd UpdateAdvert) NewAdvert {
+	na := Editable(a)
+	if upd.AdvertiserID != nil || upd.Advertiser != nil {
+		na.AdvertiserID, na.Advertiser = "", ""
+		if upd.AdvertiserID != nil {
+			na.AdvertiserID = *upd.AdvertiserID
+		}
+		if upd.Advertiser != nil {
+			na.Advertiser = *upd.Advertiser
+		}
+	}
+	if upd.Contacts != nil {
+		na.Contacts = *upd.Contacts
+	}
+	if upd.Size != nil {
+		na.Size = *upd.Size
+	}
+	if upd.Editions != nil {
+		na.Editions = *upd.Editions
+	}
+	if upd.Year != nil {
+		na.Year = *upd.Year
+	}
+	if upd.State != nil {
+		na.State = *upd.State
+	}
+	return na
+}
+
+// resolveAdvertiser finds the advertiser an advert is booked for. An ID takes
+// precedence over a name. A name that matches no known advertiser creates a
+// new one.
+func resolveAdvertiser(ctx context.Context, dbConn *db.DB, id, name string, now time.Time) (*advertiser.Advertiser, error) {
+	if id != "" {
+		adv, err := advertiser.Retrieve(ctx, dbConn, id)
+		switch err {
+		case nil:
+			return adv, nil
+		case advertiser.ErrInvalidID, advertiser.ErrNotFound:
+			return nil, web.NewFieldErrors(web.FieldError{
+				Field: "advertiser_id",
+				Error: "advertiser_id must name an existing advertiser",
+			})
+		}
+		return nil, err
+	}
+
+	if err := requireAdvertiser(id, name); err != nil {
+		return nil, err
+	}
+
+	return advertiser.Resolve(ctx, dbConn, name, now)
+}
+
+// requireAdvertiser checks that an advertiser is named by ID or by name.
+func requireAdvertiser(id, name string) error {
+	if id == "" && name == "" {
+		return web.NewFieldErrors(web.FieldError{
+			Field: "advertiser",
+			Error: "advertiser is required when advertiser_id is not given",
+		})
+	}
 	return nil
 }
 
-// Delete removes a product from the database.
-func Delete(ctx context.Context, dbConn *db.DB, id string) error {
+// Replace overwrites every editable field of an advert in a single write. The
+// write only succeeds if version is still the current version of the advert.
+func Replace(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, na *NewAdvert, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Replace")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	if err := checkContacts(na.Contacts); err != nil {
+		return nil, err
+	}
+	price, err := checkBooking(ctx, dbConn, na.Size, na.Year, na.Editions, na.State)
+	if err != nil {
+		return nil, err
+	}
+
+	adv, err := resolveAdvertiser(ctx, dbConn, na.AdvertiserID, na.Advertiser, now)
+	if err != nil {
+		return nil, err
+	}
+
+	prev, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+	booked := prev.CurrentStatus() != StatusCancelled
+	if booked {
+		if err := reserve(ctx, dbConn, prev.ID, na.Size, na.Year, na.Editions, prev); err != nil {
+			return nil, err
+		}
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	fields := bson.M{
+		"advertiser_id": adv.ID,
+		"advertiser":    adv.Name,
+		"size":          na.Size,
+		"contacts":      na.Contacts,
+		"editions":      na.Editions,
+		"year":          na.Year,
+		"state":         na.State,
+		"price":         price,
+		"date_modified": now,
+	}
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var a Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if booked {
+			if rerr := settle(ctx, dbConn, prev.ID, prev); rerr != nil {
+				return nil, rerr
+			}
+		}
+		if err == mgo.ErrNotFound {
+			return nil, versionError(ctx, dbConn, bson.ObjectIdHex(id))
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	if booked {
+		if err := settle(ctx, dbConn, a.ID, &a); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// Delete removes a product from the database. The delete only succeeds if
+// version is still the current version of the advert.
+func Delete(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.advert.Delete")
 	defer span.End()
 
@@ -150,17 +501,76 @@ func Delete(ctx context.Context, dbConn *db.DB, id string) error {
 		return ErrInvalidID
 	}
 
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
 
+	// A removed document cannot carry its event, so the event is staged
+	// first and released once the advert is gone.
+	ev := event.New(event.AdvertDeleted, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now)
+	if err := event.Stage(ctx, dbConn, advertsCollection, ev); err != nil {
+		return err
+	}
+
+	// Remove the document and get it back so its final state can be kept in
+	// the history.
+	var a Advert
 	f := func(collection *mgo.Collection) error {
-		return collection.Remove(q)
+		_, err := collection.Find(q).Apply(mgo.Change{Remove: true}, &a)
+		return err
 	}
 	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if derr := event.Discard(ctx, dbConn, ev.ID); derr != nil {
+			return derr
+		}
 		if err == mgo.ErrNotFound {
-			return ErrNotFound
+			return versionError(ctx, dbConn, bson.ObjectIdHex(id))
 		}
 		return errors.Wrap(err, fmt.Sprintf("db.adverts.remove(%v)", q))
 	}
 
-	return nil
-}
\ No newline at end of file
+	if err := event.Release(ctx, dbConn, ev.ID, now); err != nil {
+		return err
+	}
+
+	if err := settle(ctx, dbConn, a.ID, nil); err != nil {
+		return err
+	}
+
+	return recordRevision(ctx, dbConn, ActionDelete, claims.Subject, &a, now)
+}
+
+// versionQuery matches the expected version of a document. Adverts stored
+// before versions were introduced have no version field and are treated as
+// version 0.
+func versionQuery(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return db.Version(version)
+}
+
+// versionError works out why a versioned write matched no document. The advert
+// either no longer exists or has moved on to a newer version.
+func versionError(ctx context.Context, dbConn *db.DB, id bson.ObjectId) error {
+	q := bson.M{"_id": id}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	var n int
+	f := func(collection *mgo.Collection) error {
+		var err error
+		n, err = collection.Find(q).Count()
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.adverts.count(%s)", db.Query(q)))
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
+}
@@ -0,0 +1,241 @@
+package advert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/blob"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrAttachmentNotFound occurs when an advert has no attachment with the
+	// requested ID.
+	ErrAttachmentNotFound = errors.New("Attachment not found")
+
+	// ErrContentType occurs when an attachment is not one of the accepted
+	// file types.
+	ErrContentType = errors.New("Attachment content type is not accepted")
+
+	// ErrTooLarge occurs when an attachment is bigger than allowed.
+	ErrTooLarge = errors.New("Attachment is too large")
+)
+
+// attachmentTypes are the content types accepted for artwork and proofs.
+var attachmentTypes = map[string]bool{
+	"application/pdf":        true,
+	"application/postscript": true,
+	"image/jpeg":             true,
+	"image/png":              true,
+	"image/tiff":             true,
+}
+
+// sniffLen is how much of a file is read to work out its content type.
+const sniffLen = 512
+
+// sniff works out the content type of a file from its first bytes.
+// http.DetectContentType does not recognise TIFF, so that is checked here.
+func sniff(head []byte) string {
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return ct
+}
+
+// Attach stores a file against an advert. The content is read from r into a
+// temporary file to measure it and compute its checksum before it is put in
+// the blob store, and anything over limit bytes is rejected. The content type
+// is sniffed from the start of the file rather than taken from the client.
+// The advert must still be at version once the file is stored.
+func Attach(ctx context.Context, claims auth.Claims, dbConn *db.DB, store blob.Store, id string, version int, na *NewAttachment, r io.Reader, limit int64, now time.Time) (*Attachment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Attach")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, errors.Wrap(err, "reading attachment")
+	}
+	ct := sniff(head)
+	if !attachmentTypes[ct] {
+		return nil, ErrContentType
+	}
+	r = br
+
+	// Fail before reading the upload if the advert has gone or moved on.
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+	if !web.VersionMatches(version, cur.Version) {
+		return nil, ErrVersionConflict
+	}
+
+	tmp, err := ioutil.TempFile("", "attachment-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating attachment spool file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading attachment")
+	}
+	if size > limit {
+		return nil, ErrTooLarge
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "rewinding attachment spool file")
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	att := Attachment{
+		ID:           bson.NewObjectId(),
+		Kind:         na.Kind,
+		Filename:     filepath.Base(na.Filename),
+		ContentType:  ct,
+		Size:         size,
+		SHA256:       hex.EncodeToString(h.Sum(nil)),
+		UploadedBy:   claims.Subject,
+		DateUploaded: now,
+	}
+	att.Key = fmt.Sprintf("adverts/%s/%s", id, att.ID.Hex())
+
+	if err := store.Put(ctx, att.Key, tmp, size, ct); err != nil {
+		return nil, errors.Wrapf(err, "storing attachment %s", att.Key)
+	}
+
+	m := bson.M{
+		"$push": bson.M{"attachments": att},
+		"$set":  bson.M{"date_modified": now},
+		"$inc":  bson.M{"version": 1},
+	}
+	event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		store.Delete(ctx, att.Key)
+		return nil, err
+	}
+
+	var a Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+
+		// Do not leave the blob behind when it cannot be recorded.
+		store.Delete(ctx, att.Key)
+
+		if err == mgo.ErrNotFound {
+			return nil, versionError(ctx, dbConn, bson.ObjectIdHex(id))
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	if err := recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now); err != nil {
+		return nil, err
+	}
+
+	return &att, nil
+}
+
+// RetrieveAttachment gets the metadata of an attachment on an advert.
+func RetrieveAttachment(ctx context.Context, dbConn *db.DB, id, attachmentID string) (*Attachment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.RetrieveAttachment")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(attachmentID) {
+		return nil, ErrAttachmentNotFound
+	}
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range a.Attachments {
+		if a.Attachments[i].ID.Hex() == attachmentID {
+			return &a.Attachments[i], nil
+		}
+	}
+
+	return nil, ErrAttachmentNotFound
+}
+
+// RemoveAttachment takes an attachment off an advert at version and deletes
+// its file.
+func RemoveAttachment(ctx context.Context, claims auth.Claims, dbConn *db.DB, store blob.Store, id, attachmentID string, version int, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.RemoveAttachment")
+	defer span.End()
+
+	att, err := RetrieveAttachment(ctx, dbConn, id, attachmentID)
+	if err != nil {
+		return err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	m := bson.M{
+		"$pull": bson.M{"attachments": bson.M{"_id": att.ID}},
+		"$set":  bson.M{"date_modified": now},
+		"$inc":  bson.M{"version": 1},
+	}
+	event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version), "attachments._id": att.ID}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	var a Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			cur, err := Retrieve(ctx, dbConn, id)
+			if err != nil {
+				return err
+			}
+			if !web.VersionMatches(version, cur.Version) {
+				return ErrVersionConflict
+			}
+			return ErrAttachmentNotFound
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	if err := store.Delete(ctx, att.Key); err != nil {
+		return errors.Wrapf(err, "deleting attachment %s", att.Key)
+	}
+
+	return recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now)
+}
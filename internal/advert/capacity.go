@@ -0,0 +1,171 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// reserve takes a slot of size in each edition of year for the advert id.
+// When an edition is full the advert is put back to holding only the slots of
+// prev, its booking before the change, and edition.ErrFull is returned. prev
+// is nil for a new advert.
+func reserve(ctx context.Context, dbConn *db.DB, id bson.ObjectId, size, year string, editions []string, prev *Advert) error {
+	for _, name := range editions {
+		if err := edition.Reserve(ctx, dbConn, year, name, size, id); err != nil {
+			if rerr := settle(ctx, dbConn, id, prev); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// settle gives back every slot the advert id holds that its booking a does
+// not use. A nil or cancelled booking uses no slots.
+func settle(ctx context.Context, dbConn *db.DB, id bson.ObjectId, a *Advert) error {
+	if a == nil || a.CurrentStatus() == StatusCancelled {
+		return edition.Release(ctx, dbConn, id, "", "", nil)
+	}
+	return edition.Release(ctx, dbConn, id, a.Year, a.Size, a.Editions)
+}
+
+// Plan builds the flat plan of the specified edition. Every page is listed,
+// including pages without ad slots.
+func Plan(ctx context.Context, dbConn *db.DB, editionID string) (*FlatPlan, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Plan")
+	defer span.End()
+
+	e, err := edition.Retrieve(ctx, dbConn, editionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []bson.ObjectId
+	for _, s := range e.Slots {
+		if s.AdvertID != nil {
+			ids = append(ids, *s.AdvertID)
+		}
+	}
+
+	holders := make(map[bson.ObjectId]Advert, len(ids))
+	if len(ids) > 0 {
+		q := bson.M{"_id": bson.M{"$in": ids}}
+		if err := tenant.Filter(ctx, q); err != nil {
+			return nil, err
+		}
+
+		var adverts []Advert
+		f := func(collection *mgo.Collection) error {
+			return collection.Find(q).All(&adverts)
+		}
+		if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+		}
+		for _, a := range adverts {
+			holders[a.ID] = a
+		}
+	}
+
+	fp := FlatPlan{
+		Edition:  *e,
+		Capacity: e.Capacity(),
+		Pages:    make([]PlanPage, e.Pages),
+		Unplaced: []Advert{},
+	}
+
+	if len(e.Slots) > 0 {
+		booked, err := bookedInto(ctx, dbConn, e)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range booked {
+			if _, ok := holders[a.ID]; !ok {
+				fp.Unplaced = append(fp.Unplaced, a)
+			}
+		}
+	}
+	fp.Edition.Slots = nil
+	for i := range fp.Pages {
+		fp.Pages[i] = PlanPage{Number: i + 1, Slots: []PlanSlot{}}
+	}
+	for _, s := range e.Slots {
+		if s.Page < 1 || s.Page > len(fp.Pages) {
+			continue
+		}
+		ps := PlanSlot{Slot: s}
+		if s.AdvertID != nil {
+			a := holders[*s.AdvertID]
+			ps.Advertiser, ps.Status = a.Advertiser, a.CurrentStatus()
+		}
+		fp.Pages[s.Page-1].Slots = append(fp.Pages[s.Page-1].Slots, ps)
+	}
+	for _, p := range fp.Pages {
+		sort.Slice(p.Slots, func(i, j int) bool {
+			return p.Slots[i].Position < p.Slots[j].Position
+		})
+	}
+
+	return &fp, nil
+}
+
+// Place reserves slots in an edition for the adverts booked into it that hold
+// none, such as those booked before its layout was planned. Adverts are
+// placed in the order they were booked and those that do not fit are left
+// unplaced.
+func Place(ctx context.Context, dbConn *db.DB, e *edition.Edition) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Place")
+	defer span.End()
+
+	booked, err := bookedInto(ctx, dbConn, e)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range booked {
+		err := edition.Reserve(ctx, dbConn, e.Year, e.Name, a.Size, a.ID)
+		if err != nil && err != edition.ErrFull {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bookedInto retrieves the adverts booked into an edition that have not been
+// cancelled, oldest booking first.
+func bookedInto(ctx context.Context, dbConn *db.DB, e *edition.Edition) ([]Advert, error) {
+	q := bson.M{
+		"year":     e.Year,
+		"editions": e.Name,
+		"status":   bson.M{"$ne": StatusCancelled},
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	// An edition only takes bookings from its own tenant, whatever the
+	// scope it is looked at in.
+	if e.TenantID.Valid() {
+		q["tenant_id"] = e.TenantID
+	}
+
+	var adverts []Advert
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("date_created").All(&adverts)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	return adverts, nil
+}
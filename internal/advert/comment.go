@@ -0,0 +1,352 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const commentsCollection = "advert_comments"
+
+// CommentEventSource names the collection whose comments carry the events
+// raised by writes to them until they are moved to the outbox.
+const CommentEventSource = commentsCollection
+
+var (
+	// ErrCommentNotFound occurs when an advert has no comment with the
+	// requested ID.
+	ErrCommentNotFound = errors.New("Comment not found")
+
+	// ErrNotAuthor occurs when someone other than its author changes a
+	// comment.
+	ErrNotAuthor = errors.New("Only the author may change a comment")
+
+	// ErrCommentVersionConflict occurs when a write names a version of the
+	// comment that is no longer current.
+	ErrCommentVersionConflict = errors.New("Version does not match the current comment")
+)
+
+// commentIndex supports listing the comments on an advert in order.
+var commentIndex = mgo.Index{
+	Key: []string{"advert_id", "date_created"},
+}
+
+// mentionPattern matches an email address written as @jane@example.com at the
+// start of the body or after a space or opening bracket.
+var mentionPattern = regexp.MustCompile(`(?:^|[\s(])@([^\s@]+@[^\s@]+)`)
+
+// mentions returns the IDs of the users mentioned in a comment body. Addresses
+// that do not belong to a user are ignored.
+func mentions(ctx context.Context, dbConn *db.DB, body string) ([]string, error) {
+	var emails []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		email := strings.TrimRight(m[1], ".,;:!?)")
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		emails = append(emails, email)
+	}
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	users, err := user.ByEmail(ctx, dbConn, emails)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.ID.Hex()
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Comments retrieves the comments on the specified advert, oldest first.
+// Replies name the comment they answer in ParentID.
+func Comments(ctx context.Context, dbConn *db.DB, id string) ([]Comment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Comments")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return comments(ctx, dbConn, a.ID)
+}
+
+// comments retrieves the comments on an advert, oldest first.
+func comments(ctx context.Context, dbConn *db.DB, id bson.ObjectId) ([]Comment, error) {
+	q := bson.M{"advert_id": id}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	cs := []Comment{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("date_created", "_id").All(&cs)
+	}
+	if err := dbConn.Execute(ctx, commentsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_comments.find(%s)", db.Query(q)))
+	}
+
+	return cs, nil
+}
+
+// RetrieveComment gets a single comment on the specified advert.
+func RetrieveComment(ctx context.Context, dbConn *db.DB, id, commentID string) (*Comment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.RetrieveComment")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) || !bson.IsObjectIdHex(commentID) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(commentID), "advert_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var c *Comment
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&c)
+	}
+	if err := dbConn.Execute(ctx, commentsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrCommentNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_comments.find(%s)", db.Query(q)))
+	}
+
+	return c, nil
+}
+
+// AddComment adds a comment to the specified advert on behalf of the user in
+// claims. A comment naming a parent is a reply to that comment.
+func AddComment(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, nc *NewComment, now time.Time) (*Comment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.AddComment")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	c := Comment{
+		ID:           bson.NewObjectId(),
+		TenantID:     a.TenantID,
+		AdvertID:     a.ID,
+		Author:       claims.Subject,
+		Body:         nc.Body,
+		Version:      1,
+		DateCreated:  now,
+		DateModified: now,
+	}
+
+	if nc.ParentID != "" {
+		parent, err := RetrieveComment(ctx, dbConn, id, nc.ParentID)
+		if err != nil {
+			if err != ErrInvalidID && err != ErrCommentNotFound {
+				return nil, err
+			}
+			return nil, web.NewFieldErrors(web.FieldError{
+				Field: "parent_id",
+				Error: "parent_id must be a comment on this advert",
+			})
+		}
+		c.ParentID = &parent.ID
+	}
+
+	if c.Mentions, err = mentions(ctx, dbConn, c.Body); err != nil {
+		return nil, err
+	}
+
+	doc, err := event.Attach(&c, commentEvent(event.CommentCreated, &c, claims.Subject, now))
+	if err != nil {
+		return nil, err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(commentIndex); err != nil {
+			return err
+		}
+		return collection.Insert(doc)
+	}
+	if err := dbConn.Execute(ctx, commentsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_comments.insert(%s)", db.Query(&c)))
+	}
+
+	return &c, nil
+}
+
+// EditComment replaces the body of a comment. Only the author may edit a
+// comment and the write only succeeds if version is still the current
+// version of the comment.
+func EditComment(ctx context.Context, claims auth.Claims, dbConn *db.DB, id, commentID string, version int, uc *UpdateComment, now time.Time) (*Comment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.EditComment")
+	defer span.End()
+
+	ms, err := mentions(ctx, dbConn, uc.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bson.M{
+		"body":          uc.Body,
+		"mentions":      ms,
+		"date_modified": now.Truncate(time.Millisecond),
+	}
+
+	return changeComment(ctx, claims, dbConn, id, commentID, version, event.CommentUpdated, fields, now)
+}
+
+// DeleteComment removes a comment. Only the author may delete a comment and
+// the write only succeeds if version is still the current version of the
+// comment. The comment is kept, without its body, so replies to it stay in
+// place in the thread.
+func DeleteComment(ctx context.Context, claims auth.Claims, dbConn *db.DB, id, commentID string, version int, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.DeleteComment")
+	defer span.End()
+
+	fields := bson.M{
+		"body":          "",
+		"mentions":      nil,
+		"deleted":       true,
+		"date_modified": now.Truncate(time.Millisecond),
+	}
+
+	_, err := changeComment(ctx, claims, dbConn, id, commentID, version, event.CommentDeleted, fields, now)
+	return err
+}
+
+// changeComment applies fields to a comment written by the user in claims and
+// raises the named event.
+func changeComment(ctx context.Context, claims auth.Claims, dbConn *db.DB, id, commentID string, version int, name string, fields bson.M, now time.Time) (*Comment, error) {
+	cur, err := RetrieveComment(ctx, dbConn, id, commentID)
+	if err != nil {
+		return nil, err
+	}
+	if cur.Deleted {
+		return nil, ErrCommentNotFound
+	}
+	if cur.Author != claims.Subject {
+		return nil, ErrNotAuthor
+	}
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	event.Push(m, commentEvent(name, cur, claims.Subject, now))
+	q := bson.M{"_id": cur.ID, "version": db.Version(version), "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var c Comment
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &c)
+		return err
+	}
+	if err := dbConn.Execute(ctx, commentsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrCommentVersionConflict
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_comments.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &c, nil
+}
+
+// commentEvent returns an event about a comment. The event names the advert
+// the comment is on so subscribers can find it.
+func commentEvent(name string, c *Comment, actor string, now time.Time) event.Event {
+	ev := event.New(name, event.AggregateComment, c.ID, actor, now)
+	ev.Data = bson.M{"advert_id": c.AdvertID}
+	return ev
+}
+
+// activityNoise lists the fields that change on every write and say nothing
+// about what was changed.
+var activityNoise = map[string]bool{
+	"version":       true,
+	"date_modified": true,
+}
+
+// ActivityFeed merges the comments on the specified advert with its recorded
+// changes into a single feed, oldest first.
+func ActivityFeed(ctx context.Context, dbConn *db.DB, id string) ([]Activity, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.ActivityFeed")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, err := comments(ctx, dbConn, a.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Adverts booked before history was kept have no revisions.
+	revs, err := History(ctx, dbConn, id)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	feed := make([]Activity, 0, len(cs)+len(revs))
+	for i := range revs {
+		act := Activity{
+			Kind:     ActivityChange,
+			Actor:    revs[i].Actor,
+			Date:     revs[i].Date,
+			Action:   revs[i].Action,
+			Revision: revs[i].Number,
+		}
+		if i > 0 {
+			changes, err := Diff(&revs[i-1], &revs[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "revision %d", revs[i].Number)
+			}
+			for _, c := range changes {
+				if !activityNoise[c.Field] {
+					act.Changes = append(act.Changes, c)
+				}
+			}
+		}
+		feed = append(feed, act)
+	}
+	for i := range cs {
+		feed = append(feed, Activity{
+			Kind:    ActivityComment,
+			Actor:   cs[i].Author,
+			Date:    cs[i].DateCreated,
+			Comment: &cs[i],
+		})
+	}
+
+	sort.SliceStable(feed, func(i, j int) bool {
+		return feed[i].Date.Before(feed[j].Date)
+	})
+
+	return feed, nil
+}
@@ -0,0 +1,180 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrContactNotFound occurs when an advert has no contact for a role.
+	ErrContactNotFound = errors.New("Contact not found")
+
+	// ErrInvalidRole occurs when a contact role is not one of the Contact
+	// constants.
+	ErrInvalidRole = errors.New("Contact role must be primary, billing or artwork")
+)
+
+// validRole reports whether role is one of the Contact constants.
+func validRole(role string) bool {
+	switch role {
+	case ContactPrimary, ContactBilling, ContactArtwork:
+		return true
+	}
+	return false
+}
+
+// checkContacts enforces the rules for a set of contacts that validation tags
+// cannot express. Each role may only be held by one contact.
+func checkContacts(cs []Contact) error {
+	seen := make(map[string]bool, len(cs))
+	for _, c := range cs {
+		if seen[c.Role] {
+			return web.NewFieldErrors(web.FieldError{
+				Field: "contacts",
+				Error: fmt.Sprintf("contacts has more than one %s contact", c.Role),
+			})
+		}
+		seen[c.Role] = true
+	}
+	return nil
+}
+
+// ContactFor returns the advert's contact for a role and whether there is one.
+func ContactFor(a *Advert, role string) (Contact, bool) {
+	for _, c := range a.Contacts {
+		if c.Role == role {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
+
+// SetContact adds or replaces the contact for a role on an advert at version.
+func SetContact(ctx context.Context, claims auth.Claims, dbConn *db.DB, id, role string, version int, nc *NewContact, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.SetContact")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	if !validRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	now = now.Truncate(time.Millisecond)
+	c := Contact{
+		Role:  role,
+		Name:  nc.Name,
+		Email: nc.Email,
+		Phone: nc.Phone,
+	}
+
+	// Replace the contact in place if the role is already held, otherwise
+	// append it. Each write is conditional on the role so two concurrent
+	// requests cannot both append a contact for the same role.
+	writes := []struct {
+		q bson.M
+		m bson.M
+	}{
+		{
+			q: bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version), "contacts.role": role},
+			m: bson.M{"$set": bson.M{"contacts.$": c, "date_modified": now}, "$inc": bson.M{"version": 1}},
+		},
+		{
+			q: bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version), "contacts.role": bson.M{"$ne": role}},
+			m: bson.M{"$push": bson.M{"contacts": c}, "$set": bson.M{"date_modified": now}, "$inc": bson.M{"version": 1}},
+		},
+	}
+
+	for _, w := range writes {
+		if err := tenant.Filter(ctx, w.q); err != nil {
+			return nil, err
+		}
+	}
+
+	ev := event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now)
+
+	var a Advert
+	for _, w := range writes {
+		event.Push(w.m, ev)
+		f := func(collection *mgo.Collection) error {
+			_, err := collection.Find(w.q).Apply(mgo.Change{Update: w.m, ReturnNew: true}, &a)
+			return err
+		}
+		err := dbConn.Execute(ctx, advertsCollection, f)
+		if err == nil {
+			if err := recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now); err != nil {
+				return nil, err
+			}
+			return &a, nil
+		}
+		if err != mgo.ErrNotFound {
+			return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(w.q), db.Query(w.m)))
+		}
+	}
+
+	// Neither write matched so the advert does not exist or has moved on.
+	return nil, versionError(ctx, dbConn, bson.ObjectIdHex(id))
+}
+
+// RemoveContact removes the contact for a role from an advert at version.
+func RemoveContact(ctx context.Context, claims auth.Claims, dbConn *db.DB, id, role string, version int, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.RemoveContact")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	if !validRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version), "contacts.role": role}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+	m := bson.M{
+		"$pull": bson.M{"contacts": bson.M{"role": role}},
+		"$set":  bson.M{"date_modified": now},
+		"$inc":  bson.M{"version": 1},
+	}
+	event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, bson.ObjectIdHex(id), claims.Subject, now))
+
+	var a Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			cur, err := Retrieve(ctx, dbConn, id)
+			if err != nil {
+				return nil, err
+			}
+			if !web.VersionMatches(version, cur.Version) {
+				return nil, ErrVersionConflict
+			}
+			return nil, ErrContactNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	if err := recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
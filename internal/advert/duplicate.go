@@ -0,0 +1,270 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// booking holds the parts of an advert that identify who booked it and
+// where, normalised for comparison.
+type booking struct {
+	id           bson.ObjectId
+	advertiserID bson.ObjectId
+	name         string
+	emails       map[string]bool
+	phones       map[string]bool
+	year         string
+	editions     []string
+}
+
+// newBooking normalises the identifying parts of an advert.
+func newBooking(id, advertiserID bson.ObjectId, name string, contacts []Contact, year string, editions []string) booking {
+	b := booking{
+		id:           id,
+		advertiserID: advertiserID,
+		name:         advertiser.Normalize(name),
+		emails:       make(map[string]bool),
+		phones:       make(map[string]bool),
+		year:         year,
+		editions:     editions,
+	}
+	for _, c := range contacts {
+		if e := advertiser.NormalizeEmail(c.Email); e != "" {
+			b.emails[e] = true
+		}
+		if p := advertiser.NormalizePhone(c.Phone); p != "" {
+			b.phones[p] = true
+		}
+	}
+	return b
+}
+
+// bookingOf normalises the identifying parts of a stored advert.
+func bookingOf(a *Advert) booking {
+	return newBooking(a.ID, a.AdvertiserID, a.Advertiser, a.Contacts, a.Year, a.Editions)
+}
+
+// compare returns the editions two bookings share and the reasons they look
+// like the same booking. Bookings for different years or with no edition in
+// common are never duplicates.
+func compare(a, b booking) (shared, reasons []string) {
+	if a.year != b.year {
+		return nil, nil
+	}
+	for _, e := range a.editions {
+		for _, f := range b.editions {
+			if e == f {
+				shared = append(shared, e)
+				break
+			}
+		}
+	}
+	if len(shared) == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case a.advertiserID.Valid() && a.advertiserID == b.advertiserID:
+		reasons = append(reasons, MatchAdvertiser)
+	case a.name != "" && b.name != "" && advertiser.Similarity(a.name, b.name) >= advertiser.ClusterThreshold:
+		reasons = append(reasons, MatchName)
+	}
+	for e := range a.emails {
+		if b.emails[e] {
+			reasons = append(reasons, MatchEmail)
+			break
+		}
+	}
+	for p := range a.phones {
+		if b.phones[p] {
+			reasons = append(reasons, MatchPhone)
+			break
+		}
+	}
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+
+	return shared, reasons
+}
+
+// Duplicates finds the adverts that booking na may duplicate. An advert is a
+// suspect when it is booked into one of the same editions in the same year
+// for the same or an alike advertiser, or with a contact in common. self is
+// the ID of the advert being changed and is empty for a new advert.
+// Cancelled adverts are ignored.
+func Duplicates(ctx context.Context, dbConn *db.DB, na *NewAdvert, self string) ([]Suspect, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Duplicates")
+	defer span.End()
+
+	// Work out the advertiser the booking will resolve to without creating
+	// one. A name that matches no advertiser is compared by name alone.
+	var (
+		adv *advertiser.Advertiser
+		err error
+	)
+	if bson.IsObjectIdHex(na.AdvertiserID) {
+		adv, err = advertiser.Retrieve(ctx, dbConn, na.AdvertiserID)
+	} else {
+		adv, err = advertiser.FindByName(ctx, dbConn, na.Advertiser)
+	}
+
+	var advID bson.ObjectId
+	name := na.Advertiser
+	switch err {
+	case nil:
+		advID, name = adv.ID, adv.Name
+	case advertiser.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	var selfID bson.ObjectId
+	if bson.IsObjectIdHex(self) {
+		selfID = bson.ObjectIdHex(self)
+	}
+	b := newBooking(selfID, advID, name, na.Contacts, na.Year, na.Editions)
+
+	q := bson.M{
+		"year":     na.Year,
+		"editions": bson.M{"$in": na.Editions},
+		"status":   bson.M{"$ne": StatusCancelled},
+	}
+	if selfID.Valid() {
+		q["_id"] = bson.M{"$ne": selfID}
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var candidates []Advert
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("date_created").All(&candidates)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	suspects := []Suspect{}
+	for i := range candidates {
+		c := &candidates[i]
+		shared, reasons := compare(b, bookingOf(c))
+		if len(reasons) == 0 {
+			continue
+		}
+		suspects = append(suspects, Suspect{
+			ID:         c.ID,
+			Advertiser: c.Advertiser,
+			Year:       c.Year,
+			Editions:   shared,
+			Reasons:    reasons,
+		})
+	}
+
+	return suspects, nil
+}
+
+// DuplicateClusters groups the adverts that look like the same booking made
+// more than once so they can be cleaned up. Adverts are joined by the same
+// rules as Duplicates, and an advert joined to one member of a group belongs
+// to the whole group. An empty year checks every year.
+func DuplicateClusters(ctx context.Context, dbConn *db.DB, year string) ([]DuplicateCluster, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.DuplicateClusters")
+	defer span.End()
+
+	q := bson.M{"status": bson.M{"$ne": StatusCancelled}}
+	if year != "" {
+		q["year"] = year
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var adverts []Advert
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("year", "date_created").All(&adverts)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	bookings := make([]booking, len(adverts))
+	for i := range adverts {
+		bookings[i] = bookingOf(&adverts[i])
+	}
+
+	parent := make([]int, len(adverts))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// Adverts are sorted by year so only those up to the first of a later
+	// year need comparing.
+	why := make(map[int]map[string]bool)
+	for i := range bookings {
+		for j := i + 1; j < len(bookings) && bookings[j].year == bookings[i].year; j++ {
+			_, reasons := compare(bookings[i], bookings[j])
+			if len(reasons) == 0 {
+				continue
+			}
+			ri, rj := find(i), find(j)
+			if why[ri] == nil {
+				why[ri] = make(map[string]bool)
+			}
+			if ri != rj {
+				parent[rj] = ri
+				for r := range why[rj] {
+					why[ri][r] = true
+				}
+				delete(why, rj)
+			}
+			for _, r := range reasons {
+				why[ri][r] = true
+			}
+		}
+	}
+
+	groups := make(map[int][]Advert)
+	var roots []int
+	for i := range adverts {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], adverts[i])
+	}
+
+	clusters := []DuplicateCluster{}
+	for _, r := range roots {
+		if len(groups[r]) < 2 {
+			continue
+		}
+		c := DuplicateCluster{
+			Year:    groups[r][0].Year,
+			Adverts: groups[r],
+		}
+		for reason := range why[r] {
+			c.Reasons = append(c.Reasons, reason)
+		}
+		sort.Strings(c.Reasons)
+		clusters = append(clusters, c)
+	}
+
+	return clusters, nil
+}
@@ -0,0 +1,45 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+)
+
+// checkEditions makes sure every edition an advert is booked into is in the
+// catalogue for the advert's year and still open for bookings.
+func checkEditions(ctx context.Context, dbConn *db.DB, year string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	known, err := edition.Lookup(ctx, dbConn, year, names)
+	if err != nil {
+		return err
+	}
+
+	var fields []web.FieldError
+	for i, name := range names {
+		e, ok := known[name]
+		switch {
+		case !ok:
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("editions[%d]", i),
+				Error: fmt.Sprintf("%q is not an edition in %s", name, year),
+			})
+		case e.Status != edition.StatusOpen:
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("editions[%d]", i),
+				Error: fmt.Sprintf("%q is closed to bookings", name),
+			})
+		}
+	}
+	if len(fields) > 0 {
+		return web.NewFieldErrors(fields...)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+)
+
+// Columns are the names of the columns an advert can be exported with, in
+// their default order. Contact details are flattened into their own columns,
+// one set per role, and match the columns the importer understands.
+var Columns = []string{
+	"id",
+	"advertiser_id",
+	"advertiser",
+	"size",
+	"editions",
+	"year",
+	"state",
+	"contact.name",
+	"contact.email",
+	"contact.phone",
+	"billing.name",
+	"billing.email",
+	"billing.phone",
+	"artwork.name",
+	"artwork.email",
+	"artwork.phone",
+	"status",
+	"sales_rep",
+	"currency",
+	"total",
+	"version",
+	"date_created",
+	"date_modified",
+}
+
+// ParseColumns reads a comma separated list of export columns. An empty
+// string selects every column.
+func ParseColumns(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return Columns, nil
+	}
+
+	known := make(map[string]bool, len(Columns))
+	for _, c := range Columns {
+		known[c] = true
+	}
+
+	var cols []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if !known[c] {
+			return nil, errors.Errorf("unknown column %q", c)
+		}
+		cols = append(cols, c)
+	}
+
+	return cols, nil
+}
+
+// Row returns the values of the requested columns for an advert. Lists are
+// joined with the same separator the importer splits on.
+func Row(a *Advert, cols []string) []string {
+	row := make([]string, len(cols))
+	for i, c := range cols {
+		switch c {
+		case "id":
+			row[i] = a.ID.Hex()
+		case "advertiser_id":
+			if a.AdvertiserID.Valid() {
+				row[i] = a.AdvertiserID.Hex()
+			}
+		case "advertiser":
+			row[i] = a.Advertiser
+		case "size":
+			row[i] = a.Size
+		case "editions":
+			row[i] = strings.Join(a.Editions, listSeparator)
+		case "year":
+			row[i] = a.Year
+		case "state":
+			row[i] = strings.Join(a.State, listSeparator)
+		case "status":
+			row[i] = a.CurrentStatus()
+		case "sales_rep":
+			row[i] = a.SalesRep
+		case "currency":
+			if a.Price != nil {
+				row[i] = a.Price.Currency
+			}
+		case "total":
+			if a.Price != nil {
+				row[i] = strconv.FormatInt(a.Price.Total, 10)
+			}
+		case "version":
+			row[i] = strconv.Itoa(a.Version)
+		case "date_created":
+			row[i] = a.DateCreated.UTC().Format(time.RFC3339)
+		case "date_modified":
+			row[i] = a.DateModified.UTC().Format(time.RFC3339)
+		default:
+			parts := strings.SplitN(c, ".", 2)
+			contact, ok := ContactFor(a, contactPrefixes[parts[0]])
+			if !ok || len(parts) != 2 {
+				continue
+			}
+			switch parts[1] {
+			case "name":
+				row[i] = contact.Name
+			case "email":
+				row[i] = contact.Email
+			case "phone":
+				row[i] = contact.Phone
+			}
+		}
+	}
+	return row
+}
+
+// Export streams every advert matching the filter to fn one at a time so the
+// result set is never held in memory. It stops at the first error from fn.
+func Export(ctx context.Context, dbConn *db.DB, flt Filter, fn func(*Advert) error) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Export")
+	defer span.End()
+
+	q := flt.query()
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		iter := collection.Find(q).Sort("_id").Iter()
+
+		var a Advert
+		for iter.Next(&a) {
+			if err := fn(&a); err != nil {
+				iter.Close()
+				return err
+			}
+			a = Advert{}
+		}
+
+		return iter.Close()
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	return nil
+}
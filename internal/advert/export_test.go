@@ -0,0 +1,69 @@
+package advert
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/mattlaver/peeps/internal/platform/export"
+	"github.com/mattlaver/peeps/internal/platform/web"
+)
+
+// TestExportImportRoundTrip checks an advert exported as CSV imports again
+// with the same details, including contact phone numbers that start with a
+// character a spreadsheet treats as a formula.
+func TestExportImportRoundTrip(t *testing.T) {
+	a := Advert{
+		Advertiser: "Smith & Sons",
+		Size:       SizeHalf,
+		Editions:   []string{"Spring", "Summer"},
+		Year:       "2019",
+		State:      []string{"NSW"},
+		Contacts: []Contact{
+			{Role: ContactPrimary, Name: "Ann Smith", Email: "ann@smith.com", Phone: "+61 2 9999 9999"},
+			{Role: ContactBilling, Name: "=Accounts", Phone: "-02 9999 0000"},
+		},
+	}
+
+	var buf bytes.Buffer
+	w, err := export.NewWriter(export.CSV, &buf, Columns)
+	if err != nil {
+		t.Fatalf("NewWriter : %v", err)
+	}
+	if err := w.Write(Row(&a, Columns)); err != nil {
+		t.Fatalf("Write : %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close : %v", err)
+	}
+
+	next := csvRows(&buf)
+	rec, err := next()
+	if err != nil {
+		t.Fatalf("reading the exported row : %v", err)
+	}
+	if _, err := next(); err != io.EOF {
+		t.Fatalf("expected a single row, got error %v", err)
+	}
+
+	na, err := mapRow(rec, nil)
+	if err != nil {
+		t.Fatalf("mapRow : %v", err)
+	}
+	if err := web.Validate(na); err != nil {
+		t.Fatalf("Validate : %v", err)
+	}
+
+	want := NewAdvert{
+		Advertiser: a.Advertiser,
+		Size:       a.Size,
+		Contacts:   a.Contacts,
+		Editions:   a.Editions,
+		Year:       a.Year,
+		State:      a.State,
+	}
+	if !reflect.DeepEqual(*na, want) {
+		t.Errorf("imported advert\n got %+v\nwant %+v", *na, want)
+	}
+}
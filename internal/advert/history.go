@@ -0,0 +1,379 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/diff"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const revisionsCollection = "advert_revisions"
+
+// These are the expected values for Revision.Action.
+const (
+	ActionCreate     = "create"
+	ActionUpdate     = "update"
+	ActionDelete     = "delete"
+	ActionRevert     = "revert"
+	ActionTransition = "transition"
+)
+
+// ErrRevisionNotFound occurs when a requested revision does not exist.
+var ErrRevisionNotFound = errors.New("Revision not found")
+
+// recordRevision appends an immutable snapshot of the advert to its history.
+// The advert has already been written, so a revision that cannot be appended
+// straight away is queued in the outbox for a HistoryRecorder to append
+// later rather than failing the change. Only a revision that cannot be queued
+// either is reported as an error.
+func recordRevision(ctx context.Context, dbConn *db.DB, action, actor string, a *Advert, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.recordRevision")
+	defer span.End()
+
+	rev := Revision{
+		ID:       bson.NewObjectId(),
+		TenantID: a.TenantID,
+		AdvertID: a.ID,
+		Action:   action,
+		Actor:    actor,
+		Snapshot: *a,
+		Date:     now.Truncate(time.Millisecond),
+	}
+
+	err := appendRevision(ctx, dbConn, &rev)
+	if err == nil {
+		return nil
+	}
+	if qerr := queueRevision(ctx, dbConn, &rev); qerr != nil {
+		return errors.Wrapf(qerr, "queueing revision after %v", err)
+	}
+
+	return nil
+}
+
+// appendRevision inserts rev as the next revision of its advert. Revision
+// numbers are allocated from the highest existing number and are protected
+// by a unique index, so concurrent writers retry instead of sharing a number.
+// Appending a revision that is already in the history does nothing, so a
+// revision queued more than once is only appended once.
+func appendRevision(ctx context.Context, dbConn *db.DB, rev *Revision) error {
+	idx := mgo.Index{
+		Key:    []string{"advert_id", "number"},
+		Unique: true,
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(idx); err != nil {
+			return err
+		}
+
+		const attempts = 5
+		for i := 0; i < attempts; i++ {
+			var last Revision
+			err := collection.Find(bson.M{"advert_id": rev.AdvertID}).Sort("-number").One(&last)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+
+			rev.Number = last.Number + 1
+
+			err = collection.Insert(rev)
+			if !mgo.IsDup(err) {
+				return err
+			}
+			if n, err := collection.FindId(rev.ID).Count(); err != nil || n > 0 {
+				return err
+			}
+		}
+
+		return errors.Errorf("unable to allocate revision after %d attempts", attempts)
+	}
+	if err := dbConn.Execute(ctx, revisionsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.advert_revisions.insert(%s)", db.Query(rev)))
+	}
+
+	return nil
+}
+
+// queueRevision writes a revision to the outbox to be appended to the history
+// of its advert by a HistoryRecorder. It is numbered when it is appended, so
+// it follows any revision appended in the meantime.
+func queueRevision(ctx context.Context, dbConn *db.DB, rev *Revision) error {
+	raw, err := bson.Marshal(rev)
+	if err != nil {
+		return errors.Wrap(err, "encoding revision")
+	}
+	var data bson.M
+	if err := bson.Unmarshal(raw, &data); err != nil {
+		return errors.Wrap(err, "decoding revision")
+	}
+
+	ev := event.New(event.RevisionQueued, event.AggregateRevision, rev.ID, rev.Actor, rev.Date)
+	ev.TenantID = rev.TenantID
+	ev.Data = data
+
+	return event.Enqueue(ctx, dbConn, revisionsCollection, ev)
+}
+
+// HistoryRecorder appends the revisions queued by recordRevision as they are
+// delivered to it from the outbox.
+type HistoryRecorder struct {
+	MasterDB *db.DB
+}
+
+// Handle appends the revision carried by an event to the history of its
+// advert.
+func (r *HistoryRecorder) Handle(ctx context.Context, ev event.Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.HistoryRecorder.Handle")
+	defer span.End()
+
+	raw, err := bson.Marshal(ev.Data)
+	if err != nil {
+		return errors.Wrap(err, "encoding revision")
+	}
+	var rev Revision
+	if err := bson.Unmarshal(raw, &rev); err != nil {
+		return errors.Wrap(err, "decoding revision")
+	}
+
+	dbConn := r.MasterDB.Copy()
+	defer dbConn.Close()
+
+	return appendRevision(ctx, dbConn, &rev)
+}
+
+// History retrieves every revision of the specified advert, oldest first.
+func History(ctx context.Context, dbConn *db.DB, id string) ([]Revision, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.History")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"advert_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	revs := []Revision{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("number").All(&revs)
+	}
+	if err := dbConn.Execute(ctx, revisionsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_revisions.find(%s)", db.Query(q)))
+	}
+
+	if len(revs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return revs, nil
+}
+
+// RetrieveRevision gets a single revision of the specified advert.
+func RetrieveRevision(ctx context.Context, dbConn *db.DB, id string, number int) (*Revision, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.RetrieveRevision")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"advert_id": bson.ObjectIdHex(id), "number": number}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var rev *Revision
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&rev)
+	}
+	if err := dbConn.Execute(ctx, revisionsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrRevisionNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_revisions.find(%s)", db.Query(q)))
+	}
+
+	return rev, nil
+}
+
+// Revert restores the specified advert to the snapshot held in a revision.
+// Reverting to a revision taken before a delete restores the advert. The
+// snapshot is checked and priced like a replacement, and the write only
+// succeeds if version is still the current version of the advert, or of the
+// advert when it was deleted. The revert is itself recorded as a new revision.
+func Revert(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, number, version int, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Revert")
+	defer span.End()
+
+	rev, err := RetrieveRevision(ctx, dbConn, id, number)
+	if err != nil {
+		return nil, err
+	}
+
+	// The advert as it is now, or nil if it has been deleted. It keeps its
+	// status through the revert, and a restored advert takes the status of
+	// the snapshot.
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	version, err = checkRevertVersion(ctx, dbConn, id, cur, version)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+	s := rev.Snapshot
+
+	if err := checkContacts(s.Contacts); err != nil {
+		return nil, err
+	}
+	price, err := checkBooking(ctx, dbConn, s.Size, s.Year, s.Editions, s.State)
+	if err != nil {
+		return nil, err
+	}
+
+	status := s.CurrentStatus()
+	if cur != nil {
+		status = cur.CurrentStatus()
+	}
+	if status != StatusCancelled {
+		if err := reserve(ctx, dbConn, rev.AdvertID, s.Size, s.Year, s.Editions, cur); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := bson.M{
+		"advertiser":    s.Advertiser,
+		"size":          s.Size,
+		"editions":      s.Editions,
+		"year":          s.Year,
+		"state":         s.State,
+		"contacts":      s.Contacts,
+		"price":         price,
+		"date_created":  s.DateCreated,
+		"date_modified": now,
+	}
+
+	if s.AdvertiserID.Valid() {
+		fields["advertiser_id"] = s.AdvertiserID
+	}
+
+	// Reverting restores the content of the advert but not its status, which
+	// only moves through Transition. An advert restored after being deleted
+	// comes back with the status it had.
+	onInsert := bson.M{"status": s.CurrentStatus()}
+	if len(s.StatusHistory) > 0 {
+		onInsert["status_history"] = s.StatusHistory
+	}
+	if s.RenewedFrom != nil {
+		onInsert["renewed_from"] = s.RenewedFrom
+	}
+	if s.SalesRep != "" {
+		onInsert["sales_rep"] = s.SalesRep
+	}
+	if rev.TenantID.Valid() {
+		onInsert["tenant_id"] = rev.TenantID
+	}
+
+	name := event.AdvertUpdated
+	if cur == nil {
+		name = event.AdvertCreated
+	}
+
+	// A restored advert carries on from the version it was deleted at, which
+	// checkRevertVersion has matched, so versions it already handed out as
+	// ETags are never reused.
+	m := bson.M{"$set": fields, "$setOnInsert": onInsert}
+	if cur == nil {
+		onInsert["version"] = version + 1
+	} else {
+		m["$inc"] = bson.M{"version": 1}
+	}
+	event.Push(m, event.New(name, event.AggregateAdvert, rev.AdvertID, claims.Subject, now))
+
+	// An advert that still exists is updated at the version that was checked.
+	// A deleted one is inserted again, which fails if another request
+	// restored it first.
+	q := bson.M{"_id": rev.AdvertID, "version": versionQuery(version)}
+	if cur == nil {
+		q["version"] = bson.M{"$exists": false}
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var a Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, Upsert: cur == nil, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if rerr := settle(ctx, dbConn, rev.AdvertID, cur); rerr != nil {
+			return nil, rerr
+		}
+		switch {
+		case err == mgo.ErrNotFound:
+			return nil, versionError(ctx, dbConn, rev.AdvertID)
+		case mgo.IsDup(err):
+			if verr := versionError(ctx, dbConn, rev.AdvertID); verr != ErrNotFound {
+				return nil, ErrVersionConflict
+			}
+			return nil, ErrAlreadyRenewed
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.upsert(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	if err := settle(ctx, dbConn, a.ID, &a); err != nil {
+		return nil, err
+	}
+
+	if err := recordRevision(ctx, dbConn, ActionRevert, claims.Subject, &a, now); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// checkRevertVersion makes sure version names the advert being reverted: its
+// current version, or the version it had when it was deleted. It returns the
+// version the revert carries on from, which is the version the advert was
+// deleted at when version is web.AnyVersion.
+func checkRevertVersion(ctx context.Context, dbConn *db.DB, id string, cur *Advert, version int) (int, error) {
+	if cur != nil {
+		if !web.VersionMatches(version, cur.Version) {
+			return 0, ErrVersionConflict
+		}
+		return version, nil
+	}
+
+	revs, err := History(ctx, dbConn, id)
+	if err != nil {
+		return 0, err
+	}
+	last := revs[len(revs)-1]
+	if last.Action != ActionDelete || !web.VersionMatches(version, last.Snapshot.Version) {
+		return 0, ErrVersionConflict
+	}
+
+	return last.Snapshot.Version, nil
+}
+
+// Diff compares the snapshots of two revisions and reports every field that
+// differs. Nested documents are compared field by field using dotted names.
+func Diff(from, to *Revision) ([]diff.Change, error) {
+	return diff.Compare(from.Snapshot, to.Snapshot)
+}
@@ -0,0 +1,711 @@
+package advert
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/export"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/ratecard"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the supported import formats.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// defaultBatchSize is how many adverts are inserted per write when importing.
+const defaultBatchSize = 100
+
+// importFields are the advert fields a source column can be mapped to.
+var importFields = map[string]bool{
+	"advertiser_id": true,
+	"advertiser":    true,
+	"size":          true,
+	"editions":      true,
+	"year":          true,
+	"state":         true,
+	"contact.name":  true,
+	"contact.email": true,
+	"contact.phone": true,
+	"billing.name":  true,
+	"billing.email": true,
+	"billing.phone": true,
+	"artwork.name":  true,
+	"artwork.email": true,
+	"artwork.phone": true,
+}
+
+// contactPrefixes maps the prefix of a contact column to the contact role it
+// describes. The primary contact uses the plain contact prefix.
+var contactPrefixes = map[string]string{
+	"contact": ContactPrimary,
+	"billing": ContactBilling,
+	"artwork": ContactArtwork,
+}
+
+// listSeparator splits multi valued fields such as editions in a CSV cell.
+const listSeparator = ";"
+
+// ErrUnknownFormat occurs when an import names a format that is not supported.
+var ErrUnknownFormat = errors.New("Unknown import format")
+
+// errDuplicate is reported for a row that looks like an existing booking.
+var errDuplicate = errors.New("Advert looks like a duplicate of an existing booking")
+
+// Mapping maps the column names of an import source to advert fields.
+type Mapping map[string]string
+
+// ParseMapping reads a mapping in the form "Column=field,Other Column=field".
+// An empty string gives an empty mapping, meaning columns are already named
+// after the advert fields.
+func ParseMapping(s string) (Mapping, error) {
+	m := make(Mapping)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("mapping %q must be in the form column=field", pair)
+		}
+
+		col, field := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !importFields[field] {
+			return nil, errors.Errorf("mapping %q names unknown field %q", pair, field)
+		}
+		m[col] = field
+	}
+
+	return m, nil
+}
+
+// field returns the advert field a column maps to, if any.
+func (m Mapping) field(col string) (string, bool) {
+	if len(m) == 0 {
+		return col, importFields[col]
+	}
+	f, ok := m[col]
+	return f, ok
+}
+
+// ImportOptions controls how an import is performed.
+type ImportOptions struct {
+	Format          string
+	Mapping         Mapping
+	DryRun          bool
+	AllowDuplicates bool // Import rows that look like existing bookings.
+	BatchSize       int
+}
+
+// RowError reports why a row of an import was rejected. Rows are numbered from
+// 1 and do not count a CSV header.
+type RowError struct {
+	Row        int              `json:"row"`
+	Error      string           `json:"error"`
+	Fields     []web.FieldError `json:"fields,omitempty"`
+	Duplicates []Suspect        `json:"duplicates,omitempty"`
+}
+
+// ImportReport describes the outcome of an import.
+type ImportReport struct {
+	DryRun   bool       `json:"dry_run"`
+	Rows     int        `json:"rows"`
+	Valid    int        `json:"valid"`
+	Inserted int        `json:"inserted"`
+	Created  []string   `json:"created,omitempty"` // IDs of the inserted adverts.
+	Errors   []RowError `json:"errors"`
+}
+
+// Import reads adverts from r in the requested format, validates every row
+// against the rules for NewAdvert and inserts the valid rows in batches. The
+// report lists each rejected row. Rows that look like existing bookings, or
+// like a row before them, are rejected unless duplicates are allowed. In dry-run mode nothing is written,
+// and rows are checked against the slots that are free without taking them.
+func Import(ctx context.Context, claims auth.Claims, dbConn *db.DB, r io.Reader, opts ImportOptions, now time.Time) (_ *ImportReport, err error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Import")
+	defer span.End()
+
+	var next func() (map[string]interface{}, error)
+	switch opts.Format {
+	case FormatCSV:
+		next = csvRows(r)
+	case FormatNDJSON:
+		next = ndjsonRows(r)
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+	rep := ImportReport{
+		DryRun: opts.DryRun,
+		Errors: []RowError{},
+	}
+
+	free := make(freeSlots)
+	accepted := make(importedBookings)
+
+	// Rows waiting in the batch hold slots. However the import ends, those
+	// of rows that never reach the adverts collection are given back.
+	var batch []Advert
+	defer func() {
+		if rerr := releaseBatch(ctx, dbConn, batch); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		rep.Rows++
+
+		if err != nil {
+			if _, ok := err.(rowError); !ok {
+				return nil, err
+			}
+			rep.Errors = append(rep.Errors, RowError{Row: rep.Rows, Error: err.Error()})
+			continue
+		}
+
+		na, err := mapRow(rec, opts.Mapping)
+		if err == nil {
+			err = web.Validate(na)
+		}
+		if err == nil {
+			err = checkContacts(na.Contacts)
+		}
+		if err == nil {
+			err = requireAdvertiser(na.AdvertiserID, na.Advertiser)
+		}
+		var price *ratecard.Price
+		if err == nil {
+			price, err = checkBooking(ctx, dbConn, na.Size, na.Year, na.Editions, na.State)
+			if _, ok := err.(*web.Error); err != nil && !ok {
+				return &rep, err
+			}
+		}
+		if err != nil {
+			rep.Errors = append(rep.Errors, newRowError(rep.Rows, err))
+			continue
+		}
+
+		if !opts.AllowDuplicates {
+			suspects, err := Duplicates(ctx, dbConn, na, "")
+			if err != nil {
+				return &rep, err
+			}
+			if len(suspects) > 0 {
+				rep.Errors = append(rep.Errors, RowError{Row: rep.Rows, Error: errDuplicate.Error(), Duplicates: suspects})
+				continue
+			}
+
+			// Rows accepted earlier are not stored yet, or ever in a dry run.
+			if row, ok := accepted.find(na); ok {
+				rep.Errors = append(rep.Errors, RowError{Row: rep.Rows, Error: fmt.Sprintf("Advert looks like a duplicate of row %d", row)})
+				continue
+			}
+		}
+
+		if opts.DryRun {
+			if err := free.take(ctx, dbConn, na.Size, na.Year, na.Editions); err != nil {
+				if err != edition.ErrFull {
+					return &rep, err
+				}
+				rep.Errors = append(rep.Errors, newRowError(rep.Rows, err))
+				continue
+			}
+			accepted.add(na, rep.Rows)
+			rep.Valid++
+			continue
+		}
+
+		// Advertisers are only looked up, and created if need be, when the
+		// import is for real.
+		adv, err := resolveAdvertiser(ctx, dbConn, na.AdvertiserID, na.Advertiser, now)
+		if err != nil {
+			if _, ok := err.(*web.Error); !ok {
+				return &rep, err
+			}
+			rep.Errors = append(rep.Errors, newRowError(rep.Rows, err))
+			continue
+		}
+
+		id := bson.NewObjectId()
+		if err := reserve(ctx, dbConn, id, na.Size, na.Year, na.Editions, nil); err != nil {
+			if err != edition.ErrFull {
+				return &rep, err
+			}
+			rep.Errors = append(rep.Errors, newRowError(rep.Rows, err))
+			continue
+		}
+		accepted.add(na, rep.Rows)
+		rep.Valid++
+
+		batch = append(batch, Advert{
+			ID:           id,
+			TenantID:     tid,
+			AdvertiserID: adv.ID,
+			Advertiser:   adv.Name,
+			Size:         na.Size,
+			Contacts:     na.Contacts,
+			Editions:     na.Editions,
+			Year:         na.Year,
+			State:        na.State,
+			Price:        price,
+			Status:       StatusProspect,
+			SalesRep:     claims.Subject,
+			Version:      1,
+			DateCreated:  now,
+			DateModified: now,
+		})
+
+		if len(batch) == opts.BatchSize {
+			stored, err := insertBatch(ctx, claims, dbConn, batch, now)
+			rep.inserted(stored)
+			batch = nil
+			if err != nil {
+				return &rep, err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		stored, err := insertBatch(ctx, claims, dbConn, batch, now)
+		rep.inserted(stored)
+		batch = nil
+		if err != nil {
+			return &rep, err
+		}
+	}
+
+	return &rep, nil
+}
+
+// bookingKey names a booking of an advertiser into an edition.
+type bookingKey struct {
+	advertiser, year, edition string
+}
+
+// importedBookings remembers the row that booked each advertiser into an
+// edition, so a file that books the same advert twice is caught. Advertisers
+// are known by ID when the row gives one and by normalised name otherwise.
+type importedBookings map[bookingKey]int
+
+// keys returns the bookings a row makes.
+func (ib importedBookings) keys(na *NewAdvert) []bookingKey {
+	adv := na.AdvertiserID
+	if adv == "" {
+		adv = advertiser.Normalize(na.Advertiser)
+	}
+
+	keys := make([]bookingKey, len(na.Editions))
+	for i, name := range na.Editions {
+		keys[i] = bookingKey{adv, na.Year, name}
+	}
+	return keys
+}
+
+// find returns the earlier row that made one of the bookings of na.
+func (ib importedBookings) find(na *NewAdvert) (int, bool) {
+	for _, k := range ib.keys(na) {
+		if row, ok := ib[k]; ok {
+			return row, true
+		}
+	}
+	return 0, false
+}
+
+// add remembers the bookings made by a row.
+func (ib importedBookings) add(na *NewAdvert, row int) {
+	for _, k := range ib.keys(na) {
+		ib[k] = row
+	}
+}
+
+// slotKey names the slots of a size in an edition.
+type slotKey struct {
+	year, name, size string
+}
+
+// freeSlots counts the slots a dry run still finds free, so rows that would
+// not fit are reported without reserving anything. Editions with no planned
+// layout take any number of bookings and are counted as -1.
+type freeSlots map[slotKey]int
+
+// take claims a slot of size in each edition of year for a row. It returns
+// edition.ErrFull, claiming nothing, if one of them has none left.
+func (fs freeSlots) take(ctx context.Context, dbConn *db.DB, size, year string, editions []string) error {
+	var unseen []string
+	for _, name := range editions {
+		if _, ok := fs[slotKey{year, name, size}]; !ok {
+			unseen = append(unseen, name)
+		}
+	}
+	if len(unseen) > 0 {
+		found, err := edition.Lookup(ctx, dbConn, year, unseen)
+		if err != nil {
+			return err
+		}
+		for _, name := range unseen {
+			n := -1
+			if e, ok := found[name]; ok && len(e.Slots) > 0 {
+				n = 0
+				for _, c := range e.Capacity() {
+					if c.Size == size {
+						n = c.Free
+					}
+				}
+			}
+			fs[slotKey{year, name, size}] = n
+		}
+	}
+
+	for _, name := range editions {
+		if fs[slotKey{year, name, size}] == 0 {
+			return edition.ErrFull
+		}
+	}
+	for _, name := range editions {
+		if k := (slotKey{year, name, size}); fs[k] > 0 {
+			fs[k]--
+		}
+	}
+	return nil
+}
+
+// inserted counts a batch of adverts written by the import.
+func (rep *ImportReport) inserted(batch []Advert) {
+	rep.Inserted += len(batch)
+	for i := range batch {
+		rep.Created = append(rep.Created, batch[i].ID.Hex())
+	}
+}
+
+// newRowError reports a rejected row, listing the offending fields when the
+// error came from validation.
+func newRowError(row int, err error) RowError {
+	re := RowError{Row: row, Error: err.Error()}
+	if werr, ok := err.(*web.Error); ok {
+		re.Fields = werr.Fields
+	}
+	return re
+}
+
+// insertBatch writes a batch of imported adverts and records their history.
+// It returns the adverts that were stored. When the insert fails partway
+// that is only some of them, and the rest give back their slots. The batch
+// is dealt with either way, so its slots need not be released again.
+func insertBatch(ctx context.Context, claims auth.Claims, dbConn *db.DB, batch []Advert, now time.Time) ([]Advert, error) {
+	docs := make([]interface{}, len(batch))
+	for i := range batch {
+		doc, err := event.Attach(&batch[i], event.New(event.AdvertCreated, event.AggregateAdvert, batch[i].ID, claims.Subject, now))
+		if err != nil {
+			if rerr := releaseBatch(ctx, dbConn, batch); rerr != nil {
+				return nil, rerr
+			}
+			return nil, err
+		}
+		docs[i] = doc
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Insert(docs...)
+	}
+	stored := batch
+	ierr := dbConn.Execute(ctx, advertsCollection, f)
+	if ierr != nil {
+		var err error
+		if stored, err = reconcileBatch(ctx, dbConn, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range stored {
+		if err := recordRevision(ctx, dbConn, ActionCreate, claims.Subject, &stored[i], now); err != nil {
+			return stored, err
+		}
+	}
+
+	if ierr != nil {
+		return stored, errors.Wrap(ierr, fmt.Sprintf("db.adverts.insert(%d adverts)", len(docs)))
+	}
+	return stored, nil
+}
+
+// releaseBatch gives back the slots reserved for a batch of adverts that was
+// never inserted.
+func releaseBatch(ctx context.Context, dbConn *db.DB, batch []Advert) error {
+	for i := range batch {
+		if err := settle(ctx, dbConn, batch[i].ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileBatch works out which adverts of a batch that failed to insert
+// were stored and gives back the slots of the rest. The insert stops at the
+// first failure, so adverts that made it in keep theirs.
+func reconcileBatch(ctx context.Context, dbConn *db.DB, batch []Advert) ([]Advert, error) {
+	ids := make([]bson.ObjectId, len(batch))
+	for i := range batch {
+		ids[i] = batch[i].ID
+	}
+	q := bson.M{"_id": bson.M{"$in": ids}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var found []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Select(bson.M{"_id": 1}).All(&found)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	in := make(map[bson.ObjectId]bool, len(found))
+	for _, s := range found {
+		in[s.ID] = true
+	}
+
+	var stored, lost []Advert
+	for i := range batch {
+		if in[batch[i].ID] {
+			stored = append(stored, batch[i])
+		} else {
+			lost = append(lost, batch[i])
+		}
+	}
+	if err := releaseBatch(ctx, dbConn, lost); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// rowError marks a problem with a single row that does not stop the import.
+type rowError string
+
+func (e rowError) Error() string {
+	return string(e)
+}
+
+// csvRows returns a function that reads records from CSV data. The first row
+// must hold the column names. Cells an export escaped against formula
+// injection are unescaped so exported adverts import unchanged.
+func csvRows(r io.Reader) func() (map[string]interface{}, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var header []string
+	return func() (map[string]interface{}, error) {
+		if header == nil {
+			h, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			header = h
+		}
+
+		row, err := cr.Read()
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				return nil, rowError(perr.Error())
+			}
+			return nil, err
+		}
+
+		rec := make(map[string]interface{}, len(header))
+		for i, col := range header {
+			if i < len(row) {
+				rec[col] = export.UnescapeFormula(row[i])
+			}
+		}
+		return rec, nil
+	}
+}
+
+// ndjsonRows returns a function that reads one JSON object per line. Blank
+// lines are skipped.
+func ndjsonRows(r io.Reader) func() (map[string]interface{}, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+
+	return func() (map[string]interface{}, error) {
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				return nil, rowError(err.Error())
+			}
+			return rec, nil
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// mapRow converts a source record into a NewAdvert using the mapping.
+func mapRow(rec map[string]interface{}, m Mapping) (*NewAdvert, error) {
+	var na NewAdvert
+	contacts := make(map[string]*Contact)
+
+	// Visit columns in a stable order so errors are reported consistently.
+	cols := make([]string, 0, len(rec))
+	for col := range rec {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	for _, col := range cols {
+		field, ok := m.field(col)
+		if !ok {
+			continue
+		}
+
+		switch field {
+		case "editions", "state":
+			list, err := toList(rec[col])
+			if err != nil {
+				return nil, errors.Wrapf(err, "column %q", col)
+			}
+			if field == "editions" {
+				na.Editions = list
+			} else {
+				na.State = list
+			}
+			continue
+		}
+
+		s, err := toString(rec[col])
+		if err != nil {
+			return nil, errors.Wrapf(err, "column %q", col)
+		}
+
+		switch field {
+		case "advertiser_id":
+			na.AdvertiserID = s
+		case "advertiser":
+			na.Advertiser = s
+		case "size":
+			na.Size = s
+		case "year":
+			na.Year = s
+		default:
+			parts := strings.SplitN(field, ".", 2)
+			role := contactPrefixes[parts[0]]
+			if s == "" {
+				continue
+			}
+
+			c, ok := contacts[role]
+			if !ok {
+				c = &Contact{Role: role}
+				contacts[role] = c
+			}
+			switch parts[1] {
+			case "name":
+				c.Name = s
+			case "email":
+				c.Email = s
+			case "phone":
+				c.Phone = s
+			}
+		}
+	}
+
+	// Keep contacts in role order so the stored advert is predictable.
+	for _, role := range []string{ContactPrimary, ContactBilling, ContactArtwork} {
+		if c, ok := contacts[role]; ok {
+			na.Contacts = append(na.Contacts, *c)
+		}
+	}
+
+	return &na, nil
+}
+
+// toString converts a decoded cell into a string.
+func toString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(t), nil
+	case float64, bool:
+		return fmt.Sprint(t), nil
+	}
+	return "", errors.Errorf("expected a string but got %T", v)
+}
+
+// toList converts a decoded cell into a list of strings. Strings are split on
+// the list separator and JSON arrays are used as they are.
+func toList(v interface{}) ([]string, error) {
+	if arr, ok := v.([]interface{}); ok {
+		out := make([]string, 0, len(arr))
+		for _, item := range arr {
+			s, err := toString(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+
+	s, err := toString(v)
+	if err != nil {
+		return nil, err
+	}
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, listSeparator)
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
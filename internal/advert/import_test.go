@@ -0,0 +1,193 @@
+package advert
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseMapping checks column mappings are read and checked against the
+// advert fields.
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mapping // Nil when the mapping should be refused.
+	}{
+		{"", Mapping{}},
+		{"  ", Mapping{}},
+		{"Client=advertiser", Mapping{"Client": "advertiser"}},
+		{"Client = advertiser , Runs In=editions", Mapping{"Client": "advertiser", "Runs In": "editions"}},
+		{"Phone=contact.phone,Accounts=billing.email", Mapping{"Phone": "contact.phone", "Accounts": "billing.email"}},
+		{"Client", nil},
+		{"Client=price", nil},
+		{"Client=advertiser,", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMapping(tt.spec)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("ParseMapping(%q) = %v, want an error", tt.spec, got)
+		case tt.want != nil && err != nil:
+			t.Errorf("ParseMapping(%q) : %v", tt.spec, err)
+		case tt.want != nil && !reflect.DeepEqual(got, tt.want):
+			t.Errorf("ParseMapping(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// TestMapRow checks CSV and NDJSON rows are mapped to the fields of a new
+// advert.
+func TestMapRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		source  string
+		mapping string
+		want    NewAdvert
+	}{
+		{
+			name:   "csv named after fields",
+			format: FormatCSV,
+			source: "advertiser,size,editions,year,state,contact.name,contact.phone,notes\n" +
+				"Smith & Sons, half,Spring;Summer,2026,NSW;VIC,Jo Smith,'+61 2 9999 9999,ignored\n",
+			want: NewAdvert{
+				Advertiser: "Smith & Sons",
+				Size:       SizeHalf,
+				Editions:   []string{"Spring", "Summer"},
+				Year:       "2026",
+				State:      []string{"NSW", "VIC"},
+				Contacts:   []Contact{{Role: ContactPrimary, Name: "Jo Smith", Phone: "+61 2 9999 9999"}},
+			},
+		},
+		{
+			name:    "csv mapped",
+			format:  FormatCSV,
+			source:  "Client,Ad,Runs In,Accounts,Artwork By,Year\nAcme,full,Spring,ap@acme.test,,2027\n",
+			mapping: "Client=advertiser,Ad=size,Runs In=editions,Accounts=billing.email,Artwork By=artwork.name,Year=year",
+			want: NewAdvert{
+				Advertiser: "Acme",
+				Size:       SizeFull,
+				Editions:   []string{"Spring"},
+				Year:       "2027",
+				Contacts:   []Contact{{Role: ContactBilling, Email: "ap@acme.test"}},
+			},
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			source: "\n" + `{"advertiser_id":"5cf37266e2b7aa0001000001","size":"quarter","editions":["Spring"," Winter "],"year":2026,"state":"QLD","artwork.email":"art@acme.test","contact.email":"jo@acme.test"}` + "\n",
+			want: NewAdvert{
+				AdvertiserID: "5cf37266e2b7aa0001000001",
+				Size:         SizeQuarter,
+				Editions:     []string{"Spring", "Winter"},
+				Year:         "2026",
+				State:        []string{"QLD"},
+				Contacts: []Contact{
+					{Role: ContactPrimary, Email: "jo@acme.test"},
+					{Role: ContactArtwork, Email: "art@acme.test"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMapping(tt.mapping)
+			if err != nil {
+				t.Fatalf("ParseMapping : %v", err)
+			}
+
+			next := csvRows(strings.NewReader(tt.source))
+			if tt.format == FormatNDJSON {
+				next = ndjsonRows(strings.NewReader(tt.source))
+			}
+
+			rec, err := next()
+			if err != nil {
+				t.Fatalf("reading row : %v", err)
+			}
+			if _, err := next(); err != io.EOF {
+				t.Fatalf("reading past the row : got %v, want %v", err, io.EOF)
+			}
+
+			got, err := mapRow(rec, m)
+			if err != nil {
+				t.Fatalf("mapRow : %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Fatalf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMapRowInvalid checks cells of the wrong type are reported against
+// their column.
+func TestMapRowInvalid(t *testing.T) {
+	tests := []struct {
+		rec map[string]interface{}
+		col string
+	}{
+		{map[string]interface{}{"advertiser": map[string]interface{}{"name": "Acme"}}, "advertiser"},
+		{map[string]interface{}{"editions": []interface{}{"Spring", []interface{}{}}}, "editions"},
+		{map[string]interface{}{"contact.phone": []interface{}{"1"}}, "contact.phone"},
+	}
+
+	for _, tt := range tests {
+		_, err := mapRow(tt.rec, Mapping{})
+		if err == nil || !strings.Contains(err.Error(), `"`+tt.col+`"`) {
+			t.Errorf("mapRow(%v) = %v, want an error naming column %q", tt.rec, err, tt.col)
+		}
+	}
+}
+
+// TestRowsMalformed checks a row that cannot be read is reported as a row
+// error so the rest of the import carries on.
+func TestRowsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		next func() (map[string]interface{}, error)
+	}{
+		{"csv", csvRows(strings.NewReader("advertiser,size\n\"Acme,half\n"))},
+		{"ndjson", ndjsonRows(strings.NewReader("{\"advertiser\":\n"))},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.next(); err == nil {
+			t.Errorf("%s : read a malformed row", tt.name)
+		} else if _, ok := err.(rowError); !ok {
+			t.Errorf("%s : got %T %v, want a rowError", tt.name, err, err)
+		}
+	}
+}
+
+// TestImportedBookings checks a row booking an advertiser into an edition an
+// earlier row booked them into is caught.
+func TestImportedBookings(t *testing.T) {
+	ib := make(importedBookings)
+	ib.add(&NewAdvert{Advertiser: "Smith & Sons Pty Ltd", Year: "2026", Editions: []string{"Spring", "Summer"}}, 1)
+	ib.add(&NewAdvert{AdvertiserID: "5cf37266e2b7aa0001000001", Year: "2026", Editions: []string{"Winter"}}, 2)
+
+	tests := []struct {
+		name string
+		na   NewAdvert
+		row  int // 0 when the row is not a duplicate.
+	}{
+		{"same booking", NewAdvert{Advertiser: "Smith & Sons Pty Ltd", Year: "2026", Editions: []string{"Spring", "Summer"}}, 1},
+		{"one edition shared", NewAdvert{Advertiser: "Smith & Sons Pty Ltd", Year: "2026", Editions: []string{"Autumn", "Summer"}}, 1},
+		{"name written differently", NewAdvert{Advertiser: "  smith and sons ", Year: "2026", Editions: []string{"Spring"}}, 1},
+		{"same advertiser ID", NewAdvert{AdvertiserID: "5cf37266e2b7aa0001000001", Year: "2026", Editions: []string{"Winter"}}, 2},
+		{"other edition", NewAdvert{Advertiser: "Smith & Sons Pty Ltd", Year: "2026", Editions: []string{"Autumn"}}, 0},
+		{"other year", NewAdvert{Advertiser: "Smith & Sons Pty Ltd", Year: "2027", Editions: []string{"Spring"}}, 0},
+		{"other advertiser", NewAdvert{Advertiser: "Acme", Year: "2026", Editions: []string{"Spring"}}, 0},
+	}
+
+	for _, tt := range tests {
+		row, ok := ib.find(&tt.na)
+		if ok != (tt.row != 0) || row != tt.row {
+			t.Errorf("%s : got row %d, %v, want row %d", tt.name, row, ok, tt.row)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Spellings counts the adverts booked under each distinct advertiser name.
+// It is used to migrate adverts from free text names to advertisers.
+func Spellings(ctx context.Context, dbConn *db.DB) ([]advertiser.Spelling, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Spellings")
+	defer span.End()
+
+	match, err := tenant.Match(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := []bson.M{
+		match,
+		{"$group": bson.M{"_id": "$advertiser", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+
+	s := []advertiser.Spelling{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Pipe(pipeline).All(&s)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.aggregate(%s)", db.Query(pipeline)))
+	}
+
+	return s, nil
+}
+
+// LinkAdvertiser points every advert booked under one of the spellings at the
+// advertiser and gives it the advertiser's canonical name. It returns how many
+// adverts were changed.
+func LinkAdvertiser(ctx context.Context, claims auth.Claims, dbConn *db.DB, spellings []string, adv *advertiser.Advertiser, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.LinkAdvertiser")
+	defer span.End()
+
+	now = now.Truncate(time.Millisecond)
+
+	// Adverts already linked with the canonical name are left alone so the
+	// migration can be run again without recording empty revisions.
+	q := bson.M{
+		"advertiser": bson.M{"$in": spellings},
+		"$or": []bson.M{
+			{"advertiser_id": bson.M{"$ne": adv.ID}},
+			{"advertiser": bson.M{"$ne": adv.Name}},
+		},
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return 0, err
+	}
+
+	var ids []bson.ObjectId
+	f := func(collection *mgo.Collection) error {
+		var docs []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		if err := collection.Find(q).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+			return err
+		}
+		for _, d := range docs {
+			ids = append(ids, d.ID)
+		}
+		return nil
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	set := bson.M{
+		"advertiser_id": adv.ID,
+		"advertiser":    adv.Name,
+		"date_modified": now,
+	}
+
+	var n int
+	for _, id := range ids {
+		m := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+		event.Push(m, event.New(event.AdvertUpdated, event.AggregateAdvert, id, claims.Subject, now))
+
+		var a Advert
+		f := func(collection *mgo.Collection) error {
+			_, err := collection.FindId(id).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+			return err
+		}
+		if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+			if err == mgo.ErrNotFound {
+
+				// Deleted since we looked for it.
+				continue
+			}
+			return n, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(bson.M{"_id": id}), db.Query(m)))
+		}
+
+		if err := recordRevision(ctx, dbConn, ActionUpdate, claims.Subject, &a, now); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -3,35 +3,136 @@ package advert
 import (
 	"time"
 
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/platform/diff"
+	"github.com/mattlaver/peeps/internal/ratecard"
 	"gopkg.in/mgo.v2/bson"
 )
 
-type ContactDetails struct {
-	Name string		`bson:"name" json:"name"`
-	Email string	`bson:"email" json:"email"`
-	Phone string	`bson:"phone" json:"phone"`
+// These are the sizes an advert can be booked at.
+const (
+	SizeEighth  = "eighth"
+	SizeQuarter = "quarter"
+	SizeHalf    = "half"
+	SizeFull    = "full"
+	SizeSpread  = "spread"
+)
+
+// These are the roles a Contact can hold on an advert. An advert has at most
+// one contact per role.
+const (
+	ContactPrimary = "primary"
+	ContactBilling = "billing"
+	ContactArtwork = "artwork"
+)
+
+// Contact is someone to deal with about an advert.
+type Contact struct {
+	Role  string `bson:"role" json:"role" validate:"required,oneof=primary billing artwork"`
+	Name  string `bson:"name" json:"name" validate:"required"`
+	Email string `bson:"email" json:"email" validate:"omitempty,email"`
+	Phone string `bson:"phone" json:"phone" validate:"omitempty,phone"`
+}
+
+// NewContact is what we require from clients when setting the contact for a
+// role on an existing Advert. The role comes from the URL.
+type NewContact struct {
+	Name  string `json:"name" validate:"required"`
+	Email string `json:"email" validate:"omitempty,email"`
+	Phone string `json:"phone" validate:"omitempty,phone"`
 }
 
 // Advert is .
 type Advert struct {
-	ID           bson.ObjectId `bson:"_id" json:"id"`                      // Unique identifier
-	Advertiser   string        `bson:"advertiser" json:"advertiser"`       // Display name of the product.
-	Size     	 string        `bson:"size" json:"size"`                   // Size of advertisement.
-	Editions     []string      `bson:"editions" json:"editions"`           // Editions that the advertisement is printed
-	Year         string        `bson:"year" json:"year"`                  // Year
-	State        []string      `bson:"state" json:"state"`				   // State
-	Contact		 ContactDetails	`bson:"contact" json:"contact"`				// Contact
-	DateCreated  time.Time     `bson:"date_created" json:"date_created"`   // When the product was added.
-	DateModified time.Time     `bson:"date_modified" json:"date_modified"` // When the product record was lost modified.
-}
-
-// NewAdvert is what we require from clients when adding a Advert.
+	ID            bson.ObjectId   `bson:"_id" json:"id"`                                            // Unique identifier
+	TenantID      bson.ObjectId   `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`           // Tenant the advert is booked with.
+	AdvertiserID  bson.ObjectId   `bson:"advertiser_id,omitempty" json:"advertiser_id,omitempty"`   // Advertiser the advert is booked for.
+	Advertiser    string          `bson:"advertiser" json:"advertiser"`                             // Canonical name of the advertiser.
+	Size          string          `bson:"size" json:"size"`                                         // Size of advertisement.
+	Editions      []string        `bson:"editions" json:"editions"`                                 // Editions that the advertisement is printed
+	Year          string          `bson:"year" json:"year"`                                         // Year
+	State         []string        `bson:"state" json:"state"`                                       // State
+	Contacts      []Contact       `bson:"contacts" json:"contacts"`                                 // Contacts, at most one per role.
+	Price         *ratecard.Price `bson:"price,omitempty" json:"price,omitempty"`                   // Price worked out from the rate card when booked.
+	Status        string          `bson:"status" json:"status"`                                     // One of the Status constants.
+	StatusHistory []StatusChange  `bson:"status_history,omitempty" json:"status_history,omitempty"` // Every change of status, oldest first.
+	Attachments   []Attachment    `bson:"attachments,omitempty" json:"attachments,omitempty"`       // Artwork and proofs.
+	RenewedFrom   *bson.ObjectId  `bson:"renewed_from,omitempty" json:"renewed_from,omitempty"`     // Booking from an earlier year this advert renews.
+	SalesRep      string          `bson:"sales_rep,omitempty" json:"sales_rep,omitempty"`           // User who made the booking.
+	Version       int             `bson:"version" json:"version"`                                   // Incremented on every write.
+	DateCreated   time.Time       `bson:"date_created" json:"date_created"`                         // When the product was added.
+	DateModified  time.Time       `bson:"date_modified" json:"date_modified"`                       // When the product record was lost modified.
+}
+
+// ScoredAdvert is an advert found by a text search with its relevance.
+// Higher scores are better matches.
+type ScoredAdvert struct {
+	Advert `bson:",inline"`
+	Score  float64 `bson:"score" json:"score"`
+}
+
+// StatusChange records who moved an advert between statuses and when.
+type StatusChange struct {
+	From  string    `bson:"from" json:"from"`
+	To    string    `bson:"to" json:"to"`
+	Note  string    `bson:"note,omitempty" json:"note,omitempty"`
+	Actor string    `bson:"actor" json:"actor"`
+	Date  time.Time `bson:"date" json:"date"`
+}
+
+// These are the kinds of file that can be attached to an advert.
+const (
+	AttachmentArtwork = "artwork"
+	AttachmentProof   = "proof"
+)
+
+// Attachment describes a file attached to an advert. The file itself is kept
+// in a blob store under Key.
+type Attachment struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	Kind         string        `bson:"kind" json:"kind"`
+	Filename     string        `bson:"filename" json:"filename"`
+	ContentType  string        `bson:"content_type" json:"content_type"`
+	Size         int64         `bson:"size" json:"size"`
+	SHA256       string        `bson:"sha256" json:"sha256"` // Hex encoded checksum of the content.
+	Key          string        `bson:"key" json:"-"`
+	UploadedBy   string        `bson:"uploaded_by" json:"uploaded_by"`
+	DateUploaded time.Time     `bson:"date_uploaded" json:"date_uploaded"`
+}
+
+// NewAttachment describes a file being attached to an advert.
+type NewAttachment struct {
+	Kind     string `validate:"required,oneof=artwork proof"`
+	Filename string `validate:"required,max=255"`
+}
+
+// NewTransition is what we require from clients to move an advert to another
+// status.
+type NewTransition struct {
+	To   string `json:"to" validate:"required,oneof=prospect booked artwork_received proofed approved published cancelled"`
+	Note string `json:"note"`
+}
+
+// NewRenewal is what we require from clients to renew an advert. An empty
+// Year renews into the year after the advert's own. Empty Editions books the
+// editions of the same names in the new year.
+type NewRenewal struct {
+	Year     string   `json:"year"`
+	Editions []string `json:"editions"`
+}
+
+// NewAdvert is what we require from clients when adding a Advert. The
+// advertiser is named by AdvertiserID or, failing that, by Advertiser which is
+// matched against the names and aliases of known advertisers. A new
+// advertiser is created for a name that matches none of them.
 type NewAdvert struct {
-	Advertiser    string 		`json:"advertiser" validate:"required"`
-	Contact 	  ContactDetails `json:"contact" validate:"required"`
-	Editions      []string    	`json:"editions" validate:"required"`
-	Year          string    	`json:"year" validate:"required"`
-	State         []string      `json:"state" validate:"required"`
+	AdvertiserID string    `json:"advertiser_id"`
+	Advertiser   string    `json:"advertiser"`
+	Size         string    `json:"size" validate:"required,oneof=eighth quarter half full spread"`
+	Contacts     []Contact `json:"contacts" validate:"required,min=1,dive"`
+	Editions     []string  `json:"editions" validate:"required"`
+	Year         string    `json:"year" validate:"required"`
+	State        []string  `json:"state" validate:"required"`
 }
 
 // UpdateAdvert defines what information may be provided to modify an
@@ -41,10 +142,162 @@ type NewAdvert struct {
 // explicitly blank. Normally we do not want to use pointers to basic types but
 // we make exceptions around marshalling/unmarshalling.
 type UpdateAdvert struct {
-	Advertiser	*string 	`json:"name"`
-	Contact     *ContactDetails `json:"contact"`
-	Size     	*string   	`json:"size"`
-	Editions 	*[]string    	`json:"editions"`
-	Year     	*string		`json:"year"`
-	State       *[]string     `json:"state"`
+	AdvertiserID *string    `json:"advertiser_id"`
+	Advertiser   *string    `json:"advertiser"`
+	Contacts     *[]Contact `json:"contacts" validate:"omitempty,min=1,dive"`
+	Size         *string    `json:"size" validate:"omitempty,oneof=eighth quarter half full spread"`
+	Editions     *[]string  `json:"editions"`
+	Year         *string    `json:"year"`
+	State        *[]string  `json:"state"`
+}
+
+// Filter restricts the adverts returned by List and Export. Empty fields are
+// ignored.
+type Filter struct {
+	Status       string
+	AdvertiserID string
+	Advertiser   string
+	Size         string
+	Edition      string
+	Year         string
+	State        string
+}
+
+// Revision is an immutable snapshot of an Advert recorded every time it is
+// created, updated, deleted or reverted.
+type Revision struct {
+	ID       bson.ObjectId `bson:"_id" json:"id"`
+	TenantID bson.ObjectId `bson:"tenant_id,omitempty" json:"-"`
+	AdvertID bson.ObjectId `bson:"advert_id" json:"advert_id"`
+	Number   int           `bson:"number" json:"number"`     // Sequential per advert, starting at 1.
+	Action   string        `bson:"action" json:"action"`     // One of the Action constants.
+	Actor    string        `bson:"actor" json:"actor"`       // Subject of the claims that made the change.
+	Snapshot Advert        `bson:"snapshot" json:"snapshot"` // Full advert as it was after the change.
+	Date     time.Time     `bson:"date" json:"date"`
+}
+
+// Comment is a note left on an advert, such as a record of a call or an
+// agreement with the advertiser. A comment with a ParentID is a reply.
+type Comment struct {
+	ID           bson.ObjectId  `bson:"_id" json:"id"`
+	TenantID     bson.ObjectId  `bson:"tenant_id,omitempty" json:"-"`
+	AdvertID     bson.ObjectId  `bson:"advert_id" json:"advert_id"`
+	ParentID     *bson.ObjectId `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Author       string         `bson:"author" json:"author"` // Subject of the claims that wrote the comment.
+	Body         string         `bson:"body" json:"body"`
+	Mentions     []string       `bson:"mentions,omitempty" json:"mentions,omitempty"` // IDs of the users mentioned in the body.
+	Deleted      bool           `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	Version      int            `bson:"version" json:"version"` // Incremented on every write.
+	DateCreated  time.Time      `bson:"date_created" json:"date_created"`
+	DateModified time.Time      `bson:"date_modified" json:"date_modified"`
+}
+
+// ScoredComment is a comment found by a text search with its relevance.
+// Higher scores are better matches.
+type ScoredComment struct {
+	Comment `bson:",inline"`
+	Score   float64 `bson:"score" json:"score"`
+}
+
+// NewComment is what we require from clients when commenting on an advert.
+// Users are mentioned in the body by their email address, as in
+// @jane@example.com.
+type NewComment struct {
+	ParentID string `json:"parent_id"`
+	Body     string `json:"body" validate:"required,max=10000"`
+}
+
+// UpdateComment is what we require from clients when editing a comment.
+type UpdateComment struct {
+	Body string `json:"body" validate:"required,max=10000"`
+}
+
+// These are the expected values for Activity.Kind.
+const (
+	ActivityComment = "comment"
+	ActivityChange  = "change"
+)
+
+// Activity is an entry in the feed of everything that happened to an advert,
+// either a comment or a recorded change.
+type Activity struct {
+	Kind     string        `json:"kind"` // One of the Activity constants.
+	Actor    string        `json:"actor"`
+	Date     time.Time     `json:"date"`
+	Comment  *Comment      `json:"comment,omitempty"`
+	Action   string        `json:"action,omitempty"`   // Action of the revision for a change.
+	Revision int           `json:"revision,omitempty"` // Number of the revision for a change.
+	Changes  []diff.Change `json:"changes,omitempty"`  // Fields changed since the previous revision.
+}
+
+// These are the expected values for Suspect.Reasons and
+// DuplicateCluster.Reasons.
+const (
+	MatchAdvertiser = "advertiser"      // Booked for the same advertiser.
+	MatchName       = "advertiser_name" // Booked for advertisers with alike names.
+	MatchEmail      = "contact_email"   // A contact email address is shared.
+	MatchPhone      = "contact_phone"   // A contact phone number is shared.
+)
+
+// Suspect is an existing advert that a booking may duplicate.
+type Suspect struct {
+	ID         bson.ObjectId `json:"id"`
+	Advertiser string        `json:"advertiser"`
+	Year       string        `json:"year"`
+	Editions   []string      `json:"editions"` // Editions booked by both.
+	Reasons    []string      `json:"reasons"`  // One or more of the Match constants.
+}
+
+// DuplicateCluster is a group of adverts for the same year that look like a
+// single booking made more than once.
+type DuplicateCluster struct {
+	Year    string   `json:"year"`
+	Reasons []string `json:"reasons"` // Every Match constant that joined the group.
+	Adverts []Advert `json:"adverts"`
+}
+
+// PlanSlot is a slot in a flat plan with the advert that holds it.
+type PlanSlot struct {
+	edition.Slot
+	Advertiser string `json:"advertiser,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+// PlanPage is a page in a flat plan.
+type PlanPage struct {
+	Number int        `json:"number"`
+	Slots  []PlanSlot `json:"slots"`
+}
+
+// FlatPlan shows which advert occupies each position of an edition, page by
+// page.
+type FlatPlan struct {
+	Edition  edition.Edition    `json:"edition"`
+	Capacity []edition.Capacity `json:"capacity"`
+	Pages    []PlanPage         `json:"pages"`
+	Unplaced []Advert           `json:"unplaced"` // Adverts booked into the edition without a slot.
+}
+
+// These are the metrics a report can hold.
+const (
+	MetricCount   = "count"   // Number of adverts.
+	MetricRevenue = "revenue" // Price of the adverts net of tax, in minor units.
+	MetricYoY     = "yoy"     // Percentage change of each metric on the year before.
+)
+
+// ReportQuery describes a report on adverts. Adverts are grouped by every
+// dimension in GroupBy and the metrics worked out for each group. Adverts
+// booked from From up to but not including To are counted, and a zero time
+// leaves that end of the range open.
+type ReportQuery struct {
+	GroupBy []string
+	Metrics []string
+	From    time.Time
+	To      time.Time
+}
+
+// Table is the result of a report. Each row holds one value per column.
+type Table struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
 }
@@ -0,0 +1,39 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/ratecard"
+	"go.opencensus.io/trace"
+)
+
+// Quote prices a booking on the rate card for its year without saving it.
+func Quote(ctx context.Context, dbConn *db.DB, na *NewAdvert) (*ratecard.Price, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Quote")
+	defer span.End()
+
+	return checkBooking(ctx, dbConn, na.Size, na.Year, na.Editions, na.State)
+}
+
+// checkBooking makes sure a booking is into open editions and prices it.
+func checkBooking(ctx context.Context, dbConn *db.DB, size, year string, editions, states []string) (*ratecard.Price, error) {
+	if err := checkEditions(ctx, dbConn, year, editions); err != nil {
+		return nil, err
+	}
+
+	rc, err := ratecard.ForYear(ctx, dbConn, year)
+	if err != nil {
+		if err == ratecard.ErrNotFound {
+			return nil, web.NewFieldErrors(web.FieldError{
+				Field: "year",
+				Error: fmt.Sprintf("there is no rate card for %s", year),
+			})
+		}
+		return nil, err
+	}
+
+	return rc.Price(size, editions, states)
+}
@@ -0,0 +1,112 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrAlreadyRenewed occurs when renewing an advert that another advert
+// already renews.
+var ErrAlreadyRenewed = errors.New("Advert has already been renewed")
+
+// renewalIndex makes sure a booking is renewed at most once.
+var renewalIndex = mgo.Index{
+	Key:    []string{"renewed_from"},
+	Unique: true,
+	Sparse: true,
+}
+
+// nextYear returns the year after year.
+func nextYear(year string) (string, error) {
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		return "", web.NewFieldErrors(web.FieldError{
+			Field: "year",
+			Error: fmt.Sprintf("year is required to renew an advert booked for %q", year),
+		})
+	}
+	return strconv.Itoa(y + 1), nil
+}
+
+// Renew books a copy of the specified advert for another year, linked back to
+// it. The copy starts out as a prospect and is checked and priced against the
+// editions and rate card of its year like any new booking.
+func Renew(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, nr *NewRenewal, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Renew")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	year := nr.Year
+	if year == "" {
+		if year, err = nextYear(a.Year); err != nil {
+			return nil, err
+		}
+	}
+	if year == a.Year {
+		return nil, web.NewFieldErrors(web.FieldError{
+			Field: "year",
+			Error: "year must differ from the year of the advert",
+		})
+	}
+
+	na := Editable(a)
+	na.Year = year
+	if len(nr.Editions) > 0 {
+		na.Editions = nr.Editions
+	}
+
+	return create(ctx, claims, dbConn, &na, &a.ID, now)
+}
+
+// Unrenewed retrieves the adverts booked for year that no advert renews yet.
+// Cancelled adverts are left out.
+func Unrenewed(ctx context.Context, dbConn *db.DB, year string) ([]Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Unrenewed")
+	defer span.End()
+
+	renewed := []bson.ObjectId{}
+	rq := bson.M{"renewed_from": bson.M{"$exists": true}}
+	if err := tenant.Filter(ctx, rq); err != nil {
+		return nil, err
+	}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(rq).Distinct("renewed_from", &renewed)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.distinct(renewed_from, %s)", db.Query(rq)))
+	}
+
+	q := bson.M{
+		"year":   year,
+		"_id":    bson.M{"$nin": renewed},
+		"status": bson.M{"$ne": StatusCancelled},
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	adverts := []Advert{}
+	f = func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("advertiser").All(&adverts)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	return adverts, nil
+}
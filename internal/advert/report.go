@@ -0,0 +1,348 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Dimensions are the names a report can be grouped by, in the order their
+// columns appear.
+var Dimensions = []string{"year", "month", "edition", "state", "size", "status", "advertiser", "sales_rep"}
+
+// dimensionFields maps each dimension to the expression it groups on. Lists
+// are unwound so an advert counts once toward each of its editions or
+// states.
+var dimensionFields = map[string]interface{}{
+	"year":       "$year",
+	"month":      bson.M{"$dateToString": bson.M{"format": "%Y-%m", "date": "$date_created"}},
+	"edition":    "$editions",
+	"state":      "$state",
+	"size":       "$size",
+	"status":     bson.M{"$ifNull": []interface{}{"$status", StatusProspect}},
+	"advertiser": "$advertiser",
+	"sales_rep":  "$sales_rep",
+}
+
+// unwound lists the dimensions held as lists on an advert.
+var unwound = map[string]string{
+	"edition": "editions",
+	"state":   "state",
+}
+
+// ParseReportQuery reads a report query from the group_by, metrics, from and
+// to query parameters. Metrics default to count and revenue. Dates are given
+// as 2006-01-02 or in RFC 3339 form.
+func ParseReportQuery(v url.Values) (ReportQuery, error) {
+	var rq ReportQuery
+	var fields []web.FieldError
+
+	known := make(map[string]bool, len(Dimensions))
+	for _, d := range Dimensions {
+		known[d] = true
+	}
+	seen := make(map[string]bool)
+	for _, d := range splitList(v.Get("group_by")) {
+		switch {
+		case !known[d]:
+			fields = append(fields, web.FieldError{
+				Field: "group_by",
+				Error: fmt.Sprintf("%q is not one of %s", d, strings.Join(Dimensions, ", ")),
+			})
+		case !seen[d]:
+			rq.GroupBy = append(rq.GroupBy, d)
+		}
+		seen[d] = true
+	}
+
+	rq.Metrics = splitList(v.Get("metrics"))
+	if len(rq.Metrics) == 0 {
+		rq.Metrics = []string{MetricCount, MetricRevenue}
+	}
+	for _, m := range rq.Metrics {
+		switch m {
+		case MetricCount, MetricRevenue:
+		case MetricYoY:
+			if !seen["year"] {
+				fields = append(fields, web.FieldError{
+					Field: "metrics",
+					Error: "yoy needs the report to be grouped by year",
+				})
+			}
+		default:
+			fields = append(fields, web.FieldError{
+				Field: "metrics",
+				Error: fmt.Sprintf("%q is not one of count, revenue, yoy", m),
+			})
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &rq.From}, {"to", &rq.To}} {
+		s := v.Get(p.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, s)
+		}
+		if err != nil {
+			fields = append(fields, web.FieldError{
+				Field: p.name,
+				Error: fmt.Sprintf("%s must be a date such as 2019-07-01", p.name),
+			})
+			continue
+		}
+		*p.t = t
+	}
+
+	if len(fields) > 0 {
+		return rq, web.NewFieldErrors(fields...)
+	}
+	return rq, nil
+}
+
+// splitList splits a comma separated query parameter, dropping blanks.
+func splitList(s string) []string {
+	var list []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// Key identifies the report of the tenants ctx is scoped to so its result
+// can be cached.
+func (rq ReportQuery) Key(ctx context.Context) string {
+	scope := "*"
+	if s, err := tenant.FromContext(ctx); err == nil && !s.All {
+		scope = s.ID.Hex()
+	}
+
+	var from, to string
+	if !rq.From.IsZero() {
+		from = rq.From.UTC().Format(time.RFC3339)
+	}
+	if !rq.To.IsZero() {
+		to = rq.To.UTC().Format(time.RFC3339)
+	}
+	return strings.Join([]string{
+		scope,
+		strings.Join(rq.GroupBy, ","),
+		strings.Join(rq.Metrics, ","),
+		from,
+		to,
+	}, "|")
+}
+
+// has reports whether the query asks for a metric.
+func (rq ReportQuery) has(metric string) bool {
+	for _, m := range rq.Metrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// Report groups adverts and works out the requested metrics for each group
+// with an aggregation pipeline. Revenue is net of tax and is also grouped by
+// currency so amounts in different currencies are never added together. An
+// advert counted toward several editions or states has its revenue shared
+// evenly between them. Cancelled adverts are left out unless the report is grouped
+// by status.
+func Report(ctx context.Context, dbConn *db.DB, rq ReportQuery) (*Table, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Report")
+	defer span.End()
+
+	dims := rq.GroupBy
+	if rq.has(MetricRevenue) {
+		dims = append(dims[:len(dims):len(dims)], "currency")
+	}
+
+	match := bson.M{}
+	if err := tenant.Filter(ctx, match); err != nil {
+		return nil, err
+	}
+	created := bson.M{}
+	if !rq.From.IsZero() {
+		created["$gte"] = rq.From
+	}
+	if !rq.To.IsZero() {
+		created["$lt"] = rq.To
+	}
+	if len(created) > 0 {
+		match["date_created"] = created
+	}
+	grouped := false
+	for _, d := range rq.GroupBy {
+		grouped = grouped || d == "status"
+	}
+	if !grouped {
+		match["status"] = bson.M{"$ne": StatusCancelled}
+	}
+
+	// Each advert's revenue is divided by the number of entries it is
+	// unwound into before the lists are unwound.
+	var divisors []interface{}
+	for _, d := range rq.GroupBy {
+		if field, ok := unwound[d]; ok {
+			divisors = append(divisors, bson.M{"$max": []interface{}{1, bson.M{"$size": bson.M{"$ifNull": []interface{}{"$" + field, []interface{}{}}}}}})
+		}
+	}
+	net := bson.M{"$subtract": []interface{}{
+		bson.M{"$ifNull": []interface{}{"$price.total", 0}},
+		bson.M{"$ifNull": []interface{}{"$price.tax", 0}},
+	}}
+	share := interface{}(net)
+	if len(divisors) > 0 {
+		share = bson.M{"$divide": []interface{}{share, bson.M{"$multiply": append(divisors, 1)}}}
+	}
+
+	project := bson.M{"share": share}
+	id := bson.M{}
+	sort := bson.D{}
+	for _, d := range dims {
+		field := "$" + d
+		switch {
+		case d == "currency":
+			project[d] = "$price.currency"
+		case unwound[d] != "":
+			project[d] = "$" + unwound[d]
+		default:
+			project[d] = dimensionFields[d]
+		}
+		id[d] = field
+		sort = append(sort, bson.DocElem{Name: "_id." + d, Value: 1})
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$project": project},
+	}
+	for _, d := range rq.GroupBy {
+		if unwound[d] != "" {
+			pipeline = append(pipeline, bson.M{"$unwind": bson.M{"path": "$" + d, "preserveNullAndEmptyArrays": true}})
+		}
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{"_id": id, "count": bson.M{"$sum": 1}, "revenue": bson.M{"$sum": "$share"}}},
+	)
+	if len(sort) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sort})
+	}
+
+	var groups []struct {
+		ID      bson.M  `bson:"_id"`
+		Count   int64   `bson:"count"`
+		Revenue float64 `bson:"revenue"`
+	}
+	f := func(collection *mgo.Collection) error {
+		return collection.Pipe(pipeline).AllowDiskUse().All(&groups)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.aggregate(%s)", db.Query(pipeline)))
+	}
+
+	t := Table{Columns: append([]string{}, dims...), Rows: [][]interface{}{}}
+	var metrics []string
+	for _, m := range []string{MetricCount, MetricRevenue} {
+		if rq.has(m) {
+			metrics = append(metrics, m)
+		}
+	}
+	t.Columns = append(t.Columns, metrics...)
+	if rq.has(MetricYoY) {
+		for _, m := range metrics {
+			t.Columns = append(t.Columns, m+"_yoy")
+		}
+	}
+
+	values := make([]map[string]float64, len(groups))
+	for i, g := range groups {
+		row := make([]interface{}, 0, len(t.Columns))
+		for _, d := range dims {
+			var s string
+			if v, ok := g.ID[d].(string); ok {
+				s = v
+			}
+			row = append(row, s)
+		}
+
+		values[i] = map[string]float64{
+			MetricCount:   float64(g.Count),
+			MetricRevenue: math.Round(g.Revenue),
+		}
+		for _, m := range metrics {
+			row = append(row, int64(values[i][m]))
+		}
+		t.Rows = append(t.Rows, row)
+	}
+
+	if rq.has(MetricYoY) {
+		yoy(&t, dims, metrics, values)
+	}
+
+	return &t, nil
+}
+
+// yoy appends the percentage change of each metric on the same group in the
+// year before. It is nil when there is nothing to compare with.
+func yoy(t *Table, dims, metrics []string, values []map[string]float64) {
+	yearCol := -1
+	for i, d := range dims {
+		if d == "year" {
+			yearCol = i
+		}
+	}
+
+	// key identifies a group apart from its year.
+	key := func(row []interface{}, year string) string {
+		parts := make([]string, len(dims))
+		for i := range dims {
+			parts[i] = row[i].(string)
+		}
+		parts[yearCol] = year
+		return strings.Join(parts, "\x00")
+	}
+
+	index := make(map[string]int, len(t.Rows))
+	for i, row := range t.Rows {
+		index[key(row, row[yearCol].(string))] = i
+	}
+
+	for i, row := range t.Rows {
+		prev := -1
+		if y, err := strconv.Atoi(row[yearCol].(string)); err == nil {
+			if j, ok := index[key(row, strconv.Itoa(y-1))]; ok {
+				prev = j
+			}
+		}
+		for _, m := range metrics {
+			if prev < 0 || values[prev][m] == 0 {
+				row = append(row, nil)
+				continue
+			}
+			change := (values[i][m] - values[prev][m]) / values[prev][m] * 100
+			row = append(row, math.Round(change*10)/10)
+		}
+		t.Rows[i] = row
+	}
+}
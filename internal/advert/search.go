@@ -0,0 +1,86 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// searchIndex is the text index Search runs against. A match on the
+// advertiser counts for more than one on an edition or contact.
+var searchIndex = mgo.Index{
+	Key:     []string{"$text:advertiser", "$text:editions", "$text:contacts.name", "$text:contacts.email"},
+	Weights: map[string]int{"advertiser": 10, "editions": 3, "contacts.name": 2, "contacts.email": 2},
+	Name:    "search",
+}
+
+// commentSearchIndex is the text index SearchComments runs against.
+var commentSearchIndex = mgo.Index{
+	Key:  []string{"$text:body"},
+	Name: "search",
+}
+
+// Search finds up to limit adverts whose advertiser, editions or contacts
+// match text, best match first. Text is in the form of a Mongo $text search:
+// words, "quoted phrases" and -excluded words.
+func Search(ctx context.Context, dbConn *db.DB, text string, limit int) ([]ScoredAdvert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Search")
+	defer span.End()
+
+	q := bson.M{"$text": bson.M{"$search": text}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	s := []ScoredAdvert{}
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(searchIndex); err != nil {
+			return err
+		}
+		return collection.Find(q).
+			Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score").
+			Limit(limit).
+			All(&s)
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.find(%s)", db.Query(q)))
+	}
+
+	return s, nil
+}
+
+// SearchComments finds up to limit comments whose body matches text, best
+// match first. Deleted comments are never found.
+func SearchComments(ctx context.Context, dbConn *db.DB, text string, limit int) ([]ScoredComment, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.SearchComments")
+	defer span.End()
+
+	q := bson.M{"$text": bson.M{"$search": text}, "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	s := []ScoredComment{}
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(commentSearchIndex); err != nil {
+			return err
+		}
+		return collection.Find(q).
+			Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score").
+			Limit(limit).
+			All(&s)
+	}
+	if err := dbConn.Execute(ctx, commentsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advert_comments.find(%s)", db.Query(q)))
+	}
+
+	return s, nil
+}
@@ -0,0 +1,198 @@
+package advert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the stages of an advert's life. A new advert is a prospect.
+const (
+	StatusProspect        = "prospect"
+	StatusBooked          = "booked"
+	StatusArtworkReceived = "artwork_received"
+	StatusProofed         = "proofed"
+	StatusApproved        = "approved"
+	StatusPublished       = "published"
+	StatusCancelled       = "cancelled"
+)
+
+var (
+	// ErrIllegalTransition occurs when an advert is asked to move to a status
+	// it cannot reach from its current one.
+	ErrIllegalTransition = errors.New("Advert cannot move to that status from its current status")
+
+	// ErrTransitionForbidden occurs when the caller does not hold a role the
+	// transition requires.
+	ErrTransitionForbidden = errors.New("You are not authorized to move the advert to that status")
+)
+
+// transition is a move the state machine allows. Roles lists who may make
+// it, any authenticated user if it is empty.
+type transition struct {
+	To    string
+	Roles []string
+}
+
+// approvers are the roles that may sign off an advert for print.
+var approvers = []string{auth.RoleAdmin, auth.RoleEditor}
+
+// transitions is the state machine. It maps each status to the moves that
+// can be made out of it.
+var transitions = map[string][]transition{
+	StatusProspect: {
+		{To: StatusBooked},
+		{To: StatusCancelled},
+	},
+	StatusBooked: {
+		{To: StatusArtworkReceived},
+		{To: StatusCancelled},
+	},
+	StatusArtworkReceived: {
+		{To: StatusProofed},
+		{To: StatusCancelled},
+	},
+	StatusProofed: {
+		{To: StatusApproved, Roles: approvers},
+		{To: StatusArtworkReceived}, // Changes requested and new artwork supplied.
+		{To: StatusCancelled},
+	},
+	StatusApproved: {
+		{To: StatusPublished, Roles: approvers},
+		{To: StatusProofed, Roles: approvers}, // Approval withdrawn.
+		{To: StatusCancelled, Roles: approvers},
+	},
+	StatusCancelled: {
+		{To: StatusProspect},
+	},
+}
+
+// CurrentStatus returns the status of the advert. Adverts stored before
+// statuses were introduced are prospects.
+func (a *Advert) CurrentStatus() string {
+	if a.Status == "" {
+		return StatusProspect
+	}
+	return a.Status
+}
+
+// Allowed lists the statuses the holder of claims may move an advert to.
+func Allowed(claims auth.Claims, a *Advert) []string {
+	next := []string{}
+	for _, t := range transitions[a.CurrentStatus()] {
+		if len(t.Roles) == 0 || claims.HasRole(t.Roles...) {
+			next = append(next, t.To)
+		}
+	}
+	return next
+}
+
+// Transition moves an advert to a new status if the state machine allows it
+// and the claims hold a role the move requires. Who made the move and when is
+// kept on the advert. The write only succeeds if version is still the
+// current version of the advert.
+func Transition(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, tr *NewTransition, now time.Time) (*Advert, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advert.Transition")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+	if !web.VersionMatches(version, a.Version) {
+		return nil, ErrVersionConflict
+	}
+
+	from := a.CurrentStatus()
+
+	var t *transition
+	for i := range transitions[from] {
+		if transitions[from][i].To == tr.To {
+			t = &transitions[from][i]
+			break
+		}
+	}
+	switch {
+	case t == nil:
+		return nil, ErrIllegalTransition
+	case len(t.Roles) > 0 && !claims.HasRole(t.Roles...):
+		return nil, ErrTransitionForbidden
+	}
+
+	// An advert coming back from cancellation needs its slots again.
+	reopen := from == StatusCancelled && tr.To != StatusCancelled
+	if reopen {
+		if err := reserve(ctx, dbConn, a.ID, a.Size, a.Year, a.Editions, a); err != nil {
+			return nil, err
+		}
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	sc := StatusChange{
+		From:  from,
+		To:    tr.To,
+		Note:  tr.Note,
+		Actor: claims.Subject,
+		Date:  now,
+	}
+
+	m := bson.M{
+		"$set":  bson.M{"status": tr.To, "date_modified": now},
+		"$push": bson.M{"status_history": sc},
+		"$inc":  bson.M{"version": 1},
+	}
+	ev := event.New(event.AdvertTransitioned, event.AggregateAdvert, a.ID, claims.Subject, now)
+	ev.Data = bson.M{"from": from, "to": tr.To}
+	event.Push(m, ev)
+	// The move is only valid from the status it was checked against, which
+	// the version alone does not hold to when any version is accepted.
+	// Prospects written before statuses existed have none.
+	q := bson.M{"_id": a.ID, "version": versionQuery(version), "status": from}
+	if from == StatusProspect {
+		q["status"] = bson.M{"$in": []interface{}{StatusProspect, "", nil}}
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var upd Advert
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &upd)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertsCollection, f); err != nil {
+		if reopen {
+			if rerr := settle(ctx, dbConn, a.ID, a); rerr != nil {
+				return nil, rerr
+			}
+		}
+		if err == mgo.ErrNotFound {
+			return nil, versionError(ctx, dbConn, a.ID)
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.adverts.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	// A cancelled advert gives its slots back for others to book.
+	if tr.To == StatusCancelled {
+		if err := settle(ctx, dbConn, upd.ID, &upd); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := recordRevision(ctx, dbConn, ActionTransition, claims.Subject, &upd, now); err != nil {
+		return nil, err
+	}
+
+	return &upd, nil
+}
@@ -0,0 +1,96 @@
+package advert
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/auth"
+)
+
+// TestAllowed checks the moves the state machine offers from each status to
+// users with and without the roles some moves require.
+func TestAllowed(t *testing.T) {
+	var (
+		user   = []string{auth.RoleUser}
+		editor = []string{auth.RoleUser, auth.RoleEditor}
+		admin  = []string{auth.RoleAdmin}
+	)
+
+	tests := []struct {
+		status string
+		roles  []string
+		want   []string
+	}{
+		{"", user, []string{StatusBooked, StatusCancelled}},
+		{StatusProspect, user, []string{StatusBooked, StatusCancelled}},
+		{StatusBooked, user, []string{StatusArtworkReceived, StatusCancelled}},
+		{StatusArtworkReceived, user, []string{StatusProofed, StatusCancelled}},
+		{StatusProofed, user, []string{StatusArtworkReceived, StatusCancelled}},
+		{StatusProofed, editor, []string{StatusApproved, StatusArtworkReceived, StatusCancelled}},
+		{StatusProofed, admin, []string{StatusApproved, StatusArtworkReceived, StatusCancelled}},
+		{StatusApproved, user, []string{}},
+		{StatusApproved, editor, []string{StatusPublished, StatusProofed, StatusCancelled}},
+		{StatusApproved, admin, []string{StatusPublished, StatusProofed, StatusCancelled}},
+		{StatusPublished, admin, []string{}},
+		{StatusCancelled, user, []string{StatusProspect}},
+	}
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		claims := auth.NewClaims("5cf37266e2b7aa0001000001", tt.roles, now, time.Hour)
+		a := Advert{Status: tt.status}
+
+		got := Allowed(claims, &a)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Allowed(%v, %q) = %v, want %v", tt.roles, tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestTransitionsReachable checks every move of the state machine leads to
+// a status it knows, and that every status can be reached from a prospect.
+func TestTransitionsReachable(t *testing.T) {
+	statuses := []string{
+		StatusProspect,
+		StatusBooked,
+		StatusArtworkReceived,
+		StatusProofed,
+		StatusApproved,
+		StatusPublished,
+		StatusCancelled,
+	}
+	known := make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		known[s] = true
+	}
+
+	for from, ts := range transitions {
+		if !known[from] {
+			t.Errorf("transitions from unknown status %q", from)
+		}
+		for _, tr := range ts {
+			if !known[tr.To] {
+				t.Errorf("%s moves to unknown status %q", from, tr.To)
+			}
+		}
+	}
+
+	seen := map[string]bool{StatusProspect: true}
+	queue := []string{StatusProspect}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, tr := range transitions[from] {
+			if !seen[tr.To] {
+				seen[tr.To] = true
+				queue = append(queue, tr.To)
+			}
+		}
+	}
+	for _, s := range statuses {
+		if !seen[s] {
+			t.Errorf("%s cannot be reached from %s", s, StatusProspect)
+		}
+	}
+}
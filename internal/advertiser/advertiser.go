@@ -0,0 +1,517 @@
+package advertiser
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const advertisersCollection = "advertisers"
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the
+	// advertiser that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current advertiser")
+
+	// ErrNameTaken occurs when a name or alias already belongs to another
+	// advertiser.
+	ErrNameTaken = errors.New("Name or alias already belongs to another advertiser")
+)
+
+// keysIndex makes sure no two advertisers of a tenant answer to the same
+// normalised name.
+var keysIndex = mgo.Index{
+	Key:    []string{"tenant_id", "keys"},
+	Unique: true,
+}
+
+// keys builds the normalised lookup keys for a name and its aliases.
+func keys(name string, aliases []string) []string {
+	seen := make(map[string]bool)
+	var ks []string
+	for _, n := range append([]string{name}, aliases...) {
+		k := Normalize(n)
+		if k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+// List retrieves a list of existing advertisers from the database.
+func List(ctx context.Context, dbConn *db.DB) ([]Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.List")
+	defer span.End()
+
+	q := bson.M{"deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	a := []Advertiser{}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("name").All(&a)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.find(%s)", db.Query(q)))
+	}
+
+	return a, nil
+}
+
+// Retrieve gets the specified advertiser from the database.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var a *Advertiser
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&a)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.find(%s)", db.Query(q)))
+	}
+
+	return a, nil
+}
+
+// FindByName gets the advertiser whose name or one of whose aliases matches
+// name once both are normalised.
+func FindByName(ctx context.Context, dbConn *db.DB, name string) (*Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.FindByName")
+	defer span.End()
+
+	k := Normalize(name)
+	if k == "" {
+		return nil, ErrNotFound
+	}
+
+	q := bson.M{"keys": k, "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var a *Advertiser
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&a)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.find(%s)", db.Query(q)))
+	}
+
+	return a, nil
+}
+
+// Create inserts a new advertiser into the database.
+func Create(ctx context.Context, dbConn *db.DB, na *NewAdvertiser, now time.Time) (*Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Create")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	a := Advertiser{
+		ID:             bson.NewObjectId(),
+		TenantID:       tid,
+		Name:           na.Name,
+		Aliases:        na.Aliases,
+		BillingAddress: na.BillingAddress,
+		Contacts:       na.Contacts,
+		Keys:           keys(na.Name, na.Aliases),
+		Version:        1,
+		DateCreated:    now,
+		DateModified:   now,
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(keysIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&a)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrNameTaken
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.insert(%s)", db.Query(&a)))
+	}
+
+	return &a, nil
+}
+
+// Resolve finds the advertiser known by name, creating one if there is none.
+func Resolve(ctx context.Context, dbConn *db.DB, name string, now time.Time) (*Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Resolve")
+	defer span.End()
+
+	a, err := FindByName(ctx, dbConn, name)
+	if err != ErrNotFound {
+		return a, err
+	}
+
+	a, err = Create(ctx, dbConn, &NewAdvertiser{Name: name}, now)
+	if err == ErrNameTaken {
+
+		// Someone else created it between our lookup and insert.
+		return FindByName(ctx, dbConn, name)
+	}
+	return a, err
+}
+
+// Update replaces an advertiser document in the database. The write only
+// succeeds if version is still the current version of the advertiser.
+func Update(ctx context.Context, dbConn *db.DB, id string, version int, upd *UpdateAdvertiser, now time.Time) (*Advertiser, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Update")
+	defer span.End()
+
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bson.M{}
+
+	name, aliases := cur.Name, cur.Aliases
+	if upd.Name != nil {
+		name = *upd.Name
+		fields["name"] = name
+	}
+	if upd.Aliases != nil {
+		aliases = *upd.Aliases
+		fields["aliases"] = aliases
+	}
+	if upd.Name != nil || upd.Aliases != nil {
+		fields["keys"] = keys(name, aliases)
+	}
+	if upd.BillingAddress != nil {
+		fields["billing_address"] = *upd.BillingAddress
+	}
+	if upd.Contacts != nil {
+		fields["contacts"] = *upd.Contacts
+	}
+
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	q := bson.M{"_id": cur.ID, "version": db.Version(version), "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var a Advertiser
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &a)
+		return err
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		switch {
+		case err == mgo.ErrNotFound:
+			return nil, ErrVersionConflict
+		case mgo.IsDup(err):
+			return nil, ErrNameTaken
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &a, nil
+}
+
+// AddAliases records more spellings of an advertiser's name. Spellings that
+// already normalise to one of its keys are ignored.
+func AddAliases(ctx context.Context, dbConn *db.DB, id bson.ObjectId, aliases []string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.AddAliases")
+	defer span.End()
+
+	a, err := Retrieve(ctx, dbConn, id.Hex())
+	if err != nil {
+		return err
+	}
+
+	have := make(map[string]bool)
+	for _, k := range a.Keys {
+		have[k] = true
+	}
+
+	var add []string
+	for _, alias := range aliases {
+		if k := Normalize(alias); k != "" && !have[k] {
+			have[k] = true
+			add = append(add, alias)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+
+	all := append(a.Aliases, add...)
+	m := bson.M{
+		"$set": bson.M{
+			"aliases":       all,
+			"keys":          keys(a.Name, all),
+			"date_modified": now.Truncate(time.Millisecond),
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	q := bson.M{"_id": id, "version": a.Version, "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Update(q, m)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		switch {
+		case err == mgo.ErrNotFound:
+			return ErrVersionConflict
+		case mgo.IsDup(err):
+			return ErrNameTaken
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.advertisers.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// Delete removes an advertiser. The delete only succeeds if version is still
+// the current version of the advertiser.
+//
+// The advertiser is only marked deleted, so an advert booked against it while
+// it was being deleted still refers to an advertiser on record. Its lookup
+// keys are replaced with one no name normalises to, so its names are free to
+// be used by another advertiser.
+func Delete(ctx context.Context, dbConn *db.DB, id string, version int, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Delete")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+
+	m := bson.M{
+		"$set": bson.M{
+			"deleted":       true,
+			"keys":          []string{"#" + id},
+			"date_modified": now.Truncate(time.Millisecond),
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version), "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Update(q, m)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.advertisers.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// Spelling is one way an advertiser name has been written and how often.
+type Spelling struct {
+	Name  string `bson:"_id" json:"name"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Cluster is a group of spellings judged to name the same advertiser. The
+// most frequently used spelling is chosen as the canonical name.
+type Cluster struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+// ClusterThreshold is the Similarity two normalised names need to be placed
+// in the same Cluster.
+const ClusterThreshold = 0.85
+
+// ClusterSpellings groups spellings of advertiser names. Spellings that
+// normalise to the same name always share a cluster and names that are
+// merely similar are joined when their Similarity meets ClusterThreshold.
+func ClusterSpellings(spellings []Spelling) []Cluster {
+
+	// Group by normalised name first, then join similar groups with a
+	// union-find over the distinct normalised names.
+	byKey := make(map[string][]Spelling)
+	var ks []string
+	for _, s := range spellings {
+		k := Normalize(s.Name)
+		if k == "" {
+			continue
+		}
+		if _, ok := byKey[k]; !ok {
+			ks = append(ks, k)
+		}
+		byKey[k] = append(byKey[k], s)
+	}
+	sort.Strings(ks)
+
+	parent := make([]int, len(ks))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range ks {
+		for j := i + 1; j < len(ks); j++ {
+			if Similarity(ks[i], ks[j]) >= ClusterThreshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	groups := make(map[int][]Spelling)
+	var roots []int
+	for i, k := range ks {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], byKey[k]...)
+	}
+
+	clusters := make([]Cluster, 0, len(roots))
+	for _, r := range roots {
+		g := groups[r]
+		sort.Slice(g, func(i, j int) bool {
+			if g[i].Count != g[j].Count {
+				return g[i].Count > g[j].Count
+			}
+			return g[i].Name < g[j].Name
+		})
+
+		c := Cluster{Name: g[0].Name, Aliases: []string{}}
+		for _, s := range g[1:] {
+			c.Aliases = append(c.Aliases, s.Name)
+		}
+		clusters = append(clusters, c)
+	}
+
+	return clusters
+}
+
+// Duplicates groups advertisers that look like the same company, because
+// their names or aliases are alike or because they share a contact email
+// address or phone number. Advertisers with no likely duplicate are left out.
+func Duplicates(advertisers []Advertiser) [][]Advertiser {
+	parent := make([]int, len(advertisers))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// Advertisers sharing a contact are joined through the first advertiser
+	// seen with it.
+	contacts := make(map[string]int)
+	for i, a := range advertisers {
+		for _, c := range a.Contacts {
+			for _, k := range []string{"email:" + NormalizeEmail(c.Email), "phone:" + NormalizePhone(c.Phone)} {
+				if strings.HasSuffix(k, ":") {
+					continue
+				}
+				if j, ok := contacts[k]; ok {
+					parent[find(i)] = find(j)
+					continue
+				}
+				contacts[k] = i
+			}
+		}
+	}
+
+	for i := range advertisers {
+		for j := i + 1; j < len(advertisers); j++ {
+			if find(i) != find(j) && alike(advertisers[i].Keys, advertisers[j].Keys) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	groups := make(map[int][]Advertiser)
+	var roots []int
+	for i, a := range advertisers {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], a)
+	}
+
+	var dups [][]Advertiser
+	for _, r := range roots {
+		if len(groups[r]) > 1 {
+			dups = append(dups, groups[r])
+		}
+	}
+
+	return dups
+}
+
+// alike reports whether any key in a is similar enough to a key in b to name
+// the same company.
+func alike(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if Similarity(x, y) >= ClusterThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
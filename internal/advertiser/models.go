@@ -0,0 +1,67 @@
+package advertiser
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Address is a postal address.
+type Address struct {
+	Line1    string `bson:"line1" json:"line1"`
+	Line2    string `bson:"line2" json:"line2"`
+	City     string `bson:"city" json:"city"`
+	State    string `bson:"state" json:"state"`
+	Postcode string `bson:"postcode" json:"postcode"`
+	Country  string `bson:"country" json:"country"`
+}
+
+// Contact is someone to deal with at an advertiser.
+type Contact struct {
+	Name  string `bson:"name" json:"name" validate:"required"`
+	Title string `bson:"title" json:"title"`
+	Email string `bson:"email" json:"email" validate:"omitempty,email"`
+	Phone string `bson:"phone" json:"phone" validate:"omitempty,phone"`
+}
+
+// Advertiser is a company that books adverts. Adverts reference it by ID.
+type Advertiser struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	TenantID       bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Name           string        `bson:"name" json:"name"`       // Canonical name.
+	Aliases        []string      `bson:"aliases" json:"aliases"` // Other spellings of the name.
+	BillingAddress Address       `bson:"billing_address" json:"billing_address"`
+	Contacts       []Contact     `bson:"contacts" json:"contacts"`
+	Keys           []string      `bson:"keys" json:"-"` // Normalised name and aliases used for lookups.
+	Deleted        bool          `bson:"deleted,omitempty" json:"-"`
+	Version        int           `bson:"version" json:"version"`
+	DateCreated    time.Time     `bson:"date_created" json:"date_created"`
+	DateModified   time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// NewAdvertiser is what we require from clients when adding an Advertiser.
+type NewAdvertiser struct {
+	Name           string    `json:"name" validate:"required"`
+	Aliases        []string  `json:"aliases"`
+	BillingAddress Address   `json:"billing_address"`
+	Contacts       []Contact `json:"contacts" validate:"dive"`
+}
+
+// UpdateAdvertiser defines what information may be provided to modify an
+// existing Advertiser. All fields are optional so clients can send just the
+// fields they want changed. It uses pointer fields so we can differentiate
+// between a field that was not provided and a field that was provided as
+// explicitly blank.
+type UpdateAdvertiser struct {
+	Name           *string    `json:"name" validate:"omitempty,min=1"`
+	Aliases        *[]string  `json:"aliases"`
+	BillingAddress *Address   `json:"billing_address"`
+	Contacts       *[]Contact `json:"contacts" validate:"omitempty,dive"`
+}
+
+// Scored is an advertiser found by a text search with its relevance. Higher
+// scores are better matches.
+type Scored struct {
+	Advertiser `bson:",inline"`
+	Score      float64 `bson:"score" json:"score"`
+}
@@ -0,0 +1,133 @@
+package advertiser
+
+import (
+	"strings"
+	"unicode"
+)
+
+// suffixes are words that do not distinguish one company from another and are
+// dropped from the end of a normalised name.
+var suffixes = map[string]bool{
+	"pty":          true,
+	"ltd":          true,
+	"limited":      true,
+	"inc":          true,
+	"incorporated": true,
+	"llc":          true,
+	"co":           true,
+	"company":      true,
+	"corp":         true,
+	"corporation":  true,
+	"plc":          true,
+}
+
+// Normalize reduces an advertiser name to a form where different spellings of
+// the same company compare equal. It lowercases the name, spells out &, drops
+// punctuation, a leading "the" and trailing company suffixes such as Pty Ltd.
+func Normalize(name string) string {
+	name = strings.ToLower(strings.Replace(name, "&", " and ", -1))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '\'' || r == '’' || r == '.':
+			// Drop apostrophes and dots so "Joe's" and "Joes" or "P.T.Y."
+			// and "pty" compare equal.
+		default:
+			b.WriteRune(' ')
+		}
+	}
+
+	words := strings.Fields(b.String())
+	if len(words) > 1 && words[0] == "the" {
+		words = words[1:]
+	}
+	for len(words) > 1 && suffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+
+	return strings.Join(words, " ")
+}
+
+// NormalizeEmail reduces an email address to the form used to compare
+// contacts.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone reduces a phone number to its last nine digits so a number
+// written with and without its country or area prefix compares equal.
+// Numbers too short to identify anyone normalise to "".
+func NormalizePhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+
+	d := b.String()
+	switch {
+	case len(d) < 6:
+		return ""
+	case len(d) > 9:
+		return d[len(d)-9:]
+	}
+	return d
+}
+
+// Similarity scores how alike two normalised names are, from 0 for nothing in
+// common to 1 for identical. It is based on the Levenshtein edit distance
+// relative to the length of the longer name.
+func Similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+
+	ra, rb := []rune(a), []rune(b)
+	max := len(ra)
+	if len(rb) > max {
+		max = len(rb)
+	}
+	if max == 0 {
+		return 1
+	}
+
+	return 1 - float64(distance(ra, rb))/float64(max)
+}
+
+// distance computes the Levenshtein edit distance between two strings.
+func distance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// min3 returns the smallest of three ints.
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
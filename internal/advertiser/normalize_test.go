@@ -0,0 +1,47 @@
+package advertiser
+
+import (
+	"math"
+	"testing"
+)
+
+// TestSimilarity checks how alike names score and which of them are close
+// enough to be clustered as the same advertiser.
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    float64
+		cluster bool
+	}{
+		{"acme", "acme", 1, true},
+		{"", "", 1, true},
+		{"acme", "", 0, false},
+		{"acme", "zenith", 0, false},
+
+		// Near: a letter or two apart in a longer name.
+		{"harbour view cafe", "harbor view cafe", 1 - 1.0/17, true},
+		{"smith and sons", "smith and son", 1 - 1.0/14, true},
+		{"blue mountains bakery", "blue mountain bakers", 1 - 2.0/21, true},
+		{"coastal surf supplies", "coastal surf supply", 1 - 3.0/21, true},
+		{"greenway landscapes", "greenway landscaping", 1 - 3.0/20, true},
+
+		// Far: the same number of edits weighs more in a shorter name.
+		{"acme", "acne", 0.75, false},
+		{"sunrise bakery", "sunset bakery", 1 - 3.0/14, false},
+		{"bright smiles dental", "bright smile dentist", 0.8, false},
+		{"main street motors", "main st motors", 1 - 4.0/18, false},
+	}
+
+	for _, tt := range tests {
+		got := Similarity(tt.a, tt.b)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if rev := Similarity(tt.b, tt.a); rev != got {
+			t.Errorf("Similarity(%q, %q) = %v, but %v the other way round", tt.a, tt.b, got, rev)
+		}
+		if cluster := got >= ClusterThreshold; cluster != tt.cluster {
+			t.Errorf("Similarity(%q, %q) = %v, clustered %v, want %v", tt.a, tt.b, got, cluster, tt.cluster)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package advertiser
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// searchIndex is the text index Search runs against. A match on the name
+// counts for more than one on a contact.
+var searchIndex = mgo.Index{
+	Key:     []string{"$text:name", "$text:aliases", "$text:contacts.name", "$text:contacts.email"},
+	Weights: map[string]int{"name": 10, "aliases": 5, "contacts.name": 2, "contacts.email": 2},
+	Name:    "search",
+}
+
+// Search finds up to limit advertisers of the tenant of ctx whose names or
+// contacts match text, best match first. Text is in the form of a Mongo $text search: words,
+// "quoted phrases" and -excluded words.
+func Search(ctx context.Context, dbConn *db.DB, text string, limit int) ([]Scored, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.advertiser.Search")
+	defer span.End()
+
+	q := bson.M{"$text": bson.M{"$search": text}, "deleted": bson.M{"$ne": true}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	s := []Scored{}
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(searchIndex); err != nil {
+			return err
+		}
+		return collection.Find(q).
+			Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score").
+			Limit(limit).
+			All(&s)
+	}
+	if err := dbConn.Execute(ctx, advertisersCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.advertisers.find(%s)", db.Query(q)))
+	}
+
+	return s, nil
+}
@@ -0,0 +1,425 @@
+// Package audit keeps an append-only log of the actions taken through the
+// API. Entries are written by the Audit middleware and are never changed
+// once written; a hash chain per tenant lets Verify detect entries that were.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/diff"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const auditCollection = "audit_log"
+
+// These bound the number of entries List returns.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// ErrContention occurs when an entry could not be appended because other
+// entries kept taking its place in the chain.
+var ErrContention = errors.New("Audit log is too busy to append to")
+
+// seqIndex makes sure only one entry takes each place in a chain. Each tenant
+// has its own chain, so tenants never contend for the next place. Actions
+// taken across every tenant have no tenant and share one chain.
+var seqIndex = mgo.Index{
+	Key:    []string{"tenant_id", "seq"},
+	Unique: true,
+}
+
+// appendAttempts is how many times Record tries to take the next place in the
+// chain before giving up.
+const appendAttempts = 10
+
+// chain returns the query matching the entries of a tenant's chain.
+func chain(tid bson.ObjectId) bson.M {
+	if tid.Valid() {
+		return bson.M{"tenant_id": tid}
+	}
+	return bson.M{"tenant_id": bson.M{"$exists": false}}
+}
+
+// Record appends an entry to the chain of its tenant, linking it to the entry
+// before. The sequence number and hashes of e are set by Record, as is its ID
+// unless it already has one. Recording an entry that is already in the log
+// does nothing, so an entry queued more than once is only appended once.
+func Record(ctx context.Context, dbConn *db.DB, e *Entry) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.Record")
+	defer span.End()
+
+	// Mongo keeps times to the millisecond, so the hash covers the date as
+	// it is stored.
+	e.Date = e.Date.Truncate(time.Millisecond).UTC()
+	if !e.ID.Valid() {
+		e.ID = bson.NewObjectId()
+	}
+
+	q := chain(e.TenantID)
+
+	for i := 0; i < appendAttempts; i++ {
+		var last Entry
+		f := func(collection *mgo.Collection) error {
+			if err := collection.EnsureIndex(seqIndex); err != nil {
+				return err
+			}
+			return collection.Find(q).Sort("-seq").One(&last)
+		}
+		if err := dbConn.Execute(ctx, auditCollection, f); err != nil && err != mgo.ErrNotFound {
+			return errors.Wrap(err, fmt.Sprintf("db.audit_log.find(%s).sort(-seq)", db.Query(q)))
+		}
+
+		e.Seq = last.Seq + 1
+		e.PrevHash = last.Hash
+		hash, err := Hash(e)
+		if err != nil {
+			return err
+		}
+		e.Hash = hash
+
+		var found int
+		f = func(collection *mgo.Collection) error {
+			err := collection.Insert(e)
+			if mgo.IsDup(err) {
+				var cerr error
+				if found, cerr = collection.FindId(e.ID).Count(); cerr != nil {
+					return cerr
+				}
+			}
+			return err
+		}
+		err = dbConn.Execute(ctx, auditCollection, f)
+		if err == nil || found > 0 {
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return errors.Wrap(err, fmt.Sprintf("db.audit_log.insert(%s)", db.Query(e)))
+		}
+	}
+
+	return ErrContention
+}
+
+// Queue writes an entry to the outbox to be appended to the log by a
+// Recorder, for when Record could not append it straight away. The entry is
+// not lost however long the log stays too busy.
+func Queue(ctx context.Context, dbConn *db.DB, e *Entry) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.Queue")
+	defer span.End()
+
+	if !e.ID.Valid() {
+		e.ID = bson.NewObjectId()
+	}
+	e.Seq, e.PrevHash, e.Hash = 0, "", ""
+
+	raw, err := bson.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding entry")
+	}
+	var data bson.M
+	if err := bson.Unmarshal(raw, &data); err != nil {
+		return errors.Wrap(err, "decoding entry")
+	}
+
+	ev := event.New(event.AuditQueued, event.AggregateAudit, e.ID, e.Actor, e.Date)
+	ev.TenantID = e.TenantID
+	ev.Data = data
+
+	return event.Enqueue(ctx, dbConn, auditCollection, ev)
+}
+
+// Recorder appends the entries queued by Queue as they are delivered to it
+// from the outbox.
+type Recorder struct {
+	MasterDB *db.DB
+}
+
+// Handle appends the entry carried by an event to the log.
+func (r *Recorder) Handle(ctx context.Context, ev event.Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.Recorder.Handle")
+	defer span.End()
+
+	raw, err := bson.Marshal(ev.Data)
+	if err != nil {
+		return errors.Wrap(err, "encoding entry")
+	}
+	var e Entry
+	if err := bson.Unmarshal(raw, &e); err != nil {
+		return errors.Wrap(err, "decoding entry")
+	}
+
+	dbConn := r.MasterDB.Copy()
+	defer dbConn.Close()
+
+	return Record(ctx, dbConn, &e)
+}
+
+// Hash works out the hash of an entry from everything in it but its ID and
+// its own hash.
+func Hash(e *Entry) (string, error) {
+	doc := struct {
+		TenantID   string        `json:"tenant_id,omitempty"`
+		Seq        int64         `json:"seq"`
+		Actor      string        `json:"actor"`
+		Action     string        `json:"action"`
+		Resource   string        `json:"resource"`
+		ResourceID string        `json:"resource_id"`
+		Changes    []diff.Change `json:"changes"`
+		Status     int           `json:"status"`
+		Outcome    string        `json:"outcome"`
+		SourceIP   string        `json:"source_ip"`
+		UserAgent  string        `json:"user_agent"`
+		TraceID    string        `json:"trace_id"`
+		Date       string        `json:"date"`
+		PrevHash   string        `json:"prev_hash"`
+	}{
+		TenantID:   e.TenantID.Hex(),
+		Seq:        e.Seq,
+		Actor:      e.Actor,
+		Action:     e.Action,
+		Resource:   e.Resource,
+		ResourceID: e.ResourceID,
+		Changes:    e.Changes,
+		Status:     e.Status,
+		Outcome:    e.Outcome,
+		SourceIP:   e.SourceIP,
+		UserAgent:  e.UserAgent,
+		TraceID:    e.TraceID,
+		Date:       e.Date.UTC().Format(time.RFC3339Nano),
+		PrevHash:   e.PrevHash,
+	}
+	if len(doc.Changes) == 0 {
+		doc.Changes = nil
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "encoding entry for hashing")
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// List retrieves the entries of the tenant of ctx matching flt, newest
+// first. Entries of actions taken across every tenant are only listed in the
+// scope of all of them, where entries are ordered by date as each tenant's
+// chain is numbered on its own.
+func List(ctx context.Context, dbConn *db.DB, flt Filter) ([]Entry, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.List")
+	defer span.End()
+
+	scope, err := tenant.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q := bson.M{}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+	sort := []string{"-seq"}
+	if scope.All {
+		sort = []string{"-date", "-_id"}
+	}
+	for k, v := range map[string]string{
+		"actor":       flt.Actor,
+		"action":      flt.Action,
+		"resource":    flt.Resource,
+		"resource_id": flt.ResourceID,
+		"outcome":     flt.Outcome,
+	} {
+		if v != "" {
+			q[k] = v
+		}
+	}
+	date := bson.M{}
+	if !flt.From.IsZero() {
+		date["$gte"] = flt.From
+	}
+	if !flt.To.IsZero() {
+		date["$lt"] = flt.To
+	}
+	if len(date) > 0 {
+		q["date"] = date
+	}
+	if flt.Before > 0 {
+		q["seq"] = bson.M{"$lt": flt.Before}
+	}
+
+	limit := flt.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	entries := []Entry{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort(sort...).Limit(limit).All(&entries)
+	}
+	if err := dbConn.Execute(ctx, auditCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.audit_log.find(%s)", db.Query(q)))
+	}
+
+	return entries, nil
+}
+
+// Verify walks the chain of the tenant of ctx from its first entry and checks
+// that every entry follows on from the one before and still has the hash it
+// was written with. In the scope of all tenants every chain is walked. It
+// stops at the first broken entry.
+func Verify(ctx context.Context, dbConn *db.DB) (*Verification, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.audit.Verify")
+	defer span.End()
+
+	scope, err := tenant.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chain of actions taken across every tenant has no tenant ID.
+	tids := []bson.ObjectId{scope.ID}
+	if scope.All {
+		tids = []bson.ObjectId{""}
+		var found []bson.ObjectId
+		f := func(collection *mgo.Collection) error {
+			return collection.Find(nil).Distinct("tenant_id", &found)
+		}
+		if err := dbConn.Execute(ctx, auditCollection, f); err != nil {
+			return nil, errors.Wrap(err, "db.audit_log.distinct(tenant_id)")
+		}
+		tids = append(tids, found...)
+	}
+
+	ver := Verification{Valid: true}
+	for _, tid := range tids {
+		if err := verify(ctx, dbConn, tid, &ver); err != nil {
+			return nil, err
+		}
+		if !ver.Valid {
+			break
+		}
+	}
+
+	return &ver, nil
+}
+
+// verify walks the chain of a tenant, adding what it finds to ver.
+func verify(ctx context.Context, dbConn *db.DB, tid bson.ObjectId, ver *Verification) error {
+	q := chain(tid)
+
+	f := func(collection *mgo.Collection) error {
+		iter := collection.Find(q).Sort("seq").Iter()
+
+		var seq int64
+		var prev string
+		var e Entry
+		for iter.Next(&e) {
+			seq++
+			ver.Entries++
+
+			var reason string
+			switch {
+			case e.Seq != seq:
+				reason = fmt.Sprintf("expected entry %d, found %d", seq, e.Seq)
+			case e.PrevHash != prev:
+				reason = "entry does not follow on from the one before"
+			default:
+				hash, err := Hash(&e)
+				if err != nil {
+					iter.Close()
+					return err
+				}
+				if hash != e.Hash {
+					reason = "entry has changed since it was written"
+				}
+			}
+			if reason != "" {
+				ver.Valid, ver.TenantID, ver.Seq, ver.Reason = false, tid, seq, reason
+				break
+			}
+
+			prev = e.Hash
+			e = Entry{}
+		}
+		return iter.Close()
+	}
+	if err := dbConn.Execute(ctx, auditCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.audit_log.find(%s).sort(seq)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// ParseFilter reads a filter from the actor, action, resource, resource_id,
+// outcome, from, to, before and limit query parameters. Dates are given as
+// 2006-01-02 or in RFC 3339 form.
+func ParseFilter(v url.Values) (Filter, error) {
+	flt := Filter{
+		Actor:      v.Get("actor"),
+		Action:     v.Get("action"),
+		Resource:   v.Get("resource"),
+		ResourceID: v.Get("resource_id"),
+		Outcome:    v.Get("outcome"),
+	}
+	var fields []web.FieldError
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &flt.From}, {"to", &flt.To}} {
+		s := v.Get(p.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, s)
+		}
+		if err != nil {
+			fields = append(fields, web.FieldError{
+				Field: p.name,
+				Error: fmt.Sprintf("%s must be a date such as 2019-07-01", p.name),
+			})
+			continue
+		}
+		*p.t = t
+	}
+
+	if s := v.Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			fields = append(fields, web.FieldError{Field: "before", Error: "before must be a sequence number"})
+		}
+		flt.Before = n
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxLimit {
+			fields = append(fields, web.FieldError{Field: "limit", Error: fmt.Sprintf("limit must be between 1 and %d", MaxLimit)})
+		}
+		flt.Limit = n
+	}
+
+	if len(fields) > 0 {
+		return flt, web.NewFieldErrors(fields...)
+	}
+	return flt, nil
+}
@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/tests"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestHash checks the hash covers every field of an entry but its ID and its
+// own hash.
+func TestHash(t *testing.T) {
+	e := Entry{
+		ID:         bson.NewObjectId(),
+		TenantID:   bson.NewObjectId(),
+		Seq:        2,
+		Actor:      "5cf37266e2b7aa0001000001",
+		Action:     "PUT /v1/adverts/:id",
+		Resource:   "adverts",
+		ResourceID: "5cf37266e2b7aa0001000002",
+		Status:     http.StatusOK,
+		Outcome:    OutcomeSuccess,
+		Date:       time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC),
+		PrevHash:   "abc",
+	}
+	want, err := Hash(&e)
+	if err != nil {
+		t.Fatalf("Hash : %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(e *Entry)
+		changed bool
+	}{
+		{"id", func(e *Entry) { e.ID = bson.NewObjectId() }, false},
+		{"hash", func(e *Entry) { e.Hash = "def" }, false},
+		{"tenant", func(e *Entry) { e.TenantID = bson.NewObjectId() }, true},
+		{"seq", func(e *Entry) { e.Seq = 3 }, true},
+		{"actor", func(e *Entry) { e.Actor = "someone else" }, true},
+		{"status", func(e *Entry) { e.Status = http.StatusForbidden }, true},
+		{"date", func(e *Entry) { e.Date = e.Date.Add(time.Millisecond) }, true},
+		{"prev hash", func(e *Entry) { e.PrevHash = "abd" }, true},
+	}
+
+	for _, tt := range tests {
+		c := e
+		tt.change(&c)
+		got, err := Hash(&c)
+		if err != nil {
+			t.Fatalf("%s : Hash : %v", tt.name, err)
+		}
+		if (got != want) != tt.changed {
+			t.Errorf("%s : hash changed %v, want %v", tt.name, got != want, tt.changed)
+		}
+	}
+}
+
+// TestVerify checks a chain that has been tampered with is reported broken
+// at the entry that was changed.
+func TestVerify(t *testing.T) {
+	masterDB, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	now := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	chains := []struct {
+		name   string
+		tamper func(collection *mgo.Collection, tid bson.ObjectId) error
+		seq    int64 // 0 when the chain is intact.
+		reason string
+	}{
+		{
+			name:   "intact",
+			tamper: func(*mgo.Collection, bson.ObjectId) error { return nil },
+		},
+		{
+			name: "field changed",
+			tamper: func(collection *mgo.Collection, tid bson.ObjectId) error {
+				return collection.Update(bson.M{"tenant_id": tid, "seq": 3}, bson.M{"$set": bson.M{"actor": "someone else"}})
+			},
+			seq:    3,
+			reason: "entry has changed since it was written",
+		},
+		{
+			name: "hash rewritten",
+			tamper: func(collection *mgo.Collection, tid bson.ObjectId) error {
+				var e Entry
+				if err := collection.Find(bson.M{"tenant_id": tid, "seq": 2}).One(&e); err != nil {
+					return err
+				}
+				e.Outcome = OutcomeFailure
+				hash, err := Hash(&e)
+				if err != nil {
+					return err
+				}
+				return collection.UpdateId(e.ID, bson.M{"$set": bson.M{"outcome": e.Outcome, "hash": hash}})
+			},
+			seq:    3,
+			reason: "entry does not follow on from the one before",
+		},
+		{
+			name: "entry removed",
+			tamper: func(collection *mgo.Collection, tid bson.ObjectId) error {
+				return collection.Remove(bson.M{"tenant_id": tid, "seq": 4})
+			},
+			seq:    4,
+			reason: "expected entry 4, found 5",
+		},
+	}
+
+	for _, tt := range chains {
+		t.Run(tt.name, func(t *testing.T) {
+			tid := bson.NewObjectId()
+			ctx := tenant.With(context.Background(), tid)
+
+			for i := 0; i < 5; i++ {
+				e := Entry{
+					TenantID: tid,
+					Actor:    "5cf37266e2b7aa0001000001",
+					Action:   "PUT /v1/adverts/:id",
+					Resource: "adverts",
+					Status:   http.StatusOK,
+					Outcome:  OutcomeSuccess,
+					Date:     now.Add(time.Duration(i) * time.Minute),
+				}
+				if err := Record(ctx, masterDB, &e); err != nil {
+					t.Fatalf("recording entry %d : %v", i+1, err)
+				}
+			}
+
+			f := func(collection *mgo.Collection) error {
+				return tt.tamper(collection, tid)
+			}
+			if err := masterDB.Execute(ctx, auditCollection, f); err != nil {
+				t.Fatalf("tampering : %v", err)
+			}
+
+			ver, err := Verify(ctx, masterDB)
+			if err != nil {
+				t.Fatalf("Verify : %v", err)
+			}
+			if ver.Valid != (tt.seq == 0) || ver.Seq != tt.seq || ver.Reason != tt.reason {
+				t.Fatalf("got valid %v at seq %d %q, want seq %d %q", ver.Valid, ver.Seq, ver.Reason, tt.seq, tt.reason)
+			}
+		})
+	}
+}
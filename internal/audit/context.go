@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ctxKey represents the type of value for the context key.
+type ctxKey int
+
+// Key is used to store and retrieve the Note for a request.
+const Key ctxKey = 1
+
+// Note collects what the handlers of a request know about the action so the
+// Audit middleware can record it. Fields left empty are worked out from the
+// request.
+type Note struct {
+	TenantID   bson.ObjectId
+	Actor      string
+	Action     string
+	ResourceID string
+	Before     interface{}
+	After      interface{}
+}
+
+// note returns the Note for the request, or nil when the request is not
+// being audited.
+func note(ctx context.Context) *Note {
+	n, _ := ctx.Value(Key).(*Note)
+	return n
+}
+
+// Actor records who is taking the action.
+func Actor(ctx context.Context, actor string) {
+	if n := note(ctx); n != nil {
+		n.Actor = actor
+	}
+}
+
+// Tenant records the tenant the action was taken in.
+func Tenant(ctx context.Context, id bson.ObjectId) {
+	if n := note(ctx); n != nil {
+		n.TenantID = id
+	}
+}
+
+// Login marks the request as an attempt to log in as email.
+func Login(ctx context.Context, email string) {
+	if n := note(ctx); n != nil {
+		n.Actor, n.Action = email, ActionLogin
+	}
+}
+
+// Changed records the state of the resource before and after the action.
+// Before is nil for a create and after is nil for a delete. Both are compared
+// as they appear in the API, so fields kept out of responses, such as
+// password hashes, never reach the log.
+func Changed(ctx context.Context, id string, before, after interface{}) {
+	if n := note(ctx); n != nil {
+		n.ResourceID, n.Before, n.After = id, before, after
+	}
+}
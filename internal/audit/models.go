@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/diff"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the expected values for Entry.Outcome.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// ActionLogin is the action recorded for every attempt to get a token.
+const ActionLogin = "login"
+
+// Entry records an action taken through the API. The entries of a tenant are
+// chained: each holds the hash of the one before it, so an entry changed or
+// removed after it was written breaks the chain.
+type Entry struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	TenantID   bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`     // Tenant the action was taken in, empty for every tenant.
+	Seq        int64         `bson:"seq" json:"seq"`                                     // Position in the tenant's chain, starting at 1.
+	Actor      string        `bson:"actor" json:"actor"`                                 // Subject of the claims, or the email given at login.
+	Action     string        `bson:"action" json:"action"`                               // Method and path, or ActionLogin.
+	Resource   string        `bson:"resource" json:"resource"`                           // Collection acted on, such as adverts.
+	ResourceID string        `bson:"resource_id,omitempty" json:"resource_id,omitempty"` // ID of the document acted on.
+	Changes    []diff.Change `bson:"changes,omitempty" json:"changes,omitempty"`         // Filled in by handlers that know the state before and after.
+	Status     int           `bson:"status" json:"status"`                               // HTTP status of the response.
+	Outcome    string        `bson:"outcome" json:"outcome"`                             // One of the Outcome constants.
+	SourceIP   string        `bson:"source_ip" json:"source_ip"`
+	UserAgent  string        `bson:"user_agent" json:"user_agent"`
+	TraceID    string        `bson:"trace_id" json:"trace_id"`
+	Date       time.Time     `bson:"date" json:"date"`
+	PrevHash   string        `bson:"prev_hash" json:"prev_hash"` // Hash of the entry before, empty for the first.
+	Hash       string        `bson:"hash" json:"hash"`           // SHA-256 of this entry and PrevHash.
+}
+
+// Filter restricts the entries returned by List. Empty fields are ignored.
+// Entries from From up to but not including To are returned, newest first,
+// and Before pages back through the log by returning entries with a lower
+// sequence number.
+type Filter struct {
+	Actor      string
+	Action     string
+	Resource   string
+	ResourceID string
+	Outcome    string
+	From       time.Time
+	To         time.Time
+	Before     int64
+	Limit      int
+}
+
+// Verification is the result of checking the hash chains.
+type Verification struct {
+	Entries  int64         `json:"entries"` // Number of entries checked.
+	Valid    bool          `json:"valid"`
+	TenantID bson.ObjectId `json:"tenant_id,omitempty"` // Tenant whose chain is broken, empty for every tenant.
+	Seq      int64         `json:"seq,omitempty"`       // First entry found to be broken.
+	Reason   string        `json:"reason,omitempty"`    // How the chain is broken there.
+}
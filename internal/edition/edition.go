@@ -0,0 +1,326 @@
+package edition
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const editionsCollection = "editions"
+
+// EventSource names the collection whose editions carry the events raised by
+// writes to them until they are moved to the outbox.
+const EventSource = editionsCollection
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the edition
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current edition")
+
+	// ErrDuplicate occurs when an edition with the same name already exists
+	// for the year.
+	ErrDuplicate = errors.New("Edition already exists for the year")
+)
+
+// nameIndex makes sure an edition name is used once per year by a tenant.
+var nameIndex = mgo.Index{
+	Key:    []string{"tenant_id", "year", "name"},
+	Unique: true,
+}
+
+// List retrieves the editions from the database in publication order. An
+// empty year lists every edition.
+func List(ctx context.Context, dbConn *db.DB, year string) ([]Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.List")
+	defer span.End()
+
+	q := bson.M{}
+	if year != "" {
+		q["year"] = year
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	e := []Edition{}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("publication_date").All(&e)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.find(%s)", db.Query(q)))
+	}
+
+	return e, nil
+}
+
+// Retrieve gets the specified edition from the database.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var e *Edition
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&e)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.find(%s)", db.Query(q)))
+	}
+
+	return e, nil
+}
+
+// Lookup gets the editions of a year with the given names, keyed by name.
+// Names with no edition are missing from the result. Every tenant has its own
+// editions, so ctx must be scoped to a single tenant.
+func Lookup(ctx context.Context, dbConn *db.DB, year string, names []string) (map[string]Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Lookup")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := bson.M{"tenant_id": tid, "year": year, "name": bson.M{"$in": names}}
+
+	var found []Edition
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).All(&found)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.find(%s)", db.Query(q)))
+	}
+
+	m := make(map[string]Edition, len(found))
+	for _, e := range found {
+		m[e.Name] = e
+	}
+
+	return m, nil
+}
+
+// Create inserts a new edition into the database.
+func Create(ctx context.Context, dbConn *db.DB, ne *NewEdition, now time.Time) (*Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Create")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDates(ne.PublicationDate, ne.CopyDeadline); err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	e := Edition{
+		ID:              bson.NewObjectId(),
+		TenantID:        tid,
+		Name:            ne.Name,
+		Year:            ne.Year,
+		PublicationDate: ne.PublicationDate.Truncate(time.Millisecond),
+		CopyDeadline:    ne.CopyDeadline.Truncate(time.Millisecond),
+		Status:          ne.Status,
+		Version:         1,
+		DateCreated:     now,
+		DateModified:    now,
+	}
+	if e.Status == "" {
+		e.Status = StatusOpen
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(nameIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&e)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.insert(%s)", db.Query(&e)))
+	}
+
+	return &e, nil
+}
+
+// Update modifies an edition in the database. The write only succeeds if
+// version is still the current version of the edition.
+func Update(ctx context.Context, dbConn *db.DB, id string, version int, upd *UpdateEdition, now time.Time) (*Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Update")
+	defer span.End()
+
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bson.M{}
+
+	pub, deadline := cur.PublicationDate, cur.CopyDeadline
+	if upd.PublicationDate != nil {
+		pub = upd.PublicationDate.Truncate(time.Millisecond)
+		fields["publication_date"] = pub
+	}
+	if upd.CopyDeadline != nil {
+		deadline = upd.CopyDeadline.Truncate(time.Millisecond)
+		fields["copy_deadline"] = deadline
+	}
+	if err := checkDates(pub, deadline); err != nil {
+		return nil, err
+	}
+	if upd.Status != nil {
+		fields["status"] = *upd.Status
+	}
+
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	q := bson.M{"_id": cur.ID, "version": db.Version(version)}
+
+	// A new deadline is announced again when it comes up.
+	if upd.CopyDeadline != nil {
+		m["$unset"] = bson.M{"deadline_reminded": ""}
+	}
+
+	var e Edition
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+		return err
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &e, nil
+}
+
+// Delete removes an edition from the database. The delete only succeeds if
+// version is still the current version of the edition.
+func Delete(ctx context.Context, dbConn *db.DB, id string, version int) error {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Delete")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Remove(q)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.editions.remove(%s)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// RemindDeadlines raises an edition.deadline event for each open edition
+// whose copy deadline falls within the given time of now and has not been
+// announced yet. It returns the editions the event was raised for.
+func RemindDeadlines(ctx context.Context, dbConn *db.DB, within time.Duration, now time.Time) ([]Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.RemindDeadlines")
+	defer span.End()
+
+	now = now.Truncate(time.Millisecond)
+
+	q := bson.M{
+		"status":            StatusOpen,
+		"copy_deadline":     bson.M{"$gt": now, "$lte": now.Add(within)},
+		"deadline_reminded": bson.M{"$exists": false},
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var due []Edition
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("copy_deadline").All(&due)
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.editions.find(%s)", db.Query(q)))
+	}
+
+	reminded := []Edition{}
+	for _, d := range due {
+
+		// The edition is checked again as it is marked, so an edition
+		// changed or announced since it was found is left alone.
+		ev := event.New(event.EditionDeadline, event.AggregateEdition, d.ID, "", now)
+		ev.Data = bson.M{"copy_deadline": d.CopyDeadline}
+
+		uq := bson.M{"_id": d.ID, "copy_deadline": d.CopyDeadline, "deadline_reminded": bson.M{"$exists": false}}
+		m := event.Push(bson.M{"$set": bson.M{"deadline_reminded": now}}, ev)
+
+		var e Edition
+		f := func(collection *mgo.Collection) error {
+			_, err := collection.Find(uq).Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+			return err
+		}
+		if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+			if err == mgo.ErrNotFound {
+				continue
+			}
+			return reminded, errors.Wrap(err, fmt.Sprintf("db.editions.update(%s, %s)", db.Query(uq), db.Query(m)))
+		}
+		reminded = append(reminded, e)
+	}
+
+	return reminded, nil
+}
+
+// checkDates makes sure copy is due before the edition is published.
+func checkDates(pub, deadline time.Time) error {
+	if !deadline.Before(pub) {
+		return web.NewFieldErrors(web.FieldError{
+			Field: "copy_deadline",
+			Error: "copy_deadline must be before publication_date",
+		})
+	}
+	return nil
+}
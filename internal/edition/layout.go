@@ -0,0 +1,245 @@
+package edition
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrFull occurs when an edition has no free slot for the size of an
+	// advert being booked into it.
+	ErrFull = errors.New("Edition has no free slot for the advert size")
+
+	// ErrLayoutInUse occurs when a new layout drops or resizes a slot that an
+	// advert holds.
+	ErrLayoutInUse = errors.New("Layout removes a slot held by an advert")
+)
+
+// Sizes lists the sizes of advert from smallest.
+var Sizes = []string{"eighth", "quarter", "half", "full", "spread"}
+
+// Capacity counts the slots of the edition by size, smallest size first.
+func (e *Edition) Capacity() []Capacity {
+	bySize := make(map[string]*Capacity)
+	for _, s := range e.Slots {
+		c, ok := bySize[s.Size]
+		if !ok {
+			c = &Capacity{Size: s.Size}
+			bySize[s.Size] = c
+		}
+		c.Slots++
+		if s.AdvertID != nil {
+			c.Booked++
+		} else {
+			c.Free++
+		}
+	}
+
+	caps := []Capacity{}
+	for _, size := range Sizes {
+		if c, ok := bySize[size]; ok {
+			caps = append(caps, *c)
+		}
+	}
+	return caps
+}
+
+// SetLayout plans the pages and ad slots of an edition. Adverts keep the
+// slots they hold as long as the new layout has a slot of the same size at
+// the same page and position. The write only succeeds if version is still
+// the current version of the edition.
+func SetLayout(ctx context.Context, dbConn *db.DB, id string, version int, nl *NewLayout, now time.Time) (*Edition, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.SetLayout")
+	defer span.End()
+
+	type place struct{ page, position int }
+
+	var fields []web.FieldError
+	seen := make(map[place]bool, len(nl.Slots))
+	for i, s := range nl.Slots {
+		p := place{s.Page, s.Position}
+		switch {
+		case s.Page > nl.Pages:
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("slots[%d].page", i),
+				Error: fmt.Sprintf("page must be at most %d", nl.Pages),
+			})
+		case seen[p]:
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("slots[%d].position", i),
+				Error: fmt.Sprintf("page %d already has a slot at position %d", s.Page, s.Position),
+			})
+		}
+		seen[p] = true
+	}
+	if len(fields) > 0 {
+		return nil, web.NewFieldErrors(fields...)
+	}
+
+	// Slots are reserved without touching the version, so the write is also
+	// made conditional on the slots we read. A booking made in between means
+	// working the layout out again.
+	const attempts = 5
+	for i := 0; i < attempts; i++ {
+		cur, err := Retrieve(ctx, dbConn, id)
+		if err != nil {
+			return nil, err
+		}
+		if !web.VersionMatches(version, cur.Version) {
+			return nil, ErrVersionConflict
+		}
+
+		held := make(map[place]Slot)
+		for _, s := range cur.Slots {
+			if s.AdvertID != nil {
+				held[place{s.Page, s.Position}] = s
+			}
+		}
+
+		slots := make([]Slot, len(nl.Slots))
+		for i, s := range nl.Slots {
+			slots[i] = Slot{Page: s.Page, Position: s.Position, Size: s.Size}
+			p := place{s.Page, s.Position}
+			if h, ok := held[p]; ok && h.Size == s.Size {
+				slots[i].AdvertID = h.AdvertID
+				delete(held, p)
+			}
+		}
+		if len(held) > 0 {
+			return nil, ErrLayoutInUse
+		}
+
+		m := bson.M{
+			"$set": bson.M{
+				"pages":         nl.Pages,
+				"slots":         slots,
+				"date_modified": now.Truncate(time.Millisecond),
+			},
+			"$inc": bson.M{"version": 1},
+		}
+		q := bson.M{"_id": cur.ID, "version": db.Version(version), "slots": cur.Slots}
+		if len(cur.Slots) == 0 {
+			q["slots"] = bson.M{"$exists": false}
+		}
+
+		var e Edition
+		f := func(collection *mgo.Collection) error {
+			_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+			return err
+		}
+		err = dbConn.Execute(ctx, editionsCollection, f)
+		if err == nil {
+			return &e, nil
+		}
+		if err != mgo.ErrNotFound {
+			return nil, errors.Wrap(err, fmt.Sprintf("db.editions.update(%s, %s)", db.Query(q), db.Query(m)))
+		}
+	}
+
+	return nil, errors.Errorf("unable to set layout after %d attempts", attempts)
+}
+
+// Reserve takes a free slot of size in the named edition for an advert. It
+// does nothing if the advert already holds a slot of that size there or the
+// edition has no planned layout. The slot is taken in a single write so two
+// bookings can never be given the same slot. Editions are found by name, so
+// ctx must be scoped to a single tenant.
+func Reserve(ctx context.Context, dbConn *db.DB, year, name, size string, advertID bson.ObjectId) error {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Reserve")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return err
+	}
+
+	held := bson.M{"tenant_id": tid, "year": year, "name": name, "slots": bson.M{"$elemMatch": bson.M{"size": size, "advert_id": advertID}}}
+	free := bson.M{"tenant_id": tid, "year": year, "name": name, "slots": bson.M{"$elemMatch": bson.M{"size": size, "advert_id": bson.M{"$exists": false}}}}
+	m := bson.M{"$set": bson.M{"slots.$.advert_id": advertID}}
+
+	var n int
+	f := func(collection *mgo.Collection) error {
+		var err error
+		if n, err = collection.Find(held).Count(); err != nil || n > 0 {
+			return err
+		}
+		if err = collection.Update(free, m); err != mgo.ErrNotFound {
+			return err
+		}
+
+		// Nothing was free. That is only a problem if the layout is planned.
+		n, err = collection.Find(bson.M{"tenant_id": tid, "year": year, "name": name, "slots.0": bson.M{"$exists": true}}).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrFull
+		}
+		return nil
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		if err == ErrFull {
+			return err
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.editions.update(%s, %s)", db.Query(free), db.Query(m)))
+	}
+
+	return nil
+}
+
+// Release gives back the slots an advert holds, except those of size in the
+// editions of year named by keep. Passing no editions to keep gives back
+// every slot the advert holds.
+func Release(ctx context.Context, dbConn *db.DB, advertID bson.ObjectId, year, size string, keep []string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.edition.Release")
+	defer span.End()
+
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+
+	q := bson.M{"slots.advert_id": advertID}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	var holding []Edition
+	f := func(collection *mgo.Collection) error {
+		if err := collection.Find(q).All(&holding); err != nil {
+			return err
+		}
+
+		for _, e := range holding {
+			for i, s := range e.Slots {
+				if s.AdvertID == nil || *s.AdvertID != advertID {
+					continue
+				}
+				if e.Year == year && kept[e.Name] && s.Size == size {
+					continue
+				}
+
+				key := fmt.Sprintf("slots.%d.advert_id", i)
+				err := collection.Update(bson.M{"_id": e.ID, key: advertID}, bson.M{"$unset": bson.M{key: ""}})
+				if err != nil && err != mgo.ErrNotFound {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := dbConn.Execute(ctx, editionsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.editions.update(%s)", db.Query(q)))
+	}
+
+	return nil
+}
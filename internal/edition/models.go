@@ -0,0 +1,82 @@
+package edition
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the states an edition can be in. Adverts can only be booked into
+// an open edition.
+const (
+	StatusOpen   = "open"
+	StatusClosed = "closed"
+)
+
+// Edition is a single issue of the publication that adverts are booked into.
+// Adverts refer to editions by name within a year, and each tenant has its
+// own editions.
+type Edition struct {
+	ID               bson.ObjectId `bson:"_id" json:"id"`
+	TenantID         bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Name             string        `bson:"name" json:"name"`
+	Year             string        `bson:"year" json:"year"`
+	PublicationDate  time.Time     `bson:"publication_date" json:"publication_date"`
+	CopyDeadline     time.Time     `bson:"copy_deadline" json:"copy_deadline"`                             // Last day artwork is accepted.
+	DeadlineReminded *time.Time    `bson:"deadline_reminded,omitempty" json:"deadline_reminded,omitempty"` // When the copy deadline was announced as coming up.
+	Status           string        `bson:"status" json:"status"`
+	Pages            int           `bson:"pages,omitempty" json:"pages,omitempty"` // Printed pages, when the layout is planned.
+	Slots            []Slot        `bson:"slots,omitempty" json:"slots,omitempty"` // Ad positions, when the layout is planned.
+	Version          int           `bson:"version" json:"version"`
+	DateCreated      time.Time     `bson:"date_created" json:"date_created"`
+	DateModified     time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// Slot is a position on a page that holds one advert of a size. An edition
+// with no slots has no planned layout and takes any number of bookings.
+type Slot struct {
+	Page     int            `bson:"page" json:"page"`
+	Position int            `bson:"position" json:"position"` // Order of the slot on its page, from 1.
+	Size     string         `bson:"size" json:"size"`
+	AdvertID *bson.ObjectId `bson:"advert_id,omitempty" json:"advert_id,omitempty"` // Advert holding the slot.
+}
+
+// Capacity counts the slots of a size in an edition.
+type Capacity struct {
+	Size   string `json:"size"`
+	Slots  int    `json:"slots"`
+	Booked int    `json:"booked"`
+	Free   int    `json:"free"`
+}
+
+// NewEdition is what we require from clients when adding an Edition. The
+// status defaults to open.
+type NewEdition struct {
+	Name            string    `json:"name" validate:"required"`
+	Year            string    `json:"year" validate:"required"`
+	PublicationDate time.Time `json:"publication_date" validate:"required"`
+	CopyDeadline    time.Time `json:"copy_deadline" validate:"required"`
+	Status          string    `json:"status" validate:"omitempty,oneof=open closed"`
+}
+
+// UpdateEdition defines what information may be provided to modify an
+// existing Edition. The name and year cannot be changed because adverts refer
+// to the edition by them.
+type UpdateEdition struct {
+	PublicationDate *time.Time `json:"publication_date"`
+	CopyDeadline    *time.Time `json:"copy_deadline"`
+	Status          *string    `json:"status" validate:"omitempty,oneof=open closed"`
+}
+
+// NewLayout is what we require from clients to plan the pages of an Edition.
+type NewLayout struct {
+	Pages int       `json:"pages" validate:"required,min=1"`
+	Slots []NewSlot `json:"slots" validate:"required,min=1,dive"`
+}
+
+// NewSlot is a position on a page planned by a NewLayout.
+type NewSlot struct {
+	Page     int    `json:"page" validate:"required,min=1"`
+	Position int    `json:"position" validate:"required,min=1"`
+	Size     string `json:"size" validate:"required,oneof=eighth quarter half full spread"`
+}
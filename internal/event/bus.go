@@ -0,0 +1,85 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Handler handles an event delivered to a subscriber. Events are delivered at
+// least once, so a handler must cope with seeing the same event again.
+type Handler func(ctx context.Context, ev Event) error
+
+// subscription is a handler and the events it is delivered.
+type subscription struct {
+	handler Handler
+	names   map[string]bool // Empty for every event.
+}
+
+// Bus holds the in-process subscribers to events.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string]subscription
+}
+
+// NewBus returns a Bus with no subscribers.
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[string]subscription),
+	}
+}
+
+// Subscribe registers h under the name subscriber to be delivered the named
+// events, or every event when no names are given. The subscriber name is how
+// the outbox keeps track of who has handled an event, so it must stay the
+// same from one release to the next.
+func (b *Bus) Subscribe(subscriber string, h Handler, names ...string) {
+	s := subscription{
+		handler: h,
+		names:   make(map[string]bool, len(names)),
+	}
+	for _, n := range names {
+		s.names[n] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs[subscriber] = s
+}
+
+// subscribers returns the names of the subscribers to an event in order.
+func (b *Bus) subscribers(name string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var subs []string
+	for sub, s := range b.subs {
+		if len(s.names) == 0 || s.names[name] {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Strings(subs)
+
+	return subs
+}
+
+// handle delivers an event to a subscriber. A handler that panics is treated
+// as having failed.
+func (b *Bus) handle(ctx context.Context, subscriber string, ev Event) (err error) {
+	b.mu.RLock()
+	s, ok := b.subs[subscriber]
+	b.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return s.handler(ctx, ev)
+}
@@ -0,0 +1,347 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sourceIndex supports finding the aggregates holding events that have not
+// been moved to the outbox.
+var sourceIndex = mgo.Index{
+	Key:    []string{"outbox._id"},
+	Sparse: true,
+}
+
+// batchSize is the most aggregates or staged events looked at in one pass.
+const batchSize = 100
+
+// failureLimit is the most failures kept for an event.
+const failureLimit = 20
+
+// Dispatcher moves events from the aggregates that raised them to the outbox
+// and delivers them to the subscribers on a Bus. Several dispatchers can share
+// an outbox; each event is claimed by one of them at a time.
+type Dispatcher struct {
+	MasterDB *db.DB
+	Bus      *Bus
+	Log      *log.Logger
+	Sources  []string // Collections whose documents carry events.
+
+	Interval    time.Duration // How often to look for due events.
+	Lease       time.Duration // How long a claim on an event lasts.
+	Grace       time.Duration // How long a staged event waits to be released or discarded.
+	MaxAttempts int           // Attempts before an event is given up on.
+	Backoff     time.Duration // Wait before the first retry, doubled for each one after.
+	MaxBackoff  time.Duration // Longest wait between retries.
+}
+
+// NewDispatcher returns a Dispatcher that delivers the events raised in the
+// sources collections to the subscribers on bus, retrying for about four
+// hours before giving up.
+func NewDispatcher(masterDB *db.DB, bus *Bus, log *log.Logger, sources ...string) *Dispatcher {
+	return &Dispatcher{
+		MasterDB:    masterDB,
+		Bus:         bus,
+		Log:         log,
+		Sources:     sources,
+		Interval:    time.Second,
+		Lease:       time.Minute,
+		Grace:       time.Minute,
+		MaxAttempts: 10,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  6 * time.Hour,
+	}
+}
+
+// Run delivers events as they come due until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+
+	for {
+		if _, err := d.RunOnce(ctx, time.Now()); err != nil {
+			d.Log.Printf("event : dispatching : %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce moves new events to the outbox, settles staged events and delivers
+// every event due by now. It reports how many events were tried, whether or
+// not every subscriber handled them.
+func (d *Dispatcher) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Dispatcher.RunOnce")
+	defer span.End()
+
+	dbConn := d.MasterDB.Copy()
+	defer dbConn.Close()
+
+	for _, source := range d.Sources {
+		if err := d.relay(ctx, dbConn, source, now); err != nil {
+			return 0, err
+		}
+	}
+	if err := d.settle(ctx, dbConn, now); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for ctx.Err() == nil {
+		e, err := d.claim(ctx, dbConn, now)
+		if err != nil {
+			return n, err
+		}
+		if e == nil {
+			break
+		}
+		if err := d.deliver(ctx, dbConn, e, now); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// relay moves the events carried by documents in source to the outbox. An
+// event is written to the outbox before it is taken off its document, so a
+// dispatcher stopping part way through leaves it to be moved again rather
+// than lost.
+func (d *Dispatcher) relay(ctx context.Context, dbConn *db.DB, source string, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Dispatcher.relay")
+	defer span.End()
+
+	now = now.Truncate(time.Millisecond)
+
+	var docs []struct {
+		ID       bson.ObjectId `bson:"_id"`
+		TenantID bson.ObjectId `bson:"tenant_id,omitempty"`
+		Outbox   []Event       `bson:"outbox"`
+	}
+
+	q := bson.M{"outbox._id": bson.M{"$exists": true}}
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(sourceIndex); err != nil {
+			return err
+		}
+		return collection.Find(q).Select(bson.M{"tenant_id": 1, outboxField: 1}).Limit(batchSize).All(&docs)
+	}
+	if err := dbConn.Execute(ctx, source, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.%s.find(%s)", source, db.Query(q)))
+	}
+
+	for _, doc := range docs {
+		ids := make([]bson.ObjectId, len(doc.Outbox))
+		for i, ev := range doc.Outbox {
+			ids[i] = ev.ID
+			ev.TenantID = doc.TenantID
+			e := Entry{
+				Event:        ev,
+				Source:       source,
+				Status:       StatusPending,
+				Handled:      []string{},
+				NextAttempt:  now,
+				Failures:     []Failure{},
+				DateCreated:  ev.Date,
+				DateModified: now,
+			}
+
+			// An event already in the outbox was moved by a relay that
+			// stopped before taking it off its document.
+			f := func(collection *mgo.Collection) error {
+				if err := collection.EnsureIndex(dueIndex); err != nil {
+					return err
+				}
+				if err := collection.EnsureIndex(logIndex); err != nil {
+					return err
+				}
+				if err := collection.Insert(&e); err != nil && !mgo.IsDup(err) {
+					return err
+				}
+				return nil
+			}
+			if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("db.outbox.insert(%s)", db.Query(&e)))
+			}
+		}
+
+		q := bson.M{"_id": doc.ID}
+		m := bson.M{"$pull": bson.M{outboxField: bson.M{"_id": bson.M{"$in": ids}}}}
+		f := func(collection *mgo.Collection) error {
+			err := collection.Update(q, m)
+			if err == mgo.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		if err := dbConn.Execute(ctx, source, f); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("db.%s.update(%s, %s)", source, db.Query(q), db.Query(m)))
+		}
+	}
+
+	return nil
+}
+
+// settle decides the fate of staged events that were neither released nor
+// discarded within the grace period. The event is released when its aggregate
+// is gone and discarded when it is still there.
+func (d *Dispatcher) settle(ctx context.Context, dbConn *db.DB, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Dispatcher.settle")
+	defer span.End()
+
+	q := bson.M{"status": StatusStaged, "date_created": bson.M{"$lte": now.Add(-d.Grace)}}
+
+	var staged []Entry
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Limit(batchSize).All(&staged)
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.find(%s)", db.Query(q)))
+	}
+
+	for _, e := range staged {
+		q := bson.M{"_id": e.AggregateID}
+
+		var n int
+		f := func(collection *mgo.Collection) error {
+			var err error
+			n, err = collection.Find(q).Count()
+			return err
+		}
+		if err := dbConn.Execute(ctx, e.Source, f); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("db.%s.count(%s)", e.Source, db.Query(q)))
+		}
+
+		var err error
+		if n == 0 {
+			err = release(ctx, dbConn, e.ID, now)
+		} else {
+			err = discard(ctx, dbConn, e.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// claim takes the event that has been due longest, or returns nil when none
+// is due.
+func (d *Dispatcher) claim(ctx context.Context, dbConn *db.DB, now time.Time) (*Entry, error) {
+	q := bson.M{
+		"status":       bson.M{"$in": []string{StatusPending, StatusDelivering}},
+		"next_attempt": bson.M{"$lte": now},
+	}
+	m := bson.M{"$set": bson.M{
+		"status":       StatusDelivering,
+		"next_attempt": now.Add(d.Lease).Truncate(time.Millisecond),
+	}}
+
+	var e Entry
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Sort("next_attempt").Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+		return err
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.outbox.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &e, nil
+}
+
+// deliver hands a claimed event to every subscriber that has not yet handled
+// it and records the outcome.
+func (d *Dispatcher) deliver(ctx context.Context, dbConn *db.DB, e *Entry, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Dispatcher.deliver")
+	defer span.End()
+
+	handled := make(map[string]bool, len(e.Handled))
+	for _, sub := range e.Handled {
+		handled[sub] = true
+	}
+
+	date := now.Truncate(time.Millisecond)
+
+	var done []string
+	var failures []Failure
+	for _, sub := range d.Bus.subscribers(e.Name) {
+		if handled[sub] {
+			continue
+		}
+		if err := d.Bus.handle(ctx, sub, e.Event); err != nil {
+			failures = append(failures, Failure{Subscriber: sub, Error: err.Error(), Date: date})
+			continue
+		}
+		done = append(done, sub)
+	}
+
+	tries := e.Tries + 1
+	fields := bson.M{
+		"tries":         tries,
+		"date_modified": date,
+	}
+	switch {
+	case len(failures) == 0:
+		fields["status"] = StatusDelivered
+	case tries >= d.MaxAttempts:
+		fields["status"] = StatusDead
+		d.Log.Printf("event : %s %s : given up after %d attempts : %s", e.Name, e.ID.Hex(), tries, failures[0].Error)
+	default:
+		fields["status"] = StatusPending
+		fields["next_attempt"] = now.Add(d.backoff(tries)).Truncate(time.Millisecond)
+	}
+
+	m := bson.M{"$set": fields}
+	if len(done) > 0 {
+		m["$addToSet"] = bson.M{"handled": bson.M{"$each": done}}
+	}
+	if len(failures) > 0 {
+		m["$push"] = bson.M{"failures": bson.M{"$each": failures, "$slice": -failureLimit}}
+	}
+
+	// The claim is checked so a dispatcher whose lease lapsed does not
+	// overwrite the outcome recorded by the one that took over.
+	q := bson.M{"_id": e.ID, "status": StatusDelivering, "next_attempt": e.NextAttempt}
+
+	f := func(collection *mgo.Collection) error {
+		err := collection.Update(q, m)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// backoff returns how long to wait after the given number of tries.
+func (d *Dispatcher) backoff(tries int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < tries && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
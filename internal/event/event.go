@@ -0,0 +1,336 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const outboxCollection = "outbox"
+
+// outboxField is the field of an aggregate holding the events raised by the
+// write that last changed it until they are moved to the outbox.
+const outboxField = "outbox"
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrNotDead occurs when retrying an event that has not been given up on.
+	ErrNotDead = errors.New("Event has not been given up on")
+)
+
+// dueIndex supports finding the events that are due.
+var dueIndex = mgo.Index{
+	Key: []string{"status", "next_attempt"},
+}
+
+// logIndex supports listing the events in the outbox, newest first.
+var logIndex = mgo.Index{
+	Key: []string{"status", "-date_created"},
+}
+
+// listLimit is the most events List returns.
+const listLimit = 100
+
+// New returns an event about the aggregate with the given ID.
+func New(name, aggregate string, id bson.ObjectId, actor string, now time.Time) Event {
+	return Event{
+		ID:          bson.NewObjectId(),
+		Name:        name,
+		Aggregate:   aggregate,
+		AggregateID: id,
+		Actor:       actor,
+		Date:        now.Truncate(time.Millisecond),
+	}
+}
+
+// Push adds evs to the update m so they are written in the same operation as
+// the change they record.
+func Push(m bson.M, evs ...Event) bson.M {
+	push, ok := m["$push"].(bson.M)
+	if !ok {
+		push = bson.M{}
+		m["$push"] = push
+	}
+	push[outboxField] = bson.M{"$each": evs}
+	return m
+}
+
+// Attach returns doc with evs added so they are inserted in the same operation
+// as the document they record.
+func Attach(doc interface{}, evs ...Event) (bson.D, error) {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding document")
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, errors.Wrap(err, "decoding document")
+	}
+	return append(d, bson.DocElem{Name: outboxField, Value: evs}), nil
+}
+
+// Stage writes an event to the outbox ahead of removing its aggregate from
+// source, since a removed document cannot carry it. The event is held back
+// until Release or Discard says what became of the removal. Should neither be
+// called the dispatcher settles it by checking whether the aggregate is gone.
+func Stage(ctx context.Context, dbConn *db.DB, source string, ev Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Stage")
+	defer span.End()
+
+	// The aggregate will be gone by the time the event is delivered, so its
+	// tenant is taken now.
+	var agg struct {
+		TenantID bson.ObjectId `bson:"tenant_id,omitempty"`
+	}
+	q := bson.M{"_id": ev.AggregateID}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Select(bson.M{"tenant_id": 1}).One(&agg)
+	}
+	if err := dbConn.Execute(ctx, source, f); err != nil && err != mgo.ErrNotFound {
+		return errors.Wrap(err, fmt.Sprintf("db.%s.find(%s)", source, db.Query(q)))
+	}
+	ev.TenantID = agg.TenantID
+
+	e := Entry{
+		Event:        ev,
+		Source:       source,
+		Status:       StatusStaged,
+		Handled:      []string{},
+		NextAttempt:  ev.Date,
+		Failures:     []Failure{},
+		DateCreated:  ev.Date,
+		DateModified: ev.Date,
+	}
+
+	f = func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(dueIndex); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(logIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&e)
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.insert(%s)", db.Query(&e)))
+	}
+
+	return nil
+}
+
+// Enqueue writes an event that no aggregate carries straight to the outbox
+// for delivery. Source names the collection the event is about.
+func Enqueue(ctx context.Context, dbConn *db.DB, source string, ev Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Enqueue")
+	defer span.End()
+
+	e := Entry{
+		Event:        ev,
+		Source:       source,
+		Status:       StatusPending,
+		Handled:      []string{},
+		NextAttempt:  ev.Date,
+		Failures:     []Failure{},
+		DateCreated:  ev.Date,
+		DateModified: ev.Date,
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(dueIndex); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(logIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&e)
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.insert(%s)", db.Query(&e)))
+	}
+
+	return nil
+}
+
+// Release queues a staged event for delivery once its aggregate is removed.
+func Release(ctx context.Context, dbConn *db.DB, id bson.ObjectId, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Release")
+	defer span.End()
+
+	return release(ctx, dbConn, id, now)
+}
+
+// release moves a staged event on to pending.
+func release(ctx context.Context, dbConn *db.DB, id bson.ObjectId, now time.Time) error {
+	now = now.Truncate(time.Millisecond)
+
+	q := bson.M{"_id": id, "status": StatusStaged}
+	m := bson.M{"$set": bson.M{
+		"status":        StatusPending,
+		"next_attempt":  now,
+		"date_modified": now,
+	}}
+
+	f := func(collection *mgo.Collection) error {
+		err := collection.Update(q, m)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// Discard drops a staged event whose aggregate was not removed after all.
+func Discard(ctx context.Context, dbConn *db.DB, id bson.ObjectId) error {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Discard")
+	defer span.End()
+
+	return discard(ctx, dbConn, id)
+}
+
+// discard removes a staged event from the outbox.
+func discard(ctx context.Context, dbConn *db.DB, id bson.ObjectId) error {
+	q := bson.M{"_id": id, "status": StatusStaged}
+
+	f := func(collection *mgo.Collection) error {
+		err := collection.Remove(q)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.outbox.remove(%s)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// List retrieves the most recent events in the outbox with the given status,
+// newest first. An empty status lists events whatever their status.
+func List(ctx context.Context, dbConn *db.DB, status string) ([]Entry, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.List")
+	defer span.End()
+
+	q := bson.M{}
+	if status != "" {
+		q["status"] = status
+	}
+
+	es := []Entry{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-date_created").Limit(listLimit).All(&es)
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.outbox.find(%s)", db.Query(q)))
+	}
+
+	return es, nil
+}
+
+// Retry queues an event that was given up on to be delivered again straight
+// away to the subscribers that have not handled it.
+func Retry(ctx context.Context, dbConn *db.DB, id string, now time.Time) (*Entry, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Retry")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "status": StatusDead}
+	m := bson.M{"$set": bson.M{
+		"status":        StatusPending,
+		"tries":         0,
+		"next_attempt":  now,
+		"date_modified": now,
+	}}
+
+	var e Entry
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+		if err == mgo.ErrNotFound {
+			delete(q, "status")
+			if n, cerr := collection.Find(q).Count(); cerr != nil {
+				return cerr
+			} else if n > 0 {
+				return ErrNotDead
+			}
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+		if err == ErrNotDead || err == ErrNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.outbox.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &e, nil
+}
+
+// purgeBatch is the most events removed by one write when purging.
+const purgeBatch = 1000
+
+// Purge removes the events delivered before the given time and reports how
+// many were removed. Events that were given up on are kept until they are
+// retried. It works in batches and stops between them when ctx is cancelled.
+func Purge(ctx context.Context, dbConn *db.DB, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.event.Purge")
+	defer span.End()
+
+	q := bson.M{"status": StatusDelivered, "date_modified": bson.M{"$lt": before}}
+
+	var n int
+	for ctx.Err() == nil {
+		var docs []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		f := func(collection *mgo.Collection) error {
+			return collection.Find(q).Select(bson.M{"_id": 1}).Limit(purgeBatch).All(&docs)
+		}
+		if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.outbox.find(%s)", db.Query(q)))
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		ids := make([]bson.ObjectId, len(docs))
+		for i, d := range docs {
+			ids[i] = d.ID
+		}
+
+		rq := bson.M{"_id": bson.M{"$in": ids}}
+		f = func(collection *mgo.Collection) error {
+			info, err := collection.RemoveAll(rq)
+			if info != nil {
+				n += info.Removed
+			}
+			return err
+		}
+		if err := dbConn.Execute(ctx, outboxCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.outbox.remove(%d events)", len(ids)))
+		}
+	}
+
+	return n, ctx.Err()
+}
@@ -0,0 +1,79 @@
+package event
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the domain events raised by writes to adverts, editions and
+// users, and the events carrying an audit entry or an advert revision that
+// is waiting to be appended to its log.
+const (
+	AdvertCreated      = "advert.created"
+	AdvertUpdated      = "advert.updated"
+	AdvertTransitioned = "advert.transitioned"
+	AdvertDeleted      = "advert.deleted"
+	EditionDeadline    = "edition.deadline"
+	UserCreated        = "user.created"
+	UserUpdated        = "user.updated"
+	UserDeleted        = "user.deleted"
+	CommentCreated     = "comment.created"
+	CommentUpdated     = "comment.updated"
+	CommentDeleted     = "comment.deleted"
+	AuditQueued        = "audit.queued"
+	RevisionQueued     = "revision.queued"
+)
+
+// These are the aggregates events are raised about.
+const (
+	AggregateAdvert   = "advert"
+	AggregateEdition  = "edition"
+	AggregateUser     = "user"
+	AggregateComment  = "comment"
+	AggregateAudit    = "audit"
+	AggregateRevision = "revision"
+)
+
+// These are the expected values for Entry.Status.
+const (
+	StatusStaged     = "staged"     // Written ahead of a delete that may not happen.
+	StatusPending    = "pending"    // Waiting for its next attempt.
+	StatusDelivering = "delivering" // Being handed to subscribers by a dispatcher.
+	StatusDelivered  = "delivered"  // Handled by every subscriber.
+	StatusDead       = "dead"       // Given up on after too many attempts.
+)
+
+// Event records that an aggregate changed. Events name what changed rather
+// than carry it; subscribers that need the new state retrieve it.
+type Event struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Name        string        `bson:"name" json:"name"`
+	Aggregate   string        `bson:"aggregate" json:"aggregate"`
+	AggregateID bson.ObjectId `bson:"aggregate_id" json:"aggregate_id"`
+	TenantID    bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"` // Tenant of the aggregate, filled in from it by the outbox.
+	Actor       string        `bson:"actor,omitempty" json:"actor,omitempty"`         // Subject of the user who made the change.
+	Data        bson.M        `bson:"data,omitempty" json:"data,omitempty"`           // Details particular to the event.
+	Date        time.Time     `bson:"date" json:"date"`
+}
+
+// Failure records a subscriber failing to handle an event.
+type Failure struct {
+	Subscriber string    `bson:"subscriber" json:"subscriber"`
+	Error      string    `bson:"error" json:"error"`
+	Date       time.Time `bson:"date" json:"date"`
+}
+
+// Entry is an event in the outbox together with the state of its delivery to
+// subscribers.
+type Entry struct {
+	Event        `bson:",inline"`
+	Source       string    `bson:"source" json:"source"`   // Collection holding the aggregate.
+	Status       string    `bson:"status" json:"status"`   // Status constants.
+	Handled      []string  `bson:"handled" json:"handled"` // Subscribers that have handled the event.
+	Tries        int       `bson:"tries" json:"tries"`
+	NextAttempt  time.Time `bson:"next_attempt" json:"next_attempt"`
+	Failures     []Failure `bson:"failures" json:"failures"` // The most recent failures, oldest first.
+	DateCreated  time.Time `bson:"date_created" json:"date_created"`
+	DateModified time.Time `bson:"date_modified" json:"date_modified"`
+}
@@ -0,0 +1,502 @@
+package invoice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const invoicesCollection = "invoices"
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the invoice
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current invoice")
+
+	// ErrStatus occurs when a change is not allowed in the invoice's status.
+	ErrStatus = errors.New("Invoice status does not allow this change")
+)
+
+// numberIndex makes sure no two invoices of a tenant share a number, so each
+// tenant has its own sequence. Drafts have no number, and as a sparse compound
+// index would still hold every draft under its tenant, the index is partial.
+// mgo.Index cannot describe a partial index so it is built by ensureNumberIndex.
+var numberIndex = bson.M{
+	"name":   "tenant_id_1_number_1",
+	"key":    bson.D{{Name: "tenant_id", Value: 1}, {Name: "number", Value: 1}},
+	"unique": true,
+	"partialFilterExpression": bson.M{
+		"number": bson.M{"$exists": true},
+	},
+}
+
+// ensureNumberIndex builds numberIndex on the collection if it is not there.
+func ensureNumberIndex(collection *mgo.Collection) error {
+	cmd := bson.D{
+		{Name: "createIndexes", Value: collection.Name},
+		{Name: "indexes", Value: []bson.M{numberIndex}},
+	}
+	return collection.Database.Run(cmd, nil)
+}
+
+// billedIndex stops an advert from being on two invoices that have not been
+// voided. Voiding an invoice unsets its billed adverts so they can be invoiced
+// again.
+var billedIndex = mgo.Index{
+	Key:    []string{"billed_adverts"},
+	Unique: true,
+	Sparse: true,
+}
+
+// issueAttempts bounds how often issuing retries after losing a race for the
+// next number to another writer.
+const issueAttempts = 10
+
+// List retrieves the invoices matching the filter, newest first.
+func List(ctx context.Context, dbConn *db.DB, flt Filter) ([]Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.List")
+	defer span.End()
+
+	q := bson.M{}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+	if bson.IsObjectIdHex(flt.AdvertiserID) {
+		q["advertiser_id"] = bson.ObjectIdHex(flt.AdvertiserID)
+	}
+	if flt.Status != "" {
+		q["status"] = flt.Status
+	}
+
+	inv := []Invoice{}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-date_created").All(&inv)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.find(%s)", db.Query(q)))
+	}
+
+	return inv, nil
+}
+
+// Retrieve gets the specified invoice from the database.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var inv *Invoice
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&inv)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.find(%s)", db.Query(q)))
+	}
+
+	return inv, nil
+}
+
+// Create drafts an invoice for adverts booked by an advertiser. Each advert
+// becomes a line charged at the price stored on it. An advert can only be on
+// one invoice that has not been voided.
+func Create(ctx context.Context, claims auth.Claims, dbConn *db.DB, ni *NewInvoice, now time.Time) (*Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.Create")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	adv, err := advertiser.Retrieve(ctx, dbConn, ni.AdvertiserID)
+	if err != nil {
+		if err == advertiser.ErrInvalidID || err == advertiser.ErrNotFound {
+			return nil, web.NewFieldErrors(web.FieldError{
+				Field: "advertiser_id",
+				Error: "advertiser_id must name an existing advertiser",
+			})
+		}
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	inv := Invoice{
+		ID:             bson.NewObjectId(),
+		TenantID:       tid,
+		Status:         StatusDraft,
+		AdvertiserID:   adv.ID,
+		Advertiser:     adv.Name,
+		BillingAddress: adv.BillingAddress,
+		Lines:          make([]Line, 0, len(ni.AdvertIDs)),
+		Terms:          ni.Terms,
+		CreatedBy:      claims.Subject,
+		Version:        1,
+		DateCreated:    now,
+		DateModified:   now,
+	}
+	if inv.Terms == 0 {
+		inv.Terms = DefaultTerms
+	}
+
+	var fields []web.FieldError
+	ids := make([]bson.ObjectId, 0, len(ni.AdvertIDs))
+	for i, id := range ni.AdvertIDs {
+		field := fmt.Sprintf("advert_ids[%d]", i)
+
+		a, err := advert.Retrieve(ctx, dbConn, id)
+		if err != nil {
+			if err == advert.ErrInvalidID || err == advert.ErrNotFound {
+				fields = append(fields, web.FieldError{Field: field, Error: "advert does not exist"})
+				continue
+			}
+			return nil, err
+		}
+
+		switch {
+		case a.AdvertiserID != adv.ID:
+			fields = append(fields, web.FieldError{Field: field, Error: "advert is booked for another advertiser"})
+			continue
+		case a.Price == nil:
+			fields = append(fields, web.FieldError{Field: field, Error: "advert has not been priced"})
+			continue
+		case inv.Currency != "" && a.Price.Currency != inv.Currency:
+			fields = append(fields, web.FieldError{Field: field, Error: fmt.Sprintf("advert is priced in %s, not %s", a.Price.Currency, inv.Currency)})
+			continue
+		}
+
+		inv.Currency = a.Price.Currency
+		if inv.TaxName == "" {
+			inv.TaxName = a.Price.TaxName
+		}
+
+		l := Line{
+			AdvertID:    a.ID,
+			Description: fmt.Sprintf("%s page advert, %s %s", capitalize(a.Size), strings.Join(a.Editions, ", "), a.Year),
+			Net:         a.Price.Total - a.Price.Tax,
+			Tax:         a.Price.Tax,
+			Total:       a.Price.Total,
+		}
+		inv.Lines = append(inv.Lines, l)
+		inv.Net += l.Net
+		inv.Tax += l.Tax
+		inv.Total += l.Total
+		ids = append(ids, a.ID)
+	}
+	if len(fields) > 0 {
+		return nil, web.NewFieldErrors(fields...)
+	}
+
+	if err := checkInvoiced(ctx, dbConn, ids); err != nil {
+		return nil, err
+	}
+
+	// The check above gives a helpful error for adverts already invoiced. The
+	// unique index on billed adverts catches one invoiced since.
+	inv.Billed = ids
+
+	f := func(collection *mgo.Collection) error {
+		if err := ensureNumberIndex(collection); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(billedIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&inv)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			if err := checkInvoiced(ctx, dbConn, ids); err != nil {
+				return nil, err
+			}
+			return nil, web.NewFieldErrors(web.FieldError{
+				Field: "advert_ids",
+				Error: "an advert was invoiced at the same time",
+			})
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.insert(%s)", db.Query(&inv)))
+	}
+
+	return &inv, nil
+}
+
+// checkInvoiced fails with a field error for each advert that is already on an
+// invoice that has not been voided.
+func checkInvoiced(ctx context.Context, dbConn *db.DB, ids []bson.ObjectId) error {
+	billed, err := invoiced(ctx, dbConn, ids)
+	if err != nil {
+		return err
+	}
+
+	var fields []web.FieldError
+	for i, id := range ids {
+		if num, ok := billed[id]; ok {
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("advert_ids[%d]", i),
+				Error: fmt.Sprintf("advert is already on invoice %s", num),
+			})
+		}
+	}
+	if len(fields) > 0 {
+		return web.NewFieldErrors(fields...)
+	}
+
+	return nil
+}
+
+// invoiced finds which of the adverts are already on an invoice that has not
+// been voided. It maps each to the invoice reference, or ID for a draft.
+func invoiced(ctx context.Context, dbConn *db.DB, ids []bson.ObjectId) (map[bson.ObjectId]string, error) {
+	q := bson.M{
+		"lines.advert_id": bson.M{"$in": ids},
+		"status":          bson.M{"$ne": StatusVoid},
+	}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var found []Invoice
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).All(&found)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.find(%s)", db.Query(q)))
+	}
+
+	m := make(map[bson.ObjectId]string)
+	for _, inv := range found {
+		ref := inv.Reference()
+		if ref == "" {
+			ref = inv.ID.Hex()
+		}
+		for _, l := range inv.Lines {
+			m[l.AdvertID] = ref
+		}
+	}
+
+	return m, nil
+}
+
+// Issue gives a draft invoice its tenant's next number and fixes its contents.
+// Numbers are taken in the same write that issues the invoice and the unique
+// index on tenant and number rejects a number another writer took first, so
+// each tenant's sequence has no gaps and no duplicates however many instances
+// are issuing at once.
+func Issue(ctx context.Context, dbConn *db.DB, id string, version int, now time.Time) (*Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.Issue")
+	defer span.End()
+
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+	due := now.AddDate(0, 0, cur.Terms)
+
+	q := bson.M{"_id": cur.ID, "status": StatusDraft, "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < issueAttempts; attempt++ {
+		next, err := nextNumber(ctx, dbConn, cur.TenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		m := bson.M{
+			"$set": bson.M{
+				"number":        next,
+				"status":        StatusIssued,
+				"issue_date":    now,
+				"due_date":      due,
+				"date_modified": now,
+			},
+			"$inc": bson.M{"version": 1},
+		}
+
+		var inv Invoice
+		f := func(collection *mgo.Collection) error {
+			if err := ensureNumberIndex(collection); err != nil {
+				return err
+			}
+			_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &inv)
+			return err
+		}
+		err = dbConn.Execute(ctx, invoicesCollection, f)
+		switch {
+		case err == nil:
+			return &inv, nil
+		case err == mgo.ErrNotFound:
+			return nil, transitionError(ctx, dbConn, id, version)
+		case mgo.IsDup(err):
+			continue
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil, errors.Errorf("issuing invoice %s: gave up after %d attempts to take a number", id, issueAttempts)
+}
+
+// nextNumber returns one more than the highest invoice number the tenant has
+// used. The tenant is the invoice's own rather than the context's, as a
+// super-admin issues in the scope of every tenant.
+func nextNumber(ctx context.Context, dbConn *db.DB, tid bson.ObjectId) (int, error) {
+	q := bson.M{"tenant_id": tid, "number": bson.M{"$exists": true}}
+
+	var last struct {
+		Number int `bson:"number"`
+	}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-number").Select(bson.M{"number": 1}).One(&last)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil && err != mgo.ErrNotFound {
+		return 0, errors.Wrap(err, fmt.Sprintf("db.invoices.find(%s)", db.Query(q)))
+	}
+
+	return last.Number + 1, nil
+}
+
+// MarkPaid records payment of an issued invoice.
+func MarkPaid(ctx context.Context, dbConn *db.DB, id string, version int, p *Payment, now time.Time) (*Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.MarkPaid")
+	defer span.End()
+
+	fields := bson.M{
+		"status":    StatusPaid,
+		"paid_date": p.Date.Truncate(time.Millisecond),
+	}
+	return transition(ctx, dbConn, id, version, StatusIssued, fields, nil, now)
+}
+
+// Void cancels an issued invoice. It keeps its number so the sequence stays
+// complete and its adverts may be invoiced again.
+func Void(ctx context.Context, dbConn *db.DB, id string, version int, c *Cancellation, now time.Time) (*Invoice, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.Void")
+	defer span.End()
+
+	fields := bson.M{
+		"status":      StatusVoid,
+		"void_reason": c.Reason,
+	}
+	unset := bson.M{"billed_adverts": ""}
+	return transition(ctx, dbConn, id, version, StatusIssued, fields, unset, now)
+}
+
+// transition moves an invoice out of status from by setting fields and
+// removing the unset fields. The write only succeeds if version is still the
+// current version of the invoice.
+func transition(ctx context.Context, dbConn *db.DB, id string, version int, from string, fields, unset bson.M, now time.Time) (*Invoice, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		m["$unset"] = unset
+	}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "status": from, "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var inv Invoice
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &inv)
+		return err
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, transitionError(ctx, dbConn, id, version)
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.invoices.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &inv, nil
+}
+
+// Delete removes a draft invoice from the database. Issued invoices are never
+// deleted. The delete only succeeds if version is still the current version.
+func Delete(ctx context.Context, dbConn *db.DB, id string, version int) error {
+	ctx, span := trace.StartSpan(ctx, "internal.invoice.Delete")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "status": StatusDraft, "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Remove(q)
+	}
+	if err := dbConn.Execute(ctx, invoicesCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return transitionError(ctx, dbConn, id, version)
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.invoices.remove(%s)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// transitionError works out why a conditional write to an invoice matched
+// nothing.
+func transitionError(ctx context.Context, dbConn *db.DB, id string, version int) error {
+	cur, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return err
+	}
+	if !web.VersionMatches(version, cur.Version) {
+		return ErrVersionConflict
+	}
+	return ErrStatus
+}
+
+// capitalize upper-cases the first letter of s, such as an advert size used
+// to start a line description.
+func capitalize(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[n:]
+}
@@ -0,0 +1,99 @@
+package invoice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the states an invoice moves through. A draft has no number and
+// may be deleted. Issuing numbers the invoice and from then on its contents
+// never change, only its status.
+const (
+	StatusDraft  = "draft"
+	StatusIssued = "issued"
+	StatusPaid   = "paid"
+	StatusVoid   = "void"
+)
+
+// DefaultTerms is how many days after issue an invoice is due when the
+// request does not say.
+const DefaultTerms = 30
+
+// Line charges for one advert. Amounts are in minor units of the invoice
+// currency and come from the price stored on the advert.
+type Line struct {
+	AdvertID    bson.ObjectId `bson:"advert_id" json:"advert_id"`
+	Description string        `bson:"description" json:"description"`
+	Net         int64         `bson:"net" json:"net"` // After discounts and surcharges.
+	Tax         int64         `bson:"tax" json:"tax"`
+	Total       int64         `bson:"total" json:"total"`
+}
+
+// Invoice bills an advertiser for one or more adverts.
+type Invoice struct {
+	ID             bson.ObjectId      `bson:"_id" json:"id"`
+	TenantID       bson.ObjectId      `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Number         int                `bson:"number,omitempty" json:"number,omitempty"` // Assigned in sequence when issued.
+	Status         string             `bson:"status" json:"status"`
+	AdvertiserID   bson.ObjectId      `bson:"advertiser_id" json:"advertiser_id"`
+	Advertiser     string             `bson:"advertiser" json:"advertiser"`
+	BillingAddress advertiser.Address `bson:"billing_address" json:"billing_address"`
+	Currency       string             `bson:"currency" json:"currency"`
+	TaxName        string             `bson:"tax_name,omitempty" json:"tax_name,omitempty"`
+	Lines          []Line             `bson:"lines" json:"lines"`
+	Billed         []bson.ObjectId    `bson:"billed_adverts,omitempty" json:"-"` // Adverts held by this invoice until it is voided.
+	Net            int64              `bson:"net" json:"net"`
+	Tax            int64              `bson:"tax" json:"tax"`
+	Total          int64              `bson:"total" json:"total"`
+	Terms          int                `bson:"terms" json:"terms"` // Days from issue until payment is due.
+	IssueDate      *time.Time         `bson:"issue_date,omitempty" json:"issue_date,omitempty"`
+	DueDate        *time.Time         `bson:"due_date,omitempty" json:"due_date,omitempty"`
+	PaidDate       *time.Time         `bson:"paid_date,omitempty" json:"paid_date,omitempty"`
+	VoidReason     string             `bson:"void_reason,omitempty" json:"void_reason,omitempty"`
+	CreatedBy      string             `bson:"created_by" json:"created_by"`
+	Version        int                `bson:"version" json:"version"`
+	DateCreated    time.Time          `bson:"date_created" json:"date_created"`
+	DateModified   time.Time          `bson:"date_modified" json:"date_modified"`
+}
+
+// Reference is the invoice number as printed, or an empty string for a draft.
+func (inv *Invoice) Reference() string {
+	if inv.Number == 0 {
+		return ""
+	}
+	return fmt.Sprintf("INV-%06d", inv.Number)
+}
+
+// NewInvoice is what we require from clients when drafting an Invoice. Every
+// advert must be booked for the advertiser and priced in the same currency.
+type NewInvoice struct {
+	AdvertiserID string   `json:"advertiser_id" validate:"required"`
+	AdvertIDs    []string `json:"advert_ids" validate:"required,min=1,unique"`
+	Terms        int      `json:"terms" validate:"omitempty,min=0"`
+}
+
+// Payment records when an issued invoice was paid.
+type Payment struct {
+	Date time.Time `json:"date" validate:"required"`
+}
+
+// Cancellation records why an issued invoice was voided.
+type Cancellation struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+// Filter restricts the invoices returned by List. Empty fields are ignored.
+type Filter struct {
+	AdvertiserID string
+	Status       string
+}
+
+// Party is a business named on an invoice document.
+type Party struct {
+	Name    string
+	TaxID   string
+	Address advertiser.Address
+}
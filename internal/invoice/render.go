@@ -0,0 +1,324 @@
+package invoice
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/platform/pdf"
+)
+
+// minorDigits lists currencies whose minor unit is not a hundredth of the
+// major unit. Every other currency has two digits.
+var minorDigits = map[string]int{
+	"BHD": 3, "CLP": 0, "ISK": 0, "JPY": 0, "JOD": 3, "KRW": 0,
+	"KWD": 3, "OMR": 3, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+// Amount formats an amount in minor units as a decimal number of major units.
+func Amount(amount int64, currency string) string {
+	digits, ok := minorDigits[currency]
+	if !ok {
+		digits = 2
+	}
+	if digits == 0 {
+		return fmt.Sprintf("%d", amount)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	scale := int64(1)
+	for i := 0; i < digits; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, digits, amount%scale)
+}
+
+// date formats an optional date for a document.
+func date(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// address returns the non empty lines of an address.
+func address(a advertiser.Address) []string {
+	var lines []string
+	for _, l := range []string{a.Line1, a.Line2, strings.TrimSpace(a.City + " " + a.State + " " + a.Postcode), a.Country} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// WritePDF renders the invoice as a PDF issued by seller. Drafts are marked as
+// such so they are not mistaken for a tax invoice.
+func WritePDF(w io.Writer, inv *Invoice, seller Party) error {
+	const (
+		left   = 50
+		right  = pdf.PageWidth - 50
+		bottom = 80
+	)
+
+	doc := pdf.New()
+	y := float64(pdf.PageHeight - 60)
+
+	title := "TAX INVOICE"
+	switch inv.Status {
+	case StatusDraft:
+		title = "DRAFT INVOICE"
+	case StatusVoid:
+		title = "TAX INVOICE - VOID"
+	}
+	doc.Text(left, y, pdf.Bold, 18, title)
+	doc.TextRight(right, y, pdf.Bold, 12, inv.Reference())
+
+	y -= 30
+	doc.Text(left, y, pdf.Bold, 10, seller.Name)
+	for _, l := range address(seller.Address) {
+		y -= 13
+		doc.Text(left, y, pdf.Regular, 10, l)
+	}
+	if seller.TaxID != "" {
+		y -= 13
+		doc.Text(left, y, pdf.Regular, 10, "Tax ID: "+seller.TaxID)
+	}
+
+	y -= 30
+	doc.Text(left, y, pdf.Bold, 10, "Bill to")
+	doc.Text(350, y, pdf.Bold, 10, "Issued")
+	doc.TextRight(right, y, pdf.Regular, 10, date(inv.IssueDate))
+	y -= 13
+	doc.Text(left, y, pdf.Regular, 10, inv.Advertiser)
+	doc.Text(350, y, pdf.Bold, 10, "Due")
+	doc.TextRight(right, y, pdf.Regular, 10, date(inv.DueDate))
+	for _, l := range address(inv.BillingAddress) {
+		y -= 13
+		doc.Text(left, y, pdf.Regular, 10, l)
+	}
+
+	y -= 35
+	header := func() {
+		doc.Text(left, y, pdf.Bold, 10, "Description")
+		doc.TextRight(400, y, pdf.Bold, 10, "Net")
+		doc.TextRight(470, y, pdf.Bold, 10, "Tax")
+		doc.TextRight(right, y, pdf.Bold, 10, "Total "+inv.Currency)
+		y -= 6
+		doc.Line(left, y, right, y)
+		y -= 14
+	}
+	header()
+
+	for _, l := range inv.Lines {
+		if y < bottom {
+			doc.AddPage()
+			y = pdf.PageHeight - 60
+			header()
+		}
+		doc.Text(left, y, pdf.Regular, 10, l.Description)
+		doc.TextRight(400, y, pdf.Regular, 10, Amount(l.Net, inv.Currency))
+		doc.TextRight(470, y, pdf.Regular, 10, Amount(l.Tax, inv.Currency))
+		doc.TextRight(right, y, pdf.Regular, 10, Amount(l.Total, inv.Currency))
+		y -= 16
+	}
+
+	if y < bottom+60 {
+		doc.AddPage()
+		y = pdf.PageHeight - 60
+	}
+	doc.Line(left, y+8, right, y+8)
+
+	taxName := inv.TaxName
+	if taxName == "" {
+		taxName = "Tax"
+	}
+	totals := []struct {
+		label  string
+		amount int64
+	}{
+		{"Net", inv.Net},
+		{taxName, inv.Tax},
+		{"Total " + inv.Currency, inv.Total},
+	}
+	y -= 6
+	for i, t := range totals {
+		font := pdf.Regular
+		if i == len(totals)-1 {
+			font = pdf.Bold
+		}
+		doc.Text(350, y, font, 10, t.label)
+		doc.TextRight(right, y, font, 10, Amount(t.amount, inv.Currency))
+		y -= 16
+	}
+
+	if inv.Status == StatusVoid && inv.VoidReason != "" {
+		y -= 20
+		doc.Text(left, y, pdf.Regular, 10, "Voided: "+inv.VoidReason)
+	}
+
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// The types below are the parts of an OASIS UBL 2.1 invoice that we fill in.
+
+type ublInvoice struct {
+	XMLName                 xml.Name       `xml:"Invoice"`
+	Xmlns                   string         `xml:"xmlns,attr"`
+	Cac                     string         `xml:"xmlns:cac,attr"`
+	Cbc                     string         `xml:"xmlns:cbc,attr"`
+	UBLVersionID            string         `xml:"cbc:UBLVersionID"`
+	ID                      string         `xml:"cbc:ID"`
+	IssueDate               string         `xml:"cbc:IssueDate"`
+	DueDate                 string         `xml:"cbc:DueDate,omitempty"`
+	InvoiceTypeCode         string         `xml:"cbc:InvoiceTypeCode"`
+	Note                    string         `xml:"cbc:Note,omitempty"`
+	DocumentCurrencyCode    string         `xml:"cbc:DocumentCurrencyCode"`
+	AccountingSupplierParty ublParty       `xml:"cac:AccountingSupplierParty"`
+	AccountingCustomerParty ublParty       `xml:"cac:AccountingCustomerParty"`
+	TaxTotal                ublTaxTotal    `xml:"cac:TaxTotal"`
+	LegalMonetaryTotal      ublTotals      `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLines            []ublInvoiceLn `xml:"cac:InvoiceLine"`
+}
+
+type ublParty struct {
+	Name        string          `xml:"cac:Party>cac:PartyName>cbc:Name"`
+	Address     *ublAddress     `xml:"cac:Party>cac:PostalAddress,omitempty"`
+	TaxScheme   *ublPartyTaxSch `xml:"cac:Party>cac:PartyTaxScheme,omitempty"`
+	LegalEntity string          `xml:"cac:Party>cac:PartyLegalEntity>cbc:RegistrationName"`
+}
+
+type ublPartyTaxSch struct {
+	CompanyID string `xml:"cbc:CompanyID"`
+	TaxScheme string `xml:"cac:TaxScheme>cbc:ID"`
+}
+
+type ublAddress struct {
+	StreetName           string `xml:"cbc:StreetName,omitempty"`
+	AdditionalStreetName string `xml:"cbc:AdditionalStreetName,omitempty"`
+	CityName             string `xml:"cbc:CityName,omitempty"`
+	PostalZone           string `xml:"cbc:PostalZone,omitempty"`
+	CountrySubentity     string `xml:"cbc:CountrySubentity,omitempty"`
+	Country              string `xml:"cac:Country>cbc:IdentificationCode,omitempty"`
+}
+
+type ublAmount struct {
+	Currency string `xml:"currencyID,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ublTaxTotal struct {
+	TaxAmount ublAmount `xml:"cbc:TaxAmount"`
+}
+
+type ublTotals struct {
+	LineExtensionAmount ublAmount `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount  ublAmount `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount  ublAmount `xml:"cbc:TaxInclusiveAmount"`
+	PayableAmount       ublAmount `xml:"cbc:PayableAmount"`
+}
+
+type ublInvoiceLn struct {
+	ID                  string    `xml:"cbc:ID"`
+	InvoicedQuantity    string    `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount `xml:"cbc:LineExtensionAmount"`
+	Description         string    `xml:"cac:Item>cbc:Description"`
+	Name                string    `xml:"cac:Item>cbc:Name"`
+	SellersItemID       string    `xml:"cac:Item>cac:SellersItemIdentification>cbc:ID"`
+	PriceAmount         ublAmount `xml:"cac:Price>cbc:PriceAmount"`
+}
+
+// newUBLParty builds a UBL party from a name, tax registration and address.
+func newUBLParty(name, taxID, taxScheme string, a advertiser.Address) ublParty {
+	p := ublParty{
+		Name:        name,
+		LegalEntity: name,
+	}
+	if taxID != "" {
+		p.TaxScheme = &ublPartyTaxSch{CompanyID: taxID, TaxScheme: taxScheme}
+	}
+	if a != (advertiser.Address{}) {
+		p.Address = &ublAddress{
+			StreetName:           a.Line1,
+			AdditionalStreetName: a.Line2,
+			CityName:             a.City,
+			PostalZone:           a.Postcode,
+			CountrySubentity:     a.State,
+			Country:              a.Country,
+		}
+	}
+	return p
+}
+
+// WriteUBL renders the invoice as an OASIS UBL 2.1 invoice issued by seller.
+func WriteUBL(w io.Writer, inv *Invoice, seller Party) error {
+	amount := func(v int64) ublAmount {
+		return ublAmount{Currency: inv.Currency, Value: Amount(v, inv.Currency)}
+	}
+
+	id := inv.Reference()
+	if id == "" {
+		id = inv.ID.Hex()
+	}
+
+	taxScheme := inv.TaxName
+	if taxScheme == "" {
+		taxScheme = "VAT"
+	}
+
+	doc := ublInvoice{
+		Xmlns:                   "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2",
+		Cac:                     "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2",
+		Cbc:                     "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2",
+		UBLVersionID:            "2.1",
+		ID:                      id,
+		IssueDate:               date(inv.IssueDate),
+		DueDate:                 date(inv.DueDate),
+		InvoiceTypeCode:         "380",
+		DocumentCurrencyCode:    inv.Currency,
+		AccountingSupplierParty: newUBLParty(seller.Name, seller.TaxID, taxScheme, seller.Address),
+		AccountingCustomerParty: newUBLParty(inv.Advertiser, "", taxScheme, inv.BillingAddress),
+		TaxTotal:                ublTaxTotal{TaxAmount: amount(inv.Tax)},
+		LegalMonetaryTotal: ublTotals{
+			LineExtensionAmount: amount(inv.Net),
+			TaxExclusiveAmount:  amount(inv.Net),
+			TaxInclusiveAmount:  amount(inv.Total),
+			PayableAmount:       amount(inv.Total),
+		},
+	}
+	if doc.IssueDate == "" {
+		doc.IssueDate = inv.DateCreated.UTC().Format("2006-01-02")
+	}
+	switch inv.Status {
+	case StatusDraft:
+		doc.Note = "Draft"
+	case StatusVoid:
+		doc.Note = "Void: " + inv.VoidReason
+	}
+
+	for i, l := range inv.Lines {
+		doc.InvoiceLines = append(doc.InvoiceLines, ublInvoiceLn{
+			ID:                  fmt.Sprint(i + 1),
+			InvoicedQuantity:    "1",
+			LineExtensionAmount: amount(l.Net),
+			Description:         l.Description,
+			Name:                "Advert",
+			SellersItemID:       l.AdvertID.Hex(),
+			PriceAmount:         amount(l.Net),
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
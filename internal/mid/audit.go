@@ -0,0 +1,111 @@
+package mid
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/diff"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Audit records every request that changes something, and every login, in
+// the audit log. It must run outside Errors so the status sent for a failed
+// request is known. An entry that cannot be written is queued through the
+// outbox; a failure to do even that is logged rather than returned as the
+// response has already been sent.
+func Audit(log *log.Logger, masterDB *db.DB) web.Middleware {
+
+	// This is the actual middleware function to be executed.
+	f := func(before web.Handler) web.Handler {
+
+		// Create the handler that will be attached in the middleware chain.
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request, params map[string]string) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.Audit")
+			defer span.End()
+
+			// If the context is missing this value, request the service
+			// to be shutdown gracefully.
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web value missing from context")
+			}
+
+			n := audit.Note{ResourceID: params["id"]}
+			ctx = context.WithValue(ctx, audit.Key, &n)
+
+			err := before(ctx, w, r, params)
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				if n.Action != audit.ActionLogin {
+					return err
+				}
+			}
+
+			e := audit.Entry{
+				TenantID:   n.TenantID,
+				Actor:      n.Actor,
+				Action:     n.Action,
+				Resource:   resource(r.URL.Path),
+				ResourceID: n.ResourceID,
+				Status:     v.StatusCode,
+				Outcome:    audit.OutcomeSuccess,
+				SourceIP:   r.RemoteAddr,
+				UserAgent:  r.UserAgent(),
+				TraceID:    v.TraceID,
+				Date:       v.Now,
+			}
+			if e.Action == "" {
+				e.Action = r.Method + " " + r.URL.Path
+			}
+			if e.Status == 0 || e.Status >= http.StatusBadRequest {
+				e.Outcome = audit.OutcomeFailure
+			}
+			if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+				e.SourceIP = host
+			}
+			if n.Before != nil || n.After != nil {
+				changes, diffErr := diff.Compare(n.Before, n.After)
+				if diffErr != nil {
+					log.Printf("%s : audit : diffing %s : %v", v.TraceID, e.Action, diffErr)
+				}
+				e.Changes = changes
+			}
+
+			dbConn := masterDB.Copy()
+			defer dbConn.Close()
+
+			// An entry that cannot be appended now is queued in the outbox
+			// to be appended later, so the log never loses an action.
+			if recErr := audit.Record(ctx, dbConn, &e); recErr != nil {
+				log.Printf("%s : audit : recording %s : %v", v.TraceID, e.Action, recErr)
+				if qErr := audit.Queue(ctx, dbConn, &e); qErr != nil {
+					log.Printf("%s : audit : queueing %s : %v", v.TraceID, e.Action, qErr)
+				}
+			}
+
+			// Return the error so it can be handled further up the chain.
+			return err
+		}
+
+		return h
+	}
+
+	return f
+}
+
+// resource returns the collection a path acts on, the segment after the API
+// version.
+func resource(path string) string {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segs) < 2 {
+		return ""
+	}
+	return segs[1]
+}
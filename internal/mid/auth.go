@@ -5,10 +5,13 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/mattlaver/peeps/internal/audit"
 	"github.com/mattlaver/peeps/internal/platform/auth"
 	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/mattlaver/peeps/internal/tenant"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // ErrForbidden is returned when an authenticated user does not have a
@@ -18,7 +21,10 @@ var ErrForbidden = web.NewRequestError(
 	http.StatusForbidden,
 )
 
-// Authenticate validates a JWT from the `Authorization` header.
+// Authenticate validates a JWT from the `Authorization` header and scopes the
+// request to the tenant of its claims. Super-admins may choose another tenant
+// with the `X-Tenant` header, or every tenant with `X-Tenant: *`, and reach
+// every tenant when their claims name none.
 func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 
 	// This is the actual middleware function to be executed.
@@ -45,10 +51,25 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 				return web.NewRequestError(err, http.StatusUnauthorized)
 			}
 
+			ctx, err = scope(ctx, claims, r.Header.Get("X-Tenant"))
+			if err != nil {
+				return err
+			}
+
 			// Add claims to the context so they can be retrieved later.
 			ctx = context.WithValue(ctx, auth.Key, claims)
+			audit.Actor(ctx, claims.Subject)
+			if tid, err := tenant.ID(ctx); err == nil {
+				audit.Tenant(ctx, tid)
+			}
 
-			return after(ctx, w, r, params)
+			// Writes that belong to a single tenant cannot be made in the
+			// scope of all of them; the super-admin must choose one.
+			err = after(ctx, w, r, params)
+			if errors.Cause(err) == tenant.ErrAllTenants {
+				return web.NewRequestError(tenant.ErrAllTenants, http.StatusBadRequest)
+			}
+			return err
 		}
 
 		return h
@@ -87,6 +108,32 @@ func HasRole(roles ...string) web.Middleware {
 	return f
 }
 
+// scope returns ctx scoped to the tenant the claims may reach, or the one a
+// super-admin asked for in hdr.
+func scope(ctx context.Context, claims auth.Claims, hdr string) (context.Context, error) {
+	super := claims.HasRole(auth.RoleSuperAdmin)
+
+	switch {
+	case hdr != "" && !super:
+		return nil, ErrForbidden
+	case hdr == "*":
+		return tenant.WithAll(ctx), nil
+	case hdr != "":
+		if !bson.IsObjectIdHex(hdr) {
+			err := errors.New("X-Tenant header must be a tenant ID or *")
+			return nil, web.NewRequestError(err, http.StatusBadRequest)
+		}
+		return tenant.With(ctx, bson.ObjectIdHex(hdr)), nil
+	case claims.Tenant == "" && super:
+		return tenant.WithAll(ctx), nil
+	case !bson.IsObjectIdHex(claims.Tenant):
+		err := errors.New("token does not name a tenant")
+		return nil, web.NewRequestError(err, http.StatusUnauthorized)
+	}
+
+	return tenant.With(ctx, bson.ObjectIdHex(claims.Tenant)), nil
+}
+
 // parseAuthHeader parses an authorization header. Expected header is of
 // the format `Bearer <token>`.
 func parseAuthHeader(bearerStr string) (string, error) {
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the things people can be told about an advert.
+const (
+	TopicDeadline = "deadline" // An edition's copy deadline is coming up.
+	TopicArtwork  = "artwork"  // The deadline is coming up and no artwork has arrived.
+	TopicStatus   = "status"   // The advert moved to another status.
+)
+
+// Topics are every topic, in the order they are shown.
+var Topics = []string{TopicDeadline, TopicArtwork, TopicStatus}
+
+// These are the ways notifications can be sent.
+const (
+	ModeImmediate = "immediate" // One email per notification as it happens.
+	ModeDigest    = "digest"    // One email a day listing everything since the last.
+	ModeOff       = "off"       // No email at all.
+)
+
+// These are the expected values for Notification.Status.
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusFailed  = "failed" // Given up on after too many attempts.
+)
+
+// Preferences are how a user wants to be notified. Users who have not set
+// any get the defaults: every topic, immediately, in the default locale.
+type Preferences struct {
+	UserID       bson.ObjectId `bson:"_id" json:"user_id"`
+	Locale       string        `bson:"locale" json:"locale"` // Language of the emails, such as "en" or "fr".
+	Mode         string        `bson:"mode" json:"mode"`     // One of the Mode constants.
+	Topics       []string      `bson:"topics" json:"topics"` // Topics the user wants to hear about.
+	Version      int           `bson:"version" json:"version"`
+	DateModified time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// Wants reports whether p asks for notifications about topic.
+func (p *Preferences) Wants(topic string) bool {
+	if p.Mode == ModeOff {
+		return false
+	}
+	for _, t := range p.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPreferences is what we require from clients when setting a user's
+// preferences.
+type NewPreferences struct {
+	Locale string   `json:"locale" validate:"required"`
+	Mode   string   `json:"mode" validate:"required,oneof=immediate digest off"`
+	Topics []string `json:"topics" validate:"dive,oneof=deadline artwork status"`
+}
+
+// Notification is something one person is to be told about one advert. It
+// waits in the queue until it is sent on its own or in a digest.
+type Notification struct {
+	ID          bson.ObjectId  `bson:"_id" json:"id"`
+	Key         string         `bson:"key" json:"-"` // Event, advert and recipient, so an event delivered twice queues once.
+	EventID     bson.ObjectId  `bson:"event_id" json:"event_id"`
+	Topic       string         `bson:"topic" json:"topic"`
+	To          string         `bson:"to" json:"to"` // In lower case, so a recipient gets one digest.
+	Name        string         `bson:"name,omitempty" json:"name,omitempty"`
+	UserID      *bson.ObjectId `bson:"user_id,omitempty" json:"user_id,omitempty"` // Set when the recipient is a user.
+	Locale      string         `bson:"locale" json:"locale"`
+	Digest      bool           `bson:"digest" json:"digest"`
+	Details     Details        `bson:"details" json:"details"`
+	Status      string         `bson:"status" json:"status"`
+	Tries       int            `bson:"tries" json:"tries"`
+	Error       string         `bson:"error,omitempty" json:"error,omitempty"` // Why the last try failed.
+	DateCreated time.Time      `bson:"date_created" json:"date_created"`
+	DateSent    *time.Time     `bson:"date_sent,omitempty" json:"date_sent,omitempty"`
+}
+
+// Details are what a notification tells about its advert.
+type Details struct {
+	AdvertID     bson.ObjectId `bson:"advert_id" json:"advert_id"`
+	Advertiser   string        `bson:"advertiser" json:"advertiser"`
+	Edition      string        `bson:"edition,omitempty" json:"edition,omitempty"`
+	Year         string        `bson:"year" json:"year"`
+	CopyDeadline time.Time     `bson:"copy_deadline,omitempty" json:"copy_deadline,omitempty"`
+	From         string        `bson:"from,omitempty" json:"from,omitempty"` // Status moved from, for TopicStatus.
+	To           string        `bson:"to,omitempty" json:"to,omitempty"`     // Status moved to, for TopicStatus.
+}
@@ -0,0 +1,490 @@
+// Package notify emails the people behind an advert about what is happening
+// to it: copy deadlines coming up, artwork still missing and changes of
+// status.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/email"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const notificationsCollection = "notifications"
+
+// keyIndex makes sure an event queues one notification per advert and
+// recipient however many times it is delivered.
+var keyIndex = mgo.Index{
+	Key:    []string{"key"},
+	Unique: true,
+}
+
+// dueIndex supports finding the notifications waiting to be sent.
+var dueIndex = mgo.Index{
+	Key: []string{"status", "digest", "to"},
+}
+
+// sendLimit is the most notifications one call to Send or SendDigests works
+// through.
+const sendLimit = 500
+
+// Notifier turns advert and edition events into emails to the contacts of
+// the adverts and the reps who booked them.
+type Notifier struct {
+	MasterDB    *db.DB
+	Mailer      email.Mailer
+	Locale      string // Locale of recipients who are not users or have not chosen one.
+	MaxAttempts int    // Times an email is tried before it is given up on.
+}
+
+// New returns a Notifier that sends email with mailer.
+func New(masterDB *db.DB, mailer email.Mailer) *Notifier {
+	return &Notifier{
+		MasterDB:    masterDB,
+		Mailer:      mailer,
+		Locale:      fallbackLocale,
+		MaxAttempts: 5,
+	}
+}
+
+// recipient is someone to be told about an advert.
+type recipient struct {
+	email  string
+	name   string
+	userID *bson.ObjectId
+}
+
+// Handle queues the notifications for an event. It is subscribed to the bus
+// for advert transitions and edition deadlines; other events are ignored.
+func (n *Notifier) Handle(ctx context.Context, ev event.Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.Handle")
+	defer span.End()
+
+	dbConn := n.MasterDB.Copy()
+	defer dbConn.Close()
+
+	// Events come from every tenant. Each is looked up across all of them
+	// and then handled in the scope of the tenant it belongs to.
+	ctx = tenant.WithAll(ctx)
+
+	switch ev.Name {
+	case event.AdvertTransitioned:
+		return n.transitioned(ctx, dbConn, ev)
+	case event.EditionDeadline:
+		return n.deadline(ctx, dbConn, ev)
+	}
+	return nil
+}
+
+// transitioned queues a notification of an advert's change of status.
+func (n *Notifier) transitioned(ctx context.Context, dbConn *db.DB, ev event.Event) error {
+	a, err := advert.Retrieve(ctx, dbConn, ev.AggregateID.Hex())
+	if err != nil {
+		if err == advert.ErrNotFound {
+			return nil // Deleted since, so there is no one to tell.
+		}
+		return err
+	}
+	ctx = tenant.With(ctx, a.TenantID)
+
+	from, _ := ev.Data["from"].(string)
+	to, _ := ev.Data["to"].(string)
+	d := Details{
+		AdvertID:   a.ID,
+		Advertiser: a.Advertiser,
+		Year:       a.Year,
+		From:       from,
+		To:         to,
+	}
+
+	return n.queue(ctx, dbConn, ev, []advertTopic{{a, TopicStatus, d}})
+}
+
+// deadline queues a reminder of an edition's copy deadline for every advert
+// booked in it. Adverts still without artwork are reminded of that instead.
+func (n *Notifier) deadline(ctx context.Context, dbConn *db.DB, ev event.Event) error {
+	e, err := edition.Retrieve(ctx, dbConn, ev.AggregateID.Hex())
+	if err != nil {
+		if err == edition.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	ctx = tenant.With(ctx, e.TenantID)
+
+	as, err := advert.List(ctx, dbConn, advert.Filter{Edition: e.Name, Year: e.Year})
+	if err != nil {
+		return err
+	}
+
+	var ats []advertTopic
+	for i := range as {
+		a := &as[i]
+		if a.Status == advert.StatusCancelled || a.Status == advert.StatusPublished {
+			continue
+		}
+		topic := TopicDeadline
+		if !hasArtwork(a) {
+			topic = TopicArtwork
+		}
+		d := Details{
+			AdvertID:     a.ID,
+			Advertiser:   a.Advertiser,
+			Edition:      e.Name,
+			Year:         e.Year,
+			CopyDeadline: e.CopyDeadline,
+		}
+		ats = append(ats, advertTopic{a, topic, d})
+	}
+
+	return n.queue(ctx, dbConn, ev, ats)
+}
+
+// hasArtwork reports whether artwork has been attached to a.
+func hasArtwork(a *advert.Advert) bool {
+	for _, at := range a.Attachments {
+		if at.Kind == advert.AttachmentArtwork {
+			return true
+		}
+	}
+	return false
+}
+
+// advertTopic is what to tell the people behind one advert.
+type advertTopic struct {
+	advert  *advert.Advert
+	topic   string
+	details Details
+}
+
+// queue stores a notification for everyone behind each advert who wants to
+// hear about its topic. Notifications an earlier delivery of ev queued are
+// left as they are.
+func (n *Notifier) queue(ctx context.Context, dbConn *db.DB, ev event.Event, ats []advertTopic) error {
+	if len(ats) == 0 {
+		return nil
+	}
+
+	// Find who to tell about each advert. Contacts and reps are matched to
+	// users by email so users' preferences apply whichever way they are
+	// reached.
+	recipients := make([][]recipient, len(ats))
+	var emails, reps []string
+	for i, at := range ats {
+		recipients[i] = recipientsOf(at.advert)
+		for _, r := range recipients[i] {
+			emails = append(emails, r.email)
+		}
+		if at.advert.SalesRep != "" {
+			reps = append(reps, at.advert.SalesRep)
+		}
+	}
+
+	repUsers, err := user.ByID(ctx, dbConn, reps)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]user.User, len(repUsers))
+	for _, u := range repUsers {
+		byID[u.ID.Hex()] = u
+		emails = append(emails, u.Email)
+	}
+
+	users, err := user.ByEmail(ctx, dbConn, emails)
+	if err != nil {
+		return err
+	}
+	byEmail := make(map[string]user.User, len(users))
+	ids := make([]bson.ObjectId, len(users))
+	for i, u := range users {
+		byEmail[strings.ToLower(u.Email)] = u
+		ids[i] = u.ID
+	}
+
+	prefs, err := preferencesOf(ctx, dbConn, ids, n.Locale)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	var docs []interface{}
+	for i, at := range ats {
+		rs := recipients[i]
+		if u, ok := byID[at.advert.SalesRep]; ok && u.Email != "" {
+			rs = append(rs, recipient{email: u.Email, name: u.Name})
+		}
+
+		seen := make(map[string]bool)
+		for _, r := range rs {
+			addr := strings.ToLower(r.email)
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+
+			p := defaults("", n.Locale)
+			if u, ok := byEmail[addr]; ok {
+				id := u.ID
+				r.userID = &id
+				p = prefs[u.ID]
+			}
+			if !p.Wants(at.topic) {
+				continue
+			}
+
+			docs = append(docs, &Notification{
+				ID:          bson.NewObjectId(),
+				Key:         fmt.Sprintf("%s:%s:%s", ev.ID.Hex(), at.advert.ID.Hex(), addr),
+				EventID:     ev.ID,
+				Topic:       at.topic,
+				To:          addr,
+				Name:        r.name,
+				UserID:      r.userID,
+				Locale:      p.Locale,
+				Digest:      p.Mode == ModeDigest,
+				Details:     at.details,
+				Status:      StatusPending,
+				DateCreated: now,
+			})
+		}
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(keyIndex); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(dueIndex); err != nil {
+			return err
+		}
+
+		// Insert one at a time so a notification already queued does not
+		// stop the rest.
+		for _, d := range docs {
+			if err := collection.Insert(d); err != nil && !mgo.IsDup(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := dbConn.Execute(ctx, notificationsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.notifications.insert(%d notifications of %s)", len(docs), ev.ID.Hex()))
+	}
+
+	return nil
+}
+
+// recipientsOf returns the contacts of a that have an email address.
+func recipientsOf(a *advert.Advert) []recipient {
+	var rs []recipient
+	for _, c := range a.Contacts {
+		if c.Email != "" {
+			rs = append(rs, recipient{email: c.Email, name: c.Name})
+		}
+	}
+	return rs
+}
+
+// Send emails the pending notifications that are not waiting for a digest.
+// It returns how many were sent.
+func (n *Notifier) Send(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.Send")
+	defer span.End()
+
+	dbConn := n.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ns, err := pending(ctx, dbConn, false)
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int
+	for _, nt := range ns {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+
+		subject, body, err := render(nt)
+		if err == nil {
+			m := email.Message{To: []string{address(nt.Name, nt.To)}, Subject: subject, HTML: body}
+			err = n.Mailer.Send(ctx, m)
+		}
+		if err := n.record(ctx, dbConn, []Notification{nt}, err, now); err != nil {
+			return sent, err
+		}
+		if err == nil {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// SendDigests emails each recipient one message listing all their pending
+// notifications that wait for a digest. It returns how many were sent.
+func (n *Notifier) SendDigests(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.SendDigests")
+	defer span.End()
+
+	dbConn := n.MasterDB.Copy()
+	defer dbConn.Close()
+
+	ns, err := pending(ctx, dbConn, true)
+	if err != nil {
+		return 0, err
+	}
+
+	// Pending notifications come sorted by recipient, so each run of the
+	// same address is one digest.
+	var sent int
+	for len(ns) > 0 {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+
+		i := 1
+		for i < len(ns) && ns[i].To == ns[0].To {
+			i++
+		}
+		group := ns[:i]
+		ns = ns[i:]
+
+		subject, body, err := renderDigest(group[0].Name, group)
+		if err == nil {
+			m := email.Message{To: []string{address(group[0].Name, group[0].To)}, Subject: subject, HTML: body}
+			err = n.Mailer.Send(ctx, m)
+		}
+		if err := n.record(ctx, dbConn, group, err, now); err != nil {
+			return sent, err
+		}
+		if err == nil {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// pending retrieves the notifications waiting to be sent, oldest first for
+// each recipient.
+func pending(ctx context.Context, dbConn *db.DB, digest bool) ([]Notification, error) {
+	q := bson.M{"status": StatusPending, "digest": digest}
+
+	ns := []Notification{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("to", "date_created").Limit(sendLimit).All(&ns)
+	}
+	if err := dbConn.Execute(ctx, notificationsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.notifications.find(%s)", db.Query(q)))
+	}
+
+	return ns, nil
+}
+
+// record marks ns as sent, or as tried once more if sending failed with
+// sendErr. Notifications tried MaxAttempts times are given up on.
+func (n *Notifier) record(ctx context.Context, dbConn *db.DB, ns []Notification, sendErr error, now time.Time) error {
+	now = now.Truncate(time.Millisecond)
+
+	ids := make([]bson.ObjectId, len(ns))
+	for i, nt := range ns {
+		ids[i] = nt.ID
+	}
+	q := bson.M{"_id": bson.M{"$in": ids}}
+
+	m := bson.M{
+		"$set": bson.M{"status": StatusSent, "date_sent": now},
+		"$inc": bson.M{"tries": 1},
+	}
+	if sendErr != nil {
+		status := StatusPending
+		for _, nt := range ns {
+			if nt.Tries+1 >= n.MaxAttempts {
+				status = StatusFailed
+			}
+		}
+		m["$set"] = bson.M{"status": status, "error": sendErr.Error()}
+	}
+
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.UpdateAll(q, m)
+		return err
+	}
+	if err := dbConn.Execute(ctx, notificationsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.notifications.update(%s)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// address returns the address of a recipient with their name, when known.
+func address(name, addr string) string {
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// purgeBatch is the most notifications removed by one write when purging.
+const purgeBatch = 1000
+
+// Purge removes the notifications queued before the given time that were sent
+// or given up on and reports how many were removed. It works in batches and
+// stops between them when ctx is cancelled.
+func Purge(ctx context.Context, dbConn *db.DB, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.Purge")
+	defer span.End()
+
+	q := bson.M{
+		"status":       bson.M{"$in": []string{StatusSent, StatusFailed}},
+		"date_created": bson.M{"$lt": before},
+	}
+
+	var n int
+	for ctx.Err() == nil {
+		var docs []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		f := func(collection *mgo.Collection) error {
+			return collection.Find(q).Select(bson.M{"_id": 1}).Limit(purgeBatch).All(&docs)
+		}
+		if err := dbConn.Execute(ctx, notificationsCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.notifications.find(%s)", db.Query(q)))
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		ids := make([]bson.ObjectId, len(docs))
+		for i, d := range docs {
+			ids[i] = d.ID
+		}
+
+		rq := bson.M{"_id": bson.M{"$in": ids}}
+		f = func(collection *mgo.Collection) error {
+			info, err := collection.RemoveAll(rq)
+			if info != nil {
+				n += info.Removed
+			}
+			return err
+		}
+		if err := dbConn.Execute(ctx, notificationsCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.notifications.remove(%d notifications)", len(ids)))
+		}
+	}
+
+	return n, ctx.Err()
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const preferencesCollection = "notification_preferences"
+
+var (
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the
+	// preferences that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current preferences")
+)
+
+// defaults are the preferences of a user who has not set any.
+func defaults(id bson.ObjectId, locale string) Preferences {
+	return Preferences{
+		UserID: id,
+		Locale: locale,
+		Mode:   ModeImmediate,
+		Topics: append([]string(nil), Topics...),
+	}
+}
+
+// RetrievePreferences gets the notification preferences of the specified
+// user, or the defaults in locale if they have not set any. Defaults have
+// version 0.
+func RetrievePreferences(ctx context.Context, dbConn *db.DB, id, locale string) (*Preferences, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.RetrievePreferences")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	ps, err := preferencesOf(ctx, dbConn, []bson.ObjectId{bson.ObjectIdHex(id)}, locale)
+	if err != nil {
+		return nil, err
+	}
+	p := ps[bson.ObjectIdHex(id)]
+
+	return &p, nil
+}
+
+// preferencesOf gets the preferences of each of the users, with the defaults
+// in locale for those who have not set any.
+func preferencesOf(ctx context.Context, dbConn *db.DB, ids []bson.ObjectId, locale string) (map[bson.ObjectId]Preferences, error) {
+	q := bson.M{"_id": bson.M{"$in": ids}}
+
+	var found []Preferences
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).All(&found)
+	}
+	if err := dbConn.Execute(ctx, preferencesCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.notification_preferences.find(%s)", db.Query(q)))
+	}
+
+	ps := make(map[bson.ObjectId]Preferences, len(ids))
+	for _, id := range ids {
+		ps[id] = defaults(id, locale)
+	}
+	for _, p := range found {
+		ps[p.UserID] = p
+	}
+
+	return ps, nil
+}
+
+// SetPreferences replaces the notification preferences of the specified
+// user. The write only succeeds if version is still the current version of
+// their preferences, which is 0 for a user still on the defaults.
+func SetPreferences(ctx context.Context, dbConn *db.DB, id string, version int, np *NewPreferences, now time.Time) (*Preferences, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.notify.SetPreferences")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+	if !Supported(np.Locale) {
+		return nil, web.NewFieldErrors(web.FieldError{
+			Field: "locale",
+			Error: fmt.Sprintf("locale %q is not supported", np.Locale),
+		})
+	}
+
+	topics := []string{}
+	seen := make(map[string]bool)
+	for _, t := range np.Topics {
+		if !seen[t] {
+			seen[t] = true
+			topics = append(topics, t)
+		}
+	}
+
+	m := bson.M{
+		"$set": bson.M{
+			"locale":        np.Locale,
+			"mode":          np.Mode,
+			"topics":        topics,
+			"date_modified": now.Truncate(time.Millisecond),
+		},
+		"$inc": bson.M{"version": 1},
+	}
+
+	// Preferences still on the defaults are not stored, so the first write
+	// inserts them. If someone else stored them first, the insert fails on
+	// the duplicate ID.
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+
+	var p Preferences
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, Upsert: version == 0 || version == web.AnyVersion, ReturnNew: true}, &p)
+		return err
+	}
+	if err := dbConn.Execute(ctx, preferencesCollection, f); err != nil {
+		if mgo.IsDup(err) || err == mgo.ErrNotFound {
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.notification_preferences.update(%s)", db.Query(q)))
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fallbackLocale is used for locales we have no templates for.
+const fallbackLocale = "en"
+
+// locale holds what it takes to write emails in one language.
+type locale struct {
+	months   [12]string
+	statuses map[string]string // Advert statuses as they read in the language.
+	text     string            // Defines the subject, body, digest_subject and digest templates.
+}
+
+// locales are the languages emails can be written in, by locale tag.
+var locales = map[string]locale{
+	"en": {
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		statuses: map[string]string{
+			"prospect":         "a prospect",
+			"booked":           "booked",
+			"artwork_received": "artwork received",
+			"proofed":          "proofed",
+			"approved":         "approved",
+			"published":        "published",
+			"cancelled":        "cancelled",
+		},
+		text: `
+{{define "line"}}{{with .Details}}{{if eq $.Topic "status"}}The advert for {{.Advertiser}} in {{.Year}} moved from {{status .From}} to {{status .To}}.{{else if eq $.Topic "artwork"}}We have no artwork yet for {{.Advertiser}} in {{.Edition}} {{.Year}}. The copy deadline is {{date .CopyDeadline}}.{{else}}The copy deadline for {{.Advertiser}} in {{.Edition}} {{.Year}} is {{date .CopyDeadline}}.{{end}}{{end}}{{end}}
+{{define "subject"}}{{with .Details}}{{if eq $.Topic "status"}}{{.Advertiser}} is now {{status .To}}{{else if eq $.Topic "artwork"}}Artwork needed for {{.Advertiser}} by {{date .CopyDeadline}}{{else}}Copy deadline for {{.Advertiser}} on {{date .CopyDeadline}}{{end}}{{end}}{{end}}
+{{define "body"}}<!DOCTYPE html>
+<html lang="en"><body>
+<p>Hello{{with .Name}} {{.}}{{end}},</p>
+<p>{{template "line" .}}</p>
+<p>Peeps</p>
+</body></html>{{end}}
+{{define "digest_subject"}}Your advert updates: {{len .Notifications}} new{{end}}
+{{define "digest"}}<!DOCTYPE html>
+<html lang="en"><body>
+<p>Hello{{with .Name}} {{.}}{{end}},</p>
+<p>Here is what happened to your adverts since we last wrote.</p>
+<ul>{{range .Notifications}}
+<li>{{template "line" .}}</li>{{end}}
+</ul>
+<p>Peeps</p>
+</body></html>{{end}}`,
+	},
+	"fr": {
+		months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		statuses: map[string]string{
+			"prospect":         "prospect",
+			"booked":           "réservée",
+			"artwork_received": "visuel reçu",
+			"proofed":          "épreuve envoyée",
+			"approved":         "validée",
+			"published":        "publiée",
+			"cancelled":        "annulée",
+		},
+		text: `
+{{define "line"}}{{with .Details}}{{if eq $.Topic "status"}}L'annonce de {{.Advertiser}} pour {{.Year}} est passée de « {{status .From}} » à « {{status .To}} ».{{else if eq $.Topic "artwork"}}Nous n'avons pas encore reçu le visuel de {{.Advertiser}} pour {{.Edition}} {{.Year}}. La date limite de remise est le {{date .CopyDeadline}}.{{else}}La date limite de remise pour {{.Advertiser}} dans {{.Edition}} {{.Year}} est le {{date .CopyDeadline}}.{{end}}{{end}}{{end}}
+{{define "subject"}}{{with .Details}}{{if eq $.Topic "status"}}{{.Advertiser}} : annonce {{status .To}}{{else if eq $.Topic "artwork"}}Visuel attendu pour {{.Advertiser}} avant le {{date .CopyDeadline}}{{else}}Date limite pour {{.Advertiser}} le {{date .CopyDeadline}}{{end}}{{end}}{{end}}
+{{define "body"}}<!DOCTYPE html>
+<html lang="fr"><body>
+<p>Bonjour{{with .Name}} {{.}}{{end}},</p>
+<p>{{template "line" .}}</p>
+<p>Peeps</p>
+</body></html>{{end}}
+{{define "digest_subject"}}Vos annonces : {{len .Notifications}} nouveauté(s){{end}}
+{{define "digest"}}<!DOCTYPE html>
+<html lang="fr"><body>
+<p>Bonjour{{with .Name}} {{.}}{{end}},</p>
+<p>Voici ce qui a changé pour vos annonces depuis notre dernier message.</p>
+<ul>{{range .Notifications}}
+<li>{{template "line" .}}</li>{{end}}
+</ul>
+<p>Peeps</p>
+</body></html>{{end}}`,
+	},
+}
+
+// templates are the parsed templates of each locale.
+var templates = func() map[string]*template.Template {
+	ts := make(map[string]*template.Template, len(locales))
+	for tag, l := range locales {
+		l := l
+		funcs := template.FuncMap{
+			"date": func(t time.Time) string {
+				return fmt.Sprintf("%d %s %d", t.Day(), l.months[t.Month()-1], t.Year())
+			},
+			"status": func(s string) string {
+				if v, ok := l.statuses[s]; ok {
+					return v
+				}
+				return s
+			},
+		}
+		ts[tag] = template.Must(template.New(tag).Funcs(funcs).Parse(l.text))
+	}
+	return ts
+}()
+
+// Supported reports whether emails can be written in the locale, or at least
+// in its language.
+func Supported(tag string) bool {
+	_, ok := closest(tag)
+	return ok
+}
+
+// closest returns the locale we have templates for that is closest to tag:
+// the locale itself or else its language.
+func closest(tag string) (string, bool) {
+	tag = strings.ToLower(strings.Replace(tag, "_", "-", -1))
+	if _, ok := templates[tag]; ok {
+		return tag, true
+	}
+	if i := strings.Index(tag, "-"); i > 0 {
+		if _, ok := templates[tag[:i]]; ok {
+			return tag[:i], true
+		}
+	}
+	return "", false
+}
+
+// match returns the closest locale to tag, or the fallback if there is none.
+func match(tag string) string {
+	if l, ok := closest(tag); ok {
+		return l
+	}
+	return fallbackLocale
+}
+
+// execute renders the subject and body templates named for data in the
+// closest locale to tag.
+func execute(tag, subject, body string, data interface{}) (string, string, error) {
+	t := templates[match(tag)]
+
+	var s, b bytes.Buffer
+	if err := t.ExecuteTemplate(&s, subject, data); err != nil {
+		return "", "", errors.Wrapf(err, "rendering %s", subject)
+	}
+	if err := t.ExecuteTemplate(&b, body, data); err != nil {
+		return "", "", errors.Wrapf(err, "rendering %s", body)
+	}
+
+	// Subjects are plain text, so undo the escaping meant for HTML.
+	return html.UnescapeString(s.String()), b.String(), nil
+}
+
+// render returns the subject and HTML body of the email for n.
+func render(n Notification) (string, string, error) {
+	return execute(n.Locale, "subject", "body", n)
+}
+
+// renderDigest returns the subject and HTML body of a digest of ns sent to
+// name. It is written in the locale of the first notification.
+func renderDigest(name string, ns []Notification) (string, string, error) {
+	data := struct {
+		Name          string
+		Notifications []Notification
+	}{name, ns}
+	return execute(ns[0].Locale, "digest_subject", "digest", data)
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// details is the advert the notifications in these tests are about. The
+// advertiser holds characters that are escaped in HTML.
+var details = Details{
+	Advertiser:   "Smith & Sons",
+	Edition:      "Spring",
+	Year:         "2019",
+	CopyDeadline: time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC),
+	From:         "booked",
+	To:           "approved",
+}
+
+// TestRender checks every topic renders in every locale, with the subject as
+// plain text and the body as HTML.
+func TestRender(t *testing.T) {
+	tests := []struct {
+		locale  string
+		topic   string
+		subject string
+		line    string
+	}{
+		{"en", TopicStatus, "Smith & Sons is now approved", "The advert for Smith &amp; Sons in 2019 moved from booked to approved."},
+		{"en", TopicArtwork, "Artwork needed for Smith & Sons by 1 March 2019", "We have no artwork yet for Smith &amp; Sons in Spring 2019. The copy deadline is 1 March 2019."},
+		{"en", TopicDeadline, "Copy deadline for Smith & Sons on 1 March 2019", "The copy deadline for Smith &amp; Sons in Spring 2019 is 1 March 2019."},
+		{"fr", TopicStatus, "Smith & Sons : annonce validée", "L'annonce de Smith &amp; Sons pour 2019 est passée de « réservée » à « validée »."},
+		{"fr", TopicArtwork, "Visuel attendu pour Smith & Sons avant le 1 mars 2019", "Nous n'avons pas encore reçu le visuel de Smith &amp; Sons pour Spring 2019. La date limite de remise est le 1 mars 2019."},
+		{"fr", TopicDeadline, "Date limite pour Smith & Sons le 1 mars 2019", "La date limite de remise pour Smith &amp; Sons dans Spring 2019 est le 1 mars 2019."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.locale+"/"+tt.topic, func(t *testing.T) {
+			n := Notification{Topic: tt.topic, Name: "Jane", Locale: tt.locale, Details: details}
+
+			subject, body, err := render(n)
+			if err != nil {
+				t.Fatalf("rendering : %v", err)
+			}
+			if subject != tt.subject {
+				t.Errorf("subject = %q, want %q", subject, tt.subject)
+			}
+			if !strings.Contains(body, tt.line) {
+				t.Errorf("body = %q, want it to hold %q", body, tt.line)
+			}
+			if !strings.Contains(body, `<html lang="`+tt.locale+`">`) {
+				t.Errorf("body = %q, want it in %s", body, tt.locale)
+			}
+		})
+	}
+
+	// Every locale must have been tested.
+	for tag := range locales {
+		var found bool
+		for _, tt := range tests {
+			found = found || tt.locale == tag
+		}
+		if !found {
+			t.Errorf("locale %s is not tested", tag)
+		}
+	}
+}
+
+// TestRenderDigest checks a digest renders in every locale with a line for
+// each notification.
+func TestRenderDigest(t *testing.T) {
+	tests := []struct {
+		locale  string
+		subject string
+	}{
+		{"en", "Your advert updates: 2 new"},
+		{"fr", "Vos annonces : 2 nouveauté(s)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			ns := []Notification{
+				{Topic: TopicStatus, Locale: tt.locale, Details: details},
+				{Topic: TopicDeadline, Locale: tt.locale, Details: details},
+			}
+
+			subject, body, err := renderDigest("Jane", ns)
+			if err != nil {
+				t.Fatalf("rendering : %v", err)
+			}
+			if subject != tt.subject {
+				t.Errorf("subject = %q, want %q", subject, tt.subject)
+			}
+			if n := strings.Count(body, "<li>"); n != len(ns) {
+				t.Errorf("body has %d lines, want %d", n, len(ns))
+			}
+			if !strings.Contains(body, "Jane,") {
+				t.Errorf("body = %q, want it to greet Jane", body)
+			}
+		})
+	}
+}
+
+// TestStatuses checks every locale names every advert status.
+func TestStatuses(t *testing.T) {
+	for tag, l := range locales {
+		for status := range locales[fallbackLocale].statuses {
+			if _, ok := l.statuses[status]; !ok {
+				t.Errorf("locale %s does not name status %s", tag, status)
+			}
+		}
+	}
+}
+
+// TestMatch checks locales fall back to their language and then to the
+// fallback locale.
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"fr", "fr"},
+		{"fr-CA", "fr"},
+		{"fr_BE", "fr"},
+		{"EN-GB", "en"},
+		{"de", fallbackLocale},
+		{"", fallbackLocale},
+	}
+
+	for _, tt := range tests {
+		if got := match(tt.tag); got != tt.want {
+			t.Errorf("match(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
@@ -10,8 +10,10 @@ import (
 
 // These are the expected values for Claims.Roles.
 const (
-	RoleAdmin = "ADMIN"
-	RoleUser  = "USER"
+	RoleSuperAdmin = "SUPERADMIN" // Works across every tenant.
+	RoleAdmin      = "ADMIN"
+	RoleEditor     = "EDITOR"
+	RoleUser       = "USER"
 )
 
 // ctxKey represents the type of value for the context key.
@@ -22,7 +24,8 @@ const Key ctxKey = 1
 
 // Claims represents the authorization claims transmitted via a JWT.
 type Claims struct {
-	Roles []string `json:"roles"`
+	Roles  []string `json:"roles"`
+	Tenant string   `json:"tenant,omitempty"` // Tenant the subject belongs to.
 	jwt.StandardClaims
 }
 
@@ -46,7 +49,7 @@ func NewClaims(subject string, roles []string, now time.Time, expires time.Durat
 func (c Claims) Valid() error {
 	for _, r := range c.Roles {
 		switch r {
-		case RoleAdmin, RoleUser: // Role is valid.
+		case RoleSuperAdmin, RoleAdmin, RoleEditor, RoleUser: // Role is valid.
 		default:
 			return fmt.Errorf("invalid role %q", r)
 		}
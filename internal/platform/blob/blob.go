@@ -0,0 +1,54 @@
+// Package blob stores files such as advert artwork outside the database. The
+// Store interface has implementations for a local directory and for S3 or any
+// service compatible with it, such as MinIO.
+package blob
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound occurs when no blob is stored under a key.
+var ErrNotFound = errors.New("Blob not found")
+
+// ErrInvalidKey occurs when a key could escape the store, such as one that
+// holds a ".." segment.
+var ErrInvalidKey = errors.New("Blob key is not valid")
+
+// Object is an open blob. Seeking lets it be served with HTTP range requests.
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Store keeps blobs under slash separated keys.
+type Store interface {
+
+	// Put stores size bytes read from r under key, replacing any blob
+	// already there.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Open returns the blob stored under key. The size must be the size the
+	// blob was stored with.
+	Open(ctx context.Context, key string, size int64) (Object, error)
+
+	// Delete removes the blob stored under key. Deleting a missing blob is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey rejects keys that are empty, absolute or climb out of the store.
+func validKey(key string) bool {
+	if key == "" || key[0] == '/' {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
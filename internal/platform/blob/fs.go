@@ -0,0 +1,97 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// FS stores blobs as files below a directory.
+type FS struct {
+	Root string
+}
+
+// NewFS returns a Store that keeps blobs below root, creating it if needed.
+func NewFS(root string) (*FS, error) {
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, errors.Wrap(err, "creating blob directory")
+	}
+	return &FS{Root: root}, nil
+}
+
+// path returns the file a key is stored in.
+func (fs *FS) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(fs.Root, filepath.FromSlash(key)), nil
+}
+
+// Put implements the Store interface. The blob is written to a temporary file
+// and renamed into place so readers never see part of it.
+func (fs *FS) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return errors.Wrap(err, "creating blob directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "creating blob file")
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing blob file")
+	}
+	if n != size {
+		tmp.Close()
+		return errors.Errorf("blob %s: wrote %d bytes, expected %d", key, n, size)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "closing blob file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "moving blob file into place")
+}
+
+// Open implements the Store interface.
+func (fs *FS) Open(ctx context.Context, key string, size int64) (Object, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "opening blob file")
+	}
+	return f, nil
+}
+
+// Delete implements the Store interface.
+func (fs *FS) Delete(ctx context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing blob file")
+	}
+	return nil
+}
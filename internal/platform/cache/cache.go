@@ -0,0 +1,74 @@
+// Package cache holds values in memory for a limited time so the results of
+// expensive work can be reused.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// item is a value and when it stops being usable.
+type item struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Cache holds up to a fixed number of values, each for the same length of
+// time. It is safe for concurrent use.
+type Cache struct {
+	ttl time.Duration
+	max int
+
+	mu    sync.Mutex
+	items map[string]item
+}
+
+// New returns a Cache that holds up to max values for ttl each.
+func New(ttl time.Duration, max int) *Cache {
+	return &Cache{
+		ttl:   ttl,
+		max:   max,
+		items: make(map[string]item),
+	}
+}
+
+// Get returns the value stored under key if it has not expired by now.
+func (c *Cache) Get(key string, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(it.expires) {
+		delete(c.items, key)
+		return nil, false
+	}
+	return it.value, true
+}
+
+// Set stores value under key as of now. When the cache is full, expired
+// values are dropped and then, if need be, the value closest to expiring.
+func (c *Cache) Set(key string, value interface{}, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; !ok && len(c.items) >= c.max {
+		var oldest string
+		for k, it := range c.items {
+			if !now.Before(it.expires) {
+				delete(c.items, k)
+				continue
+			}
+			if oldest == "" || it.expires.Before(c.items[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.items) >= c.max && oldest != "" {
+			delete(c.items, oldest)
+		}
+	}
+
+	c.items[key] = item{value: value, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,13 @@
+package db
+
+import "gopkg.in/mgo.v2/bson"
+
+// Version matches the expected version of a document in a query. A negative
+// version, as web.IfMatch reports for "If-Match: *", matches whatever version
+// the document is on.
+func Version(version int) interface{} {
+	if version < 0 {
+		return bson.M{"$ne": version}
+	}
+	return version
+}
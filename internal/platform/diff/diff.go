@@ -0,0 +1,87 @@
+// Package diff compares values by their JSON form. It backs both the change
+// history of adverts and the changes recorded in the audit log, so the two
+// always agree on what changed.
+package diff
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Change is a field that differs between two values.
+type Change struct {
+	Field string      `bson:"field" json:"field"`
+	From  interface{} `bson:"from" json:"from"`
+	To    interface{} `bson:"to" json:"to"`
+}
+
+// Compare reports every field that differs between before and after, sorted
+// by field. Nested objects are compared field by field using dotted names. A
+// nil value has no fields, so comparing against one lists every field.
+func Compare(before, after interface{}) ([]Change, error) {
+	a, err := flatten(before)
+	if err != nil {
+		return nil, errors.Wrap(err, "flattening before")
+	}
+	b, err := flatten(after)
+	if err != nil {
+		return nil, errors.Wrap(err, "flattening after")
+	}
+
+	keys := make(map[string]struct{})
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+
+	changes := []Change{}
+	for k := range keys {
+		if reflect.DeepEqual(a[k], b[k]) {
+			continue
+		}
+		changes = append(changes, Change{Field: k, From: a[k], To: b[k]})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes, nil
+}
+
+// flatten converts a value into a map keyed by dotted JSON field names.
+func flatten(v interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return out, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", sub)
+				continue
+			}
+			out[prefix+k] = v
+		}
+	}
+	walk("", doc)
+
+	return out, nil
+}
@@ -0,0 +1,112 @@
+// Package email sends email through a Mailer.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is an email with an HTML body.
+type Message struct {
+	From    string // Sender address; the Mailer's own is used when empty.
+	To      []string
+	Subject string
+	HTML    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// check makes sure every address of a message is well formed, which also
+// keeps line breaks out of the headers.
+func (m Message) check() error {
+	if len(m.To) == 0 {
+		return errors.New("message has no recipients")
+	}
+	for _, a := range append([]string{m.From}, m.To...) {
+		if _, err := mail.ParseAddress(a); err != nil {
+			return errors.Wrapf(err, "address %q", a)
+		}
+	}
+	return nil
+}
+
+// addressOf returns the bare address of a well formed address such as
+// "Jane <jane@example.com>".
+func addressOf(s string) string {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	return a.Address
+}
+
+// bytes encodes the message as it is sent, with its body in quoted-printable
+// UTF-8.
+func (m Message) bytes(now time.Time) ([]byte, error) {
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, errors.Wrap(err, "generating message ID")
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(m.From, "@"); i >= 0 {
+		domain = strings.TrimRight(m.From[i+1:], ">")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%x@%s>\r\n", id, domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(m.HTML)); err != nil {
+		return nil, errors.Wrap(err, "encoding body")
+	}
+	if err := qp.Close(); err != nil {
+		return nil, errors.Wrap(err, "encoding body")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Log is a Mailer that logs messages instead of sending them. It suits
+// development, where there is no mail server.
+type Log struct {
+	Log  *log.Logger
+	From string
+}
+
+// NewLog returns a Mailer that logs messages to log.
+func NewLog(log *log.Logger, from string) *Log {
+	return &Log{Log: log, From: from}
+}
+
+// Send logs the recipients and subject of m.
+func (l *Log) Send(ctx context.Context, m Message) error {
+	if m.From == "" {
+		m.From = l.From
+	}
+	if err := m.check(); err != nil {
+		return err
+	}
+	l.Log.Printf("email : %s -> %s : %s", m.From, strings.Join(m.To, ", "), m.Subject)
+	return nil
+}
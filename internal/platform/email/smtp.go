@@ -0,0 +1,111 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// SMTP is a Mailer that hands messages to an SMTP server. The connection is
+// upgraded with STARTTLS when the server offers it, and authenticated when a
+// username is set.
+type SMTP struct {
+	Addr     string // host:port of the server.
+	Username string
+	Password string
+	From     string        // Sender of messages that do not name one.
+	Timeout  time.Duration // Longest a message may take to send.
+}
+
+// NewSMTP returns a Mailer that sends through the server at addr.
+func NewSMTP(addr, username, password, from string, timeout time.Duration) *SMTP {
+	return &SMTP{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+		From:     from,
+		Timeout:  timeout,
+	}
+}
+
+// Send delivers m to the server for every recipient.
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.email.SMTP.Send")
+	defer span.End()
+
+	if m.From == "" {
+		m.From = s.From
+	}
+	if err := m.check(); err != nil {
+		return err
+	}
+	body, err := m.bytes(time.Now())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "server address %q", s.Addr)
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "connecting")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "greeting")
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.Wrap(err, "starting TLS")
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return errors.Wrap(err, "authenticating")
+		}
+	}
+
+	if err := c.Mail(addressOf(m.From)); err != nil {
+		return errors.Wrap(err, "MAIL FROM")
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(addressOf(to)); err != nil {
+			return errors.Wrapf(err, "RCPT TO %s", to)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "DATA")
+	}
+	if _, err := w.Write(body); err != nil {
+		return errors.Wrap(err, "writing message")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "ending message")
+	}
+
+	return c.Quit()
+}
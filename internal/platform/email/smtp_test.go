@@ -0,0 +1,268 @@
+package email_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/email"
+)
+
+// session records what a client sent to the fake server.
+type session struct {
+	commands []string
+	auth     string
+	from     string
+	rcpts    []string
+	data     []byte
+}
+
+// server is a fake SMTP server that offers AUTH PLAIN but not STARTTLS. It
+// rejects recipients at reject.example.com.
+type server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	sessions []*session
+	done     sync.WaitGroup
+}
+
+// newServer starts a fake SMTP server on a local port.
+func newServer(t *testing.T) *server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening : %v", err)
+	}
+
+	s := server{ln: ln}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.done.Add(1)
+			go func() {
+				defer s.done.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+
+	return &s
+}
+
+// Addr is the host:port the server listens on.
+func (s *server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and waits for its sessions to end.
+func (s *server) Close() {
+	s.ln.Close()
+	s.done.Wait()
+}
+
+// serve speaks SMTP to one client.
+func (s *server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var ss session
+	s.mu.Lock()
+	s.sessions = append(s.sessions, &ss)
+	s.mu.Unlock()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP fake")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		ss.commands = append(ss.commands, verb)
+		s.mu.Unlock()
+
+		switch {
+		case verb == "EHLO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250 AUTH PLAIN")
+
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH PLAIN "):
+			s.mu.Lock()
+			ss.auth = line[len("AUTH PLAIN "):]
+			s.mu.Unlock()
+			tp.PrintfLine("235 2.7.0 Authentication successful")
+
+		case verb == "MAIL":
+			s.mu.Lock()
+			ss.from = line
+			s.mu.Unlock()
+			tp.PrintfLine("250 2.1.0 OK")
+
+		case verb == "RCPT":
+			if strings.Contains(line, "@reject.example.com") {
+				tp.PrintfLine("550 5.1.1 No such user")
+				continue
+			}
+			s.mu.Lock()
+			ss.rcpts = append(ss.rcpts, line)
+			s.mu.Unlock()
+			tp.PrintfLine("250 2.1.5 OK")
+
+		case verb == "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			ss.data = data
+			s.mu.Unlock()
+			tp.PrintfLine("250 2.0.0 OK queued")
+
+		case verb == "QUIT":
+			tp.PrintfLine("221 2.0.0 Bye")
+			return
+
+		default:
+			tp.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+// session returns the only session the server has had.
+func (s *server) session(t *testing.T) *session {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sessions) != 1 {
+		t.Fatalf("server had %d sessions, want 1", len(s.sessions))
+	}
+	return s.sessions[0]
+}
+
+// TestSMTPSend checks a message is sent without STARTTLS when the server
+// does not offer it, authenticated, to every recipient.
+func TestSMTPSend(t *testing.T) {
+	srv := newServer(t)
+
+	m := email.NewSMTP(srv.Addr(), "peeps", "secret", "Peeps <noreply@example.com>", 5*time.Second)
+	msg := email.Message{
+		To:      []string{"Jane <jane@example.com>", "bob@example.com"},
+		Subject: "Advert approved",
+		HTML:    "<p>Your advert was approved.</p>",
+	}
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("sending : %v", err)
+	}
+	srv.Close()
+
+	ss := srv.session(t)
+
+	for _, c := range ss.commands {
+		if c == "STARTTLS" {
+			t.Error("client sent STARTTLS, which the server did not offer")
+		}
+	}
+
+	auth, err := base64.StdEncoding.DecodeString(ss.auth)
+	if err != nil {
+		t.Fatalf("decoding AUTH : %v", err)
+	}
+	if want := "\x00peeps\x00secret"; string(auth) != want {
+		t.Errorf("AUTH PLAIN = %q, want %q", auth, want)
+	}
+
+	if want := "MAIL FROM:<noreply@example.com>"; !strings.HasPrefix(ss.from, want) {
+		t.Errorf("MAIL = %q, want %q", ss.from, want)
+	}
+
+	want := []string{"RCPT TO:<jane@example.com>", "RCPT TO:<bob@example.com>"}
+	if len(ss.rcpts) != len(want) {
+		t.Fatalf("RCPT = %q, want %q", ss.rcpts, want)
+	}
+	for i := range want {
+		if ss.rcpts[i] != want[i] {
+			t.Errorf("RCPT %d = %q, want %q", i, ss.rcpts[i], want[i])
+		}
+	}
+
+	got, err := mail.ReadMessage(bytes.NewReader(ss.data))
+	if err != nil {
+		t.Fatalf("reading message : %v", err)
+	}
+	if h := got.Header.Get("From"); h != "Peeps <noreply@example.com>" {
+		t.Errorf("From = %q", h)
+	}
+	if h := got.Header.Get("To"); h != "Jane <jane@example.com>, bob@example.com" {
+		t.Errorf("To = %q", h)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(got.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("Subject = %q, %v, want %q", subject, err, msg.Subject)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(got.Body))
+	if err != nil {
+		t.Fatalf("decoding body : %v", err)
+	}
+	// The message ends with the line break that comes before the final dot.
+	if strings.TrimRight(string(body), "\r\n") != msg.HTML {
+		t.Errorf("body = %q, want %q", body, msg.HTML)
+	}
+}
+
+// TestSMTPNoAuth checks a Mailer without a username does not authenticate.
+func TestSMTPNoAuth(t *testing.T) {
+	srv := newServer(t)
+
+	m := email.NewSMTP(srv.Addr(), "", "", "noreply@example.com", 5*time.Second)
+	if err := m.Send(context.Background(), email.Message{To: []string{"jane@example.com"}, Subject: "Hi", HTML: "<p>Hi</p>"}); err != nil {
+		t.Fatalf("sending : %v", err)
+	}
+	srv.Close()
+
+	for _, c := range srv.session(t).commands {
+		if c == "AUTH" {
+			t.Error("client authenticated without a username")
+		}
+	}
+}
+
+// TestSMTPRejectedRecipient checks a recipient the server refuses fails the
+// send without the message being sent.
+func TestSMTPRejectedRecipient(t *testing.T) {
+	srv := newServer(t)
+
+	m := email.NewSMTP(srv.Addr(), "", "", "noreply@example.com", 5*time.Second)
+	err := m.Send(context.Background(), email.Message{To: []string{"jane@example.com", "bob@reject.example.com"}, Subject: "Hi", HTML: "<p>Hi</p>"})
+	if err == nil || !strings.Contains(err.Error(), "bob@reject.example.com") {
+		t.Errorf("sending = %v, want an error naming the rejected recipient", err)
+	}
+	srv.Close()
+
+	if ss := srv.session(t); ss.data != nil {
+		t.Error("message was sent despite a rejected recipient")
+	}
+}
@@ -0,0 +1,228 @@
+// Package export writes rows of values as CSV, NDJSON or XLSX. Every format is
+// written as rows arrive so large result sets can be streamed to a client
+// without being held in memory.
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// These are the supported export formats.
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+	XLSX   = "xlsx"
+)
+
+// ErrUnknownFormat occurs when an export names a format that is not supported.
+var ErrUnknownFormat = errors.New("Unknown export format")
+
+// contentTypes maps each format to the media type it is served as.
+var contentTypes = map[string]string{
+	CSV:    "text/csv",
+	NDJSON: "application/x-ndjson",
+	XLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// ContentType returns the media type for a format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Negotiate picks a format from the media types listed in an Accept header.
+// It returns an empty string if none of them are supported.
+func Negotiate(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for format, ct := range contentTypes {
+			if mt == ct {
+				return format
+			}
+		}
+		if mt == "application/ndjson" {
+			return NDJSON
+		}
+	}
+	return ""
+}
+
+// Writer writes rows of values in one of the export formats. Each row must
+// hold one value per column. Abort ends an export that failed part way through
+// with a record saying why, as by then the client has already been sent a
+// successful status.
+type Writer interface {
+	Write(row []string) error
+	Abort(reason string) error
+	Close() error
+}
+
+// NewWriter returns a Writer for the format that writes to w. CSV and XLSX
+// output starts with a header row of column names. NDJSON output uses the
+// column names as object keys.
+func NewWriter(format string, w io.Writer, columns []string) (Writer, error) {
+	switch format {
+	case CSV:
+		cw := csvWriter{w: csv.NewWriter(w)}
+		if err := cw.Write(columns); err != nil {
+			return nil, err
+		}
+		return &cw, nil
+
+	case NDJSON:
+		return &ndjsonWriter{w: w, columns: columns}, nil
+
+	case XLSX:
+		xw, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		if err := xw.Write(columns); err != nil {
+			return nil, err
+		}
+		return xw, nil
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+// csvWriter writes rows as RFC 4180 CSV.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+// Write implements the Writer interface.
+func (cw *csvWriter) Write(row []string) error {
+	cells := make([]string, len(row))
+	for i, cell := range row {
+		cells[i] = escapeFormula(cell)
+	}
+	return cw.w.Write(cells)
+}
+
+// Abort implements the Writer interface.
+func (cw *csvWriter) Abort(reason string) error {
+	if err := cw.w.Write([]string{abortRecord(reason)}); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// Close implements the Writer interface.
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ndjsonWriter writes each row as a JSON object on its own line. The keys are
+// written in column order.
+type ndjsonWriter struct {
+	w       io.Writer
+	columns []string
+	buf     bytes.Buffer
+}
+
+// Write implements the Writer interface.
+func (nw *ndjsonWriter) Write(row []string) error {
+	nw.buf.Reset()
+	nw.buf.WriteByte('{')
+	for i, col := range nw.columns {
+		if i > 0 {
+			nw.buf.WriteByte(',')
+		}
+		var cell string
+		if i < len(row) {
+			cell = row[i]
+		}
+		if err := nw.field(col, cell); err != nil {
+			return err
+		}
+	}
+	nw.buf.WriteString("}\n")
+
+	_, err := nw.w.Write(nw.buf.Bytes())
+	return err
+}
+
+// field appends a key and its value to the object being built.
+func (nw *ndjsonWriter) field(key, value string) error {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	nw.buf.Write(k)
+	nw.buf.WriteByte(':')
+	nw.buf.Write(v)
+	return nil
+}
+
+// Abort implements the Writer interface. The last line is an object holding
+// only an error key.
+func (nw *ndjsonWriter) Abort(reason string) error {
+	nw.buf.Reset()
+	nw.buf.WriteByte('{')
+	if err := nw.field("error", reason); err != nil {
+		return err
+	}
+	nw.buf.WriteString("}\n")
+
+	_, err := nw.w.Write(nw.buf.Bytes())
+	return err
+}
+
+// Close implements the Writer interface.
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
+
+// escapeFormula stops a spreadsheet from running a CSV cell as a formula by
+// prefixing text that starts with a formula character, a tab or a carriage
+// return with a quote. Numbers such as -12.50 are left alone.
+func escapeFormula(cell string) string {
+	if cell == "" {
+		return cell
+	}
+	switch cell[0] {
+	case '=', '+', '-', '@':
+		if _, err := strconv.ParseFloat(cell, 64); err == nil {
+			return cell
+		}
+		return "'" + cell
+	case '\t', '\r':
+		return "'" + cell
+	}
+	return cell
+}
+
+// UnescapeFormula reverses escapeFormula so a CSV export can be imported
+// again. Only a quote in front of text escapeFormula would have escaped is
+// removed.
+func UnescapeFormula(cell string) string {
+	if len(cell) < 2 || cell[0] != '\'' {
+		return cell
+	}
+	if escapeFormula(cell[1:]) != cell {
+		return cell
+	}
+	return cell[1:]
+}
+
+// abortRecord is the single cell written to the end of a spreadsheet export
+// that failed part way through.
+func abortRecord(reason string) string {
+	return "#ERROR: " + reason
+}
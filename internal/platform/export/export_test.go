@@ -0,0 +1,80 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestEscapeFormula checks cells a spreadsheet would evaluate are escaped and
+// that escaping can be undone.
+func TestEscapeFormula(t *testing.T) {
+	tests := []struct {
+		cell string
+		want string
+	}{
+		{"", ""},
+		{"Smith & Sons", "Smith & Sons"},
+		{"=SUM(A1:A2)", "'=SUM(A1:A2)"},
+		{"@cmd", "'@cmd"},
+		{"+61 2 9999 9999", "'+61 2 9999 9999"},
+		{"-1+2", "'-1+2"},
+		{"\tindent", "'\tindent"},
+		{"\rreturn", "'\rreturn"},
+		{"-12.50", "-12.50"},
+		{"+3", "+3"},
+		{"'quoted", "'quoted"},
+	}
+
+	for _, tt := range tests {
+		got := escapeFormula(tt.cell)
+		if got != tt.want {
+			t.Errorf("escapeFormula(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+		if back := UnescapeFormula(got); back != tt.cell {
+			t.Errorf("UnescapeFormula(%q) = %q, want %q", got, back, tt.cell)
+		}
+	}
+}
+
+// TestXLSXNotEscaped checks XLSX cells are written as they are, since inline
+// strings are never evaluated.
+func TestXLSXNotEscaped(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(XLSX, &buf, []string{"phone"})
+	if err != nil {
+		t.Fatalf("NewWriter : %v", err)
+	}
+	if err := w.Write([]string{"+61 2 9999 9999"}); err != nil {
+		t.Fatalf("Write : %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close : %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading the workbook : %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening the worksheet : %v", err)
+		}
+		sheet, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading the worksheet : %v", err)
+		}
+		if !strings.Contains(string(sheet), "<t xml:space=\"preserve\">+61 2 9999 9999</t>") {
+			t.Errorf("worksheet does not hold the phone number as it is:\n%s", sheet)
+		}
+		return
+	}
+	t.Fatal("workbook has no worksheet")
+}
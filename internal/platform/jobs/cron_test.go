@@ -0,0 +1,120 @@
+package jobs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/jobs"
+)
+
+// TestParseInvalid checks expressions that cannot be read are refused.
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"@fortnightly",
+	}
+
+	for _, spec := range tests {
+		if _, err := jobs.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+// TestNext checks when schedules next run.
+func TestNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatalf("parsing %q : %v", s, err)
+		}
+		return v
+	}
+
+	// The 1st of June 2026 is a Monday.
+	tests := []struct {
+		spec string
+		from string
+		want string // Empty when the schedule never runs.
+	}{
+		{"* * * * *", "2026-06-01 10:00", "2026-06-01 10:01"},
+		{"*/15 * * * *", "2026-06-01 10:07", "2026-06-01 10:15"},
+		{"*/15 * * * *", "2026-06-01 10:45", "2026-06-01 11:00"},
+		{"5/20 * * * *", "2026-06-01 10:30", "2026-06-01 10:45"},
+		{"0 9 * * *", "2026-06-01 09:00", "2026-06-02 09:00"},
+		{"30 2 * * *", "2026-06-01 23:59", "2026-06-02 02:30"},
+		{"0 9-17/4 * * *", "2026-06-01 10:00", "2026-06-01 13:00"},
+		{"0 8,12 * * *", "2026-06-01 08:30", "2026-06-01 12:00"},
+		{"0 9 * * mon-fri", "2026-06-05 10:00", "2026-06-08 09:00"},
+		{"0 9 * * SAT", "2026-06-01 00:00", "2026-06-06 09:00"},
+		{"0 0 * * 7", "2026-06-01 00:00", "2026-06-07 00:00"},
+		{"0 0 * * 0", "2026-06-01 00:00", "2026-06-07 00:00"},
+		{"0 0 1 * *", "2026-06-15 00:00", "2026-07-01 00:00"},
+		{"0 0 31 * *", "2026-06-01 00:00", "2026-07-31 00:00"},
+		{"0 0 1 jan *", "2026-06-01 00:00", "2027-01-01 00:00"},
+		{"0 0 29 feb *", "2026-06-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 feb *", "2026-06-01 00:00", ""},
+
+		// Restricting both days runs on either, as in cron.
+		{"0 0 15 * fri", "2026-06-01 00:00", "2026-06-05 00:00"},
+		{"0 0 3 * fri", "2026-06-01 00:00", "2026-06-03 00:00"},
+
+		// A stepped day field is still unrestricted.
+		{"0 0 */2 * fri", "2026-06-01 00:00", "2026-06-05 00:00"},
+
+		{"@hourly", "2026-06-01 10:30", "2026-06-01 11:00"},
+		{"@daily", "2026-06-01 10:30", "2026-06-02 00:00"},
+		{"@weekly", "2026-06-01 10:30", "2026-06-07 00:00"},
+		{"@monthly", "2026-06-01 10:30", "2026-07-01 00:00"},
+		{"@yearly", "2026-06-01 10:30", "2027-01-01 00:00"},
+	}
+
+	for _, tt := range tests {
+		s, err := jobs.Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q) : %v", tt.spec, err)
+			continue
+		}
+
+		got := s.Next(at(tt.from))
+		var want time.Time
+		if tt.want != "" {
+			want = at(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("Parse(%q).Next(%s) = %v, want %v", tt.spec, tt.from, got, want)
+		}
+	}
+}
+
+// TestNextLocation checks schedules run at the wall clock time of the
+// location they are asked about.
+func TestNextLocation(t *testing.T) {
+	loc := time.FixedZone("AEST", 10*60*60)
+
+	s, err := jobs.Parse("0 9 * * *")
+	if err != nil {
+		t.Fatalf("Parse : %v", err)
+	}
+
+	got := s.Next(time.Date(2026, 6, 1, 9, 0, 0, 0, loc))
+	want := time.Date(2026, 6, 2, 9, 0, 0, 0, loc)
+	if !got.Equal(want) || got.Location() != loc {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
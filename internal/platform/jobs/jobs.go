@@ -0,0 +1,542 @@
+// Package jobs runs recurring work on cron schedules. Each job runs on one
+// replica at a time, kept to it by a lock in Mongo, and every run is kept in
+// a history.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	locksCollection = "job_locks"
+	runsCollection  = "job_runs"
+)
+
+var (
+	// ErrUnknownJob occurs when no job is registered with a name.
+	ErrUnknownJob = errors.New("Job not found")
+
+	// ErrLocked occurs when a job is already running somewhere.
+	ErrLocked = errors.New("Job is already running")
+
+	// ErrStopping occurs when a job is started during shutdown.
+	ErrStopping = errors.New("Scheduler is shutting down")
+)
+
+// historyIndex supports listing the runs of a job, newest first.
+var historyIndex = mgo.Index{
+	Key: []string{"job", "-date_started"},
+}
+
+// runLimit is the most runs Runs returns.
+const runLimit = 100
+
+// Func does the work of a job. The context is cancelled when the job is asked
+// to stop during shutdown; the job should save its progress with Save and
+// return.
+type Func func(ctx context.Context, run *Run) error
+
+// job is a registered job.
+type job struct {
+	name     string
+	spec     string
+	schedule *Schedule
+	f        Func
+	local    bool
+	next     time.Time
+}
+
+// Scheduler runs registered jobs when their schedules come due and when they
+// are triggered by hand.
+type Scheduler struct {
+	MasterDB *db.DB
+	Log      *log.Logger
+	Owner    string         // Identifies this process in locks and run history.
+	Location *time.Location // Zone schedules are read in.
+
+	Interval    time.Duration // How often to look for jobs that are due.
+	Lease       time.Duration // How long a lock lasts unless renewed.
+	StopTimeout time.Duration // How long stopped jobs have to return.
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	stopping bool
+	running  sync.WaitGroup
+	runCtx   context.Context
+	stopRuns context.CancelFunc
+}
+
+// New returns a Scheduler with no jobs that reads schedules in UTC.
+func New(masterDB *db.DB, log *log.Logger) *Scheduler {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		MasterDB:    masterDB,
+		Log:         log,
+		Owner:       fmt.Sprintf("%s:%d", host, os.Getpid()),
+		Location:    time.UTC,
+		Interval:    time.Second,
+		Lease:       time.Minute,
+		StopTimeout: 10 * time.Second,
+		jobs:        make(map[string]*job),
+		runCtx:      ctx,
+		stopRuns:    cancel,
+	}
+}
+
+// Register adds a job that runs on one replica at a time whenever spec, a
+// cron expression, comes due.
+func (s *Scheduler) Register(name, spec string, f Func) error {
+	return s.register(name, spec, f, false)
+}
+
+// RegisterLocal adds a job that runs on every replica whenever spec, a cron
+// expression, comes due. It suits work on state held in the process, such as
+// a cache.
+func (s *Scheduler) RegisterLocal(name, spec string, f Func) error {
+	return s.register(name, spec, f, true)
+}
+
+// register adds a job.
+func (s *Scheduler) register(name, spec string, f Func, local bool) error {
+	sched, err := Parse(spec)
+	if err != nil {
+		return errors.Wrapf(err, "job %s", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("job %s is already registered", name)
+	}
+	s.jobs[name] = &job{
+		name:     name,
+		spec:     spec,
+		schedule: sched,
+		f:        f,
+		local:    local,
+	}
+
+	return nil
+}
+
+// Run starts jobs as they come due until ctx is cancelled. Jobs that are still
+// running when it returns are left to Shutdown.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	now := time.Now().In(s.Location)
+	for _, j := range s.jobs {
+		j.next = j.schedule.Next(now)
+	}
+	s.mu.Unlock()
+
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.tick(ctx, now)
+		}
+	}
+}
+
+// tick starts every job due by now.
+func (s *Scheduler) tick(ctx context.Context, now time.Time) {
+	now = now.In(s.Location)
+
+	var due []*job
+	var slots []time.Time
+
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if j.next.IsZero() || j.next.After(now) {
+			continue
+		}
+		due = append(due, j)
+		slots = append(slots, j.next)
+		j.next = j.schedule.Next(now)
+	}
+	s.mu.Unlock()
+
+	for i, j := range due {
+		slot := slots[i]
+		if _, err := s.start(ctx, j, TriggerSchedule, &slot); err != nil && err != ErrLocked && err != ErrStopping {
+			s.Log.Printf("jobs : %s : starting : %v", j.name, err)
+		}
+	}
+}
+
+// Trigger starts the named job straight away, whatever its schedule. It
+// returns the run once it has started, without waiting for it to finish.
+func (s *Scheduler) Trigger(ctx context.Context, name string) (*Run, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.jobs.Trigger")
+	defer span.End()
+
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownJob
+	}
+
+	return s.start(ctx, j, TriggerManual, nil)
+}
+
+// Jobs describes the registered jobs in name order, with the last run of each.
+func (s *Scheduler) Jobs(ctx context.Context) ([]Info, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.jobs.Jobs")
+	defer span.End()
+
+	s.mu.Lock()
+	infos := make([]Info, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		info := Info{
+			Name:     j.name,
+			Schedule: j.spec,
+			Local:    j.local,
+		}
+		if !j.next.IsZero() {
+			next := j.next
+			info.Next = &next
+		}
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, k int) bool {
+		return infos[i].Name < infos[k].Name
+	})
+
+	dbConn := s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	for i := range infos {
+		runs, err := runs(ctx, dbConn, infos[i].Name, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) > 0 {
+			infos[i].Last = &runs[0]
+		}
+	}
+
+	return infos, nil
+}
+
+// Runs retrieves the most recent runs of the named job, newest first.
+func (s *Scheduler) Runs(ctx context.Context, name string) ([]Run, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.jobs.Runs")
+	defer span.End()
+
+	s.mu.Lock()
+	_, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownJob
+	}
+
+	dbConn := s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	return runs(ctx, dbConn, name, runLimit)
+}
+
+// runs retrieves the most recent runs of a job, newest first.
+func runs(ctx context.Context, dbConn *db.DB, name string, limit int) ([]Run, error) {
+	q := bson.M{"job": name}
+
+	rs := []Run{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-date_started").Limit(limit).All(&rs)
+	}
+	if err := dbConn.Execute(ctx, runsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.job_runs.find(%s)", db.Query(q)))
+	}
+
+	return rs, nil
+}
+
+// Purge removes the runs that finished before the given time and reports how
+// many were removed.
+func Purge(ctx context.Context, dbConn *db.DB, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.jobs.Purge")
+	defer span.End()
+
+	q := bson.M{"status": bson.M{"$ne": StatusRunning}, "date_finished": bson.M{"$lt": before}}
+
+	var n int
+	f := func(collection *mgo.Collection) error {
+		info, err := collection.RemoveAll(q)
+		if info != nil {
+			n = info.Removed
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, runsCollection, f); err != nil {
+		return n, errors.Wrap(err, fmt.Sprintf("db.job_runs.remove(%s)", db.Query(q)))
+	}
+
+	return n, nil
+}
+
+// Shutdown stops jobs from starting and waits for running ones to finish.
+// When ctx is done first the running jobs are asked to stop and given
+// StopTimeout to checkpoint and return.
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.stopRuns()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(s.StopTimeout):
+		return errors.New("jobs did not stop in time")
+	}
+}
+
+// start claims a job and runs it in the background. The slot is the time a
+// scheduled run was due, so replicas that see it due at slightly different
+// times run it once between them.
+func (s *Scheduler) start(ctx context.Context, j *job, trigger string, slot *time.Time) (*Run, error) {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return nil, ErrStopping
+	}
+	s.running.Add(1)
+	s.mu.Unlock()
+
+	run, err := s.claim(ctx, j, trigger, slot)
+	if err != nil {
+		s.running.Done()
+		return nil, err
+	}
+
+	go func() {
+		defer s.running.Done()
+		s.execute(j, run)
+	}()
+
+	return run, nil
+}
+
+// claim takes the lock on a job and records the start of a run.
+func (s *Scheduler) claim(ctx context.Context, j *job, trigger string, slot *time.Time) (*Run, error) {
+	dbConn := s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	now := time.Now().Truncate(time.Millisecond)
+
+	run := Run{
+		ID:          bson.NewObjectId(),
+		Job:         j.name,
+		Owner:       s.Owner,
+		Trigger:     trigger,
+		Scheduled:   slot,
+		Status:      StatusRunning,
+		DateStarted: now,
+		s:           s,
+	}
+
+	if !j.local {
+		if err := s.lock(ctx, dbConn, j.name, run.ID, slot, now); err != nil {
+			return nil, err
+		}
+
+		// Holding the lock means no other run of the job is going, so any
+		// still marked as running were cut off.
+		if err := abandon(ctx, dbConn, j.name, now); err != nil {
+			s.unlock(ctx, dbConn, j.name, run.ID, now)
+			return nil, err
+		}
+	}
+
+	prev, err := runs(ctx, dbConn, j.name, 1)
+	if err == nil && len(prev) > 0 && prev[0].Status == StatusInterrupted {
+		run.resume = prev[0].Checkpoint
+	}
+
+	if err == nil {
+		f := func(collection *mgo.Collection) error {
+			if err := collection.EnsureIndex(historyIndex); err != nil {
+				return err
+			}
+			return collection.Insert(&run)
+		}
+		if err = dbConn.Execute(ctx, runsCollection, f); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("db.job_runs.insert(%s)", db.Query(&run)))
+		}
+	}
+	if err != nil {
+		if !j.local {
+			s.unlock(ctx, dbConn, j.name, run.ID, now)
+		}
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// execute runs a claimed job, keeping its lock alive, and records how it
+// went.
+func (s *Scheduler) execute(j *job, run *Run) {
+	ctx, span := trace.StartSpan(s.runCtx, "internal.platform.jobs.execute")
+	defer span.End()
+
+	// Each run has its own cancel so losing its lock stops only this run.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	renewed := make(chan struct{})
+	stopRenew := make(chan struct{})
+	if !j.local {
+		go func() {
+			defer close(renewed)
+			s.renew(j.name, run.ID, stopRenew, cancel)
+		}()
+	} else {
+		close(renewed)
+	}
+
+	err := call(ctx, j.f, run)
+
+	close(stopRenew)
+	<-renewed
+
+	now := time.Now().Truncate(time.Millisecond)
+	fields := bson.M{
+		"status":        StatusSucceeded,
+		"date_finished": now,
+	}
+	switch {
+	case err == nil:
+	case ctx.Err() != nil && s.runCtx.Err() == nil:
+
+		// Only losing the lock cancels a run while the scheduler is still
+		// going. Another run has taken over, so this one is not resumed.
+		fields["status"] = StatusAbandoned
+		fields["error"] = err.Error()
+	case ctx.Err() != nil:
+		fields["status"] = StatusInterrupted
+		fields["error"] = err.Error()
+	default:
+		fields["status"] = StatusFailed
+		fields["error"] = err.Error()
+		s.Log.Printf("jobs : %s : %v", j.name, err)
+	}
+
+	// The outcome is recorded with a fresh context as the run's own may
+	// have been cancelled by the shutdown.
+	bg := context.Background()
+
+	dbConn := s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	q := bson.M{"_id": run.ID}
+	m := bson.M{"$set": fields}
+	f := func(collection *mgo.Collection) error {
+		return collection.Update(q, m)
+	}
+	if err := dbConn.Execute(bg, runsCollection, f); err != nil {
+		s.Log.Printf("jobs : %s : recording run : %v", j.name, errors.Wrap(err, fmt.Sprintf("db.job_runs.update(%s, %s)", db.Query(q), db.Query(m))))
+	}
+
+	if !j.local {
+		s.unlock(bg, dbConn, j.name, run.ID, now)
+	}
+}
+
+// call runs a job, treating a panic as an error.
+func call(ctx context.Context, f Func, run *Run) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return f(ctx, run)
+}
+
+// Save records the progress of a run as its checkpoint. Should the run be
+// interrupted, the next run of the job can pick it up with Resume.
+func (r *Run) Save(ctx context.Context, v interface{}) error {
+	ctx, span := trace.StartSpan(ctx, "internal.platform.jobs.Save")
+	defer span.End()
+
+	dbConn := r.s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	q := bson.M{"_id": r.ID}
+	m := bson.M{"$set": bson.M{"checkpoint": v}}
+
+	// The checkpoint is saved even when ctx has been cancelled, as that is
+	// when it matters most.
+	f := func(collection *mgo.Collection) error {
+		return collection.Update(q, m)
+	}
+	if err := dbConn.Execute(context.Background(), runsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.job_runs.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	r.Checkpoint = v
+	return nil
+}
+
+// Resume decodes into v the checkpoint left by the interrupted run this one
+// follows. It reports false when there is none, so the job starts afresh.
+func (r *Run) Resume(v interface{}) (bool, error) {
+	if r.resume == nil {
+		return false, nil
+	}
+
+	raw, err := bson.Marshal(bson.M{"v": r.resume})
+	if err != nil {
+		return false, errors.Wrap(err, "encoding checkpoint")
+	}
+	var doc struct {
+		V bson.Raw `bson:"v"`
+	}
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return false, errors.Wrap(err, "decoding checkpoint")
+	}
+	if err := doc.V.Unmarshal(v); err != nil {
+		return false, errors.Wrap(err, "decoding checkpoint")
+	}
+
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// lock takes the lock on a job for a run. A lock is free once it expires, and
+// a scheduled run also needs its slot to be later than the last one taken.
+// Locks are documents keyed by job name, so when the lock is held the upsert
+// collides with the existing document.
+func (s *Scheduler) lock(ctx context.Context, dbConn *db.DB, name string, runID bson.ObjectId, slot *time.Time, now time.Time) error {
+	q := bson.M{"_id": name, "expires": bson.M{"$lte": now}}
+	fields := bson.M{
+		"owner":   s.Owner,
+		"run_id":  runID,
+		"expires": now.Add(s.Lease),
+	}
+	if slot != nil {
+		q["$or"] = []bson.M{
+			{"slot": bson.M{"$lt": *slot}},
+			{"slot": bson.M{"$exists": false}},
+		}
+		fields["slot"] = *slot
+	}
+	m := bson.M{"$set": fields}
+
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, Upsert: true}, nil)
+		return err
+	}
+	if err := dbConn.Execute(ctx, locksCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			return ErrLocked
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.job_locks.upsert(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// unlock lets go of the lock held for a run. The lock document is kept so the
+// last slot taken is remembered. A failure is logged as the lock lapses on
+// its own.
+func (s *Scheduler) unlock(ctx context.Context, dbConn *db.DB, name string, runID bson.ObjectId, now time.Time) {
+	q := bson.M{"_id": name, "run_id": runID}
+	m := bson.M{"$set": bson.M{"expires": now}}
+
+	f := func(collection *mgo.Collection) error {
+		err := collection.Update(q, m)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, locksCollection, f); err != nil {
+		s.Log.Printf("jobs : %s : unlocking : %v", name, errors.Wrap(err, fmt.Sprintf("db.job_locks.update(%s, %s)", db.Query(q), db.Query(m))))
+	}
+}
+
+// renew keeps the lock held for a run from expiring until stop is closed.
+// Should the lock be lost to another run, lost is called so the run stops
+// rather than go on alongside the other.
+func (s *Scheduler) renew(name string, runID bson.ObjectId, stop <-chan struct{}, lost context.CancelFunc) {
+	t := time.NewTicker(s.Lease / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			dbConn := s.MasterDB.Copy()
+
+			q := bson.M{"_id": name, "run_id": runID}
+			m := bson.M{"$set": bson.M{"expires": now.Add(s.Lease).Truncate(time.Millisecond)}}
+
+			f := func(collection *mgo.Collection) error {
+				return collection.Update(q, m)
+			}
+			err := dbConn.Execute(context.Background(), locksCollection, f)
+			dbConn.Close()
+
+			switch {
+			case err == mgo.ErrNotFound:
+				s.Log.Printf("jobs : %s : lock was lost to another run", name)
+				lost()
+				return
+			case err != nil:
+				s.Log.Printf("jobs : %s : renewing lock : %v", name, errors.Wrap(err, fmt.Sprintf("db.job_locks.update(%s, %s)", db.Query(q), db.Query(m))))
+			}
+		}
+	}
+}
+
+// abandon marks the runs of a job still recorded as running as abandoned.
+func abandon(ctx context.Context, dbConn *db.DB, name string, now time.Time) error {
+	q := bson.M{"job": name, "status": StatusRunning}
+	m := bson.M{"$set": bson.M{"status": StatusAbandoned, "date_finished": now}}
+
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.UpdateAll(q, m)
+		return err
+	}
+	if err := dbConn.Execute(ctx, runsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.job_runs.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
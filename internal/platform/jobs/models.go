@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the expected values for Run.Status.
+const (
+	StatusRunning     = "running"     // Still going.
+	StatusSucceeded   = "succeeded"   // Returned without error.
+	StatusFailed      = "failed"      // Returned an error.
+	StatusInterrupted = "interrupted" // Stopped by a shutdown; the next run resumes from its checkpoint.
+	StatusAbandoned   = "abandoned"   // Its process stopped without recording the outcome, or it lost its lock.
+)
+
+// These are the expected values for Run.Trigger.
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+// Info describes a registered job.
+type Info struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Local    bool       `json:"local"` // Runs on every replica rather than one.
+	Next     *time.Time `json:"next,omitempty"`
+	Last     *Run       `json:"last,omitempty"`
+}
+
+// Run records one run of a job.
+type Run struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	Job          string        `bson:"job" json:"job"`
+	Owner        string        `bson:"owner" json:"owner"`     // Process that ran the job.
+	Trigger      string        `bson:"trigger" json:"trigger"` // Trigger constants.
+	Scheduled    *time.Time    `bson:"scheduled,omitempty" json:"scheduled,omitempty"`
+	Status       string        `bson:"status" json:"status"` // Status constants.
+	Error        string        `bson:"error,omitempty" json:"error,omitempty"`
+	Checkpoint   interface{}   `bson:"checkpoint,omitempty" json:"checkpoint,omitempty"` // Progress saved by the job.
+	DateStarted  time.Time     `bson:"date_started" json:"date_started"`
+	DateFinished *time.Time    `bson:"date_finished,omitempty" json:"date_finished,omitempty"`
+
+	// resume is the checkpoint of the interrupted run this one follows.
+	resume interface{}
+	s      *Scheduler
+}
@@ -0,0 +1,394 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON encoded values.
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// These are the media types for the supported patch formats.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrMalformed occurs when a patch document cannot be understood.
+	ErrMalformed = errors.New("patch document is malformed")
+
+	// ErrTestFailed occurs when a JSON Patch test operation does not match the
+	// target document. No part of the patch is applied.
+	ErrTestFailed = errors.New("patch test operation failed")
+)
+
+// Error describes a patch that is well formed but cannot be applied to the
+// target document, such as a path that does not exist.
+type Error struct {
+	Op   string
+	Path string
+	Msg  string
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return "patch " + e.Op + " " + e.Path + ": " + e.Msg
+}
+
+// Merge applies an RFC 7396 merge patch to doc and returns the result.
+func Merge(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, errors.Wrap(err, "decoding document")
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, errors.Wrap(ErrMalformed, err.Error())
+	}
+
+	return json.Marshal(mergeValue(target, p))
+}
+
+// mergeValue implements the MergePatch function from RFC 7396 section 2.
+func mergeValue(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergeValue(t[k], v)
+	}
+
+	return t
+}
+
+// operation is a single step of an RFC 6902 patch.
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"` // Holds null when the value is null, and nothing when it is missing.
+}
+
+// Apply applies an RFC 6902 JSON Patch to doc and returns the result. The
+// operations are applied in order and the patch is all or nothing.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, errors.Wrap(err, "decoding document")
+	}
+
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(ErrMalformed, err.Error())
+	}
+
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, errors.Wrapf(ErrMalformed, "operation %d is missing path", i)
+		}
+
+		var err error
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, errors.Wrapf(ErrMalformed, "operation %d is missing value", i)
+			}
+			var v interface{}
+			if err := json.Unmarshal(op.Value, &v); err != nil {
+				return nil, errors.Wrapf(ErrMalformed, "operation %d value: %v", i, err)
+			}
+			switch op.Op {
+			case "add":
+				target, err = add(target, *op.Path, v)
+			case "replace":
+				target, err = replace(target, *op.Path, v)
+			case "test":
+				err = test(target, *op.Path, v)
+			}
+
+		case "remove":
+			target, _, err = remove(target, *op.Path)
+
+		case "move", "copy":
+			if op.From == nil {
+				return nil, errors.Wrapf(ErrMalformed, "operation %d is missing from", i)
+			}
+			var v interface{}
+			if op.Op == "move" {
+				if strings.HasPrefix(*op.Path, *op.From+"/") {
+					return nil, &Error{op.Op, *op.Path, "cannot move a value into one of its children"}
+				}
+				target, v, err = remove(target, *op.From)
+			} else {
+				v, err = get(target, *op.From)
+				if err == nil {
+					v, err = clone(v)
+				}
+			}
+			if err == nil {
+				target, err = add(target, *op.Path, v)
+			}
+
+		default:
+			return nil, errors.Wrapf(ErrMalformed, "operation %d has unknown op %q", i, op.Op)
+		}
+
+		if err != nil {
+			if e, ok := err.(*Error); ok && e.Op == "" {
+				e.Op = op.Op
+			}
+			return nil, err
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+// clone deep copies a decoded JSON value so a copied value does not share
+// maps or slices with its source.
+func clone(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped reference tokens.
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, &Error{Path: path, Msg: "pointer must start with /"}
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		t = strings.Replace(t, "~1", "/", -1)
+		tokens[i] = strings.Replace(t, "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex converts a reference token into an index of an array of length
+// n. When appending is allowed the "-" token and n itself are accepted.
+func arrayIndex(token string, n int, appending bool) (int, bool) {
+	if appending && token == "-" {
+		return n, true
+	}
+
+	// Leading zeros are not permitted by RFC 6901.
+	if len(token) > 1 && token[0] == '0' {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, false
+	}
+
+	max := n - 1
+	if appending {
+		max = n
+	}
+	if i > max {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// get returns the value referenced by path.
+func get(doc interface{}, path string) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := doc
+	for _, t := range tokens {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, &Error{Path: path, Msg: "path does not exist"}
+			}
+			cur = v
+		case []interface{}:
+			i, ok := arrayIndex(t, len(c), false)
+			if !ok {
+				return nil, &Error{Path: path, Msg: "array index out of range"}
+			}
+			cur = c[i]
+		default:
+			return nil, &Error{Path: path, Msg: "path does not exist"}
+		}
+	}
+
+	return cur, nil
+}
+
+// root is passed as the parent when a pointer references the whole document.
+type root struct{}
+
+// update walks to the parent of the value referenced by path and calls fn to
+// produce the replacement for that parent. It returns the new document.
+func update(doc interface{}, path string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return fn(root{}, "")
+	}
+
+	var walk func(cur interface{}, tokens []string) (interface{}, error)
+	walk = func(cur interface{}, tokens []string) (interface{}, error) {
+		if len(tokens) == 1 {
+			return fn(cur, tokens[0])
+		}
+
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			child, ok := c[tokens[0]]
+			if !ok {
+				return nil, &Error{Path: path, Msg: "path does not exist"}
+			}
+			v, err := walk(child, tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[tokens[0]] = v
+			return c, nil
+
+		case []interface{}:
+			i, ok := arrayIndex(tokens[0], len(c), false)
+			if !ok {
+				return nil, &Error{Path: path, Msg: "array index out of range"}
+			}
+			v, err := walk(c[i], tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[i] = v
+			return c, nil
+		}
+
+		return nil, &Error{Path: path, Msg: "path does not exist"}
+	}
+
+	return walk(doc, tokens)
+}
+
+// add implements the RFC 6902 add operation.
+func add(doc interface{}, path string, value interface{}) (interface{}, error) {
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case root:
+			return value, nil
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			i, ok := arrayIndex(token, len(p), true)
+			if !ok {
+				return nil, &Error{Path: path, Msg: "array index out of range"}
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, &Error{Path: path, Msg: "parent is not an object or array"}
+	})
+}
+
+// remove implements the RFC 6902 remove operation. It also returns the value
+// that was removed so move can reuse it.
+func remove(doc interface{}, path string) (interface{}, interface{}, error) {
+	var removed interface{}
+	out, err := update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[token]
+			if !ok {
+				return nil, &Error{Path: path, Msg: "path does not exist"}
+			}
+			removed = v
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			i, ok := arrayIndex(token, len(p), false)
+			if !ok {
+				return nil, &Error{Path: path, Msg: "array index out of range"}
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, &Error{Path: path, Msg: "cannot remove the whole document"}
+	})
+
+	return out, removed, err
+}
+
+// replace implements the RFC 6902 replace operation.
+func replace(doc interface{}, path string, value interface{}) (interface{}, error) {
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case root:
+			return value, nil
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok {
+				return nil, &Error{Path: path, Msg: "path does not exist"}
+			}
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			i, ok := arrayIndex(token, len(p), false)
+			if !ok {
+				return nil, &Error{Path: path, Msg: "array index out of range"}
+			}
+			p[i] = value
+			return p, nil
+		}
+		return nil, &Error{Path: path, Msg: "parent is not an object or array"}
+	})
+}
+
+// test implements the RFC 6902 test operation.
+func test(doc interface{}, path string, value interface{}) error {
+	v, err := get(doc, path)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(v, value) {
+		return errors.Wrapf(ErrTestFailed, "value at %s", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package stream fans events out to live subscribers and keeps the most
+// recent ones so a subscriber that lost its connection can catch up.
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind by before
+// it is dropped.
+const subscriberBuffer = 64
+
+// Event is something that happened, as sent to subscribers.
+type Event struct {
+	ID    string      // Unique for the life of the broker, see Broker.
+	Name  string      // Such as advert.created.
+	Value interface{} // What the event is about.
+	Data  []byte      // Value encoded as JSON.
+}
+
+// Broker publishes events to subscribers. Event IDs are the time the broker
+// started and a sequence number, so IDs from before a restart are never
+// mistaken for current ones. It is safe for concurrent use.
+type Broker struct {
+	epoch string
+
+	mu     sync.Mutex
+	seq    uint64
+	buf    []Event // Ring of the most recent events.
+	next   int     // Where the next event goes in buf.
+	full   bool
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewBroker returns a Broker that keeps the last size events for replay.
+func NewBroker(size int) *Broker {
+	return &Broker{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		buf:   make([]Event, size),
+		subs:  make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber. Subscribers too far behind to
+// take it are dropped; they can resume from the replay buffer.
+func (b *Broker) Publish(name string, value interface{}) (Event, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Event{}, errors.Wrapf(err, "encoding %s", name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return Event{}, nil
+	}
+
+	b.seq++
+	ev := Event{
+		ID:    fmt.Sprintf("%s-%d", b.epoch, b.seq),
+		Name:  name,
+		Value: value,
+		Data:  data,
+	}
+
+	if len(b.buf) > 0 {
+		b.buf[b.next] = ev
+		b.next = (b.next + 1) % len(b.buf)
+		b.full = b.full || b.next == 0
+	}
+
+	for s := range b.subs {
+		select {
+		case s.c <- ev:
+		default:
+			b.drop(s)
+		}
+	}
+
+	return ev, nil
+}
+
+// Subscribe starts a subscription. Events published after lastID that are
+// still held are returned to be sent first. It reports false when lastID was
+// given but the events since cannot all be replayed, because it is too old
+// or from before a restart. The subscriber should then start afresh.
+func (b *Broker) Subscribe(lastID string) (*Subscription, []Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Subscription{b: b, c: make(chan Event, subscriberBuffer)}
+	s.C = s.c
+	if b.closed {
+		close(s.c)
+		return &s, nil, lastID == ""
+	}
+	b.subs[&s] = struct{}{}
+
+	if lastID == "" {
+		return &s, nil, true
+	}
+
+	held := b.held()
+	seq, ok := b.parse(lastID)
+	if !ok || seq > b.seq {
+		return &s, nil, false
+	}
+
+	first := b.seq + 1
+	if len(held) > 0 {
+		first = b.seq - uint64(len(held)) + 1
+	}
+	if seq+1 < first {
+		return &s, nil, false
+	}
+
+	return &s, held[len(held)-int(b.seq-seq):], true
+}
+
+// Close ends every subscription and stops new ones.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		b.drop(s)
+	}
+}
+
+// held returns the events in the replay buffer, oldest first.
+func (b *Broker) held() []Event {
+	if !b.full {
+		return append([]Event(nil), b.buf[:b.next]...)
+	}
+	return append(append([]Event(nil), b.buf[b.next:]...), b.buf[:b.next]...)
+}
+
+// parse returns the sequence number of an event ID issued by this broker.
+func (b *Broker) parse(id string) (uint64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// drop ends a subscription. The caller holds the lock.
+func (b *Broker) drop(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Subscription receives the events published after it started. C is closed
+// when the subscription ends.
+type Subscription struct {
+	C <-chan Event
+
+	b *Broker
+	c chan Event
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+
+	s.b.drop(s)
+}
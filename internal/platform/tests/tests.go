@@ -0,0 +1,54 @@
+// Package tests holds the support shared by the tests that run against
+// MongoDB.
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dialTimeout is how long to wait for MongoDB before skipping the test.
+const dialTimeout = 2 * time.Second
+
+// NewUnit connects to a fresh database on the MongoDB at TEST_DB_HOST, or
+// localhost when that is not set. When it cannot connect the test is skipped,
+// unless TEST_DB_HOST was set, as it is in CI, in which case the test fails
+// so tests that need MongoDB are never quietly left out. The returned func
+// drops the database and closes the connection.
+func NewUnit(t *testing.T) (*db.DB, func()) {
+	t.Helper()
+
+	host, required := os.LookupEnv("TEST_DB_HOST")
+	if host == "" {
+		host = "localhost:27017"
+	}
+	url := fmt.Sprintf("%s/peeps_test_%s", host, bson.NewObjectId().Hex())
+
+	masterDB, err := db.New(url, dialTimeout)
+	if err != nil {
+		if required {
+			t.Fatalf("MongoDB is not reachable at %s : %v", host, err)
+		}
+		t.Skipf("MongoDB is not reachable at %s : %v", host, err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		f := func(collection *mgo.Collection) error {
+			return collection.Database.DropDatabase()
+		}
+		if err := masterDB.Execute(context.Background(), "tests", f); err != nil {
+			t.Errorf("dropping the test database : %v", err)
+		}
+		masterDB.Close()
+	}
+
+	return masterDB, teardown
+}
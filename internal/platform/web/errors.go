@@ -1,6 +1,8 @@
 package web
 
 import (
+	"net/http"
+
 	"github.com/pkg/errors"
 )
 
@@ -30,6 +32,17 @@ func NewRequestError(err error, status int) error {
 	return &Error{err, status, nil}
 }
 
+// NewFieldErrors reports problems with specific request fields. Decode uses it
+// for validation tag failures and it may be used for rules that tags cannot
+// express, such as checks against stored data.
+func NewFieldErrors(fields ...FieldError) error {
+	return &Error{
+		Err:    errors.New("field validation error"),
+		Status: http.StatusBadRequest,
+		Fields: fields,
+	}
+}
+
 // Error implements the error interface. It uses the default message of the
 // wrapped error. This is what will be shown in the services' logs.
 func (err *Error) Error() string {
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AnyVersion is the version IfMatch reports for "If-Match: *". It matches
+// whatever version of a document is current, as long as the document exists.
+const AnyVersion = -1
+
+// ETag formats a document version as a strong entity tag suitable for the
+// ETag response header.
+func ETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// IfMatch reads the version a client expects to be modifying from the
+// If-Match request header. Writes are refused with 428 Precondition Required
+// when the header is missing so clients cannot skip the check by accident.
+// "If-Match: *" is reported as AnyVersion.
+func IfMatch(r *http.Request) (int, error) {
+	hdr := strings.TrimSpace(r.Header.Get("If-Match"))
+	if hdr == "" {
+		err := errors.New("missing If-Match header")
+		return 0, NewRequestError(err, http.StatusPreconditionRequired)
+	}
+	if hdr == "*" {
+		return AnyVersion, nil
+	}
+
+	version, ok := parseETag(hdr)
+	if !ok {
+		err := errors.Errorf("If-Match header %q is not a valid entity tag", hdr)
+		return 0, NewRequestError(err, http.StatusBadRequest)
+	}
+
+	return version, nil
+}
+
+// VersionMatches reports whether version, as read by IfMatch, names the
+// current version of a document.
+func VersionMatches(version, current int) bool {
+	return version == AnyVersion || version == current
+}
+
+// NotModified reports whether the If-None-Match request header already names
+// the provided version, in which case the client copy is current.
+func NotModified(r *http.Request, version int) bool {
+	hdr := r.Header.Get("If-None-Match")
+	if hdr == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(hdr, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		// If-None-Match uses the weak comparison so a weak tag still matches.
+		v, ok := parseETag(strings.TrimPrefix(tag, "W/"))
+		if ok && v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseETag extracts the version number from a quoted entity tag.
+func parseETag(tag string) (int, bool) {
+	s, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, false
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+
+	return v, true
+}
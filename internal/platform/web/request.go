@@ -2,9 +2,9 @@ package web
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/go-playground/locales/en"
@@ -32,6 +32,15 @@ func init() {
 	lang, _ := translator.GetTranslator("en")
 	en_translations.RegisterDefaultTranslations(validate, lang)
 
+	// Register the validations we provide on top of the built in ones.
+	validate.RegisterValidation("phone", isPhone)
+	validate.RegisterTranslation("phone", lang, func(ut ut.Translator) error {
+		return ut.Add("phone", "{0} must be a valid phone number", true)
+	}, func(ut ut.Translator, fe validator.FieldError) string {
+		t, _ := ut.T("phone", fe.Field())
+		return t
+	})
+
 	// Use JSON tag names for errors instead of Go struct names.
 	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
 		name := strings.SplitN(fld.Tag.Get("json"), ",", 2)[0]
@@ -53,6 +62,12 @@ func Decode(r *http.Request, val interface{}) error {
 		return NewRequestError(err, http.StatusBadRequest)
 	}
 
+	return Validate(val)
+}
+
+// Validate checks the validation tags of the provided struct value. Failures
+// are reported as an *Error listing each offending field.
+func Validate(val interface{}) error {
 	if err := validate.Struct(val); err != nil {
 
 		// Use a type assertion to get the real error value.
@@ -74,12 +89,29 @@ func Decode(r *http.Request, val interface{}) error {
 			fields = append(fields, field)
 		}
 
-		return &Error{
-			Err:    errors.New("field validation error"),
-			Status: http.StatusBadRequest,
-			Fields: fields,
-		}
+		return NewFieldErrors(fields...)
 	}
 
 	return nil
 }
+
+// phoneRE matches the characters allowed in a phone number. An optional
+// leading + is followed by digits and common separators.
+var phoneRE = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+
+// isPhone is the validation function for the phone tag. It accepts numbers
+// written with the usual separators as long as they hold 6 to 15 digits.
+func isPhone(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+	if !phoneRE.MatchString(s) {
+		return false
+	}
+
+	var digits int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 6 && digits <= 15
+}
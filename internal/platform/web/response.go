@@ -35,7 +35,7 @@ func RespondError(ctx context.Context, w http.ResponseWriter, err error) error {
 }
 
 // Respond converts a Go value to JSON and sends it to the client.
-// If code is StatusNoContent, v is expected to be nil.
+// If code is StatusNoContent or StatusNotModified, v is expected to be nil.
 func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statusCode int) error {
 
 	// Set the status code for the request logger middleware.
@@ -48,7 +48,7 @@ func Respond(ctx context.Context, w http.ResponseWriter, data interface{}, statu
 	v.StatusCode = statusCode
 
 	// If there is nothing to marshal then set status code and return.
-	if statusCode == http.StatusNoContent {
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
 		w.WriteHeader(statusCode)
 		return nil
 	}
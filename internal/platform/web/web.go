@@ -20,6 +20,10 @@ type ctxKey int
 // KeyValues is how request values or stored/retrieved.
 const KeyValues ctxKey = 1
 
+// keyConn is how the controller for the connection a request arrived on is
+// stored/retrieved.
+const keyConn ctxKey = 2
+
 // Values represent state for each request.
 type Values struct {
 	TraceID    string
@@ -95,6 +99,12 @@ func (a *App) Handle(verb, path string, handler Handler, mw ...Middleware) {
 		}
 		ctx = context.WithValue(ctx, KeyValues, &v)
 
+		// The writer ochttp passes on hides the connection, so give handlers
+		// one that can still set its deadlines.
+		if conn, ok := r.Context().Value(keyConn).(*http.ResponseController); ok {
+			w = &connWriter{ResponseWriter: w, conn: conn}
+		}
+
 		// Call the wrapped handler functions.
 		if err := handler(ctx, w, r, params); err != nil {
 			a.log.Printf("*****> critical shutdown error: %v", err)
@@ -111,5 +121,36 @@ func (a *App) Handle(verb, path string, handler Handler, mw ...Middleware) {
 // of the embedded TreeMux by using the ochttp.Handler instead. That Handler
 // wraps the TreeMux handler so the routes are served.
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	a.och.ServeHTTP(w, r)
+	ctx := context.WithValue(r.Context(), keyConn, http.NewResponseController(w))
+	a.och.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// connWriter restores the connection deadlines of the writer the server
+// passed in, so http.NewResponseController works on the writer a handler is
+// given. Everything else goes through the writer ochttp wraps it in.
+type connWriter struct {
+	http.ResponseWriter
+	conn *http.ResponseController
+}
+
+// SetReadDeadline sets the deadline for reading the request body.
+func (cw *connWriter) SetReadDeadline(t time.Time) error {
+	return cw.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing the response.
+func (cw *connWriter) SetWriteDeadline(t time.Time) error {
+	return cw.conn.SetWriteDeadline(t)
+}
+
+// Flush implements the http.Flusher interface.
+func (cw *connWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the writer ochttp wrapped the server's in.
+func (cw *connWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
 }
@@ -0,0 +1,96 @@
+package ratecard
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Amounts of money are held as integers in the minor unit of the currency,
+// such as cents, so prices add up exactly. Percentages are held in basis
+// points where 10000 is 100%.
+
+// Rate is the price of a size of advert in an edition. A rate with no edition
+// applies to every edition that has no rate of its own.
+type Rate struct {
+	Size    string `bson:"size" json:"size" validate:"required,oneof=eighth quarter half full spread"`
+	Edition string `bson:"edition,omitempty" json:"edition,omitempty"`
+	Amount  int64  `bson:"amount" json:"amount" validate:"min=0"`
+}
+
+// Discount takes a percentage off bookings into at least MinEditions
+// editions. Only the largest discount a booking qualifies for applies.
+type Discount struct {
+	MinEditions int `bson:"min_editions" json:"min_editions" validate:"min=2"`
+	BasisPoints int `bson:"basis_points" json:"basis_points" validate:"min=0,max=10000"`
+}
+
+// Surcharge adds a percentage to bookings that run in a state.
+type Surcharge struct {
+	State       string `bson:"state" json:"state" validate:"required"`
+	BasisPoints int    `bson:"basis_points" json:"basis_points" validate:"min=0"`
+}
+
+// Tax is charged on the discounted and surcharged amount.
+type Tax struct {
+	Name        string `bson:"name" json:"name"`
+	BasisPoints int    `bson:"basis_points" json:"basis_points" validate:"min=0"`
+}
+
+// RateCard holds the prices for bookings in a year. There is one rate card
+// per year for each tenant and every amount on it is in its currency.
+type RateCard struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	TenantID     bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Year         string        `bson:"year" json:"year"`
+	Currency     string        `bson:"currency" json:"currency"` // ISO 4217 code.
+	Rates        []Rate        `bson:"rates" json:"rates"`
+	Discounts    []Discount    `bson:"discounts" json:"discounts"`
+	Surcharges   []Surcharge   `bson:"surcharges" json:"surcharges"`
+	Tax          Tax           `bson:"tax" json:"tax"`
+	Version      int           `bson:"version" json:"version"`
+	DateCreated  time.Time     `bson:"date_created" json:"date_created"`
+	DateModified time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// NewRateCard is what we require from clients when adding a RateCard.
+type NewRateCard struct {
+	Year       string      `json:"year" validate:"required"`
+	Currency   string      `json:"currency" validate:"required,len=3,alpha"`
+	Rates      []Rate      `json:"rates" validate:"required,min=1,dive"`
+	Discounts  []Discount  `json:"discounts" validate:"dive"`
+	Surcharges []Surcharge `json:"surcharges" validate:"dive"`
+	Tax        Tax         `json:"tax"`
+}
+
+// UpdateRateCard defines what may be changed on an existing RateCard. The
+// year cannot change. Fields that are not provided are left as they are.
+type UpdateRateCard struct {
+	Currency   *string      `json:"currency" validate:"omitempty,len=3,alpha"`
+	Rates      *[]Rate      `json:"rates" validate:"omitempty,min=1,dive"`
+	Discounts  *[]Discount  `json:"discounts" validate:"omitempty,dive"`
+	Surcharges *[]Surcharge `json:"surcharges" validate:"omitempty,dive"`
+	Tax        *Tax         `json:"tax"`
+}
+
+// Line is the price of one edition of a booking before adjustments.
+type Line struct {
+	Edition string `bson:"edition" json:"edition"`
+	Size    string `bson:"size" json:"size"`
+	Amount  int64  `bson:"amount" json:"amount"`
+}
+
+// Price is the breakdown of what a booking costs. Total is Subtotal less
+// Discount plus Surcharge plus Tax.
+type Price struct {
+	Currency        string        `bson:"currency" json:"currency"`
+	Lines           []Line        `bson:"lines" json:"lines"`
+	Subtotal        int64         `bson:"subtotal" json:"subtotal"`
+	Discount        int64         `bson:"discount" json:"discount"`
+	Surcharge       int64         `bson:"surcharge" json:"surcharge"`
+	Tax             int64         `bson:"tax" json:"tax"`
+	TaxName         string        `bson:"tax_name,omitempty" json:"tax_name,omitempty"`
+	Total           int64         `bson:"total" json:"total"`
+	RateCardID      bson.ObjectId `bson:"rate_card_id" json:"rate_card_id"`
+	RateCardVersion int           `bson:"rate_card_version" json:"rate_card_version"` // Version of the rate card the price came from.
+}
@@ -0,0 +1,89 @@
+package ratecard
+
+import (
+	"fmt"
+
+	"github.com/mattlaver/peeps/internal/platform/web"
+)
+
+// Price works out what a booking of size into editions, running in states,
+// costs on the rate card.
+func (rc *RateCard) Price(size string, editions, states []string) (*Price, error) {
+	p := Price{
+		Currency:        rc.Currency,
+		Lines:           make([]Line, 0, len(editions)),
+		TaxName:         rc.Tax.Name,
+		RateCardID:      rc.ID,
+		RateCardVersion: rc.Version,
+	}
+
+	var fields []web.FieldError
+	for i, ed := range editions {
+		amount, ok := rc.rate(size, ed)
+		if !ok {
+			fields = append(fields, web.FieldError{
+				Field: fmt.Sprintf("editions[%d]", i),
+				Error: fmt.Sprintf("the %s rate card has no %s rate for %q", rc.Year, size, ed),
+			})
+			continue
+		}
+		p.Lines = append(p.Lines, Line{Edition: ed, Size: size, Amount: amount})
+		p.Subtotal += amount
+	}
+	if len(fields) > 0 {
+		return nil, web.NewFieldErrors(fields...)
+	}
+
+	var discount int
+	for _, d := range rc.Discounts {
+		if len(editions) >= d.MinEditions && d.BasisPoints > discount {
+			discount = d.BasisPoints
+		}
+	}
+	p.Discount = percent(p.Subtotal, discount)
+	net := p.Subtotal - p.Discount
+
+	var surcharge int
+	for _, st := range states {
+		for _, s := range rc.Surcharges {
+			if s.State == st {
+				surcharge += s.BasisPoints
+			}
+		}
+	}
+	p.Surcharge = percent(net, surcharge)
+	net += p.Surcharge
+
+	p.Tax = percent(net, rc.Tax.BasisPoints)
+	p.Total = net + p.Tax
+
+	return &p, nil
+}
+
+// rate finds the amount for a size in an edition, falling back to the rate
+// for the size that applies to every edition.
+func (rc *RateCard) rate(size, edition string) (int64, bool) {
+	var amount int64
+	var found bool
+	for _, r := range rc.Rates {
+		if r.Size != size {
+			continue
+		}
+		switch r.Edition {
+		case edition:
+			return r.Amount, true
+		case "":
+			amount, found = r.Amount, true
+		}
+	}
+	return amount, found
+}
+
+// percent takes basis points of an amount, rounding half away from zero.
+func percent(amount int64, bp int) int64 {
+	v := amount * int64(bp)
+	if v < 0 {
+		return (v - 5000) / 10000
+	}
+	return (v + 5000) / 10000
+}
@@ -0,0 +1,101 @@
+package ratecard
+
+import "testing"
+
+// TestPercent checks basis points are taken of amounts rounding half away
+// from zero.
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount int64
+		bp     int
+		want   int64
+	}{
+		{0, 1000, 0},
+		{100000, 0, 0},
+		{100000, 1000, 10000},
+		{14, 1000, 1},
+		{15, 1000, 2},
+		{5, 5000, 3},
+		{4, 5000, 2},
+		{-14, 1000, -1},
+		{-15, 1000, -2},
+		{-5, 5000, -3},
+		{55555, 150, 833},
+	}
+
+	for _, tt := range tests {
+		if got := percent(tt.amount, tt.bp); got != tt.want {
+			t.Errorf("percent(%d, %d) = %d, want %d", tt.amount, tt.bp, got, tt.want)
+		}
+	}
+}
+
+// TestPrice checks a booking is priced from the rates of its editions, less
+// the largest discount it qualifies for, plus the surcharges of every state
+// it runs in, with tax charged on the result.
+func TestPrice(t *testing.T) {
+	rc := RateCard{
+		Year:     "2026",
+		Currency: "AUD",
+		Rates: []Rate{
+			{Size: "full", Amount: 100000},
+			{Size: "full", Edition: "Spring", Amount: 120000},
+			{Size: "half", Amount: 55555},
+		},
+		Discounts: []Discount{
+			{MinEditions: 2, BasisPoints: 500},
+			{MinEditions: 3, BasisPoints: 1000},
+		},
+		Surcharges: []Surcharge{
+			{State: "NSW", BasisPoints: 250},
+			{State: "VIC", BasisPoints: 150},
+		},
+		Tax: Tax{Name: "GST", BasisPoints: 1000},
+	}
+
+	type amounts struct {
+		Subtotal, Discount, Surcharge, Tax, Total int64
+	}
+
+	tests := []struct {
+		name     string
+		size     string
+		editions []string
+		states   []string
+		want     amounts
+	}{
+		{"rate for every edition", "full", []string{"Summer"}, nil,
+			amounts{Subtotal: 100000, Tax: 10000, Total: 110000}},
+		{"rate for the edition", "full", []string{"Spring"}, nil,
+			amounts{Subtotal: 120000, Tax: 12000, Total: 132000}},
+		{"two edition discount", "full", []string{"Spring", "Summer"}, nil,
+			amounts{Subtotal: 220000, Discount: 11000, Tax: 20900, Total: 229900}},
+		{"largest discount with stacked surcharges", "full", []string{"Spring", "Summer", "Autumn"}, []string{"NSW", "VIC"},
+			amounts{Subtotal: 320000, Discount: 32000, Surcharge: 11520, Tax: 29952, Total: 329472}},
+		{"tax rounded half up", "half", []string{"Summer"}, nil,
+			amounts{Subtotal: 55555, Tax: 5556, Total: 61111}},
+		{"tax charged after the surcharge", "half", []string{"Summer"}, []string{"VIC"},
+			amounts{Subtotal: 55555, Surcharge: 833, Tax: 5639, Total: 62027}},
+		{"state without a surcharge", "half", []string{"Summer"}, []string{"QLD"},
+			amounts{Subtotal: 55555, Tax: 5556, Total: 61111}},
+	}
+
+	for _, tt := range tests {
+		p, err := rc.Price(tt.size, tt.editions, tt.states)
+		if err != nil {
+			t.Errorf("%s : Price : %v", tt.name, err)
+			continue
+		}
+		got := amounts{p.Subtotal, p.Discount, p.Surcharge, p.Tax, p.Total}
+		if got != tt.want {
+			t.Errorf("%s : got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if len(p.Lines) != len(tt.editions) || p.Currency != "AUD" || p.TaxName != "GST" {
+			t.Errorf("%s : got %d lines in %s with %s, want %d lines in AUD with GST", tt.name, len(p.Lines), p.Currency, p.TaxName, len(tt.editions))
+		}
+	}
+
+	if _, err := rc.Price("eighth", []string{"Spring"}, nil); err == nil {
+		t.Errorf("priced a size with no rate")
+	}
+}
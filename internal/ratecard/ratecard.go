@@ -0,0 +1,233 @@
+package ratecard
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const rateCardsCollection = "rate_cards"
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the rate card
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current rate card")
+
+	// ErrDuplicate occurs when a rate card already exists for the year.
+	ErrDuplicate = errors.New("Rate card already exists for the year")
+)
+
+// yearIndex makes sure a tenant has only one rate card per year.
+var yearIndex = mgo.Index{
+	Key:    []string{"tenant_id", "year"},
+	Unique: true,
+}
+
+// List retrieves every rate card from the database, latest year first.
+func List(ctx context.Context, dbConn *db.DB) ([]RateCard, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.List")
+	defer span.End()
+
+	q := bson.M{}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	rc := []RateCard{}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-year").All(&rc)
+	}
+	if err := dbConn.Execute(ctx, rateCardsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.rate_cards.find(%s)", db.Query(q)))
+	}
+
+	return rc, nil
+}
+
+// Retrieve gets the specified rate card from the database.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*RateCard, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	return find(ctx, dbConn, bson.M{"_id": bson.ObjectIdHex(id)})
+}
+
+// ForYear gets the rate card bookings in a year are priced with. Every
+// tenant has its own, so ctx must be scoped to a single tenant.
+func ForYear(ctx context.Context, dbConn *db.DB, year string) (*RateCard, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.ForYear")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return find(ctx, dbConn, bson.M{"tenant_id": tid, "year": year})
+}
+
+// find gets the single rate card of the tenant of ctx matching q.
+func find(ctx context.Context, dbConn *db.DB, q bson.M) (*RateCard, error) {
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var rc *RateCard
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&rc)
+	}
+	if err := dbConn.Execute(ctx, rateCardsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.rate_cards.find(%s)", db.Query(q)))
+	}
+
+	return rc, nil
+}
+
+// Create inserts a new rate card into the database.
+func Create(ctx context.Context, dbConn *db.DB, nr *NewRateCard, now time.Time) (*RateCard, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.Create")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	rc := RateCard{
+		ID:           bson.NewObjectId(),
+		TenantID:     tid,
+		Year:         nr.Year,
+		Currency:     strings.ToUpper(nr.Currency),
+		Rates:        nr.Rates,
+		Discounts:    nr.Discounts,
+		Surcharges:   nr.Surcharges,
+		Tax:          nr.Tax,
+		Version:      1,
+		DateCreated:  now,
+		DateModified: now,
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(yearIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&rc)
+	}
+	if err := dbConn.Execute(ctx, rateCardsCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.rate_cards.insert(%s)", db.Query(&rc)))
+	}
+
+	return &rc, nil
+}
+
+// Update modifies a rate card in the database. The write only succeeds if
+// version is still the current version of the rate card. Adverts already
+// priced keep the price they were booked at.
+func Update(ctx context.Context, dbConn *db.DB, id string, version int, upd *UpdateRateCard, now time.Time) (*RateCard, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.Update")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	fields := bson.M{}
+	if upd.Currency != nil {
+		fields["currency"] = strings.ToUpper(*upd.Currency)
+	}
+	if upd.Rates != nil {
+		fields["rates"] = *upd.Rates
+	}
+	if upd.Discounts != nil {
+		fields["discounts"] = *upd.Discounts
+	}
+	if upd.Surcharges != nil {
+		fields["surcharges"] = *upd.Surcharges
+	}
+	if upd.Tax != nil {
+		fields["tax"] = *upd.Tax
+	}
+
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var rc RateCard
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &rc)
+		return err
+	}
+	if err := dbConn.Execute(ctx, rateCardsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return nil, err
+			}
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.rate_cards.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &rc, nil
+}
+
+// Delete removes a rate card from the database. The delete only succeeds if
+// version is still the current version of the rate card.
+func Delete(ctx context.Context, dbConn *db.DB, id string, version int) error {
+	ctx, span := trace.StartSpan(ctx, "internal.ratecard.Delete")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Remove(q)
+	}
+	if err := dbConn.Execute(ctx, rateCardsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.rate_cards.remove(%s)", db.Query(q)))
+	}
+
+	return nil
+}
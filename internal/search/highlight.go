@@ -0,0 +1,132 @@
+package search
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetLen is the most runes of a long field shown in a highlight.
+const snippetLen = 200
+
+// Terms returns the words and phrases a search looks for. Excluded words and
+// phrases, those starting with a minus, are left out.
+func Terms(text string) []string {
+	var terms []string
+	for text != "" {
+		text = strings.TrimLeft(text, " \t\r\n")
+		if text == "" {
+			break
+		}
+
+		exclude := false
+		if text[0] == '-' {
+			exclude, text = true, text[1:]
+		}
+
+		var term string
+		if strings.HasPrefix(text, `"`) {
+			end := strings.Index(text[1:], `"`)
+			if end < 0 {
+				term, text = text[1:], ""
+			} else {
+				term, text = text[1:end+1], text[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(text, " \t\r\n")
+			if end < 0 {
+				end = len(text)
+			}
+			term, text = text[:end], text[end:]
+		}
+
+		if term = strings.TrimSpace(term); term != "" && !exclude {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// matcher returns a pattern matching any of the terms regardless of case.
+// Longer terms are tried first so a phrase wins over a word inside it.
+func matcher(terms []string) *regexp.Regexp {
+	if len(terms) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = regexp.QuoteMeta(t)
+	}
+	sort.SliceStable(quoted, func(i, j int) bool {
+		return len(quoted[i]) > len(quoted[j])
+	})
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// highlight splits value into fragments marking where re matches. It reports
+// false when nothing matches. Long values are cut down to the part around
+// the first match.
+func highlight(field, value string, re *regexp.Regexp) (Highlight, bool) {
+	if re == nil {
+		return Highlight{}, false
+	}
+	locs := re.FindAllStringIndex(value, -1)
+	if len(locs) == 0 {
+		return Highlight{}, false
+	}
+
+	start, end := 0, len(value)
+	if utf8.RuneCountInString(value) > snippetLen {
+		start = back(value, locs[0][0], snippetLen/4)
+		end = forward(value, start, snippetLen)
+	}
+
+	h := Highlight{Field: field}
+	if start > 0 {
+		h.Fragments = append(h.Fragments, Fragment{Text: "…"})
+	}
+	pos := start
+	for _, l := range locs {
+		if l[0] < pos {
+			continue
+		}
+		if l[0] >= end {
+			break
+		}
+		if l[1] > end {
+			end = l[1]
+		}
+		if l[0] > pos {
+			h.Fragments = append(h.Fragments, Fragment{Text: value[pos:l[0]]})
+		}
+		h.Fragments = append(h.Fragments, Fragment{Text: value[l[0]:l[1]], Match: true})
+		pos = l[1]
+	}
+	if pos < end {
+		h.Fragments = append(h.Fragments, Fragment{Text: value[pos:end]})
+	}
+	if end < len(value) {
+		h.Fragments = append(h.Fragments, Fragment{Text: "…"})
+	}
+
+	return h, true
+}
+
+// back returns the byte offset n runes before i in s.
+func back(s string, i, n int) int {
+	for ; n > 0 && i > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return i
+}
+
+// forward returns the byte offset n runes after i in s.
+func forward(s string, i, n int) int {
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return i
+}
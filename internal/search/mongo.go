@@ -0,0 +1,142 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"go.opencensus.io/trace"
+)
+
+// Mongo is an Index backed by Mongo text indexes on the adverts, advertisers
+// and comments collections.
+type Mongo struct {
+	masterDB *db.DB
+}
+
+// NewMongo returns an Index that searches the database behind masterDB.
+func NewMongo(masterDB *db.DB) *Mongo {
+	return &Mongo{masterDB: masterDB}
+}
+
+// Search runs q against each kind in turn and merges the hits by score.
+func (m *Mongo) Search(ctx context.Context, q Query) ([]Hit, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.search.Mongo.Search")
+	defer span.End()
+
+	dbConn := m.masterDB.Copy()
+	defer dbConn.Close()
+
+	re := matcher(Terms(q.Text))
+
+	hits := []Hit{}
+	for _, k := range q.Kinds {
+		switch k {
+		case KindAdvert:
+			found, err := advert.Search(ctx, dbConn, q.Text, q.Limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range found {
+				hits = append(hits, advertHit(&a, re))
+			}
+
+		case KindAdvertiser:
+			found, err := advertiser.Search(ctx, dbConn, q.Text, q.Limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range found {
+				hits = append(hits, advertiserHit(&a, re))
+			}
+
+		case KindComment:
+			found, err := advert.SearchComments(ctx, dbConn, q.Text, q.Limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range found {
+				hits = append(hits, commentHit(&c, re))
+			}
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+
+	return hits, nil
+}
+
+// field is a value to highlight.
+type field struct {
+	name  string
+	value string
+}
+
+// highlights returns the highlights of the fields that match re.
+func highlights(re *regexp.Regexp, fields []field) []Highlight {
+	hs := []Highlight{}
+	for _, f := range fields {
+		if h, ok := highlight(f.name, f.value, re); ok {
+			hs = append(hs, h)
+		}
+	}
+	return hs
+}
+
+// advertHit describes an advert found by a search.
+func advertHit(a *advert.ScoredAdvert, re *regexp.Regexp) Hit {
+	fields := []field{{"advertiser", a.Advertiser}}
+	for _, e := range a.Editions {
+		fields = append(fields, field{"editions", e})
+	}
+	for _, c := range a.Contacts {
+		fields = append(fields, field{"contacts.name", c.Name}, field{"contacts.email", c.Email})
+	}
+
+	return Hit{
+		Kind:       KindAdvert,
+		ID:         a.ID.Hex(),
+		Title:      fmt.Sprintf("%s %s", a.Advertiser, a.Year),
+		Score:      a.Score,
+		Highlights: highlights(re, fields),
+	}
+}
+
+// advertiserHit describes an advertiser found by a search.
+func advertiserHit(a *advertiser.Scored, re *regexp.Regexp) Hit {
+	fields := []field{{"name", a.Name}}
+	for _, al := range a.Aliases {
+		fields = append(fields, field{"aliases", al})
+	}
+	for _, c := range a.Contacts {
+		fields = append(fields, field{"contacts.name", c.Name}, field{"contacts.email", c.Email})
+	}
+
+	return Hit{
+		Kind:       KindAdvertiser,
+		ID:         a.ID.Hex(),
+		Title:      a.Name,
+		Score:      a.Score,
+		Highlights: highlights(re, fields),
+	}
+}
+
+// commentHit describes a comment found by a search.
+func commentHit(c *advert.ScoredComment, re *regexp.Regexp) Hit {
+	return Hit{
+		Kind:       KindComment,
+		ID:         c.ID.Hex(),
+		AdvertID:   c.AdvertID.Hex(),
+		Score:      c.Score,
+		Highlights: highlights(re, []field{{"body", c.Body}}),
+	}
+}
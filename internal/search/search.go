@@ -0,0 +1,124 @@
+// Package search finds adverts, advertisers and comments from free text. The
+// engine sits behind the Index interface; Mongo is backed by the database's
+// own text indexes.
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// These are the kinds of thing a search can find.
+const (
+	KindAdvert     = "advert"
+	KindAdvertiser = "advertiser"
+	KindComment    = "comment"
+)
+
+// Kinds lists every kind of thing a search can find.
+var Kinds = []string{KindAdvert, KindAdvertiser, KindComment}
+
+// These bound the number of results a search returns.
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Query is a search to run. Text is made of words, "quoted phrases" and
+// -excluded words. Only the listed kinds are searched.
+type Query struct {
+	Text  string
+	Kinds []string
+	Limit int
+}
+
+// Fragment is a piece of a highlighted field. Fragments marked Match are
+// where the search terms were found.
+type Fragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// Highlight shows where a field matched the search.
+type Highlight struct {
+	Field     string     `json:"field"`
+	Fragments []Fragment `json:"fragments"`
+}
+
+// Hit is something found by a search.
+type Hit struct {
+	Kind       string      `json:"kind"` // One of the Kind constants.
+	ID         string      `json:"id"`
+	AdvertID   string      `json:"advert_id,omitempty"` // Advert a comment is on.
+	Title      string      `json:"title,omitempty"`
+	Score      float64     `json:"score"` // Relevance, higher is better.
+	Highlights []Highlight `json:"highlights"`
+}
+
+// Index is a search engine. Search returns up to q.Limit hits of the kinds in
+// q.Kinds, best match first.
+type Index interface {
+	Search(ctx context.Context, q Query) ([]Hit, error)
+}
+
+// Search runs q against idx. An empty list of kinds searches everything.
+// Every user may search every kind; what they find is limited to their
+// tenant by the packages the index searches.
+func Search(ctx context.Context, idx Index, q Query) ([]Hit, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.search.Search")
+	defer span.End()
+
+	if err := check(&q); err != nil {
+		return nil, err
+	}
+	if len(q.Kinds) == 0 {
+		q.Kinds = Kinds
+	}
+
+	return idx.Search(ctx, q)
+}
+
+// known reports whether k is one of the kinds a search can find.
+func known(k string) bool {
+	for _, kind := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates a query and fills in its defaults.
+func check(q *Query) error {
+	var fields []web.FieldError
+
+	q.Text = strings.TrimSpace(q.Text)
+	if len(Terms(q.Text)) == 0 {
+		fields = append(fields, web.FieldError{Field: "q", Error: "q must hold at least one word to look for"})
+	}
+
+	for _, k := range q.Kinds {
+		if !known(k) {
+			fields = append(fields, web.FieldError{
+				Field: "kinds",
+				Error: fmt.Sprintf("%q is not one of %s", k, strings.Join(Kinds, ", ")),
+			})
+		}
+	}
+
+	switch {
+	case q.Limit == 0:
+		q.Limit = DefaultLimit
+	case q.Limit < 0 || q.Limit > MaxLimit:
+		fields = append(fields, web.FieldError{Field: "limit", Error: fmt.Sprintf("limit must be between 1 and %d", MaxLimit)})
+	}
+
+	if len(fields) > 0 {
+		return web.NewFieldErrors(fields...)
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package tenant_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/advertiser"
+	"github.com/mattlaver/peeps/internal/audit"
+	"github.com/mattlaver/peeps/internal/edition"
+	"github.com/mattlaver/peeps/internal/invoice"
+	"github.com/mattlaver/peeps/internal/platform/auth"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/tests"
+	"github.com/mattlaver/peeps/internal/ratecard"
+	"github.com/mattlaver/peeps/internal/search"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// seeded is the data written for one tenant.
+type seeded struct {
+	advert     string
+	edition    string
+	rateCard   string
+	user       string
+	invoice    string
+	advertiser string
+	comment    string
+}
+
+// seed books an advert for a tenant, with everything it needs, comments on it
+// and drafts an invoice for it. The advertiser and the comment both mention
+// Acme so a search for it finds something of every kind in every tenant.
+func seed(t *testing.T, ctx context.Context, dbConn *db.DB, claims auth.Claims, name string, now time.Time) seeded {
+	t.Helper()
+
+	nr := ratecard.NewRateCard{
+		Year:     "2019",
+		Currency: "AUD",
+		Rates:    []ratecard.Rate{{Size: "full", Amount: 100000}},
+		Tax:      ratecard.Tax{Name: "GST", BasisPoints: 1000},
+	}
+	rc, err := ratecard.Create(ctx, dbConn, &nr, now)
+	if err != nil {
+		t.Fatalf("%s : creating rate card : %v", name, err)
+	}
+
+	ne := edition.NewEdition{
+		Name:            "Spring",
+		Year:            "2019",
+		PublicationDate: now.AddDate(0, 2, 0),
+		CopyDeadline:    now.AddDate(0, 1, 0),
+		Status:          edition.StatusOpen,
+	}
+	ed, err := edition.Create(ctx, dbConn, &ne, now)
+	if err != nil {
+		t.Fatalf("%s : creating edition : %v", name, err)
+	}
+
+	adv, err := advertiser.Create(ctx, dbConn, &advertiser.NewAdvertiser{Name: "Acme " + name}, now)
+	if err != nil {
+		t.Fatalf("%s : creating advertiser : %v", name, err)
+	}
+
+	na := advert.NewAdvert{
+		AdvertiserID: adv.ID.Hex(),
+		Size:         "full",
+		Contacts:     []advert.Contact{{Role: "primary", Name: "Jane"}},
+		Editions:     []string{"Spring"},
+		Year:         "2019",
+		State:        []string{"NSW"},
+	}
+	a, err := advert.Create(ctx, claims, dbConn, &na, now)
+	if err != nil {
+		t.Fatalf("%s : creating advert : %v", name, err)
+	}
+
+	c, err := advert.AddComment(ctx, claims, dbConn, a.ID.Hex(), &advert.NewComment{Body: "Acme artwork is late"}, now)
+	if err != nil {
+		t.Fatalf("%s : commenting on advert : %v", name, err)
+	}
+
+	ni := invoice.NewInvoice{AdvertiserID: adv.ID.Hex(), AdvertIDs: []string{a.ID.Hex()}}
+	inv, err := invoice.Create(ctx, claims, dbConn, &ni, now)
+	if err != nil {
+		t.Fatalf("%s : creating invoice : %v", name, err)
+	}
+
+	nu := user.NewUser{
+		Name:            name,
+		Email:           name + "@example.com",
+		Roles:           []string{auth.RoleAdmin},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	}
+	u, err := user.Create(ctx, claims, dbConn, &nu, now)
+	if err != nil {
+		t.Fatalf("%s : creating user : %v", name, err)
+	}
+
+	return seeded{
+		advert:     a.ID.Hex(),
+		edition:    ed.ID.Hex(),
+		rateCard:   rc.ID.Hex(),
+		user:       u.ID.Hex(),
+		invoice:    inv.ID.Hex(),
+		advertiser: adv.ID.Hex(),
+		comment:    c.ID.Hex(),
+	}
+}
+
+// resource is the data access of one kind of tenant data, reduced to what the
+// isolation test needs.
+type resource struct {
+	name     string
+	id       func(s seeded) string
+	list     func(ctx context.Context) ([]string, error)
+	retrieve func(ctx context.Context, id string) (int, error) // Returns the version.
+	update   func(ctx context.Context, id string, version int) error
+	delete   func(ctx context.Context, id string, version int) error
+}
+
+// TestIsolation checks a tenant cannot list, retrieve, update or delete the
+// data of another.
+func TestIsolation(t *testing.T) {
+	masterDB, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	now := time.Now().Truncate(time.Millisecond)
+	claims := auth.NewClaims(bson.NewObjectId().Hex(), []string{auth.RoleAdmin}, now, time.Hour)
+
+	idA, idB := bson.NewObjectId(), bson.NewObjectId()
+	ctxA := tenant.With(context.Background(), idA)
+	ctxB := tenant.With(context.Background(), idB)
+
+	seed(t, ctxA, masterDB, claims, "a", now)
+	b := seed(t, ctxB, masterDB, claims, "b", now)
+
+	later := now.Add(time.Minute)
+	resources := []resource{
+		{
+			name: "advert",
+			id:   func(s seeded) string { return s.advert },
+			list: func(ctx context.Context) ([]string, error) {
+				as, err := advert.List(ctx, masterDB, advert.Filter{})
+				ids := make([]string, len(as))
+				for i := range as {
+					ids[i] = as[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				a, err := advert.Retrieve(ctx, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return a.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				size := "half"
+				return advert.Update(ctx, claims, masterDB, id, version, advert.UpdateAdvert{Size: &size}, later)
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return advert.Delete(ctx, claims, masterDB, id, version, later)
+			},
+		},
+		{
+			name: "edition",
+			id:   func(s seeded) string { return s.edition },
+			list: func(ctx context.Context) ([]string, error) {
+				es, err := edition.List(ctx, masterDB, "2019")
+				ids := make([]string, len(es))
+				for i := range es {
+					ids[i] = es[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				e, err := edition.Retrieve(ctx, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return e.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				status := edition.StatusClosed
+				_, err := edition.Update(ctx, masterDB, id, version, &edition.UpdateEdition{Status: &status}, later)
+				return err
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return edition.Delete(ctx, masterDB, id, version)
+			},
+		},
+		{
+			name: "rate card",
+			id:   func(s seeded) string { return s.rateCard },
+			list: func(ctx context.Context) ([]string, error) {
+				rcs, err := ratecard.List(ctx, masterDB)
+				ids := make([]string, len(rcs))
+				for i := range rcs {
+					ids[i] = rcs[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				rc, err := ratecard.Retrieve(ctx, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return rc.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				currency := "NZD"
+				_, err := ratecard.Update(ctx, masterDB, id, version, &ratecard.UpdateRateCard{Currency: &currency}, later)
+				return err
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return ratecard.Delete(ctx, masterDB, id, version)
+			},
+		},
+		{
+			name: "user",
+			id:   func(s seeded) string { return s.user },
+			list: func(ctx context.Context) ([]string, error) {
+				us, err := user.List(ctx, masterDB)
+				ids := make([]string, len(us))
+				for i := range us {
+					ids[i] = us[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				u, err := user.Retrieve(ctx, claims, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return u.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				name := "Mallory"
+				return user.Update(ctx, claims, masterDB, id, version, &user.UpdateUser{Name: &name}, later)
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return user.Delete(ctx, claims, masterDB, id, version, later)
+			},
+		},
+		{
+			name: "invoice",
+			id:   func(s seeded) string { return s.invoice },
+			list: func(ctx context.Context) ([]string, error) {
+				invs, err := invoice.List(ctx, masterDB, invoice.Filter{})
+				ids := make([]string, len(invs))
+				for i := range invs {
+					ids[i] = invs[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				inv, err := invoice.Retrieve(ctx, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return inv.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				_, err := invoice.Issue(ctx, masterDB, id, version, later)
+				return err
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return invoice.Delete(ctx, masterDB, id, version)
+			},
+		},
+		{
+			name: "advertiser",
+			id:   func(s seeded) string { return s.advertiser },
+			list: func(ctx context.Context) ([]string, error) {
+				as, err := advertiser.List(ctx, masterDB)
+				ids := make([]string, len(as))
+				for i := range as {
+					ids[i] = as[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				a, err := advertiser.Retrieve(ctx, masterDB, id)
+				if err != nil {
+					return 0, err
+				}
+				return a.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				name := "Mallory Pty Ltd"
+				_, err := advertiser.Update(ctx, masterDB, id, version, &advertiser.UpdateAdvertiser{Name: &name}, later)
+				return err
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return advertiser.Delete(ctx, masterDB, id, version, later)
+			},
+		},
+		{
+			name: "comment",
+			id:   func(s seeded) string { return s.comment },
+			list: func(ctx context.Context) ([]string, error) {
+				cs, err := advert.Comments(ctx, masterDB, b.advert)
+				if err == advert.ErrNotFound {
+					return nil, nil
+				}
+				ids := make([]string, len(cs))
+				for i := range cs {
+					ids[i] = cs[i].ID.Hex()
+				}
+				return ids, err
+			},
+			retrieve: func(ctx context.Context, id string) (int, error) {
+				c, err := advert.RetrieveComment(ctx, masterDB, b.advert, id)
+				if err != nil {
+					return 0, err
+				}
+				return c.Version, nil
+			},
+			update: func(ctx context.Context, id string, version int) error {
+				_, err := advert.EditComment(ctx, claims, masterDB, b.advert, id, version, &advert.UpdateComment{Body: "Mallory was here"}, later)
+				return err
+			},
+			delete: func(ctx context.Context, id string, version int) error {
+				return advert.DeleteComment(ctx, claims, masterDB, b.advert, id, version, later)
+			},
+		},
+	}
+
+	for _, r := range resources {
+		t.Run(r.name, func(t *testing.T) {
+			id := r.id(b)
+
+			version, err := r.retrieve(ctxB, id)
+			if err != nil {
+				t.Fatalf("retrieving as its tenant : %v", err)
+			}
+
+			ids, err := r.list(ctxA)
+			if err != nil {
+				t.Fatalf("listing as another tenant : %v", err)
+			}
+			for _, got := range ids {
+				if got == id {
+					t.Error("listed by another tenant")
+				}
+			}
+
+			if _, err := r.retrieve(ctxA, id); err == nil {
+				t.Error("retrieved by another tenant")
+			}
+			if err := r.update(ctxA, id, version); err == nil {
+				t.Error("updated by another tenant")
+			}
+			if err := r.delete(ctxA, id, version); err == nil {
+				t.Error("deleted by another tenant")
+			}
+
+			after, err := r.retrieve(ctxB, id)
+			if err != nil {
+				t.Fatalf("retrieving as its tenant after the attempts : %v", err)
+			}
+			if after != version {
+				t.Errorf("version went from %d to %d", version, after)
+			}
+		})
+	}
+
+	t.Run("revision", func(t *testing.T) {
+		a, err := advert.Retrieve(ctxB, masterDB, b.advert)
+		if err != nil {
+			t.Fatalf("retrieving advert as its tenant : %v", err)
+		}
+
+		if _, err := advert.History(ctxA, masterDB, b.advert); err == nil {
+			t.Error("history listed by another tenant")
+		}
+		if _, err := advert.RetrieveRevision(ctxA, masterDB, b.advert, 1); err == nil {
+			t.Error("revision retrieved by another tenant")
+		}
+		if _, err := advert.ActivityFeed(ctxA, masterDB, b.advert); err == nil {
+			t.Error("activity listed by another tenant")
+		}
+		if _, err := advert.Revert(ctxA, claims, masterDB, b.advert, 1, a.Version, later); err == nil {
+			t.Error("reverted by another tenant")
+		}
+
+		revs, err := advert.History(ctxB, masterDB, b.advert)
+		if err != nil {
+			t.Fatalf("listing history as its tenant : %v", err)
+		}
+		if len(revs) != 1 {
+			t.Errorf("advert has %d revisions, want 1", len(revs))
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		idx := search.NewMongo(masterDB)
+		own := map[string]bool{b.advert: true, b.advertiser: true, b.comment: true}
+
+		hits, err := search.Search(ctxA, idx, search.Query{Text: "Acme"})
+		if err != nil {
+			t.Fatalf("searching as another tenant : %v", err)
+		}
+		for _, h := range hits {
+			if own[h.ID] {
+				t.Errorf("%s %s found by another tenant", h.Kind, h.ID)
+			}
+		}
+
+		hits, err = search.Search(ctxB, idx, search.Query{Text: "Acme"})
+		if err != nil {
+			t.Fatalf("searching as its tenant : %v", err)
+		}
+		for _, h := range hits {
+			delete(own, h.ID)
+		}
+		for id := range own {
+			t.Errorf("%s not found by its tenant", id)
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		rq := advert.ReportQuery{GroupBy: []string{"advertiser"}, Metrics: []string{advert.MetricCount}}
+		for _, tt := range []struct {
+			ctx  context.Context
+			want string
+		}{{ctxA, "Acme a"}, {ctxB, "Acme b"}} {
+			tbl, err := advert.Report(tt.ctx, masterDB, rq)
+			if err != nil {
+				t.Fatalf("reporting : %v", err)
+			}
+			if len(tbl.Rows) != 1 || fmt.Sprint(tbl.Rows[0][0]) != tt.want {
+				t.Errorf("report rows = %v, want only %s", tbl.Rows, tt.want)
+			}
+		}
+	})
+
+	t.Run("audit log", func(t *testing.T) {
+		for _, tid := range []bson.ObjectId{idA, idB} {
+			e := audit.Entry{
+				TenantID: tid,
+				Actor:    claims.Subject,
+				Action:   "PUT /v1/adverts/" + b.advert,
+				Resource: "adverts",
+				Status:   204,
+				Outcome:  audit.OutcomeSuccess,
+				Date:     now,
+			}
+			if err := audit.Record(context.Background(), masterDB, &e); err != nil {
+				t.Fatalf("recording entry : %v", err)
+			}
+		}
+
+		for _, tt := range []struct {
+			ctx context.Context
+			id  bson.ObjectId
+		}{{ctxA, idA}, {ctxB, idB}} {
+			es, err := audit.List(tt.ctx, masterDB, audit.Filter{})
+			if err != nil {
+				t.Fatalf("listing entries : %v", err)
+			}
+			if len(es) != 1 {
+				t.Errorf("listed %d entries, want 1", len(es))
+			}
+			for _, e := range es {
+				if e.TenantID != tt.id {
+					t.Errorf("listed an entry of tenant %s", e.TenantID.Hex())
+				}
+			}
+		}
+	})
+}
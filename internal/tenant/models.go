@@ -0,0 +1,30 @@
+package tenant
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Tenant is a publication with its own users, adverts, editions and rate
+// cards, sharing a deployment with others.
+type Tenant struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	Slug         string        `bson:"slug" json:"slug"` // Short unique name users sign in with.
+	Name         string        `bson:"name" json:"name"`
+	Version      int           `bson:"version" json:"version"`
+	DateCreated  time.Time     `bson:"date_created" json:"date_created"`
+	DateModified time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// NewTenant is what we require from clients when adding a Tenant.
+type NewTenant struct {
+	Slug string `json:"slug" validate:"required,max=63"`
+	Name string `json:"name" validate:"required"`
+}
+
+// UpdateTenant defines what may be changed on a Tenant. The slug is fixed as
+// users sign in with it.
+type UpdateTenant struct {
+	Name *string `json:"name" validate:"omitempty,min=1"`
+}
@@ -0,0 +1,96 @@
+package tenant
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// ErrNoScope occurs when tenant data is reached with a context that does
+	// not say whose data it is. It is a programming error: every request and
+	// background task must choose a scope first.
+	ErrNoScope = errors.New("No tenant scope in context")
+
+	// ErrAllTenants occurs when something that belongs to a single tenant,
+	// such as a new advert, is written in the scope of all of them.
+	ErrAllTenants = errors.New("A tenant must be chosen")
+)
+
+// ctxKey represents the type of value for the context key.
+type ctxKey int
+
+// key is used to store and retrieve the Scope of a context.
+const key ctxKey = 1
+
+// Scope is the tenant whose data a context may reach, or every tenant.
+type Scope struct {
+	ID  bson.ObjectId
+	All bool
+}
+
+// With returns a copy of ctx scoped to the tenant with the given ID.
+func With(ctx context.Context, id bson.ObjectId) context.Context {
+	return context.WithValue(ctx, key, Scope{ID: id})
+}
+
+// WithAll returns a copy of ctx that reaches the data of every tenant. It is
+// for super-admins and for work done on behalf of the whole deployment.
+func WithAll(ctx context.Context) context.Context {
+	return context.WithValue(ctx, key, Scope{All: true})
+}
+
+// FromContext returns the scope of ctx.
+func FromContext(ctx context.Context) (Scope, error) {
+	s, ok := ctx.Value(key).(Scope)
+	if !ok || (!s.All && s.ID == "") {
+		return Scope{}, ErrNoScope
+	}
+	return s, nil
+}
+
+// ID returns the single tenant ctx is scoped to, for stamping on new data.
+func ID(ctx context.Context) (bson.ObjectId, error) {
+	s, err := FromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if s.All {
+		return "", ErrAllTenants
+	}
+	return s.ID, nil
+}
+
+// Filter adds the tenant of ctx to the query q so it only matches that
+// tenant's documents. It leaves q alone in the scope of all tenants.
+func Filter(ctx context.Context, q bson.M) error {
+	s, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !s.All {
+		q["tenant_id"] = s.ID
+	}
+	return nil
+}
+
+// Match returns an aggregation stage that keeps the documents of the tenant
+// of ctx, to go first in a pipeline.
+func Match(ctx context.Context) (bson.M, error) {
+	q := bson.M{}
+	if err := Filter(ctx, q); err != nil {
+		return nil, err
+	}
+	return bson.M{"$match": q}, nil
+}
+
+// Owns reports whether a document of the given tenant may be reached with
+// ctx.
+func Owns(ctx context.Context, id bson.ObjectId) bool {
+	s, err := FromContext(ctx)
+	if err != nil {
+		return false
+	}
+	return s.All || s.ID == id
+}
@@ -0,0 +1,225 @@
+// Package tenant keeps the publications that share a deployment apart. Each
+// tenant's users, adverts, editions and rate cards carry its ID, and every
+// query for them is filtered by the scope of the request's context.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/platform/web"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const tenantsCollection = "tenants"
+
+// These are the codes of the errors Mongo returns when dropping an index from
+// a collection that does not exist or does not have it.
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the tenant
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current tenant")
+
+	// ErrDuplicate occurs when another tenant already has the slug.
+	ErrDuplicate = errors.New("Tenant already exists with the slug")
+)
+
+// slugIndex makes sure slugs are unique.
+var slugIndex = mgo.Index{
+	Key:    []string{"slug"},
+	Unique: true,
+}
+
+// slugPattern is the form of a slug: lower case words joined by hyphens.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// List retrieves every tenant, in order of slug.
+func List(ctx context.Context, dbConn *db.DB) ([]Tenant, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.List")
+	defer span.End()
+
+	ts := []Tenant{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(nil).Sort("slug").All(&ts)
+	}
+	if err := dbConn.Execute(ctx, tenantsCollection, f); err != nil {
+		return nil, errors.Wrap(err, "db.tenants.find()")
+	}
+
+	return ts, nil
+}
+
+// Retrieve gets the specified tenant.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Tenant, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	return find(ctx, dbConn, bson.M{"_id": bson.ObjectIdHex(id)})
+}
+
+// BySlug gets the tenant with the given slug.
+func BySlug(ctx context.Context, dbConn *db.DB, slug string) (*Tenant, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.BySlug")
+	defer span.End()
+
+	return find(ctx, dbConn, bson.M{"slug": slug})
+}
+
+// find gets the single tenant matching q.
+func find(ctx context.Context, dbConn *db.DB, q bson.M) (*Tenant, error) {
+	var t *Tenant
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&t)
+	}
+	if err := dbConn.Execute(ctx, tenantsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.tenants.find(%s)", db.Query(q)))
+	}
+
+	return t, nil
+}
+
+// Create adds a tenant.
+func Create(ctx context.Context, dbConn *db.DB, nt *NewTenant, now time.Time) (*Tenant, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.Create")
+	defer span.End()
+
+	if !slugPattern.MatchString(nt.Slug) {
+		return nil, web.NewFieldErrors(web.FieldError{
+			Field: "slug",
+			Error: "slug must be lower case letters and digits joined by hyphens",
+		})
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	t := Tenant{
+		ID:           bson.NewObjectId(),
+		Slug:         nt.Slug,
+		Name:         nt.Name,
+		Version:      1,
+		DateCreated:  now,
+		DateModified: now,
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(slugIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&t)
+	}
+	if err := dbConn.Execute(ctx, tenantsCollection, f); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.tenants.insert(%s)", db.Query(&t)))
+	}
+
+	return &t, nil
+}
+
+// Update modifies a tenant. The write only succeeds if version is still the
+// current version of the tenant.
+func Update(ctx context.Context, dbConn *db.DB, id string, version int, upd *UpdateTenant, now time.Time) (*Tenant, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.Update")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	fields := bson.M{}
+	if upd.Name != nil {
+		fields["name"] = *upd.Name
+	}
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+
+	var t Tenant
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &t)
+		return err
+	}
+	if err := dbConn.Execute(ctx, tenantsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return nil, err
+			}
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.tenants.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &t, nil
+}
+
+// Adopt gives every document in the collection that belongs to no tenant to
+// the specified one, and reports how many there were. It moves the data of a
+// deployment from before tenants into its first tenant.
+func Adopt(ctx context.Context, dbConn *db.DB, id bson.ObjectId, collection string) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.Adopt")
+	defer span.End()
+
+	q := bson.M{"tenant_id": bson.M{"$exists": false}}
+	m := bson.M{"$set": bson.M{"tenant_id": id}}
+
+	var n int
+	f := func(c *mgo.Collection) error {
+		info, err := c.UpdateAll(q, m)
+		if info != nil {
+			n = info.Updated
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, collection, f); err != nil {
+		return n, errors.Wrap(err, fmt.Sprintf("db.%s.update(%s, %s)", collection, db.Query(q), db.Query(m)))
+	}
+
+	return n, nil
+}
+
+// DropIndex removes the index with the given key from the collection, if it
+// is there. It removes the unique indexes of a deployment from before tenants
+// that would stop two tenants using the same names.
+func DropIndex(ctx context.Context, dbConn *db.DB, collection string, key ...string) error {
+	ctx, span := trace.StartSpan(ctx, "internal.tenant.DropIndex")
+	defer span.End()
+
+	f := func(c *mgo.Collection) error {
+		err := c.DropIndex(key...)
+		if qerr, ok := err.(*mgo.QueryError); ok && (qerr.Code == namespaceNotFound || qerr.Code == indexNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, collection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.%s.dropIndex(%v)", collection, key))
+	}
+
+	return nil
+}
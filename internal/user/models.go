@@ -8,13 +8,16 @@ import (
 
 // User represents someone with access to our system.
 type User struct {
-	ID    bson.ObjectId `bson:"_id" json:"id"`
-	Name  string        `bson:"name" json:"name"`
-	Email string        `bson:"email" json:"email"` // TODO(jlw) enforce uniqueness
-	Roles []string      `bson:"roles" json:"roles"`
+	ID       bson.ObjectId `bson:"_id" json:"id"`
+	TenantID bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Name     string        `bson:"name" json:"name"`
+	Email    string        `bson:"email" json:"email"` // TODO(jlw) enforce uniqueness
+	Roles    []string      `bson:"roles" json:"roles"`
 
 	PasswordHash []byte `bson:"password_hash" json:"-"`
 
+	Version int `bson:"version" json:"version"` // Incremented on every write.
+
 	DateModified time.Time `bson:"date_modified" json:"date_modified"`
 	DateCreated  time.Time `bson:"date_created,omitempty" json:"date_created"`
 }
@@ -42,6 +45,15 @@ type UpdateUser struct {
 	PasswordConfirm *string  `json:"password_confirm" validate:"omitempty,eqfield=Password"`
 }
 
+// PatchUser is the document that PATCH requests are applied to. It holds the
+// fields of a User that may be changed by a patch, with the same rules as
+// NewUser. Passwords are changed through UpdateUser only.
+type PatchUser struct {
+	Name  string   `json:"name" validate:"required"`
+	Email string   `json:"email" validate:"required"`
+	Roles []string `json:"roles" validate:"required"`
+}
+
 // Token is the payload we deliver to users when they authenticate.
 type Token struct {
 	Token string `json:"token"`
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/mattlaver/peeps/internal/event"
 	"github.com/mattlaver/peeps/internal/platform/auth"
 	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/crypto/bcrypt"
@@ -16,6 +18,10 @@ import (
 
 const usersCollection = "users"
 
+// EventSource names the collection whose users carry the events raised by
+// writes to them until they are moved to the outbox.
+const EventSource = usersCollection
+
 var (
 	// ErrNotFound abstracts the mgo not found error.
 	ErrNotFound = errors.New("Entity not found")
@@ -29,6 +35,14 @@ var (
 
 	// ErrForbidden occurs when a user tries to do something that is forbidden to them according to our access control policies.
 	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrVersionConflict occurs when a write names a version of the user that
+	// is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current user")
+
+	// ErrTenantRequired occurs when the credentials given to Authenticate
+	// match users of more than one tenant.
+	ErrTenantRequired = errors.New("Sign in to a tenant")
 )
 
 // List retrieves a list of existing users from the database.
@@ -36,13 +50,18 @@ func List(ctx context.Context, dbConn *db.DB) ([]User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.List")
 	defer span.End()
 
+	q := bson.M{}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
 	u := []User{}
 
 	f := func(collection *mgo.Collection) error {
-		return collection.Find(nil).All(&u)
+		return collection.Find(q).All(&u)
 	}
 	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
-		return nil, errors.Wrap(err, "db.users.find()")
+		return nil, errors.Wrap(err, fmt.Sprintf("db.users.find(%s)", db.Query(q)))
 	}
 
 	return u, nil
@@ -63,6 +82,9 @@ func Retrieve(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string)
 	}
 
 	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
 
 	var u *User
 	f := func(collection *mgo.Collection) error {
@@ -78,11 +100,70 @@ func Retrieve(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string)
 	return u, nil
 }
 
+// ByEmail retrieves the users with any of the given email addresses. Addresses
+// with no user are missing from the result.
+func ByEmail(ctx context.Context, dbConn *db.DB, emails []string) ([]User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ByEmail")
+	defer span.End()
+
+	q := bson.M{"email": bson.M{"$in": emails}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	u := []User{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).All(&u)
+	}
+	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.users.find(%s)", db.Query(q)))
+	}
+
+	return u, nil
+}
+
+// ByID retrieves the users with any of the given IDs. IDs that are malformed
+// or have no user are missing from the result.
+func ByID(ctx context.Context, dbConn *db.DB, ids []string) ([]User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.ByID")
+	defer span.End()
+
+	var oids []bson.ObjectId
+	for _, id := range ids {
+		if bson.IsObjectIdHex(id) {
+			oids = append(oids, bson.ObjectIdHex(id))
+		}
+	}
+	if len(oids) == 0 {
+		return []User{}, nil
+	}
+
+	q := bson.M{"_id": bson.M{"$in": oids}}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	u := []User{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).All(&u)
+	}
+	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.users.find(%s)", db.Query(q)))
+	}
+
+	return u, nil
+}
+
 // Create inserts a new user into the database.
-func Create(ctx context.Context, dbConn *db.DB, nu *NewUser, now time.Time) (*User, error) {
+func Create(ctx context.Context, claims auth.Claims, dbConn *db.DB, nu *NewUser, now time.Time) (*User, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Create")
 	defer span.End()
 
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Mongo truncates times to milliseconds when storing. We and do the same
 	// here so the value we return is consistent with what we store.
 	now = now.Truncate(time.Millisecond)
@@ -94,16 +175,23 @@ func Create(ctx context.Context, dbConn *db.DB, nu *NewUser, now time.Time) (*Us
 
 	u := User{
 		ID:           bson.NewObjectId(),
+		TenantID:     tid,
 		Name:         nu.Name,
 		Email:        nu.Email,
 		PasswordHash: pw,
 		Roles:        nu.Roles,
+		Version:      1,
 		DateCreated:  now,
 		DateModified: now,
 	}
 
+	doc, err := event.Attach(&u, event.New(event.UserCreated, event.AggregateUser, u.ID, claims.Subject, now))
+	if err != nil {
+		return nil, err
+	}
+
 	f := func(collection *mgo.Collection) error {
-		return collection.Insert(&u)
+		return collection.Insert(doc)
 	}
 	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("db.users.insert(%s)", db.Query(&u)))
@@ -112,8 +200,9 @@ func Create(ctx context.Context, dbConn *db.DB, nu *NewUser, now time.Time) (*Us
 	return &u, nil
 }
 
-// Update replaces a user document in the database.
-func Update(ctx context.Context, dbConn *db.DB, id string, upd *UpdateUser, now time.Time) error {
+// Update replaces a user document in the database. The write only succeeds if
+// version is still the current version of the user.
+func Update(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, upd *UpdateUser, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Update")
 	defer span.End()
 
@@ -147,15 +236,19 @@ func Update(ctx context.Context, dbConn *db.DB, id string, upd *UpdateUser, now
 
 	fields["date_modified"] = now
 
-	m := bson.M{"$set": fields}
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	event.Push(m, event.New(event.UserUpdated, event.AggregateUser, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
 
 	f := func(collection *mgo.Collection) error {
 		return collection.Update(q, m)
 	}
 	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
 		if err == mgo.ErrNotFound {
-			return ErrNotFound
+			return versionError(ctx, dbConn, bson.ObjectIdHex(id))
 		}
 		return errors.Wrap(err, fmt.Sprintf("db.customers.update(%s, %s)", db.Query(q), db.Query(m)))
 	}
@@ -163,8 +256,48 @@ func Update(ctx context.Context, dbConn *db.DB, id string, upd *UpdateUser, now
 	return nil
 }
 
-// Delete removes a user from the database.
-func Delete(ctx context.Context, dbConn *db.DB, id string) error {
+// Replace overwrites every patchable field of a user in a single write. The
+// write only succeeds if version is still the current version of the user.
+func Replace(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, pu *PatchUser, now time.Time) (*User, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.user.Replace")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	fields := bson.M{
+		"name":          pu.Name,
+		"email":         pu.Email,
+		"roles":         pu.Roles,
+		"date_modified": now.Truncate(time.Millisecond),
+	}
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	event.Push(m, event.New(event.UserUpdated, event.AggregateUser, bson.ObjectIdHex(id), claims.Subject, now))
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var u User
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &u)
+		return err
+	}
+	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, versionError(ctx, dbConn, bson.ObjectIdHex(id))
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.users.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &u, nil
+}
+
+// Delete removes a user from the database. The delete only succeeds if version
+// is still the current version of the user.
+func Delete(ctx context.Context, claims auth.Claims, dbConn *db.DB, id string, version int, now time.Time) error {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Delete")
 	defer span.End()
 
@@ -172,19 +305,65 @@ func Delete(ctx context.Context, dbConn *db.DB, id string) error {
 		return ErrInvalidID
 	}
 
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": versionQuery(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	// A removed document cannot carry its event, so the event is staged
+	// first and released once the user is gone.
+	ev := event.New(event.UserDeleted, event.AggregateUser, bson.ObjectIdHex(id), claims.Subject, now)
+	if err := event.Stage(ctx, dbConn, usersCollection, ev); err != nil {
+		return err
+	}
 
 	f := func(collection *mgo.Collection) error {
 		return collection.Remove(q)
 	}
 	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
+		if derr := event.Discard(ctx, dbConn, ev.ID); derr != nil {
+			return derr
+		}
 		if err == mgo.ErrNotFound {
-			return ErrNotFound
+			return versionError(ctx, dbConn, bson.ObjectIdHex(id))
 		}
 		return errors.Wrap(err, fmt.Sprintf("db.users.remove(%s)", db.Query(q)))
 	}
 
-	return nil
+	return event.Release(ctx, dbConn, ev.ID, now)
+}
+
+// versionQuery matches the expected version of a document. Users stored before
+// versions were introduced have no version field and are treated as version 0.
+func versionQuery(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return db.Version(version)
+}
+
+// versionError works out why a versioned write matched no document. The user
+// either no longer exists or has moved on to a newer version.
+func versionError(ctx context.Context, dbConn *db.DB, id bson.ObjectId) error {
+	q := bson.M{"_id": id}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	var n int
+	f := func(collection *mgo.Collection) error {
+		var err error
+		n, err = collection.Find(q).Count()
+		return err
+	}
+	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.users.count(%s)", db.Query(q)))
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrVersionConflict
 }
 
 // TokenGenerator is the behavior we need in our Authenticate to generate
@@ -195,35 +374,47 @@ type TokenGenerator interface {
 
 // Authenticate finds a user by their email and verifies their password. On
 // success it returns a Token that can be used to authenticate in the future.
+// In the scope of all tenants the email may belong to users of several; the
+// password must then match exactly one of them.
 func Authenticate(ctx context.Context, dbConn *db.DB, tknGen TokenGenerator, now time.Time, email, password string) (Token, error) {
 	ctx, span := trace.StartSpan(ctx, "internal.user.Authenticate")
 	defer span.End()
 
 	q := bson.M{"email": email}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return Token{}, err
+	}
 
-	var u *User
+	var us []User
 	f := func(collection *mgo.Collection) error {
-		return collection.Find(q).One(&u)
+		return collection.Find(q).All(&us)
 	}
 	if err := dbConn.Execute(ctx, usersCollection, f); err != nil {
-
-		// Normally we would return ErrNotFound in this scenario but we do not want
-		// to leak to an unauthenticated user which emails are in the system.
-		if err == mgo.ErrNotFound {
-			return Token{}, ErrAuthenticationFailure
-		}
 		return Token{}, errors.Wrap(err, fmt.Sprintf("db.users.find(%s)", db.Query(q)))
 	}
 
-	// Compare the provided password with the saved hash. Use the bcrypt
-	// comparison function so it is cryptographically secure.
-	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
+	// Compare the provided password with the saved hashes. Use the bcrypt
+	// comparison function so it is cryptographically secure. Normally we
+	// would return ErrNotFound when there is no user but we do not want to
+	// leak to an unauthenticated user which emails are in the system.
+	var u *User
+	for i := range us {
+		if err := bcrypt.CompareHashAndPassword(us[i].PasswordHash, []byte(password)); err != nil {
+			continue
+		}
+		if u != nil {
+			return Token{}, ErrTenantRequired
+		}
+		u = &us[i]
+	}
+	if u == nil {
 		return Token{}, ErrAuthenticationFailure
 	}
 
 	// If we are this far the request is valid. Create some claims for the user
 	// and generate their token.
 	claims := auth.NewClaims(u.ID.Hex(), u.Roles, now, time.Hour)
+	claims.Tenant = u.TenantID.Hex()
 
 	tkn, err := tknGen.GenerateToken(claims)
 	if err != nil {
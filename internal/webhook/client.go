@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrForbiddenAddress occurs when a delivery would connect to an address
+// inside our own network.
+var ErrForbiddenAddress = errors.New("Endpoint address is not public")
+
+// NewClient returns a client for sending deliveries that gives up after
+// timeout. Endpoint URLs are supplied by tenants, so it refuses to connect to
+// loopback, link-local, private or unspecified addresses. The address is
+// checked as it is dialled, after the name is resolved, so a name that
+// resolves somewhere else the next time is caught too. Redirects are not
+// followed; the response asking for one is recorded like any other.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: publicOnly,
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+
+	// A proxy would be the only address dialled.
+	tr.Proxy = nil
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicOnly refuses connections to addresses that are not public.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil,
+		ip.IsLoopback(),
+		ip.IsLinkLocalUnicast(),
+		ip.IsLinkLocalMulticast(),
+		ip.IsPrivate(),
+		ip.IsUnspecified():
+		return ErrForbiddenAddress
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package webhook_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/webhook"
+)
+
+// TestClientRefusesPrivate checks deliveries are never sent inside our own
+// network, whatever an endpoint's URL names.
+func TestClientRefusesPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("delivery reached %s", r.Host)
+	}))
+	defer srv.Close()
+
+	client := webhook.NewClient(time.Second)
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"loopback", srv.URL},
+		{"localhost", "http://localhost:1"},
+		{"loopback v6", "http://[::1]:1"},
+		{"unspecified", "http://0.0.0.0:1"},
+		{"private", "http://10.0.0.1:1"},
+		{"private 172", "http://172.16.0.1:1"},
+		{"private 192", "http://192.168.1.1:1"},
+		{"private v6", "http://[fd00::1]:1"},
+		{"link-local", "http://169.254.169.254/latest/meta-data/"},
+		{"link-local v6", "http://[fe80::1]:1"},
+		{"mapped loopback", "http://[::ffff:127.0.0.1]:1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Post(tt.url, "application/json", nil)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("posted to %s", tt.url)
+			}
+			if !errors.Is(err, webhook.ErrForbiddenAddress) {
+				t.Fatalf("posting to %s : got %v, want %v", tt.url, err, webhook.ErrForbiddenAddress)
+			}
+		})
+	}
+}
+
+// TestClientNoRedirects checks a redirect is returned rather than followed,
+// so an endpoint cannot send a delivery on to an address it could not name.
+func TestClientNoRedirects(t *testing.T) {
+	client := webhook.NewClient(time.Second)
+
+	req := httptest.NewRequest("POST", "http://example.com/hook", nil)
+	if err := client.CheckRedirect(req, []*http.Request{req}); err != http.ErrUseLastResponse {
+		t.Fatalf("redirect : got %v, want %v", err, http.ErrUseLastResponse)
+	}
+}
@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const deliveriesCollection = "webhook_deliveries"
+
+var (
+	// ErrDeliveryNotFound occurs when an endpoint has no delivery with the
+	// requested ID.
+	ErrDeliveryNotFound = errors.New("Delivery not found")
+
+	// ErrDeliveryInProgress occurs when redelivering a delivery that is being
+	// sent.
+	ErrDeliveryInProgress = errors.New("Delivery is being sent")
+)
+
+// dueIndex supports finding the deliveries that are due.
+var dueIndex = mgo.Index{
+	Key: []string{"status", "next_attempt"},
+}
+
+// logIndex supports listing the deliveries of an endpoint, newest first.
+var logIndex = mgo.Index{
+	Key: []string{"endpoint_id", "-date_created"},
+}
+
+// eventIndex makes sure an event is queued for an endpoint only once, however
+// often it is handed to Enqueue.
+var eventIndex = mgo.Index{
+	Key:    []string{"event_id", "endpoint_id"},
+	Unique: true,
+}
+
+// deliveryLimit is the most deliveries Deliveries returns.
+const deliveryLimit = 100
+
+// payload is the body sent to an endpoint.
+type payload struct {
+	ID      string      `json:"id"`
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+// Enqueue queues a delivery of an event to every active endpoint of the
+// tenant of ctx subscribed to it. Data is sent as the data field of the body.
+// The ID identifies the event to endpoints; queueing the same ID again does
+// not queue it twice.
+func Enqueue(ctx context.Context, dbConn *db.DB, id, name string, data interface{}, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Enqueue")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return err
+	}
+
+	q := bson.M{"tenant_id": tid, "events": name, "active": true}
+
+	var endpoints []Endpoint
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Select(bson.M{"_id": 1}).All(&endpoints)
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.webhooks.find(%s)", db.Query(q)))
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	ev := payload{
+		ID:      id,
+		Event:   name,
+		Created: now.UTC(),
+		Data:    data,
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s", name)
+	}
+
+	docs := make([]interface{}, len(endpoints))
+	for i, e := range endpoints {
+		docs[i] = &Delivery{
+			ID:           bson.NewObjectId(),
+			EndpointID:   e.ID,
+			EventID:      ev.ID,
+			Event:        name,
+			Payload:      Payload(body),
+			Status:       StatusPending,
+			NextAttempt:  now,
+			Attempts:     []Attempt{},
+			DateCreated:  now,
+			DateModified: now,
+		}
+	}
+
+	f = func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(dueIndex); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(logIndex); err != nil {
+			return err
+		}
+		if err := collection.EnsureIndex(eventIndex); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := collection.Insert(doc); err != nil && !mgo.IsDup(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.insert(%d deliveries of %s)", len(docs), ev.ID))
+	}
+
+	return nil
+}
+
+// Deliveries retrieves the most recent deliveries to the specified endpoint,
+// newest first.
+func Deliveries(ctx context.Context, dbConn *db.DB, id string) ([]Delivery, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Deliveries")
+	defer span.End()
+
+	e, err := Retrieve(ctx, dbConn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	q := bson.M{"endpoint_id": e.ID}
+
+	ds := []Delivery{}
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("-date_created").Limit(deliveryLimit).All(&ds)
+	}
+	if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.find(%s)", db.Query(q)))
+	}
+
+	return ds, nil
+}
+
+// Redeliver queues a delivery to be sent again straight away, whatever
+// became of it before. The same payload is sent with a fresh signature.
+func Redeliver(ctx context.Context, dbConn *db.DB, id, deliveryID string, now time.Time) (*Delivery, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Redeliver")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) || !bson.IsObjectIdHex(deliveryID) {
+		return nil, ErrInvalidID
+	}
+
+	if _, err := Retrieve(ctx, dbConn, id); err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	q := bson.M{
+		"_id":         bson.ObjectIdHex(deliveryID),
+		"endpoint_id": bson.ObjectIdHex(id),
+		"status":      bson.M{"$ne": StatusDelivering},
+	}
+	m := bson.M{"$set": bson.M{
+		"status":        StatusPending,
+		"tries":         0,
+		"next_attempt":  now,
+		"date_modified": now,
+	}}
+
+	var d Delivery
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &d)
+		if err == mgo.ErrNotFound {
+			delete(q, "status")
+			if n, cerr := collection.Find(q).Count(); cerr != nil {
+				return cerr
+			} else if n > 0 {
+				return ErrDeliveryInProgress
+			}
+			return ErrDeliveryNotFound
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+		if err == ErrDeliveryInProgress || err == ErrDeliveryNotFound {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &d, nil
+}
+
+// purgeBatch is the most deliveries removed by one write when purging.
+const purgeBatch = 1000
+
+// Purge removes the deliveries that succeeded or were given up on before the
+// given time and reports how many were removed. It works in batches and stops
+// between them when ctx is cancelled.
+func Purge(ctx context.Context, dbConn *db.DB, before time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Purge")
+	defer span.End()
+
+	q := bson.M{
+		"status":        bson.M{"$in": []string{StatusSucceeded, StatusFailed}},
+		"date_modified": bson.M{"$lt": before},
+	}
+
+	var n int
+	for ctx.Err() == nil {
+		var docs []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		f := func(collection *mgo.Collection) error {
+			return collection.Find(q).Select(bson.M{"_id": 1}).Limit(purgeBatch).All(&docs)
+		}
+		if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.find(%s)", db.Query(q)))
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		ids := make([]bson.ObjectId, len(docs))
+		for i, d := range docs {
+			ids[i] = d.ID
+		}
+
+		rq := bson.M{"_id": bson.M{"$in": ids}}
+		f = func(collection *mgo.Collection) error {
+			info, err := collection.RemoveAll(rq)
+			if info != nil {
+				n += info.Removed
+			}
+			return err
+		}
+		if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+			return n, errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.remove(%d deliveries)", len(ids)))
+		}
+	}
+
+	return n, ctx.Err()
+}
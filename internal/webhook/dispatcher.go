@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Dispatcher sends queued deliveries to their endpoints. Several dispatchers
+// can share a queue; each delivery is claimed by one of them at a time.
+type Dispatcher struct {
+	MasterDB *db.DB
+	Client   *http.Client // Made by NewClient outside of tests.
+	Log      *log.Logger
+
+	Interval    time.Duration // How often to look for due deliveries.
+	MaxAttempts int           // Attempts before a delivery is given up on.
+	Backoff     time.Duration // Wait before the first retry, doubled for each one after.
+	MaxBackoff  time.Duration // Longest wait between retries.
+}
+
+// NewDispatcher returns a Dispatcher that sends deliveries with client,
+// retrying for about four hours before giving up.
+func NewDispatcher(masterDB *db.DB, client *http.Client, log *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		MasterDB:    masterDB,
+		Client:      client,
+		Log:         log,
+		Interval:    5 * time.Second,
+		MaxAttempts: 10,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  6 * time.Hour,
+	}
+}
+
+// Run sends deliveries as they come due until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.Interval)
+	defer t.Stop()
+
+	for {
+		if _, err := d.RunOnce(ctx, time.Now()); err != nil {
+			d.Log.Printf("webhook : dispatching : %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunOnce sends every delivery due by now and reports how many were sent,
+// whether or not the endpoint accepted them. Deliveries of every tenant are
+// sent.
+func (d *Dispatcher) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Dispatcher.RunOnce")
+	defer span.End()
+
+	ctx = tenant.WithAll(ctx)
+
+	dbConn := d.MasterDB.Copy()
+	defer dbConn.Close()
+
+	var n int
+	for ctx.Err() == nil {
+		dl, err := d.claim(ctx, dbConn, now)
+		if err != nil {
+			return n, err
+		}
+		if dl == nil {
+			break
+		}
+		if err := d.deliver(ctx, dbConn, dl, now); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// lease is how long a dispatcher holds a claim on a delivery. A delivery
+// whose dispatcher stopped while sending it is retried once the claim lapses.
+func (d *Dispatcher) lease() time.Duration {
+	if d.Client.Timeout > 0 {
+		return 2 * d.Client.Timeout
+	}
+	return time.Minute
+}
+
+// claim takes the delivery that has been due longest, or returns nil when
+// none is due.
+func (d *Dispatcher) claim(ctx context.Context, dbConn *db.DB, now time.Time) (*Delivery, error) {
+	q := bson.M{
+		"status":       bson.M{"$in": []string{StatusPending, StatusDelivering}},
+		"next_attempt": bson.M{"$lte": now},
+	}
+	m := bson.M{"$set": bson.M{
+		"status":       StatusDelivering,
+		"next_attempt": now.Add(d.lease()).Truncate(time.Millisecond),
+	}}
+
+	var dl Delivery
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Sort("next_attempt").Apply(mgo.Change{Update: m, ReturnNew: true}, &dl)
+		return err
+	}
+	if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return &dl, nil
+}
+
+// deliver sends a claimed delivery and records the outcome.
+func (d *Dispatcher) deliver(ctx context.Context, dbConn *db.DB, dl *Delivery, now time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Dispatcher.deliver")
+	defer span.End()
+
+	att := Attempt{Date: now.Truncate(time.Millisecond)}
+
+	e, err := Retrieve(ctx, dbConn, dl.EndpointID.Hex())
+	switch {
+	case err == ErrNotFound:
+		att.Error = "endpoint no longer exists"
+	case err != nil:
+		return err
+	case !e.Active:
+		att.Error = "endpoint is not active"
+	default:
+		start := time.Now()
+		att.Status, err = d.send(ctx, e, dl, now)
+		att.Duration = int64(time.Since(start) / time.Millisecond)
+		switch {
+		case err != nil:
+			att.Error = err.Error()
+		case att.Status < 200 || att.Status > 299:
+			att.Error = fmt.Sprintf("endpoint responded %d %s", att.Status, http.StatusText(att.Status))
+		}
+	}
+
+	tries := dl.Tries + 1
+	fields := bson.M{
+		"tries":         tries,
+		"date_modified": att.Date,
+	}
+	switch {
+	case att.Error == "":
+		fields["status"] = StatusSucceeded
+	case e == nil || !e.Active || tries >= d.MaxAttempts:
+		fields["status"] = StatusFailed
+	default:
+		fields["status"] = StatusPending
+		fields["next_attempt"] = now.Add(d.backoff(tries)).Truncate(time.Millisecond)
+	}
+
+	// The claim is checked so a dispatcher whose lease lapsed does not
+	// overwrite the outcome recorded by the one that took over.
+	q := bson.M{"_id": dl.ID, "status": StatusDelivering, "next_attempt": dl.NextAttempt}
+	m := bson.M{"$set": fields, "$push": bson.M{"attempts": att}}
+
+	f := func(collection *mgo.Collection) error {
+		err := collection.Update(q, m)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := dbConn.Execute(ctx, deliveriesCollection, f); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("db.webhook_deliveries.update(%s, %s)", db.Query(q), db.Query(m)))
+	}
+
+	return nil
+}
+
+// send posts a delivery to its endpoint and returns the status of the
+// response.
+func (d *Dispatcher) send(ctx context.Context, e *Endpoint, dl *Delivery, now time.Time) (int, error) {
+	body := []byte(dl.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Peeps-Webhooks/1.0")
+	req.Header.Set("X-Peeps-Event", dl.Event)
+	req.Header.Set("X-Peeps-Delivery", dl.ID.Hex())
+	req.Header.Set(SignatureHeader, Sign(e.Secret, now, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read some of the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return resp.StatusCode, nil
+}
+
+// backoff returns how long to wait after the given number of tries.
+func (d *Dispatcher) backoff(tries int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < tries && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.MaxBackoff {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// These are the events an endpoint can subscribe to.
+const (
+	EventAdvertCreated  = "advert.created"
+	EventAdvertUpdated  = "advert.updated"
+	EventAdvertDeleted  = "advert.deleted"
+	EventUserCreated    = "user.created"
+	EventUserUpdated    = "user.updated"
+	EventUserDeleted    = "user.deleted"
+	EventCommentCreated = "comment.created"
+	EventCommentUpdated = "comment.updated"
+	EventCommentDeleted = "comment.deleted"
+)
+
+// These are the expected values for Delivery.Status.
+const (
+	StatusPending    = "pending"    // Waiting for its next attempt.
+	StatusDelivering = "delivering" // Being sent by a dispatcher.
+	StatusSucceeded  = "succeeded"  // Accepted by the endpoint.
+	StatusFailed     = "failed"     // Given up on after too many attempts.
+)
+
+// Endpoint is a URL that is sent the events it subscribes to. It is only
+// sent the events of its own tenant.
+type Endpoint struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	TenantID     bson.ObjectId `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	URL          string        `bson:"url" json:"url"`
+	Events       []string      `bson:"events" json:"events"` // Event constants the endpoint is sent.
+	Secret       string        `bson:"secret" json:"-"`      // Key used to sign deliveries.
+	Active       bool          `bson:"active" json:"active"` // Inactive endpoints are sent nothing.
+	Version      int           `bson:"version" json:"version"`
+	DateCreated  time.Time     `bson:"date_created" json:"date_created"`
+	DateModified time.Time     `bson:"date_modified" json:"date_modified"`
+}
+
+// NewEndpoint is what we require from clients when registering an Endpoint. A
+// secret is generated when none is given. Endpoints are active unless Active
+// says otherwise.
+type NewEndpoint struct {
+	URL    string   `json:"url" validate:"required,url"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=advert.created advert.updated advert.deleted user.created user.updated user.deleted comment.created comment.updated comment.deleted"`
+	Secret string   `json:"secret" validate:"omitempty,min=16"`
+	Active *bool    `json:"active"`
+}
+
+// UpdateEndpoint defines what information may be provided to modify an
+// existing Endpoint. All fields are optional so clients can send just the
+// fields they want changed.
+type UpdateEndpoint struct {
+	URL    *string   `json:"url" validate:"omitempty,url"`
+	Events *[]string `json:"events" validate:"omitempty,min=1,dive,oneof=advert.created advert.updated advert.deleted user.created user.updated user.deleted comment.created comment.updated comment.deleted"`
+	Secret *string   `json:"secret" validate:"omitempty,min=16"`
+	Active *bool     `json:"active"`
+}
+
+// Payload is the JSON body sent to an endpoint. It is kept exactly as sent so
+// the signature can be checked against it.
+type Payload string
+
+// MarshalJSON writes the payload as the JSON it holds rather than as a string.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if p == "" {
+		return []byte("null"), nil
+	}
+	return []byte(p), nil
+}
+
+// Attempt records one try at sending a delivery.
+type Attempt struct {
+	Date     time.Time `bson:"date" json:"date"`
+	Status   int       `bson:"status,omitempty" json:"status,omitempty"` // HTTP status the endpoint responded with.
+	Error    string    `bson:"error,omitempty" json:"error,omitempty"`
+	Duration int64     `bson:"duration" json:"duration"` // Milliseconds taken.
+}
+
+// Delivery is an event queued for an endpoint, together with the log of every
+// attempt to send it.
+type Delivery struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	EndpointID   bson.ObjectId `bson:"endpoint_id" json:"endpoint_id"`
+	EventID      string        `bson:"event_id" json:"event_id"` // Shared by the deliveries of one event.
+	Event        string        `bson:"event" json:"event"`
+	Payload      Payload       `bson:"payload" json:"payload"`
+	Status       string        `bson:"status" json:"status"`             // One of the Status constants.
+	Tries        int           `bson:"tries" json:"tries"`               // Attempts since the delivery was queued or redelivered.
+	NextAttempt  time.Time     `bson:"next_attempt" json:"next_attempt"` // When a pending delivery is due, or a claim on it lapses.
+	Attempts     []Attempt     `bson:"attempts" json:"attempts"`
+	DateCreated  time.Time     `bson:"date_created" json:"date_created"`
+	DateModified time.Time     `bson:"date_modified" json:"date_modified"`
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/mattlaver/peeps/internal/advert"
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/user"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// hooked maps the events raised by writes to the webhook events they are sent
+// to endpoints as.
+var hooked = map[string]string{
+	event.AdvertCreated:      EventAdvertCreated,
+	event.AdvertUpdated:      EventAdvertUpdated,
+	event.AdvertTransitioned: EventAdvertUpdated,
+	event.AdvertDeleted:      EventAdvertDeleted,
+	event.UserCreated:        EventUserCreated,
+	event.UserUpdated:        EventUserUpdated,
+	event.UserDeleted:        EventUserDeleted,
+	event.CommentCreated:     EventCommentCreated,
+	event.CommentUpdated:     EventCommentUpdated,
+	event.CommentDeleted:     EventCommentDeleted,
+}
+
+// DomainEvents lists the events raised by writes that are sent to endpoints,
+// for subscribing a Subscriber to the bus.
+func DomainEvents() []string {
+	names := make([]string, 0, len(hooked))
+	for name := range hooked {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Subscriber queues webhook deliveries of the events delivered to it from the
+// outbox. An event is only taken off the outbox once its deliveries are
+// queued, so a failure to queue is retried rather than lost.
+type Subscriber struct {
+	MasterDB *db.DB
+}
+
+// NewSubscriber returns a Subscriber that queues deliveries in the database
+// behind masterDB.
+func NewSubscriber(masterDB *db.DB) *Subscriber {
+	return &Subscriber{MasterDB: masterDB}
+}
+
+// Handle queues the deliveries of an event to the endpoints of the tenant it
+// belongs to. The data sent is the current state of what changed. Once that
+// is gone, as for a delete, only its ID is sent.
+func (s *Subscriber) Handle(ctx context.Context, ev event.Event) error {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Subscriber.Handle")
+	defer span.End()
+
+	// Events about data that belongs to no tenant have no endpoints.
+	name, ok := hooked[ev.Name]
+	if !ok || !ev.TenantID.Valid() {
+		return nil
+	}
+	ctx = tenant.With(ctx, ev.TenantID)
+
+	dbConn := s.MasterDB.Copy()
+	defer dbConn.Close()
+
+	data, err := s.data(ctx, dbConn, ev)
+	if err != nil {
+		return err
+	}
+
+	return Enqueue(ctx, dbConn, ev.ID.Hex(), name, data, ev.Date)
+}
+
+// data returns what is sent to endpoints about an event.
+func (s *Subscriber) data(ctx context.Context, dbConn *db.DB, ev event.Event) (interface{}, error) {
+	gone := bson.M{"id": ev.AggregateID}
+
+	switch ev.Aggregate {
+	case event.AggregateAdvert:
+		a, err := advert.Retrieve(ctx, dbConn, ev.AggregateID.Hex())
+		if err != nil {
+			if err == advert.ErrNotFound {
+				return gone, nil
+			}
+			return nil, err
+		}
+		return a, nil
+
+	case event.AggregateUser:
+		us, err := user.ByID(ctx, dbConn, []string{ev.AggregateID.Hex()})
+		if err != nil {
+			return nil, err
+		}
+		if len(us) == 0 {
+			return gone, nil
+		}
+		return &us[0], nil
+
+	case event.AggregateComment:
+		advertID, _ := ev.Data["advert_id"].(bson.ObjectId)
+		c, err := advert.RetrieveComment(ctx, dbConn, advertID.Hex(), ev.AggregateID.Hex())
+		if err != nil {
+			if err == advert.ErrInvalidID || err == advert.ErrCommentNotFound {
+				return gone, nil
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+
+	return gone, nil
+}
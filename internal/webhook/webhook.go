@@ -0,0 +1,227 @@
+// Package webhook sends events to the URLs of other systems. Deliveries are
+// queued in the database, signed with the endpoint's secret and retried with
+// exponential backoff by a Dispatcher until the endpoint accepts them.
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/platform/db"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const endpointsCollection = "webhooks"
+
+var (
+	// ErrNotFound abstracts the mgo not found error.
+	ErrNotFound = errors.New("Entity not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrVersionConflict occurs when a write names a version of the endpoint
+	// that is no longer current.
+	ErrVersionConflict = errors.New("Version does not match the current endpoint")
+)
+
+// eventsIndex supports finding the endpoints of a tenant subscribed to an
+// event.
+var eventsIndex = mgo.Index{
+	Key: []string{"tenant_id", "events", "active"},
+}
+
+// List retrieves the registered endpoints.
+func List(ctx context.Context, dbConn *db.DB) ([]Endpoint, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.List")
+	defer span.End()
+
+	q := bson.M{}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	e := []Endpoint{}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).Sort("date_created").All(&e)
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhooks.find(%s)", db.Query(q)))
+	}
+
+	return e, nil
+}
+
+// Retrieve gets the specified endpoint from the database.
+func Retrieve(ctx context.Context, dbConn *db.DB, id string) (*Endpoint, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Retrieve")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var e *Endpoint
+	f := func(collection *mgo.Collection) error {
+		return collection.Find(q).One(&e)
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhooks.find(%s)", db.Query(q)))
+	}
+
+	return e, nil
+}
+
+// Create registers a new endpoint.
+func Create(ctx context.Context, dbConn *db.DB, ne *NewEndpoint, now time.Time) (*Endpoint, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Create")
+	defer span.End()
+
+	tid, err := tenant.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now = now.Truncate(time.Millisecond)
+
+	e := Endpoint{
+		ID:           bson.NewObjectId(),
+		TenantID:     tid,
+		URL:          ne.URL,
+		Events:       ne.Events,
+		Secret:       ne.Secret,
+		Active:       true,
+		Version:      1,
+		DateCreated:  now,
+		DateModified: now,
+	}
+	if ne.Active != nil {
+		e.Active = *ne.Active
+	}
+	if e.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return nil, err
+		}
+		e.Secret = secret
+	}
+
+	f := func(collection *mgo.Collection) error {
+		if err := collection.EnsureIndex(eventsIndex); err != nil {
+			return err
+		}
+		return collection.Insert(&e)
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhooks.insert(%s)", e.ID.Hex()))
+	}
+
+	return &e, nil
+}
+
+// Update modifies an endpoint. The write only succeeds if version is still
+// the current version of the endpoint.
+func Update(ctx context.Context, dbConn *db.DB, id string, version int, upd *UpdateEndpoint, now time.Time) (*Endpoint, error) {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Update")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidID
+	}
+
+	fields := bson.M{}
+	if upd.URL != nil {
+		fields["url"] = *upd.URL
+	}
+	if upd.Events != nil {
+		fields["events"] = *upd.Events
+	}
+	if upd.Secret != nil {
+		fields["secret"] = *upd.Secret
+	}
+	if upd.Active != nil {
+		fields["active"] = *upd.Active
+	}
+	fields["date_modified"] = now.Truncate(time.Millisecond)
+
+	m := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return nil, err
+	}
+
+	var e Endpoint
+	f := func(collection *mgo.Collection) error {
+		_, err := collection.Find(q).Apply(mgo.Change{Update: m, ReturnNew: true}, &e)
+		return err
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return nil, err
+			}
+			return nil, ErrVersionConflict
+		}
+		// The secret is left out of the error so it does not reach the logs.
+		return nil, errors.Wrap(err, fmt.Sprintf("db.webhooks.update(%s)", db.Query(q)))
+	}
+
+	return &e, nil
+}
+
+// Delete removes an endpoint. Deliveries still queued for it fail when they
+// come due. The delete only succeeds if version is still the current version
+// of the endpoint.
+func Delete(ctx context.Context, dbConn *db.DB, id string, version int) error {
+	ctx, span := trace.StartSpan(ctx, "internal.webhook.Delete")
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidID
+	}
+
+	q := bson.M{"_id": bson.ObjectIdHex(id), "version": db.Version(version)}
+	if err := tenant.Filter(ctx, q); err != nil {
+		return err
+	}
+
+	f := func(collection *mgo.Collection) error {
+		return collection.Remove(q)
+	}
+	if err := dbConn.Execute(ctx, endpointsCollection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			if _, err := Retrieve(ctx, dbConn, id); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+		return errors.Wrap(err, fmt.Sprintf("db.webhooks.remove(%s)", db.Query(q)))
+	}
+
+	return nil
+}
+
+// newSecret returns a random key for signing deliveries.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating secret")
+	}
+	return hex.EncodeToString(b), nil
+}
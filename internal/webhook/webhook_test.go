@@ -0,0 +1,185 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattlaver/peeps/internal/event"
+	"github.com/mattlaver/peeps/internal/platform/tests"
+	"github.com/mattlaver/peeps/internal/tenant"
+	"github.com/mattlaver/peeps/internal/webhook"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// received is a request an endpoint was sent.
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver starts an endpoint that records what it is sent and responds with
+// status.
+func receiver(t *testing.T, status int) (*httptest.Server, <-chan received) {
+	t.Helper()
+
+	reqs := make(chan received, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading delivery : %v", err)
+		}
+		reqs <- received{header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+
+	return srv, reqs
+}
+
+// TestDelivery checks an event handled from the outbox reaches a subscribed
+// endpoint once, signed with its secret.
+func TestDelivery(t *testing.T) {
+	masterDB, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	srv, reqs := receiver(t, http.StatusNoContent)
+	defer srv.Close()
+
+	now := time.Date(2019, time.March, 1, 9, 0, 0, 0, time.UTC)
+	tid := bson.NewObjectId()
+	ctx := tenant.With(context.Background(), tid)
+
+	ne := webhook.NewEndpoint{
+		URL:    srv.URL,
+		Events: []string{webhook.EventUserDeleted},
+		Secret: "0123456789abcdef",
+	}
+	e, err := webhook.Create(ctx, masterDB, &ne, now)
+	if err != nil {
+		t.Fatalf("creating endpoint : %v", err)
+	}
+
+	// The outbox delivers at least once, so the event is handled twice.
+	ev := event.New(event.UserDeleted, event.AggregateUser, bson.NewObjectId(), "", now)
+	ev.TenantID = tid
+	sub := webhook.NewSubscriber(masterDB)
+	for i := 0; i < 2; i++ {
+		if err := sub.Handle(context.Background(), ev); err != nil {
+			t.Fatalf("handling event : %v", err)
+		}
+	}
+
+	d := webhook.NewDispatcher(masterDB, srv.Client(), log.New(ioutil.Discard, "", 0))
+	n, err := d.RunOnce(context.Background(), now)
+	if err != nil {
+		t.Fatalf("dispatching : %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("dispatched %d deliveries, want 1", n)
+	}
+
+	var got received
+	select {
+	case got = <-reqs:
+	default:
+		t.Fatal("endpoint was sent nothing")
+	}
+
+	if err := webhook.Verify(e.Secret, got.header.Get(webhook.SignatureHeader), got.body, now, time.Minute); err != nil {
+		t.Errorf("verifying signature : %v", err)
+	}
+	if h := got.header.Get("X-Peeps-Event"); h != webhook.EventUserDeleted {
+		t.Errorf("X-Peeps-Event = %q, want %q", h, webhook.EventUserDeleted)
+	}
+
+	var body struct {
+		ID    string            `json:"id"`
+		Event string            `json:"event"`
+		Data  map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(got.body, &body); err != nil {
+		t.Fatalf("decoding delivery : %v", err)
+	}
+	if body.ID != ev.ID.Hex() {
+		t.Errorf("id = %q, want %q", body.ID, ev.ID.Hex())
+	}
+	if body.Event != webhook.EventUserDeleted {
+		t.Errorf("event = %q, want %q", body.Event, webhook.EventUserDeleted)
+	}
+	if body.Data["id"] != ev.AggregateID.Hex() {
+		t.Errorf("data.id = %q, want %q", body.Data["id"], ev.AggregateID.Hex())
+	}
+
+	dls, err := webhook.Deliveries(ctx, masterDB, e.ID.Hex())
+	if err != nil {
+		t.Fatalf("listing deliveries : %v", err)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(dls))
+	}
+	if dls[0].Status != webhook.StatusSucceeded {
+		t.Errorf("status = %q, want %q", dls[0].Status, webhook.StatusSucceeded)
+	}
+}
+
+// TestDeliveryRetry checks a delivery an endpoint rejects is kept for a later
+// attempt rather than dropped.
+func TestDeliveryRetry(t *testing.T) {
+	masterDB, teardown := tests.NewUnit(t)
+	defer teardown()
+
+	srv, reqs := receiver(t, http.StatusInternalServerError)
+	defer srv.Close()
+
+	now := time.Date(2019, time.March, 1, 9, 0, 0, 0, time.UTC)
+	ctx := tenant.With(context.Background(), bson.NewObjectId())
+
+	ne := webhook.NewEndpoint{
+		URL:    srv.URL,
+		Events: []string{webhook.EventAdvertDeleted},
+	}
+	e, err := webhook.Create(ctx, masterDB, &ne, now)
+	if err != nil {
+		t.Fatalf("creating endpoint : %v", err)
+	}
+
+	if err := webhook.Enqueue(ctx, masterDB, bson.NewObjectId().Hex(), webhook.EventAdvertDeleted, bson.M{"id": "1"}, now); err != nil {
+		t.Fatalf("queueing delivery : %v", err)
+	}
+
+	d := webhook.NewDispatcher(masterDB, srv.Client(), log.New(ioutil.Discard, "", 0))
+	if _, err := d.RunOnce(context.Background(), now); err != nil {
+		t.Fatalf("dispatching : %v", err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("endpoint was sent %d requests, want 1", len(reqs))
+	}
+
+	dls, err := webhook.Deliveries(ctx, masterDB, e.ID.Hex())
+	if err != nil {
+		t.Fatalf("listing deliveries : %v", err)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(dls))
+	}
+	dl := dls[0]
+	if dl.Status != webhook.StatusPending {
+		t.Errorf("status = %q, want %q", dl.Status, webhook.StatusPending)
+	}
+	if want := now.Add(d.Backoff); !dl.NextAttempt.Equal(want) {
+		t.Errorf("next attempt = %v, want %v", dl.NextAttempt, want)
+	}
+	if len(dl.Attempts) != 1 || dl.Attempts[0].Status != http.StatusInternalServerError {
+		t.Errorf("attempts = %+v, want one that got %d", dl.Attempts, http.StatusInternalServerError)
+	}
+
+	// Nothing is sent again before the delivery is due.
+	if n, err := d.RunOnce(context.Background(), now.Add(time.Second)); err != nil || n != 0 {
+		t.Errorf("dispatching early : sent %d, %v", n, err)
+	}
+}